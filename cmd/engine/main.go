@@ -1,33 +1,210 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"flag"
 	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
 	"time"
 
+	"github.com/google/uuid"
+	exdb "github.com/hakimelghazi/exchange-core/db"
+	dbsqlc "github.com/hakimelghazi/exchange-core/db/sqlc"
 	"github.com/hakimelghazi/exchange-core/internal/engine"
 )
 
 func main() {
-	book := engine.NewOrderBook()
-	m := engine.NewMatcher(book)
+	if len(os.Args) > 1 {
+		var err error
+		switch os.Args[1] {
+		case "replay":
+			err = replay(os.Args[2:])
+		case "reconcile":
+			err = reconcile(os.Args[2:])
+		default:
+			err = fmt.Errorf("unknown command %q", os.Args[1])
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	demo()
+}
+
+// replay rebuilds the books from a journal and prints their hash. With
+// -compare it first fetches the live hash from a running server, replays up
+// to the same sequence number and fails if the hashes differ.
+func replay(args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	path := fs.String("journal", os.Getenv("JOURNAL_PATH"), "journal file")
+	upTo := fs.Uint64("seq", 0, "last sequence number to replay, 0 for the whole journal")
+	compare := fs.String("compare", "", "base URL of a running server to compare with")
+	fs.Parse(args)
+
+	ctx := context.Background()
+	var live *engine.BookHash
+	if *compare != "" {
+		resp, err := http.Get(*compare + "/admin/book-hash")
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("book hash: %s", resp.Status)
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&live); err != nil {
+			return err
+		}
+		*upTo = live.Seq
+	}
+
+	store, closeStore, err := openStore(ctx)
+	if err != nil {
+		return err
+	}
+	defer closeStore()
+	eng, err := engine.NewEngine(1, store)
+	if err != nil {
+		return err
+	}
+	h, err := eng.ReplayJournal(ctx, *path, *upTo)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("seq %d hash %s\n", h.Seq, h.Hash)
+	if live != nil && live.Hash != h.Hash {
+		return fmt.Errorf("live books differ at seq %d: %s", live.Seq, live.Hash)
+	}
+	return nil
+}
+
+// reconcile asks a running server to compare its books with the orders
+// table, prints every discrepancy and, with -repair, has the server repair
+// them. It fails if discrepancies were found and left unrepaired.
+func reconcile(args []string) error {
+	fs := flag.NewFlagSet("reconcile", flag.ExitOnError)
+	server := fs.String("server", "http://localhost:8080", "base URL of the running server")
+	market := fs.String("market", "", "market to check, empty for every market")
+	repair := fs.Bool("repair", false, "bring the books in line with the orders table")
+	fs.Parse(args)
+
+	q := url.Values{}
+	if *market != "" {
+		q.Set("market", *market)
+	}
+	if *repair {
+		q.Set("repair", "true")
+	}
+	resp, err := http.Post(*server+"/admin/reconcile?"+q.Encode(), "application/json", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("reconcile: %s", resp.Status)
+	}
+	var rep engine.Reconciliation
+	if err := json.NewDecoder(resp.Body).Decode(&rep); err != nil {
+		return err
+	}
+
+	for _, d := range rep.Discrepancies {
+		fmt.Printf("%s %s %s book=%s db=%s\n", d.Market, d.OrderID, d.Problem, restingString(d.Book), restingString(d.DB))
+	}
+	fmt.Printf("seq %d: %d orders checked, %d discrepancies\n", rep.Seq, rep.Checked, len(rep.Discrepancies))
+	switch {
+	case rep.Repaired:
+		fmt.Println("repaired")
+	case len(rep.Discrepancies) > 0:
+		return fmt.Errorf("books differ from the orders table; run with -repair to fix them")
+	}
+	return nil
+}
+
+func restingString(s *engine.RestingState) string {
+	if s == nil {
+		return "-"
+	}
+	return fmt.Sprintf("%s:%d@%d", s.Side, s.Remaining, s.Price)
+}
+
+// openStore returns the Postgres store at DATABASE_URL, or an in-memory
+// store if it is not set.
+func openStore(ctx context.Context) (engine.Store, func(), error) {
+	if os.Getenv("DATABASE_URL") == "" {
+		return engine.NewMemStore(), func() {}, nil
+	}
+	pool, err := exdb.NewPool(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	store, err := engine.NewPostgresStore(pool, dbsqlc.New(pool))
+	if err != nil {
+		pool.Close()
+		return nil, nil, err
+	}
+	return store, pool.Close, nil
+}
+
+// demo runs the engine loop on an in-memory store: two users fund their
+// accounts and trade one order against the other.
+func demo() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	eng, err := engine.NewEngine(16, engine.NewMemStore())
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := eng.Bootstrap(ctx, nil); err != nil {
+		log.Fatal(err)
+	}
+	go eng.Run(ctx)
+
+	seller, buyer := uuid.NewString(), uuid.NewString()
+	for _, d := range []struct {
+		user, asset string
+		amount      int64
+	}{
+		{seller, "BTC", 1_00000000}, // 1 BTC in sats
+		{buyer, "USD", 100_00000000},
+	} {
+		t, _, err := eng.RequestTransfer(ctx, &engine.Transfer{
+			ID:          uuid.NewString(),
+			UserID:      d.user,
+			Kind:        engine.TransferDeposit,
+			Asset:       d.asset,
+			Amount:      d.amount,
+			ExternalRef: uuid.NewString(),
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		if _, err := eng.ConfirmTransfer(ctx, t.ID); err != nil {
+			log.Fatal(err)
+		}
+	}
 
 	// Maker: someone wants to SELL 1 @ 100
 	sell := &engine.Order{
-		ID:        "sell-1",
-		UserID:    "user-b",
+		ID:        uuid.NewString(),
+		UserID:    seller,
 		Market:    engine.MarketBTCUSD,
 		Side:      engine.SideSell,
 		Price:     100,
-		Quantity:  1_00000000, // 1 BTC in sats, adjust to your unit
+		Quantity:  1_00000000,
 		Remaining: 1_00000000,
 		CreatedAt: time.Now(),
 	}
-	// later: m.Submit(sell)
-
 	// Taker: someone wants to BUY 1 @ 100
 	buy := &engine.Order{
-		ID:        "buy-1",
-		UserID:    "user-a",
+		ID:        uuid.NewString(),
+		UserID:    buyer,
 		Market:    engine.MarketBTCUSD,
 		Side:      engine.SideBuy,
 		Price:     100,
@@ -37,8 +214,13 @@ func main() {
 	}
 
 	// submit maker first so it rests
-	_, _ = m.Submit(sell)
-	res, _ := m.Submit(buy)
+	if _, err := eng.Place(ctx, sell); err != nil {
+		log.Fatal(err)
+	}
+	res, err := eng.Place(ctx, buy)
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	fmt.Printf("trades: %+v\n", res.Trades)
 }
@@ -2,17 +2,22 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
+	"math"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"runtime"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/go-chi/chi/v5"
@@ -72,17 +77,31 @@ type Server struct {
 }
 
 type placeOrderRequest struct {
-	ID       string `json:"id"`      // client-supplied
-	UserID   string `json:"user_id"` // later: auth
-	Market   string `json:"market"`  // "BTC-USD"
-	Side     string `json:"side"`    // "BUY" | "SELL"
-	Price    int64  `json:"price"`   // for limit
-	Quantity int64  `json:"quantity"`
-	IsMarket bool   `json:"is_market"`
+	ID          string `json:"id"`      // client-supplied
+	UserID      string `json:"user_id"` // later: auth
+	Market      string `json:"market"`  // "BTC-USD"
+	Side        string `json:"side"`    // "BUY" | "SELL"
+	Price       int64  `json:"price"`   // for limit
+	Quantity    int64  `json:"quantity"`
+	IsMarket    bool   `json:"is_market"`
+	TimeInForce string `json:"time_in_force"` // "GTC" (default) | "IOC" | "FOK" | "POST_ONLY"
+	STPMode     string `json:"stp_mode"`      // empty = account default
+	StopPrice   int64  `json:"stop_price"`    // > 0 makes it a stop (market) or stop-limit order
+
+	DisplayQuantity int64 `json:"display_quantity"` // > 0 makes it an iceberg showing this much at a time
+	QuoteQuantity   int64 `json:"quote_quantity"`   // market buys: quote to spend instead of quantity
+
+	ExpiresAt *time.Time `json:"expires_at"` // good-till-date, omitted = until cancelled
 }
 
+// shutdownTimeout bounds how long SIGINT or SIGTERM waits for requests in
+// flight and the engine's queued commands to finish.
+const shutdownTimeout = 30 * time.Second
+
 func main() {
 	ctx := context.Background()
+	sigCtx, stopSignals := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stopSignals()
 
 	// 1) DB/pool/sqlc
 	pool, err := exdb.NewPool(ctx)
@@ -94,10 +113,46 @@ func main() {
 	queries := dbsqlc.New(pool)
 
 	// 2) engine
-	eng, err := engine.NewEngine(1024, pool, queries)
+	store, err := engine.NewPostgresStore(pool, queries)
+	if err != nil {
+		log.Fatal(err)
+	}
+	eng, err := engine.NewEngine(1024, store)
 	if err != nil {
 		log.Fatal(err)
 	}
+	if v := os.Getenv("PERSIST_BATCH"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err == nil {
+			err = eng.UseBatchSize(n)
+		}
+		if err != nil {
+			log.Fatalf("PERSIST_BATCH: %v", err)
+		}
+	}
+	if err := eng.UseAdmission(admissionFromEnv()); err != nil {
+		log.Fatalf("admission: %v", err)
+	}
+	if path := os.Getenv("JOURNAL_PATH"); path != "" {
+		journal, err := engine.OpenJournal(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer journal.Close()
+		eng.UseJournal(journal)
+
+		if dir := os.Getenv("SNAPSHOT_DIR"); dir != "" {
+			every := 5 * time.Minute
+			if v := os.Getenv("SNAPSHOT_INTERVAL"); v != "" {
+				if every, err = time.ParseDuration(v); err != nil {
+					log.Fatalf("SNAPSHOT_INTERVAL: %v", err)
+				}
+			}
+			if err := eng.UseSnapshots(dir, every); err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
 
 	if err := eng.Bootstrap(ctx, nil); err != nil {
 		log.Fatal(err)
@@ -105,15 +160,6 @@ func main() {
 	go eng.Run(ctx)
 
 	// 3) router
-	r := chi.NewRouter()
-
-	// Hygiene stack
-	r.Use(middleware.RequestID)
-	r.Use(middleware.RealIP)
-	r.Use(middleware.Logger)
-	r.Use(middleware.Recoverer)
-	r.Use(middleware.Timeout(3 * time.Second))
-
 	priceCache := pricefeed.NewPriceCache()
 	server := &Server{
 		engine:     eng,
@@ -123,101 +169,221 @@ func main() {
 
 	feed := pricefeed.NewCoinGeckoFeed()
 	markets := []string{"BTC-USD", "ETH-USD"}
-	go pricefeed.StartPriceUpdater(ctx, feed, priceCache, markets, 20*time.Second)
+	go pricefeed.StartPriceUpdater(sigCtx, feed, priceCache, markets, 20*time.Second)
+
+	srv := &http.Server{Addr: ":8080", Handler: server.routes()}
+	served := make(chan error, 1)
+	go func() {
+		log.Println("listening on :8080")
+		served <- srv.ListenAndServe()
+	}()
+	select {
+	case err := <-served:
+		log.Fatal(err)
+	case <-sigCtx.Done():
+	}
+
+	// stop taking requests, let those in flight finish, then run what the
+	// engine still has queued and commit it before the pool closes
+	log.Println("shutting down")
+	shutdownCtx, cancel := context.WithTimeout(ctx, shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Printf("http shutdown: %v", err)
+	}
+	if err := eng.Stop(shutdownCtx); err != nil {
+		log.Printf("engine stop: %v", err)
+	}
+}
+
+// routes returns the router serving every endpoint of s.
+func (s *Server) routes() chi.Router {
+	r := chi.NewRouter()
+
+	// Hygiene stack
+	r.Use(middleware.RequestID)
+	r.Use(middleware.RealIP)
+	r.Use(middleware.Logger)
+	r.Use(middleware.Recoverer)
+	r.Use(middleware.Timeout(3 * time.Second))
 
 	// Read endpoints
-	r.Get("/orders/{id}", server.handleGetOrderByID)
-	r.Get("/orders", server.handleListOrders)
-	r.Get("/trades", server.handleListTrades)
-	r.Get("/balances", server.handleGetBalances)
-	r.Get("/openapi.yaml", server.handleOpenAPIYAML)
-	r.Get("/openapi.json", server.handleOpenAPIJSON)
-	r.Get("/docs", server.handleDocs)
-	r.Get("/ticker", server.handleTicker)
+	r.Get("/orders/{id}", s.handleGetOrderByID)
+	r.Get("/orders", s.handleListOrders)
+	r.Get("/trades", s.handleListTrades)
+	r.Get("/balances", s.handleGetBalances)
+	r.Get("/openapi.yaml", s.handleOpenAPIYAML)
+	r.Get("/openapi.json", s.handleOpenAPIJSON)
+	r.Get("/docs", s.handleDocs)
+	r.Get("/ticker", s.handleTicker)
+	r.Get("/markets", s.handleListMarkets)
+	r.Put("/users/{id}/stp-mode", s.handleSetSTPMode)
+	r.Put("/users/{id}/fee-tier", s.handleSetFeeTier)
+	r.Post("/users/{id}/heartbeat", s.handleHeartbeat)
+	r.Get("/users/{id}/heartbeat", s.handleGetHeartbeat)
+
+	// Operations
+	r.Get("/admin/book-hash", s.handleBookHash)
+	r.Post("/admin/reconcile", s.handleReconcile)
+	r.Get("/admin/queue", s.handleQueueStats)
+
+	// Deposits and withdrawals
+	r.Post("/deposits", s.handleRequestTransfer(engine.TransferDeposit))
+	r.Post("/withdrawals", s.handleRequestTransfer(engine.TransferWithdrawal))
+	r.Get("/transfers/{id}", s.handleGetTransfer)
+	r.Post("/transfers/{id}/confirm", s.handleConfirmTransfer)
+	r.Post("/transfers/{id}/reject", s.handleRejectTransfer)
 
 	// POST /orders
-	r.Post("/orders", func(w http.ResponseWriter, r *http.Request) {
-		var req placeOrderRequest
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			writeProblem(w, r, http.StatusBadRequest, "invalid_json", err.Error())
-			return
-		}
+	r.Post("/orders", s.handlePlaceOrder)
 
-		// build engine.Order from request
-		order, err := toEngineOrder(req)
-		if err != nil {
-			writeProblem(w, r, http.StatusBadRequest, "validation_error", err.Error())
-			return
-		}
+	// DELETE /orders/{id}
+	r.Delete("/orders/{id}", s.handleCancelOrder)
 
-		// ensure user exists
-		userUUID, _ := uuid.Parse(order.UserID)
-		if err := ensureUser(r.Context(), queries, pgtype.UUID{Bytes: userUUID, Valid: true}); err != nil {
-			writeProblem(w, r, http.StatusInternalServerError, "engine_error", err.Error())
-			return
-		}
+	// PATCH /orders/{id}
+	r.Patch("/orders/{id}", s.handleAmendOrder)
+
+	// DELETE /orders?user_id=...&market=...&side=...
+	r.Delete("/orders", s.handleMassCancel)
+	return r
+}
+
+// handlePlaceOrder places the order in the request body.
+func (s *Server) handlePlaceOrder(w http.ResponseWriter, r *http.Request) {
+	var req placeOrderRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, "invalid_json", err.Error())
+		return
+	}
+
+	// build engine.Order from request
+	order, err := toEngineOrder(req)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, "validation_error", err.Error())
+		return
+	}
 
-		// send to engine using per-request context (timeout middleware already applied)
-		res, placeErr := eng.Place(r.Context(), order)
-		if placeErr != nil {
-			writeProblem(w, r, http.StatusInternalServerError, "engine_error", placeErr.Error())
+	// ensure user exists
+	userUUID, _ := uuid.Parse(order.UserID)
+	if err := ensureUser(r.Context(), s.queries, pgtype.UUID{Bytes: userUUID, Valid: true}); err != nil {
+		writeEngineError(w, r, err)
+		return
+	}
+
+	// fall back to the account's self-trade prevention default
+	if order.STP == engine.STPNone && strings.TrimSpace(req.STPMode) == "" {
+		mode, err := accountSTPMode(r.Context(), s.queries, pgUUIDFrom(userUUID))
+		if err != nil {
+			writeProblem(w, r, http.StatusInternalServerError, "db_error", err.Error())
 			return
 		}
+		order.STP = mode
+	}
 
-		rid := middleware.GetReqID(r.Context())
-		w.Header().Set("Content-Type", "application/json")
-		w.Header().Set("Location", "/orders/"+req.ID)
-		w.Header().Set("X-Request-ID", rid)
-		w.WriteHeader(http.StatusCreated)
-		_ = json.NewEncoder(w).Encode(toOrderCreateResponse(req, res, rid))
-	})
-
-	// DELETE /orders/{id}
-	r.Delete("/orders/{id}", func(w http.ResponseWriter, r *http.Request) {
-		id := chi.URLParam(r, "id")
+	// retries carrying the same Idempotency-Key replay the original result
+	idemKey, err := idempotencyKey(r, req)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, "validation_error", err.Error())
+		return
+	}
 
-		ok, cancelErr := eng.Cancel(r.Context(), id)
-		if cancelErr != nil {
-			writeProblem(w, r, http.StatusInternalServerError, "engine_error", cancelErr.Error())
+	// send to engine using per-request context (timeout middleware already applied)
+	res, replayed, placeErr := s.engine.PlaceIdempotent(r.Context(), order, idemKey)
+	if placeErr != nil {
+		if errors.Is(placeErr, engine.ErrIdempotencyConflict) {
+			writeProblem(w, r, http.StatusConflict, "idempotency_conflict", placeErr.Error())
 			return
 		}
-		if !ok {
-			writeProblem(w, r, http.StatusNotFound, "not_found", "order not found")
+		if errors.Is(placeErr, engine.ErrDuplicateOrderID) {
+			writeProblem(w, r, http.StatusConflict, "duplicate_order", placeErr.Error())
 			return
 		}
-		w.Header().Set("X-Request-ID", middleware.GetReqID(r.Context()))
-		w.WriteHeader(http.StatusNoContent)
-	})
-
-	// GET /trades?order_id=...
-	r.Get("/trades", func(w http.ResponseWriter, r *http.Request) {
-		orderID := r.URL.Query().Get("order_id")
-		if orderID == "" {
-			writeProblem(w, r, http.StatusBadRequest, "validation_error", "order_id required")
+		if errors.Is(placeErr, engine.ErrInsufficientFunds) {
+			writeProblem(w, r, http.StatusUnprocessableEntity, "insufficient_funds", placeErr.Error())
 			return
 		}
-		// call generated query
-		uuidVal, err := uuid.Parse(orderID)
-		if err != nil {
-			writeProblem(w, r, http.StatusBadRequest, "validation_error", "invalid order_id")
+		var rej *engine.RejectError
+		if errors.As(placeErr, &rej) {
+			writeProblem(w, r, http.StatusUnprocessableEntity, "order_rejected", placeErr.Error())
 			return
 		}
-		pgUUID := pgtype.UUID{Bytes: uuidVal, Valid: true}
+		writeEngineError(w, r, placeErr)
+		return
+	}
 
-		rows, queryErr := queries.ListTradesByOrder(r.Context(), pgUUID)
-		if queryErr != nil {
-			writeProblem(w, r, http.StatusInternalServerError, "db_error", queryErr.Error())
-			return
+	rid := middleware.GetReqID(r.Context())
+	code := http.StatusCreated
+	body, err := json.Marshal(toOrderCreateResponse(req, res, rid))
+	if err != nil {
+		writeProblem(w, r, http.StatusInternalServerError, "encode_error", err.Error())
+		return
+	}
+	if idemKey.Key != "" {
+		// the first response sent for the key is the one every retry gets
+		stored, err := s.queries.SetIdempotencyResponse(r.Context(), dbsqlc.SetIdempotencyResponseParams{
+			UserID:         pgUUIDFrom(userUUID),
+			Key:            idemKey.Key,
+			ResponseStatus: int32(code),
+			ResponseBody:   body,
+		})
+		switch {
+		case err != nil:
+			log.Printf("store response for idempotency key %q: %v", idemKey.Key, err)
+		case stored.ResponseStatus.Valid && stored.ResponseBody != nil:
+			code, body = int(stored.ResponseStatus.Int32), stored.ResponseBody
 		}
-		w.Header().Set("Content-Type", "application/json")
-		w.Header().Set("X-Request-ID", middleware.GetReqID(r.Context()))
-		_ = json.NewEncoder(w).Encode(rows)
-	})
+	}
 
-	log.Println("listening on :8080")
-	if err := http.ListenAndServe(":8080", r); err != nil {
-		log.Fatal(err)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/orders/"+req.ID)
+	w.Header().Set("X-Request-ID", rid)
+	if replayed {
+		w.Header().Set("Idempotent-Replayed", "true")
+	}
+	w.WriteHeader(code)
+	_, _ = w.Write(append(body, '\n'))
+}
+
+// handleCancelOrder cancels the order in the path.
+func (s *Server) handleCancelOrder(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+
+	ok, cancelErr := s.engine.CancelFor(r.Context(), s.orderOwner(r.Context(), id), id)
+	if cancelErr != nil {
+		writeEngineError(w, r, cancelErr)
+		return
+	}
+	if !ok {
+		writeProblem(w, r, http.StatusNotFound, "not_found", "order not found")
+		return
+	}
+	w.Header().Set("X-Request-ID", middleware.GetReqID(r.Context()))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// admissionFromEnv reads the engine's admission policy: QUEUE_REJECT_ABOVE
+// refuses commands with 503 once that many are queued, QUEUE_PER_USER once
+// that many of one user are, and QUEUE_RETRY_AFTER is the Retry-After sent
+// with the refusal. Unset limits make requests wait for room instead.
+func admissionFromEnv() engine.Admission {
+	var a engine.Admission
+	for name, dst := range map[string]*int{"QUEUE_REJECT_ABOVE": &a.RejectAbove, "QUEUE_PER_USER": &a.PerUser} {
+		if v := os.Getenv(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				log.Fatalf("%s: %v", name, err)
+			}
+			*dst = n
+		}
+	}
+	if v := os.Getenv("QUEUE_RETRY_AFTER"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			log.Fatalf("QUEUE_RETRY_AFTER: %v", err)
+		}
+		a.RetryAfter = d
 	}
+	return a
 }
 
 func toEngineOrder(req placeOrderRequest) (*engine.Order, error) {
@@ -235,43 +401,221 @@ func toEngineOrder(req placeOrderRequest) (*engine.Order, error) {
 	if _, err := uuid.Parse(req.UserID); err != nil {
 		return nil, errors.New("user_id must be a valid uuid")
 	}
-	if req.Quantity <= 0 {
+	if req.QuoteQuantity != 0 {
+		if req.QuoteQuantity < 0 || req.Quantity != 0 || !req.IsMarket {
+			return nil, errors.New("quote_quantity must be positive and replaces quantity on market orders")
+		}
+	} else if req.Quantity <= 0 {
 		return nil, errors.New("quantity must be positive")
 	}
 	if !req.IsMarket && req.Price <= 0 {
 		return nil, errors.New("limit orders require positive price")
 	}
+	if req.StopPrice < 0 {
+		return nil, errors.New("stop_price must not be negative")
+	}
+	if req.DisplayQuantity < 0 {
+		return nil, errors.New("display_quantity must not be negative")
+	}
 
 	side, err := engine.ParseSide(req.Side)
 	if err != nil {
 		return nil, err
 	}
+	tif, err := engine.ParseTimeInForce(req.TimeInForce)
+	if err != nil {
+		return nil, err
+	}
+	stp, err := engine.ParseSTPMode(req.STPMode)
+	if err != nil {
+		return nil, err
+	}
+
+	var expiresAt time.Time
+	if req.ExpiresAt != nil {
+		expiresAt = *req.ExpiresAt
+	}
 
 	return &engine.Order{
-		ID:        req.ID,
-		UserID:    req.UserID,
-		Market:    req.Market,
-		Side:      side,
-		Price:     req.Price,
-		Quantity:  req.Quantity,
-		Remaining: req.Quantity,
-		IsMarket:  req.IsMarket,
-		CreatedAt: time.Now(),
+		ID:          req.ID,
+		UserID:      req.UserID,
+		Market:      req.Market,
+		Side:        side,
+		Price:       req.Price,
+		Quantity:    req.Quantity,
+		Remaining:   req.Quantity,
+		IsMarket:    req.IsMarket,
+		TimeInForce: tif,
+		STP:         stp,
+		StopPrice:   req.StopPrice,
+		ExpiresAt:   expiresAt,
+		CreatedAt:   time.Now(),
+
+		DisplayQuantity: req.DisplayQuantity,
+		QuoteQuantity:   req.QuoteQuantity,
 	}, nil
 }
 
+type amendOrderRequest struct {
+	Price    int64 `json:"price"`    // 0 = unchanged
+	Quantity int64 `json:"quantity"` // new total quantity, 0 = unchanged
+}
+
+type amendOrderResponse struct {
+	Seq             uint64         `json:"seq"` // engine sequence number of the amend
+	OrderID         string         `json:"order_id"`
+	Price           int64          `json:"price"`
+	Quantity        int64          `json:"quantity"`
+	Remaining       int64          `json:"remaining"`
+	Filled          bool           `json:"filled"`
+	Resting         bool           `json:"resting"`
+	Cancelled       bool           `json:"cancelled"`
+	CancelledOrders []string       `json:"cancelled_orders,omitempty"`
+	Trades          []engine.Trade `json:"trades"`
+	RequestID       string         `json:"request_id"`
+}
+
+// handleAmendOrder changes the price and/or quantity of a resting order
+// without taking it off the book first.
+func (s *Server) handleAmendOrder(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if _, err := uuid.Parse(id); err != nil {
+		writeProblem(w, r, http.StatusUnprocessableEntity, "invalid order id", err.Error())
+		return
+	}
+	var req amendOrderRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, "invalid_json", err.Error())
+		return
+	}
+	if req.Price < 0 || req.Quantity < 0 {
+		writeProblem(w, r, http.StatusBadRequest, "validation_error", "price and quantity must not be negative")
+		return
+	}
+
+	a := engine.Amend{OrderID: id, UserID: s.orderOwner(r.Context(), id), Price: req.Price, Quantity: req.Quantity}
+	o, res, err := s.engine.Amend(r.Context(), a)
+	if err != nil {
+		var rej *engine.RejectError
+		switch {
+		case errors.Is(err, engine.ErrOrderNotFound):
+			writeProblem(w, r, http.StatusNotFound, "not_found", "order not found or not resting")
+		case errors.Is(err, engine.ErrInsufficientFunds):
+			writeProblem(w, r, http.StatusUnprocessableEntity, "insufficient_funds", err.Error())
+		case errors.As(err, &rej):
+			writeProblem(w, r, http.StatusUnprocessableEntity, "order_rejected", err.Error())
+		default:
+			writeEngineError(w, r, err)
+		}
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, amendOrderResponse{
+		Seq:             res.Seq,
+		OrderID:         id,
+		Price:           o.Price,
+		Quantity:        o.Quantity,
+		Remaining:       o.Remaining,
+		Filled:          res.OrderFilled,
+		Resting:         res.Remainder != nil && !res.Cancelled,
+		Cancelled:       res.Cancelled,
+		CancelledOrders: res.CancelledOrders,
+		Trades:          res.Trades,
+		RequestID:       middleware.GetReqID(r.Context()),
+	})
+}
+
+// orderOwner returns the user owning order id, so the engine queues a
+// cancel or amend of it in that user's turn, or "" if the database does not
+// know the order; the engine then finds it by id alone.
+func (s *Server) orderOwner(ctx context.Context, id string) string {
+	uid, err := uuid.Parse(id)
+	if err != nil {
+		return ""
+	}
+	row, err := s.queries.GetOrder(ctx, pgUUIDFrom(uid))
+	if err != nil {
+		return ""
+	}
+	return uuid.UUID(row.UserID.Bytes).String()
+}
+
+const maxIdempotencyKeyLen = 255
+
+// idempotencyKey reads the Idempotency-Key header and hashes the decoded
+// request, so retries that only differ in formatting still match.
+func idempotencyKey(r *http.Request, req placeOrderRequest) (engine.IdempotencyKey, error) {
+	key := strings.TrimSpace(r.Header.Get("Idempotency-Key"))
+	if key == "" {
+		return engine.IdempotencyKey{}, nil
+	}
+	if len(key) > maxIdempotencyKeyLen {
+		return engine.IdempotencyKey{}, fmt.Errorf("Idempotency-Key must be at most %d characters", maxIdempotencyKeyLen)
+	}
+	canonical, err := json.Marshal(req)
+	if err != nil {
+		return engine.IdempotencyKey{}, err
+	}
+	sum := sha256.Sum256(canonical)
+	return engine.IdempotencyKey{Key: key, RequestHash: hex.EncodeToString(sum[:])}, nil
+}
+
+type massCancelResponse struct {
+	Cancelled []string `json:"cancelled"`
+	RequestID string   `json:"request_id"`
+}
+
+// handleMassCancel cancels every open order of a user, optionally limited to
+// one market and side, in a single engine command.
+func (s *Server) handleMassCancel(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	userID := strings.TrimSpace(query.Get("user_id"))
+	if _, err := uuid.Parse(userID); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, "validation_error", "user_id must be a valid uuid")
+		return
+	}
+	f := engine.MassCancel{UserID: userID, Market: strings.TrimSpace(query.Get("market"))}
+	if side := query.Get("side"); side != "" {
+		parsed, err := engine.ParseSide(side)
+		if err != nil {
+			writeProblem(w, r, http.StatusBadRequest, "validation_error", err.Error())
+			return
+		}
+		f.Side = parsed
+	}
+
+	ids, err := s.engine.MassCancel(r.Context(), f)
+	if err != nil {
+		if errors.Is(err, engine.ErrUnknownMarket) {
+			writeProblem(w, r, http.StatusUnprocessableEntity, "unknown_market", err.Error())
+		} else {
+			writeEngineError(w, r, err)
+		}
+		return
+	}
+	if ids == nil {
+		ids = []string{}
+	}
+	writeJSON(w, r, http.StatusOK, massCancelResponse{Cancelled: ids, RequestID: middleware.GetReqID(r.Context())})
+}
+
 type orderCreateResponse struct {
-	OrderID    string         `json:"order_id"`
-	UserID     string         `json:"user_id"`
-	Market     string         `json:"market"`
-	Side       string         `json:"side"`
-	Quantity   int64          `json:"quantity"`
-	Filled     bool           `json:"filled"`
-	Remaining  int64          `json:"remaining"`
-	Resting    bool           `json:"resting"`
-	Trades     []engine.Trade `json:"trades"`
-	RequestID  string         `json:"request_id"`
-	ReceivedAt time.Time      `json:"received_at"`
+	Seq             uint64         `json:"seq"` // engine sequence number of the placement
+	OrderID         string         `json:"order_id"`
+	UserID          string         `json:"user_id"`
+	Market          string         `json:"market"`
+	Side            string         `json:"side"`
+	Quantity        int64          `json:"quantity"`
+	QuoteQuantity   int64          `json:"quote_quantity,omitempty"` // budget of a quote market buy
+	Filled          bool           `json:"filled"`
+	Remaining       int64          `json:"remaining"`
+	Resting         bool           `json:"resting"`
+	Cancelled       bool           `json:"cancelled"`
+	Untriggered     bool           `json:"untriggered"`                // stop order waiting for its trigger
+	CancelledOrders []string       `json:"cancelled_orders,omitempty"` // self-trade prevention
+	Trades          []engine.Trade `json:"trades"`
+	RequestID       string         `json:"request_id"`
+	ReceivedAt      time.Time      `json:"received_at"`
 }
 
 func toOrderCreateResponse(req placeOrderRequest, res *engine.MatchResult, requestID string) orderCreateResponse {
@@ -279,18 +623,33 @@ func toOrderCreateResponse(req placeOrderRequest, res *engine.MatchResult, reque
 	if res.Remainder != nil {
 		remaining = res.Remainder.Remaining
 	}
+	if res.Untriggered {
+		remaining = req.Quantity
+	}
+	quantity := req.Quantity
+	if req.QuoteQuantity > 0 {
+		// a quote market buy's quantity is whatever its budget bought
+		for _, tr := range res.Trades {
+			quantity += tr.Quantity
+		}
+	}
 	return orderCreateResponse{
-		OrderID:    req.ID,
-		UserID:     req.UserID,
-		Market:     req.Market,
-		Side:       strings.ToUpper(req.Side),
-		Quantity:   req.Quantity,
-		Filled:     res.OrderFilled,
-		Remaining:  remaining,
-		Resting:    res.Remainder != nil && !req.IsMarket,
-		Trades:     res.Trades,
-		RequestID:  requestID,
-		ReceivedAt: time.Now().UTC(),
+		Seq:             res.Seq,
+		OrderID:         req.ID,
+		UserID:          req.UserID,
+		Market:          req.Market,
+		Side:            strings.ToUpper(req.Side),
+		Quantity:        quantity,
+		QuoteQuantity:   req.QuoteQuantity,
+		Filled:          res.OrderFilled,
+		Remaining:       remaining,
+		Resting:         res.Remainder != nil && !req.IsMarket,
+		Cancelled:       res.Cancelled,
+		Untriggered:     res.Untriggered,
+		CancelledOrders: res.CancelledOrders,
+		Trades:          res.Trades,
+		RequestID:       requestID,
+		ReceivedAt:      time.Now().UTC(),
 	}
 }
 
@@ -304,6 +663,317 @@ func ensureUser(ctx context.Context, q *dbsqlc.Queries, id pgtype.UUID) error {
 	})
 }
 
+// accountSTPMode returns the user's default self-trade prevention mode.
+func accountSTPMode(ctx context.Context, q *dbsqlc.Queries, id pgtype.UUID) (engine.STPMode, error) {
+	user, err := q.GetUser(ctx, id)
+	if err != nil {
+		return engine.STPNone, err
+	}
+	if !user.StpMode.Valid {
+		return engine.STPNone, nil
+	}
+	return engine.ParseSTPMode(user.StpMode.String)
+}
+
+// handleSetSTPMode sets the account-level self-trade prevention default used
+// by orders that do not specify stp_mode. An empty mode clears it.
+func (s *Server) handleSetSTPMode(w http.ResponseWriter, r *http.Request) {
+	uid, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		writeProblem(w, r, http.StatusUnprocessableEntity, "invalid user id", err.Error())
+		return
+	}
+	var req struct {
+		STPMode string `json:"stp_mode"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, "invalid_json", err.Error())
+		return
+	}
+	mode, err := engine.ParseSTPMode(req.STPMode)
+	if err != nil {
+		writeProblem(w, r, http.StatusUnprocessableEntity, "validation_error", err.Error())
+		return
+	}
+
+	id := pgUUIDFrom(uid)
+	if err := ensureUser(r.Context(), s.queries, id); err != nil {
+		writeProblem(w, r, http.StatusInternalServerError, "db_error", err.Error())
+		return
+	}
+	if err := s.queries.SetUserSTPMode(r.Context(), dbsqlc.SetUserSTPModeParams{
+		ID:      id,
+		StpMode: pgtype.Text{String: string(mode), Valid: mode != engine.STPNone},
+	}); err != nil {
+		writeProblem(w, r, http.StatusInternalServerError, "db_error", err.Error())
+		return
+	}
+	writeJSON(w, r, http.StatusOK, map[string]any{
+		"user_id":  uid,
+		"stp_mode": string(mode),
+	})
+}
+
+// handleSetFeeTier assigns a fee tier overriding the market fee schedules
+// for the user. An empty tier clears it.
+func (s *Server) handleSetFeeTier(w http.ResponseWriter, r *http.Request) {
+	uid, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		writeProblem(w, r, http.StatusUnprocessableEntity, "invalid user id", err.Error())
+		return
+	}
+	var req struct {
+		FeeTier string `json:"fee_tier"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, "invalid_json", err.Error())
+		return
+	}
+	tier := strings.ToUpper(strings.TrimSpace(req.FeeTier))
+
+	if err := ensureUser(r.Context(), s.queries, pgUUIDFrom(uid)); err != nil {
+		writeProblem(w, r, http.StatusInternalServerError, "db_error", err.Error())
+		return
+	}
+	rates, err := s.engine.SetFeeTier(r.Context(), uid.String(), tier)
+	if err != nil {
+		if errors.Is(err, engine.ErrUnknownFeeTier) {
+			writeProblem(w, r, http.StatusUnprocessableEntity, "validation_error", err.Error())
+			return
+		}
+		writeEngineError(w, r, err)
+		return
+	}
+	resp := map[string]any{
+		"user_id":  uid,
+		"fee_tier": tier,
+	}
+	if rates != nil {
+		resp["maker_fee_bps"] = rates.MakerBps
+		resp["taker_fee_bps"] = rates.TakerBps
+	}
+	writeJSON(w, r, http.StatusOK, resp)
+}
+
+// handleHeartbeat arms or re-arms the user's dead man's switch. If no
+// heartbeat follows within timeout_ms, the engine cancels all of the user's
+// open orders. A timeout_ms of 0 disarms the switch.
+func (s *Server) handleHeartbeat(w http.ResponseWriter, r *http.Request) {
+	uid, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		writeProblem(w, r, http.StatusUnprocessableEntity, "invalid user id", err.Error())
+		return
+	}
+	var req struct {
+		TimeoutMs int64 `json:"timeout_ms"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, "invalid_json", err.Error())
+		return
+	}
+
+	if err := ensureUser(r.Context(), s.queries, pgUUIDFrom(uid)); err != nil {
+		writeProblem(w, r, http.StatusInternalServerError, "db_error", err.Error())
+		return
+	}
+	sw, err := s.engine.Heartbeat(r.Context(), uid.String(), time.Duration(req.TimeoutMs)*time.Millisecond)
+	if err != nil {
+		if errors.Is(err, engine.ErrInvalidDeadManTimeout) {
+			writeProblem(w, r, http.StatusBadRequest, "validation_error", err.Error())
+			return
+		}
+		writeEngineError(w, r, err)
+		return
+	}
+	if sw == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, sw)
+}
+
+// handleGetHeartbeat returns the user's armed dead man's switch.
+func (s *Server) handleGetHeartbeat(w http.ResponseWriter, r *http.Request) {
+	uid, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		writeProblem(w, r, http.StatusUnprocessableEntity, "invalid user id", err.Error())
+		return
+	}
+	row, err := s.queries.GetDeadManSwitch(r.Context(), pgUUIDFrom(uid))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			writeProblem(w, r, http.StatusNotFound, "not_found", "no dead man's switch armed")
+			return
+		}
+		writeProblem(w, r, http.StatusInternalServerError, "db_error", err.Error())
+		return
+	}
+	writeJSON(w, r, http.StatusOK, engine.DeadManSwitch{
+		UserID:    uid.String(),
+		TimeoutMs: row.TimeoutMs,
+		ExpiresAt: row.ExpiresAt.Time,
+	})
+}
+
+// handleBookHash returns the hash of the live books and the journal
+// sequence number it was taken at, to compare with a journal replay.
+func (s *Server) handleBookHash(w http.ResponseWriter, r *http.Request) {
+	h, err := s.engine.BookHash(r.Context())
+	if err != nil {
+		writeEngineError(w, r, err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, h)
+}
+
+// handleQueueStats returns the depth of the engine's command queue and how
+// many commands it admitted and refused.
+func (s *Server) handleQueueStats(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, http.StatusOK, s.engine.QueueStats())
+}
+
+// handleReconcile compares the resting orders of the books with the orders
+// table, for one market with ?market= or for all, and reports discrepancies.
+// With ?repair=true the books are brought in line with the table.
+func (s *Server) handleReconcile(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	market := strings.TrimSpace(query.Get("market"))
+	repair := false
+	if raw := query.Get("repair"); raw != "" {
+		var err error
+		if repair, err = strconv.ParseBool(raw); err != nil {
+			writeProblem(w, r, http.StatusUnprocessableEntity, "invalid repair", "repair must be true or false")
+			return
+		}
+	}
+
+	rep, err := s.engine.Reconcile(r.Context(), market, repair)
+	if err != nil {
+		if errors.Is(err, engine.ErrUnknownMarket) {
+			writeProblem(w, r, http.StatusUnprocessableEntity, "unknown_market", err.Error())
+		} else {
+			writeEngineError(w, r, err)
+		}
+		return
+	}
+	writeJSON(w, r, http.StatusOK, rep)
+}
+
+// ---------- transfer handlers ----------
+
+type transferRequest struct {
+	ID          string `json:"id"` // client-supplied
+	UserID      string `json:"user_id"`
+	Asset       string `json:"asset"`
+	Amount      int64  `json:"amount"`
+	ExternalRef string `json:"external_ref"` // chain tx hash, bank reference, ...
+}
+
+// handleRequestTransfer records a pending deposit or withdrawal. Replaying a
+// request with the same external_ref returns the original transfer with 200.
+func (s *Server) handleRequestTransfer(kind engine.TransferKind) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req transferRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeProblem(w, r, http.StatusBadRequest, "invalid_json", err.Error())
+			return
+		}
+		req.ID = strings.TrimSpace(req.ID)
+		req.ExternalRef = strings.TrimSpace(req.ExternalRef)
+		if req.ID == "" {
+			req.ID = uuid.NewString()
+		}
+		if _, err := uuid.Parse(req.ID); err != nil {
+			writeProblem(w, r, http.StatusBadRequest, "validation_error", "id must be a valid uuid")
+			return
+		}
+		uid, err := uuid.Parse(strings.TrimSpace(req.UserID))
+		if err != nil {
+			writeProblem(w, r, http.StatusBadRequest, "validation_error", "user_id must be a valid uuid")
+			return
+		}
+		if req.ExternalRef == "" {
+			writeProblem(w, r, http.StatusBadRequest, "validation_error", "external_ref required")
+			return
+		}
+		if err := ensureUser(r.Context(), s.queries, pgUUIDFrom(uid)); err != nil {
+			writeProblem(w, r, http.StatusInternalServerError, "db_error", err.Error())
+			return
+		}
+
+		t, created, err := s.engine.RequestTransfer(r.Context(), &engine.Transfer{
+			ID:          req.ID,
+			UserID:      uid.String(),
+			Kind:        kind,
+			Asset:       req.Asset,
+			Amount:      req.Amount,
+			ExternalRef: req.ExternalRef,
+		})
+		if err != nil {
+			writeTransferError(w, r, err)
+			return
+		}
+		code := http.StatusOK
+		if created {
+			code = http.StatusCreated
+			w.Header().Set("Location", "/transfers/"+t.ID)
+		}
+		writeJSON(w, r, code, t)
+	}
+}
+
+func (s *Server) handleGetTransfer(w http.ResponseWriter, r *http.Request) {
+	uid, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		writeProblem(w, r, http.StatusUnprocessableEntity, "invalid transfer id", err.Error())
+		return
+	}
+	row, err := s.queries.GetTransfer(r.Context(), pgUUIDFrom(uid))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			writeProblem(w, r, http.StatusNotFound, "transfer not found", err.Error())
+		} else {
+			writeProblem(w, r, http.StatusInternalServerError, "db_error", err.Error())
+		}
+		return
+	}
+	writeJSON(w, r, http.StatusOK, row)
+}
+
+func (s *Server) handleConfirmTransfer(w http.ResponseWriter, r *http.Request) {
+	t, err := s.engine.ConfirmTransfer(r.Context(), chi.URLParam(r, "id"))
+	if err != nil {
+		writeTransferError(w, r, err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, t)
+}
+
+func (s *Server) handleRejectTransfer(w http.ResponseWriter, r *http.Request) {
+	t, err := s.engine.RejectTransfer(r.Context(), chi.URLParam(r, "id"))
+	if err != nil {
+		writeTransferError(w, r, err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, t)
+}
+
+func writeTransferError(w http.ResponseWriter, r *http.Request, err error) {
+	var rej *engine.RejectError
+	switch {
+	case errors.Is(err, engine.ErrTransferNotFound):
+		writeProblem(w, r, http.StatusNotFound, "transfer not found", err.Error())
+	case errors.Is(err, engine.ErrTransferConflict), errors.Is(err, engine.ErrTransferNotPending):
+		writeProblem(w, r, http.StatusConflict, "transfer_conflict", err.Error())
+	case errors.Is(err, engine.ErrInsufficientFunds):
+		writeProblem(w, r, http.StatusUnprocessableEntity, "insufficient_funds", err.Error())
+	case errors.As(err, &rej):
+		writeProblem(w, r, http.StatusUnprocessableEntity, "transfer_rejected", err.Error())
+	default:
+		writeEngineError(w, r, err)
+	}
+}
+
 // ---------- read handlers ----------
 
 func (s *Server) handleGetOrderByID(w http.ResponseWriter, r *http.Request) {
@@ -335,16 +1005,30 @@ func (s *Server) handleListOrders(w http.ResponseWriter, r *http.Request) {
 	side := parseTextPtr(query.Get("side"))
 	limit := parseLimit(query.Get("limit"), 50, 500)
 
+	if raw := query.Get("after_seq"); raw != "" {
+		seq, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || seq < 0 {
+			writeProblem(w, r, http.StatusUnprocessableEntity, "invalid after_seq", "after_seq must be a non-negative integer")
+			return
+		}
+		s.listOrdersAfterSeq(w, r, seq, uuid.Nil)
+		return
+	}
+
 	var afterTS pgtype.Timestamptz
 	var afterID pgtype.UUID
 	if cur := query.Get("cursor"); cur != "" {
-		ts, id, err := decodeCursor(cur)
+		payload, err := decodeCursor(cur)
 		if err != nil {
 			writeProblem(w, r, http.StatusUnprocessableEntity, "invalid cursor", err.Error())
 			return
 		}
-		afterTS = pgTimestamptzFrom(ts)
-		afterID = pgUUIDFrom(id)
+		if payload.Seq > 0 {
+			s.listOrdersAfterSeq(w, r, payload.Seq, payload.ID)
+			return
+		}
+		afterTS = pgTimestamptzFrom(payload.TS)
+		afterID = pgUUIDFrom(payload.ID)
 	}
 
 	params := dbsqlc.ListOrdersParams{
@@ -369,7 +1053,7 @@ func (s *Server) handleListOrders(w http.ResponseWriter, r *http.Request) {
 		if last.CreatedAt.Valid {
 			ts = last.CreatedAt.Time
 		}
-		cur := encodeCursor(ts, uuid.UUID(last.ID.Bytes))
+		cur := encodeCursor(cursorPayload{TS: ts, ID: uuid.UUID(last.ID.Bytes)})
 		nextCursor = &cur
 	}
 
@@ -383,15 +1067,80 @@ func (s *Server) handleListOrders(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, r, http.StatusOK, resp)
 }
 
+// listOrdersAfterSeq lists orders in the order they last changed, starting
+// after the order id at engine sequence number seq. Its next_cursor
+// continues the same listing.
+func (s *Server) listOrdersAfterSeq(w http.ResponseWriter, r *http.Request, seq int64, id uuid.UUID) {
+	query := r.URL.Query()
+	limit := parseLimit(query.Get("limit"), 50, 500)
+
+	rows, err := s.queries.ListOrdersAfterSeq(r.Context(), dbsqlc.ListOrdersAfterSeqParams{
+		UserID:   pgUUIDFromPtr(parseUUIDPtr(query.Get("user_id"))),
+		Status:   strings.TrimSpace(query.Get("status")),
+		Side:     strings.TrimSpace(query.Get("side")),
+		AfterSeq: seq,
+		AfterID:  pgUUIDFrom(id),
+		RowLimit: int32(limit),
+	})
+	if err != nil {
+		writeProblem(w, r, http.StatusInternalServerError, "db_error", err.Error())
+		return
+	}
+
+	var nextCursor *string
+	if len(rows) == limit {
+		last := rows[len(rows)-1]
+		cur := encodeCursor(cursorPayload{Seq: last.Seq, ID: uuid.UUID(last.ID.Bytes)})
+		nextCursor = &cur
+	}
+	writeJSON(w, r, http.StatusOK, struct {
+		Items      any     `json:"items"`
+		NextCursor *string `json:"next_cursor,omitempty"`
+	}{Items: rows, NextCursor: nextCursor})
+}
+
 func (s *Server) handleListTrades(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	query := r.URL.Query()
 
 	userID := parseUUIDPtr(query.Get("user_id"))
 	orderID := parseUUIDPtr(query.Get("order_id"))
+	if orderID == nil && strings.TrimSpace(query.Get("order_id")) != "" {
+		writeProblem(w, r, http.StatusUnprocessableEntity, "invalid order_id", "order_id must be a uuid")
+		return
+	}
 	market := strings.TrimSpace(query.Get("market"))
 	limit := parseLimit(query.Get("limit"), 100, 1000)
 
+	if raw := query.Get("after_seq"); raw != "" {
+		seq, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || seq < 0 {
+			writeProblem(w, r, http.StatusUnprocessableEntity, "invalid after_seq", "after_seq must be a non-negative integer")
+			return
+		}
+		rows, err := s.queries.ListTradesAfterSeq(ctx, dbsqlc.ListTradesAfterSeqParams{
+			UserID:   pgUUIDFromPtr(userID),
+			OrderID:  pgUUIDFromPtr(orderID),
+			Market:   market,
+			AfterSeq: seq,
+			RowLimit: int32(limit),
+		})
+		if err != nil {
+			writeProblem(w, r, http.StatusInternalServerError, "db_error", err.Error())
+			return
+		}
+		// trade sequence numbers are unique, so the last one is the cursor
+		var next *int64
+		if len(rows) == limit {
+			next = &rows[len(rows)-1].Seq
+		}
+		writeJSON(w, r, http.StatusOK, struct {
+			Items        any    `json:"items"`
+			NextAfterSeq *int64 `json:"next_after_seq,omitempty"`
+		}{Items: rows, NextAfterSeq: next})
+		return
+	}
+
 	var since pgtype.Timestamptz
 	if sinceRaw := query.Get("since"); sinceRaw != "" {
 		t, err := time.Parse(time.RFC3339Nano, sinceRaw)
@@ -439,6 +1188,17 @@ func (s *Server) handleGetBalances(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, r, http.StatusOK, rows)
 }
 
+func (s *Server) handleListMarkets(w http.ResponseWriter, r *http.Request) {
+	rows, err := s.queries.ListMarkets(r.Context())
+	if err != nil {
+		writeProblem(w, r, http.StatusInternalServerError, "db_error", err.Error())
+		return
+	}
+	writeJSON(w, r, http.StatusOK, struct {
+		Items any `json:"items"`
+	}{Items: rows})
+}
+
 func (s *Server) handleTicker(w http.ResponseWriter, r *http.Request) {
 	market := strings.TrimSpace(r.URL.Query().Get("market"))
 	if market == "" {
@@ -518,6 +1278,22 @@ func writeJSON(w http.ResponseWriter, r *http.Request, code int, v any) {
 	_ = json.NewEncoder(w).Encode(v)
 }
 
+// writeEngineError reports an error from the engine: 503 with Retry-After
+// when the engine refused the command for load or is shutting down, 500
+// otherwise.
+func writeEngineError(w http.ResponseWriter, r *http.Request, err error) {
+	var overload *engine.OverloadError
+	switch {
+	case errors.As(err, &overload):
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(overload.RetryAfter.Seconds()))))
+		writeProblem(w, r, http.StatusServiceUnavailable, "engine_overloaded", err.Error())
+	case errors.Is(err, engine.ErrStopped):
+		writeProblem(w, r, http.StatusServiceUnavailable, "engine_stopped", err.Error())
+	default:
+		writeProblem(w, r, http.StatusInternalServerError, "engine_error", err.Error())
+	}
+}
+
 func writeProblem(w http.ResponseWriter, r *http.Request, code int, title, detail string) {
 	reqID := middleware.GetReqID(r.Context())
 	w.Header().Set("Content-Type", "application/problem+json")
@@ -589,24 +1365,28 @@ func pgTimestamptzFrom(t time.Time) pgtype.Timestamptz {
 	return pgtype.Timestamptz{Time: t.UTC(), Valid: true}
 }
 
+// cursorPayload is the position of a keyset listing: (ts, id), or (seq, id)
+// for a listing by engine sequence number.
 type cursorPayload struct {
-	TS time.Time `json:"ts"`
-	ID uuid.UUID `json:"id"`
+	TS  time.Time `json:"ts"`
+	ID  uuid.UUID `json:"id"`
+	Seq int64     `json:"seq,omitempty"`
 }
 
-func encodeCursor(ts time.Time, id uuid.UUID) string {
-	b, _ := json.Marshal(cursorPayload{TS: ts.UTC(), ID: id})
+func encodeCursor(payload cursorPayload) string {
+	payload.TS = payload.TS.UTC()
+	b, _ := json.Marshal(payload)
 	return base64.RawURLEncoding.EncodeToString(b)
 }
 
-func decodeCursor(cur string) (time.Time, uuid.UUID, error) {
+func decodeCursor(cur string) (cursorPayload, error) {
 	data, err := base64.RawURLEncoding.DecodeString(cur)
 	if err != nil {
-		return time.Time{}, uuid.Nil, err
+		return cursorPayload{}, err
 	}
 	var payload cursorPayload
 	if err := json.Unmarshal(data, &payload); err != nil {
-		return time.Time{}, uuid.Nil, err
+		return cursorPayload{}, err
 	}
-	return payload.TS, payload.ID, nil
+	return payload, nil
 }
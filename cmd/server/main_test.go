@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgtype"
+
+	dbsqlc "github.com/hakimelghazi/exchange-core/db/sqlc"
+	"github.com/hakimelghazi/exchange-core/internal/engine"
+)
+
+// recordingDB answers every query with no rows, or with the row set for its
+// name, and records the sqlc name of each one it ran.
+type recordingDB struct {
+	mu    sync.Mutex
+	names []string
+	rows  map[string][]any // sqlc name -> the columns of the one row returned
+}
+
+func (db *recordingDB) record(sql string) string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	name, _, _ := strings.Cut(strings.TrimPrefix(sql, "-- name: "), " ")
+	db.names = append(db.names, name)
+	return name
+}
+
+func (db *recordingDB) ran() []string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return append([]string(nil), db.names...)
+}
+
+func (db *recordingDB) Exec(ctx context.Context, sql string, args ...interface{}) (pgconn.CommandTag, error) {
+	db.record(sql)
+	return pgconn.CommandTag{}, nil
+}
+
+func (db *recordingDB) Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error) {
+	db.record(sql)
+	return emptyRows{}, nil
+}
+
+func (db *recordingDB) QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row {
+	if cols, ok := db.rows[db.record(sql)]; ok {
+		return fixedRow(cols)
+	}
+	return emptyRows{}
+}
+
+func (db *recordingDB) CopyFrom(ctx context.Context, table pgx.Identifier, columns []string, src pgx.CopyFromSource) (int64, error) {
+	return 0, errors.New("copy not supported")
+}
+
+type emptyRows struct{}
+
+func (emptyRows) Close()                                       {}
+func (emptyRows) Err() error                                   { return nil }
+func (emptyRows) CommandTag() pgconn.CommandTag                { return pgconn.CommandTag{} }
+func (emptyRows) FieldDescriptions() []pgconn.FieldDescription { return nil }
+func (emptyRows) Next() bool                                   { return false }
+func (emptyRows) Scan(dest ...any) error                       { return pgx.ErrNoRows }
+func (emptyRows) Values() ([]any, error)                       { return nil, nil }
+func (emptyRows) RawValues() [][]byte                          { return nil }
+func (emptyRows) Conn() *pgx.Conn                              { return nil }
+
+type fixedRow []any
+
+func (r fixedRow) Scan(dest ...any) error {
+	if len(dest) != len(r) {
+		return fmt.Errorf("scan %d columns into %d values", len(r), len(dest))
+	}
+	for i, col := range r {
+		reflect.ValueOf(dest[i]).Elem().Set(reflect.ValueOf(col))
+	}
+	return nil
+}
+
+func TestListTradesRoutes(t *testing.T) {
+	db := &recordingDB{}
+	router := (&Server{queries: dbsqlc.New(db)}).routes()
+	orderID := uuid.NewString()
+
+	for _, tc := range []struct {
+		query string
+		code  int
+		ran   string // query run, if any
+	}{
+		{"after_seq=5", http.StatusOK, "ListTradesAfterSeq"},
+		{"after_seq=5&order_id=" + orderID, http.StatusOK, "ListTradesAfterSeq"},
+		{"order_id=" + orderID, http.StatusOK, "ListTrades"},
+		{"", http.StatusOK, "ListTrades"},
+		{"after_seq=-1", http.StatusUnprocessableEntity, ""},
+		{"order_id=nope", http.StatusUnprocessableEntity, ""},
+	} {
+		before := len(db.ran())
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/trades?"+tc.query, nil))
+		if rec.Code != tc.code {
+			t.Fatalf("GET /trades?%s: expected %d, got %d: %s", tc.query, tc.code, rec.Code, rec.Body)
+		}
+		ran := db.ran()[before:]
+		if tc.ran == "" && len(ran) != 0 || tc.ran != "" && (len(ran) != 1 || ran[0] != tc.ran) {
+			t.Fatalf("GET /trades?%s: expected %q to run, ran %v", tc.query, tc.ran, ran)
+		}
+		if tc.code != http.StatusOK {
+			continue
+		}
+		var body map[string]json.RawMessage
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatalf("GET /trades?%s: %v", tc.query, err)
+		}
+		if _, ok := body["items"]; !ok {
+			t.Fatalf("GET /trades?%s: expected a listing, got %s", tc.query, rec.Body)
+		}
+	}
+}
+
+// A retry gets the response stored with its Idempotency-Key byte for byte,
+// not one rebuilt with a new request id and time.
+func TestPlaceOrderReturnsStoredResponse(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	eng, err := engine.NewEngine(16, engine.NewMemStore())
+	if err != nil {
+		t.Fatalf("new engine: %v", err)
+	}
+	if err := eng.Bootstrap(ctx, nil); err != nil {
+		t.Fatalf("bootstrap: %v", err)
+	}
+	done := make(chan struct{})
+	go func() {
+		eng.Run(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	stored := []byte(`{"order_id":"first","request_id":"first-request"}`)
+	db := &recordingDB{rows: map[string][]any{
+		"SetIdempotencyResponse": {pgtype.Int4{Int32: http.StatusCreated, Valid: true}, stored},
+	}}
+	router := (&Server{engine: eng, queries: dbsqlc.New(db)}).routes()
+	body := fmt.Sprintf(`{"id":%q,"user_id":%q,"market":"BTC-USD","side":"BUY","quantity":1,"is_market":true,"stp_mode":"NONE"}`,
+		uuid.NewString(), uuid.NewString())
+
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest(http.MethodPost, "/orders", strings.NewReader(body))
+		req.Header.Set("Idempotency-Key", "k1")
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		if rec.Code != http.StatusCreated {
+			t.Fatalf("POST /orders #%d: expected 201, got %d: %s", i, rec.Code, rec.Body)
+		}
+		if got := strings.TrimSpace(rec.Body.String()); got != string(stored) {
+			t.Fatalf("POST /orders #%d: expected the stored response, got %s", i, got)
+		}
+		if replayed := rec.Header().Get("Idempotent-Replayed") == "true"; replayed != (i > 0) {
+			t.Fatalf("POST /orders #%d: unexpected Idempotent-Replayed %v", i, replayed)
+		}
+	}
+}
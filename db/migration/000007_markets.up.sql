@@ -0,0 +1,19 @@
+-- markets: trading pairs and their order constraints, in engine units
+CREATE TABLE markets (
+    symbol TEXT PRIMARY KEY,                 -- 'BTC-USD'
+    base_asset TEXT NOT NULL,                -- 'BTC'
+    quote_asset TEXT NOT NULL,               -- 'USD'
+    tick_size BIGINT NOT NULL,               -- price increment
+    lot_size BIGINT NOT NULL,                -- quantity increment
+    min_notional BIGINT NOT NULL DEFAULT 0,  -- price * quantity floor, 0 = none
+    max_quantity BIGINT NOT NULL DEFAULT 0,  -- per-order cap, 0 = none
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    CONSTRAINT markets_tick_size_chk CHECK (tick_size > 0),
+    CONSTRAINT markets_lot_size_chk CHECK (lot_size > 0),
+    CONSTRAINT markets_limits_chk CHECK (min_notional >= 0 AND max_quantity >= 0)
+);
+
+INSERT INTO markets (symbol, base_asset, quote_asset, tick_size, lot_size, min_notional, max_quantity)
+VALUES
+    ('BTC-USD', 'BTC', 'USD', 1, 1, 0, 0),
+    ('ETH-USD', 'ETH', 'USD', 1, 1, 0, 0);
@@ -0,0 +1,5 @@
+ALTER TABLE orders
+  DROP CONSTRAINT IF EXISTS orders_time_in_force_chk;
+
+ALTER TABLE orders
+  DROP COLUMN IF EXISTS time_in_force;
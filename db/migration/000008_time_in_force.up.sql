@@ -0,0 +1,6 @@
+ALTER TABLE orders
+  ADD COLUMN time_in_force TEXT NOT NULL DEFAULT 'GTC';
+
+ALTER TABLE orders
+  ADD CONSTRAINT orders_time_in_force_chk
+  CHECK (time_in_force IN ('GTC', 'IOC', 'FOK', 'POST_ONLY'));
@@ -0,0 +1,5 @@
+ALTER TABLE users
+  DROP CONSTRAINT IF EXISTS users_stp_mode_chk;
+
+ALTER TABLE users
+  DROP COLUMN IF EXISTS stp_mode;
@@ -0,0 +1,7 @@
+-- account-level default for self-trade prevention; NULL = allow self-trades
+ALTER TABLE users
+  ADD COLUMN stp_mode TEXT;
+
+ALTER TABLE users
+  ADD CONSTRAINT users_stp_mode_chk
+  CHECK (stp_mode IN ('CANCEL_NEWEST', 'CANCEL_OLDEST', 'CANCEL_BOTH', 'DECREMENT_AND_CANCEL'));
@@ -0,0 +1,18 @@
+ALTER TABLE accounts
+  DROP CONSTRAINT IF EXISTS accounts_user_asset_kind_key;
+
+DELETE FROM ledger_entries
+WHERE account_id IN (SELECT id FROM accounts WHERE kind <> 'AVAILABLE');
+
+DELETE FROM accounts
+WHERE kind <> 'AVAILABLE';
+
+ALTER TABLE accounts
+  ADD CONSTRAINT accounts_user_asset_key
+  UNIQUE (user_id, asset);
+
+ALTER TABLE accounts
+  DROP CONSTRAINT IF EXISTS accounts_kind_chk;
+
+ALTER TABLE accounts
+  DROP COLUMN IF EXISTS kind;
@@ -0,0 +1,15 @@
+-- split each user/asset into AVAILABLE and HELD accounts; order holds move
+-- funds between them through the ledger
+ALTER TABLE accounts
+  ADD COLUMN kind TEXT NOT NULL DEFAULT 'AVAILABLE';
+
+ALTER TABLE accounts
+  ADD CONSTRAINT accounts_kind_chk
+  CHECK (kind IN ('AVAILABLE', 'HELD'));
+
+ALTER TABLE accounts
+  DROP CONSTRAINT IF EXISTS accounts_user_asset_key;
+
+ALTER TABLE accounts
+  ADD CONSTRAINT accounts_user_asset_kind_key
+  UNIQUE (user_id, asset, kind);
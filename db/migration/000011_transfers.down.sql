@@ -0,0 +1,14 @@
+DROP TABLE IF EXISTS transfers;
+
+DELETE FROM ledger_entries
+WHERE account_id IN (SELECT id FROM accounts WHERE kind = 'OMNIBUS');
+
+DELETE FROM accounts
+WHERE kind = 'OMNIBUS';
+
+ALTER TABLE accounts
+  DROP CONSTRAINT IF EXISTS accounts_kind_chk;
+
+ALTER TABLE accounts
+  ADD CONSTRAINT accounts_kind_chk
+  CHECK (kind IN ('AVAILABLE', 'HELD'));
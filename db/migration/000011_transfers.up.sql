@@ -0,0 +1,32 @@
+-- exchange-owned user holding the omnibus account of each asset; deposits
+-- and withdrawals post against it so every ledger stays balanced
+INSERT INTO users (id, email)
+VALUES ('00000000-0000-0000-0000-000000000001', 'exchange@example.com')
+ON CONFLICT (id) DO NOTHING;
+
+ALTER TABLE accounts
+  DROP CONSTRAINT IF EXISTS accounts_kind_chk;
+
+ALTER TABLE accounts
+  ADD CONSTRAINT accounts_kind_chk
+  CHECK (kind IN ('AVAILABLE', 'HELD', 'OMNIBUS'));
+
+-- transfers: deposits and withdrawals between users and the outside world
+CREATE TABLE transfers (
+    id UUID PRIMARY KEY,
+    user_id UUID NOT NULL REFERENCES users(id),
+    kind TEXT NOT NULL,                    -- 'DEPOSIT' | 'WITHDRAWAL'
+    asset TEXT NOT NULL,
+    amount NUMERIC(20, 8) NOT NULL,
+    status TEXT NOT NULL,                  -- 'PENDING','CONFIRMED','REJECTED'
+    external_ref TEXT NOT NULL,            -- chain tx hash, bank reference, ...
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    CONSTRAINT transfers_kind_chk CHECK (kind IN ('DEPOSIT', 'WITHDRAWAL')),
+    CONSTRAINT transfers_status_chk CHECK (status IN ('PENDING', 'CONFIRMED', 'REJECTED')),
+    CONSTRAINT transfers_amount_positive CHECK (amount > 0)
+);
+
+-- one transfer per external reference and direction
+CREATE UNIQUE INDEX IF NOT EXISTS idx_transfers_kind_external_ref
+  ON transfers (kind, external_ref);
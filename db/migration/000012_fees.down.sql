@@ -0,0 +1,30 @@
+DELETE FROM ledger_entries
+WHERE account_id IN (SELECT id FROM accounts WHERE kind = 'FEES');
+
+DELETE FROM accounts
+WHERE kind = 'FEES';
+
+ALTER TABLE accounts
+  DROP CONSTRAINT IF EXISTS accounts_kind_chk;
+
+ALTER TABLE accounts
+  ADD CONSTRAINT accounts_kind_chk
+  CHECK (kind IN ('AVAILABLE', 'HELD', 'OMNIBUS'));
+
+ALTER TABLE trades
+  DROP COLUMN IF EXISTS maker_fee,
+  DROP COLUMN IF EXISTS taker_fee,
+  DROP COLUMN IF EXISTS maker_fee_asset,
+  DROP COLUMN IF EXISTS taker_fee_asset;
+
+ALTER TABLE users
+  DROP COLUMN IF EXISTS fee_tier;
+
+DROP TABLE IF EXISTS fee_tiers;
+
+ALTER TABLE markets
+  DROP CONSTRAINT IF EXISTS markets_fees_chk;
+
+ALTER TABLE markets
+  DROP COLUMN IF EXISTS maker_fee_bps,
+  DROP COLUMN IF EXISTS taker_fee_bps;
@@ -0,0 +1,45 @@
+-- market fee schedule in basis points of the traded amount; a negative
+-- maker fee is a rebate
+ALTER TABLE markets
+  ADD COLUMN maker_fee_bps BIGINT NOT NULL DEFAULT 0,
+  ADD COLUMN taker_fee_bps BIGINT NOT NULL DEFAULT 0;
+
+ALTER TABLE markets
+  ADD CONSTRAINT markets_fees_chk
+  CHECK (taker_fee_bps BETWEEN 0 AND 10000
+         AND maker_fee_bps BETWEEN -taker_fee_bps AND 10000);
+
+-- fee tiers override the market schedule for the users assigned to them
+CREATE TABLE fee_tiers (
+    name TEXT PRIMARY KEY,
+    maker_fee_bps BIGINT NOT NULL,
+    taker_fee_bps BIGINT NOT NULL,
+    CONSTRAINT fee_tiers_fees_chk
+      CHECK (taker_fee_bps BETWEEN 0 AND 10000
+             AND maker_fee_bps BETWEEN -taker_fee_bps AND 10000)
+);
+
+ALTER TABLE users
+  ADD COLUMN fee_tier TEXT REFERENCES fee_tiers(name);
+
+-- fees are charged in the asset each side receives
+ALTER TABLE trades
+  ADD COLUMN maker_fee NUMERIC(20, 8) NOT NULL DEFAULT 0,
+  ADD COLUMN taker_fee NUMERIC(20, 8) NOT NULL DEFAULT 0,
+  ADD COLUMN maker_fee_asset TEXT NOT NULL DEFAULT '',
+  ADD COLUMN taker_fee_asset TEXT NOT NULL DEFAULT '';
+
+-- the exchange collects fees (and pays rebates) through FEES accounts
+ALTER TABLE accounts
+  DROP CONSTRAINT IF EXISTS accounts_kind_chk;
+
+ALTER TABLE accounts
+  ADD CONSTRAINT accounts_kind_chk
+  CHECK (kind IN ('AVAILABLE', 'HELD', 'OMNIBUS', 'FEES'));
+
+UPDATE markets SET maker_fee_bps = 10, taker_fee_bps = 20;
+
+INSERT INTO fee_tiers (name, maker_fee_bps, taker_fee_bps)
+VALUES
+    ('VIP1', 5, 15),
+    ('MARKET_MAKER', -2, 10);
@@ -0,0 +1,11 @@
+-- idempotency_keys: one row per (user, Idempotency-Key) written in the same
+-- transaction as the order it placed, so a retry after a timeout finds it
+CREATE TABLE idempotency_keys (
+    user_id UUID NOT NULL REFERENCES users(id),
+    key TEXT NOT NULL,
+    request_hash TEXT NOT NULL,            -- sha256 of the canonical request
+    order_id UUID NOT NULL REFERENCES orders(id),
+    result JSONB NOT NULL,                 -- match result returned to the client
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (user_id, key)
+);
@@ -0,0 +1,10 @@
+-- priority_at orders resting orders within a price level. It starts at
+-- created_at and moves to the amend time when an amend loses queue priority.
+ALTER TABLE orders
+  ADD COLUMN priority_at TIMESTAMPTZ;
+
+UPDATE orders SET priority_at = created_at;
+
+ALTER TABLE orders
+  ALTER COLUMN priority_at SET DEFAULT now(),
+  ALTER COLUMN priority_at SET NOT NULL;
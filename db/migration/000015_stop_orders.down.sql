@@ -0,0 +1,21 @@
+ALTER TABLE markets
+  DROP COLUMN IF EXISTS last_price;
+
+DROP INDEX IF EXISTS idx_orders_untriggered_by_market;
+
+UPDATE orders SET status = 'CANCELLED' WHERE status = 'UNTRIGGERED';
+
+ALTER TABLE orders
+  DROP CONSTRAINT IF EXISTS orders_stop_price_chk;
+
+ALTER TABLE orders
+  DROP CONSTRAINT IF EXISTS orders_status_chk;
+
+ALTER TABLE orders
+  ADD CONSTRAINT orders_status_chk
+  CHECK (status IN ('OPEN', 'PARTIAL', 'FILLED', 'CANCELLED'));
+
+ALTER TABLE orders
+  DROP COLUMN IF EXISTS is_market,
+  DROP COLUMN IF EXISTS stop_price,
+  DROP COLUMN IF EXISTS triggered_at;
@@ -0,0 +1,25 @@
+-- stop orders wait as UNTRIGGERED until the last trade price reaches
+-- stop_price; triggered_at records when they entered the book
+ALTER TABLE orders
+  ADD COLUMN is_market BOOLEAN NOT NULL DEFAULT false,
+  ADD COLUMN stop_price NUMERIC(20, 8),
+  ADD COLUMN triggered_at TIMESTAMPTZ;
+
+ALTER TABLE orders
+  DROP CONSTRAINT IF EXISTS orders_status_chk;
+
+ALTER TABLE orders
+  ADD CONSTRAINT orders_status_chk
+  CHECK (status IN ('OPEN', 'PARTIAL', 'FILLED', 'CANCELLED', 'UNTRIGGERED'));
+
+ALTER TABLE orders
+  ADD CONSTRAINT orders_stop_price_chk
+  CHECK (stop_price IS NULL OR stop_price > 0);
+
+CREATE INDEX IF NOT EXISTS idx_orders_untriggered_by_market
+  ON orders (market)
+  WHERE status = 'UNTRIGGERED';
+
+-- last trade price per market, the reference for stop triggers
+ALTER TABLE markets
+  ADD COLUMN last_price BIGINT;
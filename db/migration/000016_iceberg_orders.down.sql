@@ -0,0 +1,7 @@
+ALTER TABLE orders
+  DROP CONSTRAINT IF EXISTS orders_hidden_quantity_chk,
+  DROP CONSTRAINT IF EXISTS orders_display_quantity_chk;
+
+ALTER TABLE orders
+  DROP COLUMN IF EXISTS display_quantity,
+  DROP COLUMN IF EXISTS hidden_quantity;
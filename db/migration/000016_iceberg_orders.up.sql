@@ -0,0 +1,13 @@
+-- iceberg orders show display_quantity at a time; hidden_quantity is the part
+-- of remaining not yet shown in the book
+ALTER TABLE orders
+  ADD COLUMN display_quantity NUMERIC(20, 8),
+  ADD COLUMN hidden_quantity NUMERIC(20, 8) NOT NULL DEFAULT 0;
+
+ALTER TABLE orders
+  ADD CONSTRAINT orders_display_quantity_chk
+  CHECK (display_quantity IS NULL OR display_quantity > 0);
+
+ALTER TABLE orders
+  ADD CONSTRAINT orders_hidden_quantity_chk
+  CHECK (hidden_quantity >= 0 AND hidden_quantity <= remaining);
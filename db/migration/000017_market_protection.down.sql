@@ -0,0 +1,11 @@
+ALTER TABLE orders
+  DROP CONSTRAINT IF EXISTS orders_quote_quantity_chk;
+
+ALTER TABLE orders
+  DROP COLUMN IF EXISTS quote_quantity;
+
+ALTER TABLE markets
+  DROP CONSTRAINT IF EXISTS markets_price_band_chk;
+
+ALTER TABLE markets
+  DROP COLUMN IF EXISTS price_band_bps;
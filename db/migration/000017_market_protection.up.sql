@@ -0,0 +1,19 @@
+-- market orders stop walking the book price_band_bps away from the best
+-- price they arrive at; 0 = no band
+ALTER TABLE markets
+  ADD COLUMN price_band_bps BIGINT NOT NULL DEFAULT 0;
+
+ALTER TABLE markets
+  ADD CONSTRAINT markets_price_band_chk
+  CHECK (price_band_bps >= 0 AND price_band_bps < 10000);
+
+UPDATE markets SET price_band_bps = 500;
+
+-- market buys sized by the quote amount to spend; quantity is what that
+-- bought
+ALTER TABLE orders
+  ADD COLUMN quote_quantity NUMERIC(20, 8);
+
+ALTER TABLE orders
+  ADD CONSTRAINT orders_quote_quantity_chk
+  CHECK (quote_quantity IS NULL OR quote_quantity > 0);
@@ -0,0 +1,11 @@
+UPDATE orders SET status = 'CANCELLED' WHERE status = 'EXPIRED';
+
+ALTER TABLE orders
+  DROP CONSTRAINT IF EXISTS orders_status_chk;
+
+ALTER TABLE orders
+  ADD CONSTRAINT orders_status_chk
+  CHECK (status IN ('OPEN', 'PARTIAL', 'FILLED', 'CANCELLED', 'UNTRIGGERED'));
+
+ALTER TABLE orders
+  DROP COLUMN IF EXISTS expires_at;
@@ -0,0 +1,10 @@
+-- good-till-date orders are expired by the engine at expires_at
+ALTER TABLE orders
+  ADD COLUMN expires_at TIMESTAMPTZ;
+
+ALTER TABLE orders
+  DROP CONSTRAINT IF EXISTS orders_status_chk;
+
+ALTER TABLE orders
+  ADD CONSTRAINT orders_status_chk
+  CHECK (status IN ('OPEN', 'PARTIAL', 'FILLED', 'CANCELLED', 'UNTRIGGERED', 'EXPIRED'));
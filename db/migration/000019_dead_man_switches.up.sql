@@ -0,0 +1,9 @@
+-- dead_man_switches: an armed switch cancels all of the user's open orders
+-- unless a heartbeat pushes expires_at forward first
+CREATE TABLE dead_man_switches (
+    user_id UUID PRIMARY KEY REFERENCES users(id),
+    timeout_ms BIGINT NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    CONSTRAINT dead_man_switches_timeout_chk CHECK (timeout_ms > 0)
+);
@@ -0,0 +1,8 @@
+DROP INDEX IF EXISTS orders_seq_idx;
+DROP INDEX IF EXISTS trades_seq_idx;
+
+ALTER TABLE trades
+  DROP COLUMN IF EXISTS seq;
+
+ALTER TABLE orders
+  DROP COLUMN IF EXISTS seq;
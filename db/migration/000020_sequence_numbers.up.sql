@@ -0,0 +1,23 @@
+-- seq is the engine sequence number of the last event that changed an order,
+-- and of the trade itself. Existing rows are numbered in time order.
+ALTER TABLE orders
+  ADD COLUMN seq BIGINT NOT NULL DEFAULT 0;
+
+ALTER TABLE trades
+  ADD COLUMN seq BIGINT NOT NULL DEFAULT 0;
+
+CREATE TEMP TABLE seq_backfill AS
+SELECT id, kind, row_number() OVER (ORDER BY at, kind, id) AS seq
+FROM (
+    SELECT id, created_at AS at, 0 AS kind FROM orders
+    UNION ALL
+    SELECT id, traded_at AS at, 1 AS kind FROM trades
+) events;
+
+UPDATE orders o SET seq = b.seq FROM seq_backfill b WHERE b.kind = 0 AND b.id = o.id;
+UPDATE trades t SET seq = b.seq FROM seq_backfill b WHERE b.kind = 1 AND b.id = t.id;
+
+DROP TABLE seq_backfill;
+
+CREATE UNIQUE INDEX trades_seq_idx ON trades (seq);
+CREATE INDEX orders_seq_idx ON orders (seq);
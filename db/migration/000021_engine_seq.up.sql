@@ -0,0 +1,13 @@
+-- engine_seq holds the last engine sequence number handed out, so a restart
+-- continues after it even if the rows that carried it changed since
+CREATE TABLE engine_seq (
+    id BOOLEAN PRIMARY KEY DEFAULT TRUE,
+    last_seq BIGINT NOT NULL,
+    CONSTRAINT engine_seq_single_row_chk CHECK (id)
+);
+
+INSERT INTO engine_seq (id, last_seq)
+SELECT TRUE, GREATEST(
+    (SELECT COALESCE(MAX(seq), 0) FROM orders),
+    (SELECT COALESCE(MAX(seq), 0) FROM trades)
+);
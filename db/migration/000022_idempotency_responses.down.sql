@@ -0,0 +1,3 @@
+ALTER TABLE idempotency_keys
+    DROP COLUMN IF EXISTS response_body,
+    DROP COLUMN IF EXISTS response_status;
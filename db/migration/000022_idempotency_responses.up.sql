@@ -0,0 +1,5 @@
+-- the response first sent for an Idempotency-Key, returned byte for byte to
+-- every retry; NULL until the first response is stored
+ALTER TABLE idempotency_keys
+    ADD COLUMN response_status INT,
+    ADD COLUMN response_body BYTEA;
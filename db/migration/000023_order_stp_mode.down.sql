@@ -0,0 +1,5 @@
+ALTER TABLE orders
+  DROP CONSTRAINT IF EXISTS orders_stp_mode_chk;
+
+ALTER TABLE orders
+  DROP COLUMN IF EXISTS stp_mode;
@@ -0,0 +1,8 @@
+-- self-trade prevention of the order itself, so orders reloaded at bootstrap
+-- keep it; NULL = allow self-trades
+ALTER TABLE orders
+  ADD COLUMN stp_mode TEXT;
+
+ALTER TABLE orders
+  ADD CONSTRAINT orders_stp_mode_chk
+  CHECK (stp_mode IN ('CANCEL_NEWEST', 'CANCEL_OLDEST', 'CANCEL_BOTH', 'DECREMENT_AND_CANCEL'));
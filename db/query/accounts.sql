@@ -1,15 +1,15 @@
 -- name: CreateAccount :one
 INSERT INTO accounts (
-    id, user_id, asset, balance
+    id, user_id, asset, balance, kind
 ) VALUES (
-    $1, $2, $3, $4
+    $1, $2, $3, $4, $5
 ) RETURNING *;
 
 -- name: GetAccount :one
 SELECT * FROM accounts WHERE id = $1;
 
 -- name: ListAccountsByUser :many
-SELECT * FROM accounts WHERE user_id = $1 ORDER BY asset;
+SELECT * FROM accounts WHERE user_id = $1 ORDER BY asset, kind;
 
 -- name: UpdateAccountBalance :one
 UPDATE accounts
@@ -19,19 +19,31 @@ RETURNING *;
 
 -- name: GetAccountByUserAsset :one
 SELECT * FROM accounts
-WHERE user_id = $1 AND asset = $2;
+WHERE user_id = $1 AND asset = $2 AND kind = $3;
 
 -- name: UpsertAccount :one
-INSERT INTO accounts (id, user_id, asset, balance)  -- balance can remain 0; ledger is source of truth
-VALUES ($1, $2, $3, $4)
-ON CONFLICT (user_id, asset) DO NOTHING
+INSERT INTO accounts (id, user_id, asset, balance, kind)  -- balance can remain 0; ledger is source of truth
+VALUES ($1, $2, $3, $4, $5)
+ON CONFLICT (user_id, asset, kind) DO NOTHING
 RETURNING *;
 
 -- name: GetBalancesByUser :many
 SELECT a.asset,
+       a.kind,
        COALESCE(SUM(le.amount), 0)::NUMERIC(20,8) AS balance
 FROM accounts a
 LEFT JOIN ledger_entries le ON le.account_id = a.id
 WHERE a.user_id = $1
-GROUP BY a.asset
-ORDER BY a.asset;
+GROUP BY a.asset, a.kind
+ORDER BY a.asset, a.kind;
+
+-- name: ListAccountBalances :many
+-- Ledger-derived balance of every account, used to seed the engine.
+SELECT a.user_id,
+       a.asset,
+       a.kind,
+       COALESCE(SUM(le.amount), 0)::NUMERIC(20,8) AS balance
+FROM accounts a
+LEFT JOIN ledger_entries le ON le.account_id = a.id
+GROUP BY a.id
+ORDER BY a.user_id, a.asset, a.kind;
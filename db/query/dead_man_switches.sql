@@ -0,0 +1,20 @@
+-- name: DeleteDeadManSwitch :exec
+DELETE FROM dead_man_switches WHERE user_id = $1;
+
+-- name: GetDeadManSwitch :one
+SELECT * FROM dead_man_switches WHERE user_id = $1;
+
+-- name: ListDeadManSwitches :many
+SELECT * FROM dead_man_switches ORDER BY expires_at;
+
+-- name: UpsertDeadManSwitch :one
+INSERT INTO dead_man_switches (
+    user_id, timeout_ms, expires_at
+) VALUES (
+    $1, $2, $3
+)
+ON CONFLICT (user_id) DO UPDATE
+SET timeout_ms = EXCLUDED.timeout_ms,
+    expires_at = EXCLUDED.expires_at,
+    updated_at = now()
+RETURNING *;
@@ -0,0 +1,7 @@
+-- name: GetFeeTier :one
+SELECT * FROM fee_tiers WHERE name = $1;
+
+-- name: ListUserFeeTiers :many
+SELECT u.id AS user_id, t.maker_fee_bps, t.taker_fee_bps
+FROM users u
+JOIN fee_tiers t ON t.name = u.fee_tier;
@@ -0,0 +1,19 @@
+-- name: GetIdempotencyKey :one
+SELECT * FROM idempotency_keys
+WHERE user_id = $1 AND key = $2;
+
+-- name: InsertIdempotencyKey :exec
+INSERT INTO idempotency_keys (
+    user_id, key, request_hash, order_id, result
+) VALUES (
+    $1, $2, $3, $4, $5
+);
+
+-- name: SetIdempotencyResponse :one
+-- stores the response first sent for a key and returns the stored one,
+-- which an earlier response keeps
+UPDATE idempotency_keys
+SET response_status = COALESCE(response_status, sqlc.arg(response_status)::int),
+    response_body = COALESCE(response_body, sqlc.arg(response_body)::bytea)
+WHERE user_id = $1 AND key = $2
+RETURNING response_status, response_body;
@@ -0,0 +1,10 @@
+-- name: ListMarkets :many
+SELECT * FROM markets ORDER BY symbol;
+
+-- name: GetMarket :one
+SELECT * FROM markets WHERE symbol = $1;
+
+-- name: SetMarketLastPrice :exec
+UPDATE markets
+SET last_price = $2
+WHERE symbol = $1;
@@ -1,12 +1,21 @@
 -- name: UpsertOrder :one
 INSERT INTO orders (
-    id, user_id, market, side, price, quantity, remaining, status
+    id, user_id, market, side, price, quantity, remaining, status, time_in_force,
+    is_market, stop_price, triggered_at, display_quantity, hidden_quantity,
+    quote_quantity, expires_at, seq, stp_mode
 ) VALUES (
-    $1, $2, $3, $4, $5, $6, $7, $8
+    $1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18
 )
 ON CONFLICT (id) DO UPDATE
-SET remaining = EXCLUDED.remaining,
-    status    = EXCLUDED.status
+SET quantity        = EXCLUDED.quantity,
+    remaining       = EXCLUDED.remaining,
+    status          = EXCLUDED.status,
+    triggered_at    = EXCLUDED.triggered_at,
+    hidden_quantity = EXCLUDED.hidden_quantity,
+    seq             = EXCLUDED.seq,
+    -- a stop order queues from the moment it triggers
+    priority_at     = CASE WHEN orders.triggered_at IS NULL AND EXCLUDED.triggered_at IS NOT NULL
+                           THEN now() ELSE orders.priority_at END
 RETURNING *;
 
 -- name: GetOrder :one
@@ -20,14 +29,33 @@ FOR UPDATE;
 -- name: UpdateOrderAfterMatch :exec
 UPDATE orders
 SET remaining = $2,
-    status = $3
+    status = $3,
+    hidden_quantity = $4,
+    -- an iceberg order showing its next slice goes to the back of the queue
+    priority_at = CASE WHEN sqlc.arg(reset_priority)::boolean THEN now() ELSE priority_at END,
+    seq = $6
 WHERE id = $1;
 
 -- name: MarkOrderCancelled :exec
 UPDATE orders
-SET status = 'CANCELLED'
+SET status = 'CANCELLED',
+    seq = $2
 WHERE id = $1
-  AND status IN ('OPEN','PARTIAL');
+  AND status IN ('OPEN','PARTIAL','UNTRIGGERED');
+
+-- name: MarkOrderExpired :exec
+UPDATE orders
+SET status = 'EXPIRED',
+    seq = $2
+WHERE id = $1
+  AND status IN ('OPEN','PARTIAL','UNTRIGGERED');
+
+-- name: MarkOrdersCancelled :exec
+UPDATE orders
+SET status = 'CANCELLED',
+    seq = sqlc.arg(seq)
+WHERE id = ANY(sqlc.arg(ids)::uuid[])
+  AND status IN ('OPEN','PARTIAL','UNTRIGGERED');
 
 -- name: ListOrders :many
 SELECT *
@@ -55,6 +83,17 @@ ORDER BY created_at, id
 LIMIT $6;
 -- Keyset pagination with (created_at, id)
 
+-- name: ListOrdersAfterSeq :many
+-- Keyset pagination with (seq, id): orders in the order they last changed
+SELECT *
+FROM orders
+WHERE (sqlc.narg(user_id)::uuid IS NULL OR user_id = sqlc.narg(user_id))
+  AND (sqlc.arg(status)::text = '' OR status = sqlc.arg(status))
+  AND (sqlc.arg(side)::text = '' OR side = sqlc.arg(side))
+  AND (seq, id) > (sqlc.arg(after_seq)::bigint, sqlc.arg(after_id)::uuid)
+ORDER BY seq, id
+LIMIT sqlc.arg(row_limit);
+
 
 -- name: ListRestingAsks :many
 SELECT *
@@ -66,7 +105,7 @@ WHERE status IN ('OPEN','PARTIAL')
         OR $1 = ''
         OR market = $1
       )
-ORDER BY price ASC, created_at ASC, id ASC;
+ORDER BY price ASC, priority_at ASC, id ASC;
 
 -- name: ListRestingBids :many
 SELECT *
@@ -78,4 +117,26 @@ WHERE status IN ('OPEN','PARTIAL')
         OR $1 = ''
         OR market = $1
       )
-ORDER BY price DESC, created_at ASC, id ASC;
+ORDER BY price DESC, priority_at ASC, id ASC;
+
+-- name: AmendOrder :exec
+UPDATE orders
+SET price = $2,
+    quantity = $3,
+    remaining = $4,
+    status = $5,
+    priority_at = CASE WHEN sqlc.arg(reset_priority)::boolean THEN now() ELSE priority_at END,
+    hidden_quantity = $7,
+    seq = $8
+WHERE id = $1;
+
+-- name: ListUntriggeredOrders :many
+SELECT *
+FROM orders
+WHERE status = 'UNTRIGGERED'
+  AND (
+        $1::text IS NULL
+        OR $1 = ''
+        OR market = $1
+      )
+ORDER BY created_at ASC, id ASC;
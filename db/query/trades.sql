@@ -1,15 +1,24 @@
 -- name: InsertTrade :one
 INSERT INTO trades (
-    id, taker_order_id,maker_order_id, price, quantity
+    id, taker_order_id,maker_order_id, price, quantity,
+    maker_fee, taker_fee, maker_fee_asset, taker_fee_asset, seq
 ) VALUES (
-    $1, $2, $3, $4, $5
+    $1, $2, $3, $4, $5, $6, $7, $8, $9, $10
 )
 RETURNING *;
 
+-- name: InsertTrades :copyfrom
+INSERT INTO trades (
+    id, taker_order_id, maker_order_id, price, quantity,
+    maker_fee, taker_fee, maker_fee_asset, taker_fee_asset, seq
+) VALUES (
+    $1, $2, $3, $4, $5, $6, $7, $8, $9, $10
+);
+
 -- name: ListTradesByOrder :many
 SELECT * FROM trades
 WHERE taker_order_id = $1 OR maker_order_id = $1
-ORDER BY traded_at DESC;
+ORDER BY seq DESC;
 
 -- name: ListTrades :many
 SELECT t.*
@@ -20,5 +29,30 @@ WHERE ($1::uuid IS NULL OR ot.user_id = $1 OR om.user_id = $1)
   AND ($2::uuid IS NULL OR t.taker_order_id = $2 OR t.maker_order_id = $2)
   AND ($3::text = '' OR ot.market = $3 OR om.market = $3)
   AND ($4::timestamptz IS NULL OR t.traded_at >= $4)
-ORDER BY t.traded_at DESC
+ORDER BY t.seq DESC
 LIMIT $5;
+
+-- name: ListTradesAfterSeq :many
+SELECT t.*
+FROM trades t
+JOIN orders ot ON ot.id = t.taker_order_id
+JOIN orders om ON om.id = t.maker_order_id
+WHERE (sqlc.narg(user_id)::uuid IS NULL OR ot.user_id = sqlc.narg(user_id) OR om.user_id = sqlc.narg(user_id))
+  AND (sqlc.narg(order_id)::uuid IS NULL OR t.taker_order_id = sqlc.narg(order_id) OR t.maker_order_id = sqlc.narg(order_id))
+  AND (sqlc.arg(market)::text = '' OR ot.market = sqlc.arg(market) OR om.market = sqlc.arg(market))
+  AND t.seq > sqlc.arg(after_seq)::bigint
+ORDER BY t.seq
+LIMIT sqlc.arg(row_limit);
+
+-- name: GetMaxSeq :one
+-- the highest engine sequence number handed out or stored on an order or a
+-- trade
+SELECT GREATEST(
+    (SELECT COALESCE(MAX(seq), 0) FROM orders),
+    (SELECT COALESCE(MAX(seq), 0) FROM trades),
+    (SELECT COALESCE(MAX(last_seq), 0) FROM engine_seq)
+)::bigint AS seq;
+
+-- name: SetLastSeq :exec
+-- records that engine sequence numbers up to seq were handed out
+UPDATE engine_seq SET last_seq = GREATEST(last_seq, sqlc.arg(seq)::bigint);
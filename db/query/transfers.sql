@@ -0,0 +1,31 @@
+-- name: CreateTransfer :one
+INSERT INTO transfers (
+    id, user_id, kind, asset, amount, status, external_ref
+) VALUES (
+    $1, $2, $3, $4, $5, $6, $7
+)
+RETURNING *;
+
+-- name: GetTransfer :one
+SELECT * FROM transfers WHERE id = $1;
+
+-- name: GetTransferForUpdate :one
+SELECT * FROM transfers
+WHERE id = $1
+FOR UPDATE;
+
+-- name: GetTransferByExternalRef :one
+SELECT * FROM transfers
+WHERE kind = $1 AND external_ref = $2;
+
+-- name: UpdateTransferStatus :one
+UPDATE transfers
+SET status = $2,
+    updated_at = now()
+WHERE id = $1
+RETURNING *;
+
+-- name: ListPendingWithdrawals :many
+SELECT * FROM transfers
+WHERE kind = 'WITHDRAWAL' AND status = 'PENDING'
+ORDER BY created_at ASC;
@@ -13,3 +13,13 @@ SELECT * FROM users WHERE id = $1;
 INSERT INTO users (id, email)
 VALUES ($1, $2)
 ON CONFLICT (id) DO NOTHING;
+
+-- name: SetUserSTPMode :exec
+UPDATE users
+SET stp_mode = $2
+WHERE id = $1;
+
+-- name: SetUserFeeTier :exec
+UPDATE users
+SET fee_tier = $2
+WHERE id = $1;
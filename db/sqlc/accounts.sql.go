@@ -13,10 +13,10 @@ import (
 
 const createAccount = `-- name: CreateAccount :one
 INSERT INTO accounts (
-    id, user_id, asset, balance
+    id, user_id, asset, balance, kind
 ) VALUES (
-    $1, $2, $3, $4
-) RETURNING id, user_id, asset, balance
+    $1, $2, $3, $4, $5
+) RETURNING id, user_id, asset, balance, kind
 `
 
 type CreateAccountParams struct {
@@ -24,6 +24,7 @@ type CreateAccountParams struct {
 	UserID  pgtype.UUID
 	Asset   string
 	Balance pgtype.Numeric
+	Kind    string
 }
 
 func (q *Queries) CreateAccount(ctx context.Context, arg CreateAccountParams) (Account, error) {
@@ -32,6 +33,7 @@ func (q *Queries) CreateAccount(ctx context.Context, arg CreateAccountParams) (A
 		arg.UserID,
 		arg.Asset,
 		arg.Balance,
+		arg.Kind,
 	)
 	var i Account
 	err := row.Scan(
@@ -39,12 +41,13 @@ func (q *Queries) CreateAccount(ctx context.Context, arg CreateAccountParams) (A
 		&i.UserID,
 		&i.Asset,
 		&i.Balance,
+		&i.Kind,
 	)
 	return i, err
 }
 
 const getAccount = `-- name: GetAccount :one
-SELECT id, user_id, asset, balance FROM accounts WHERE id = $1
+SELECT id, user_id, asset, balance, kind FROM accounts WHERE id = $1
 `
 
 func (q *Queries) GetAccount(ctx context.Context, id pgtype.UUID) (Account, error) {
@@ -55,44 +58,49 @@ func (q *Queries) GetAccount(ctx context.Context, id pgtype.UUID) (Account, erro
 		&i.UserID,
 		&i.Asset,
 		&i.Balance,
+		&i.Kind,
 	)
 	return i, err
 }
 
 const getAccountByUserAsset = `-- name: GetAccountByUserAsset :one
-SELECT id, user_id, asset, balance FROM accounts
-WHERE user_id = $1 AND asset = $2
+SELECT id, user_id, asset, balance, kind FROM accounts
+WHERE user_id = $1 AND asset = $2 AND kind = $3
 `
 
 type GetAccountByUserAssetParams struct {
 	UserID pgtype.UUID
 	Asset  string
+	Kind   string
 }
 
 func (q *Queries) GetAccountByUserAsset(ctx context.Context, arg GetAccountByUserAssetParams) (Account, error) {
-	row := q.db.QueryRow(ctx, getAccountByUserAsset, arg.UserID, arg.Asset)
+	row := q.db.QueryRow(ctx, getAccountByUserAsset, arg.UserID, arg.Asset, arg.Kind)
 	var i Account
 	err := row.Scan(
 		&i.ID,
 		&i.UserID,
 		&i.Asset,
 		&i.Balance,
+		&i.Kind,
 	)
 	return i, err
 }
 
 const getBalancesByUser = `-- name: GetBalancesByUser :many
 SELECT a.asset,
+       a.kind,
        COALESCE(SUM(le.amount), 0)::NUMERIC(20,8) AS balance
 FROM accounts a
 LEFT JOIN ledger_entries le ON le.account_id = a.id
 WHERE a.user_id = $1
-GROUP BY a.asset
-ORDER BY a.asset
+GROUP BY a.asset, a.kind
+ORDER BY a.asset, a.kind
 `
 
 type GetBalancesByUserRow struct {
 	Asset   string
+	Kind    string
 	Balance pgtype.Numeric
 }
 
@@ -105,7 +113,51 @@ func (q *Queries) GetBalancesByUser(ctx context.Context, userID pgtype.UUID) ([]
 	var items []GetBalancesByUserRow
 	for rows.Next() {
 		var i GetBalancesByUserRow
-		if err := rows.Scan(&i.Asset, &i.Balance); err != nil {
+		if err := rows.Scan(&i.Asset, &i.Kind, &i.Balance); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listAccountBalances = `-- name: ListAccountBalances :many
+SELECT a.user_id,
+       a.asset,
+       a.kind,
+       COALESCE(SUM(le.amount), 0)::NUMERIC(20,8) AS balance
+FROM accounts a
+LEFT JOIN ledger_entries le ON le.account_id = a.id
+GROUP BY a.id
+ORDER BY a.user_id, a.asset, a.kind
+`
+
+type ListAccountBalancesRow struct {
+	UserID  pgtype.UUID
+	Asset   string
+	Kind    string
+	Balance pgtype.Numeric
+}
+
+// Ledger-derived balance of every account, used to seed the engine.
+func (q *Queries) ListAccountBalances(ctx context.Context) ([]ListAccountBalancesRow, error) {
+	rows, err := q.db.Query(ctx, listAccountBalances)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []ListAccountBalancesRow
+	for rows.Next() {
+		var i ListAccountBalancesRow
+		if err := rows.Scan(
+			&i.UserID,
+			&i.Asset,
+			&i.Kind,
+			&i.Balance,
+		); err != nil {
 			return nil, err
 		}
 		items = append(items, i)
@@ -117,7 +169,7 @@ func (q *Queries) GetBalancesByUser(ctx context.Context, userID pgtype.UUID) ([]
 }
 
 const listAccountsByUser = `-- name: ListAccountsByUser :many
-SELECT id, user_id, asset, balance FROM accounts WHERE user_id = $1 ORDER BY asset
+SELECT id, user_id, asset, balance, kind FROM accounts WHERE user_id = $1 ORDER BY asset, kind
 `
 
 func (q *Queries) ListAccountsByUser(ctx context.Context, userID pgtype.UUID) ([]Account, error) {
@@ -134,6 +186,7 @@ func (q *Queries) ListAccountsByUser(ctx context.Context, userID pgtype.UUID) ([
 			&i.UserID,
 			&i.Asset,
 			&i.Balance,
+			&i.Kind,
 		); err != nil {
 			return nil, err
 		}
@@ -149,7 +202,7 @@ const updateAccountBalance = `-- name: UpdateAccountBalance :one
 UPDATE accounts
 SET balance = $2
 WHERE id = $1
-RETURNING id, user_id, asset, balance
+RETURNING id, user_id, asset, balance, kind
 `
 
 type UpdateAccountBalanceParams struct {
@@ -165,15 +218,16 @@ func (q *Queries) UpdateAccountBalance(ctx context.Context, arg UpdateAccountBal
 		&i.UserID,
 		&i.Asset,
 		&i.Balance,
+		&i.Kind,
 	)
 	return i, err
 }
 
 const upsertAccount = `-- name: UpsertAccount :one
-INSERT INTO accounts (id, user_id, asset, balance)  -- balance can remain 0; ledger is source of truth
-VALUES ($1, $2, $3, $4)
-ON CONFLICT (user_id, asset) DO NOTHING
-RETURNING id, user_id, asset, balance
+INSERT INTO accounts (id, user_id, asset, balance, kind)  -- balance can remain 0; ledger is source of truth
+VALUES ($1, $2, $3, $4, $5)
+ON CONFLICT (user_id, asset, kind) DO NOTHING
+RETURNING id, user_id, asset, balance, kind
 `
 
 type UpsertAccountParams struct {
@@ -181,6 +235,7 @@ type UpsertAccountParams struct {
 	UserID  pgtype.UUID
 	Asset   string
 	Balance pgtype.Numeric
+	Kind    string
 }
 
 func (q *Queries) UpsertAccount(ctx context.Context, arg UpsertAccountParams) (Account, error) {
@@ -189,6 +244,7 @@ func (q *Queries) UpsertAccount(ctx context.Context, arg UpsertAccountParams) (A
 		arg.UserID,
 		arg.Asset,
 		arg.Balance,
+		arg.Kind,
 	)
 	var i Account
 	err := row.Scan(
@@ -196,6 +252,7 @@ func (q *Queries) UpsertAccount(ctx context.Context, arg UpsertAccountParams) (A
 		&i.UserID,
 		&i.Asset,
 		&i.Balance,
+		&i.Kind,
 	)
 	return i, err
 }
@@ -35,6 +35,13 @@ func (q *Queries) CreateLedger(ctx context.Context, arg CreateLedgerParams) (Led
 	return i, err
 }
 
+type InsertLedgerEntriesParams struct {
+	ID        pgtype.UUID
+	LedgerID  pgtype.UUID
+	AccountID pgtype.UUID
+	Amount    pgtype.Numeric
+}
+
 const insertLedgerEntry = `-- name: InsertLedgerEntry :exec
 INSERT INTO ledger_entries (id, ledger_id, account_id, amount)
 VALUES ($1, $2, $3, $4)
@@ -56,3 +63,9 @@ func (q *Queries) InsertLedgerEntry(ctx context.Context, arg InsertLedgerEntryPa
 	)
 	return err
 }
+
+type InsertLedgersParams struct {
+	ID      pgtype.UUID
+	RefType string
+	RefID   pgtype.UUID
+}
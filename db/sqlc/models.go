@@ -13,6 +13,36 @@ type Account struct {
 	UserID  pgtype.UUID
 	Asset   string
 	Balance pgtype.Numeric
+	Kind    string
+}
+
+type DeadManSwitch struct {
+	UserID    pgtype.UUID
+	TimeoutMs int64
+	ExpiresAt pgtype.Timestamptz
+	UpdatedAt pgtype.Timestamptz
+}
+
+type EngineSeq struct {
+	ID      bool
+	LastSeq int64
+}
+
+type FeeTier struct {
+	Name        string
+	MakerFeeBps int64
+	TakerFeeBps int64
+}
+
+type IdempotencyKey struct {
+	UserID         pgtype.UUID
+	Key            string
+	RequestHash    string
+	OrderID        pgtype.UUID
+	Result         []byte
+	CreatedAt      pgtype.Timestamptz
+	ResponseStatus pgtype.Int4
+	ResponseBody   []byte
 }
 
 type Ledger struct {
@@ -30,28 +60,73 @@ type LedgerEntry struct {
 	CreatedAt pgtype.Timestamptz
 }
 
+type Market struct {
+	Symbol       string
+	BaseAsset    string
+	QuoteAsset   string
+	TickSize     int64
+	LotSize      int64
+	MinNotional  int64
+	MaxQuantity  int64
+	CreatedAt    pgtype.Timestamptz
+	MakerFeeBps  int64
+	TakerFeeBps  int64
+	LastPrice    pgtype.Int8
+	PriceBandBps int64
+}
+
 type Order struct {
-	ID        pgtype.UUID
-	UserID    pgtype.UUID
-	Market    string
-	Side      string
-	Price     pgtype.Numeric
-	Quantity  pgtype.Numeric
-	Remaining pgtype.Numeric
-	Status    string
-	CreatedAt pgtype.Timestamptz
+	ID              pgtype.UUID
+	UserID          pgtype.UUID
+	Market          string
+	Side            string
+	Price           pgtype.Numeric
+	Quantity        pgtype.Numeric
+	Remaining       pgtype.Numeric
+	Status          string
+	CreatedAt       pgtype.Timestamptz
+	TimeInForce     string
+	PriorityAt      pgtype.Timestamptz
+	IsMarket        bool
+	StopPrice       pgtype.Numeric
+	TriggeredAt     pgtype.Timestamptz
+	DisplayQuantity pgtype.Numeric
+	HiddenQuantity  pgtype.Numeric
+	QuoteQuantity   pgtype.Numeric
+	ExpiresAt       pgtype.Timestamptz
+	Seq             int64
+	StpMode         pgtype.Text
 }
 
 type Trade struct {
-	ID           pgtype.UUID
-	TakerOrderID pgtype.UUID
-	MakerOrderID pgtype.UUID
-	Price        pgtype.Numeric
-	Quantity     pgtype.Numeric
-	TradedAt     pgtype.Timestamptz
+	ID            pgtype.UUID
+	TakerOrderID  pgtype.UUID
+	MakerOrderID  pgtype.UUID
+	Price         pgtype.Numeric
+	Quantity      pgtype.Numeric
+	TradedAt      pgtype.Timestamptz
+	MakerFee      pgtype.Numeric
+	TakerFee      pgtype.Numeric
+	MakerFeeAsset string
+	TakerFeeAsset string
+	Seq           int64
+}
+
+type Transfer struct {
+	ID          pgtype.UUID
+	UserID      pgtype.UUID
+	Kind        string
+	Asset       string
+	Amount      pgtype.Numeric
+	Status      string
+	ExternalRef string
+	CreatedAt   pgtype.Timestamptz
+	UpdatedAt   pgtype.Timestamptz
 }
 
 type User struct {
-	ID    pgtype.UUID
-	Email pgtype.Text
+	ID      pgtype.UUID
+	Email   pgtype.Text
+	StpMode pgtype.Text
+	FeeTier pgtype.Text
 }
@@ -11,8 +11,45 @@ import (
 	"github.com/jackc/pgx/v5/pgtype"
 )
 
+const amendOrder = `-- name: AmendOrder :exec
+UPDATE orders
+SET price = $2,
+    quantity = $3,
+    remaining = $4,
+    status = $5,
+    priority_at = CASE WHEN $6::boolean THEN now() ELSE priority_at END,
+    hidden_quantity = $7,
+    seq = $8
+WHERE id = $1
+`
+
+type AmendOrderParams struct {
+	ID             pgtype.UUID
+	Price          pgtype.Numeric
+	Quantity       pgtype.Numeric
+	Remaining      pgtype.Numeric
+	Status         string
+	ResetPriority  bool
+	HiddenQuantity pgtype.Numeric
+	Seq            int64
+}
+
+func (q *Queries) AmendOrder(ctx context.Context, arg AmendOrderParams) error {
+	_, err := q.db.Exec(ctx, amendOrder,
+		arg.ID,
+		arg.Price,
+		arg.Quantity,
+		arg.Remaining,
+		arg.Status,
+		arg.ResetPriority,
+		arg.HiddenQuantity,
+		arg.Seq,
+	)
+	return err
+}
+
 const getOrder = `-- name: GetOrder :one
-SELECT id, user_id, market, side, price, quantity, remaining, status, created_at FROM orders WHERE id = $1
+SELECT id, user_id, market, side, price, quantity, remaining, status, created_at, time_in_force, priority_at, is_market, stop_price, triggered_at, display_quantity, hidden_quantity, quote_quantity, expires_at, seq, stp_mode FROM orders WHERE id = $1
 `
 
 func (q *Queries) GetOrder(ctx context.Context, id pgtype.UUID) (Order, error) {
@@ -28,12 +65,23 @@ func (q *Queries) GetOrder(ctx context.Context, id pgtype.UUID) (Order, error) {
 		&i.Remaining,
 		&i.Status,
 		&i.CreatedAt,
+		&i.TimeInForce,
+		&i.PriorityAt,
+		&i.IsMarket,
+		&i.StopPrice,
+		&i.TriggeredAt,
+		&i.DisplayQuantity,
+		&i.HiddenQuantity,
+		&i.QuoteQuantity,
+		&i.ExpiresAt,
+		&i.Seq,
+		&i.StpMode,
 	)
 	return i, err
 }
 
 const getOrderForUpdate = `-- name: GetOrderForUpdate :one
-SELECT id, user_id, market, side, price, quantity, remaining, status, created_at FROM orders
+SELECT id, user_id, market, side, price, quantity, remaining, status, created_at, time_in_force, priority_at, is_market, stop_price, triggered_at, display_quantity, hidden_quantity, quote_quantity, expires_at, seq, stp_mode FROM orders
 WHERE id = $1
 FOR UPDATE
 `
@@ -51,12 +99,23 @@ func (q *Queries) GetOrderForUpdate(ctx context.Context, id pgtype.UUID) (Order,
 		&i.Remaining,
 		&i.Status,
 		&i.CreatedAt,
+		&i.TimeInForce,
+		&i.PriorityAt,
+		&i.IsMarket,
+		&i.StopPrice,
+		&i.TriggeredAt,
+		&i.DisplayQuantity,
+		&i.HiddenQuantity,
+		&i.QuoteQuantity,
+		&i.ExpiresAt,
+		&i.Seq,
+		&i.StpMode,
 	)
 	return i, err
 }
 
 const listOrders = `-- name: ListOrders :many
-SELECT id, user_id, market, side, price, quantity, remaining, status, created_at
+SELECT id, user_id, market, side, price, quantity, remaining, status, created_at, time_in_force, priority_at, is_market, stop_price, triggered_at, display_quantity, hidden_quantity, quote_quantity, expires_at, seq, stp_mode
 FROM orders
 WHERE (
         $1::uuid IS NULL
@@ -116,6 +175,86 @@ func (q *Queries) ListOrders(ctx context.Context, arg ListOrdersParams) ([]Order
 			&i.Remaining,
 			&i.Status,
 			&i.CreatedAt,
+			&i.TimeInForce,
+			&i.PriorityAt,
+			&i.IsMarket,
+			&i.StopPrice,
+			&i.TriggeredAt,
+			&i.DisplayQuantity,
+			&i.HiddenQuantity,
+			&i.QuoteQuantity,
+			&i.ExpiresAt,
+			&i.Seq,
+			&i.StpMode,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listOrdersAfterSeq = `-- name: ListOrdersAfterSeq :many
+SELECT id, user_id, market, side, price, quantity, remaining, status, created_at, time_in_force, priority_at, is_market, stop_price, triggered_at, display_quantity, hidden_quantity, quote_quantity, expires_at, seq, stp_mode
+FROM orders
+WHERE ($1::uuid IS NULL OR user_id = $1)
+  AND ($2::text = '' OR status = $2)
+  AND ($3::text = '' OR side = $3)
+  AND (seq, id) > ($4::bigint, $5::uuid)
+ORDER BY seq, id
+LIMIT $6
+`
+
+type ListOrdersAfterSeqParams struct {
+	UserID   pgtype.UUID
+	Status   string
+	Side     string
+	AfterSeq int64
+	AfterID  pgtype.UUID
+	RowLimit int32
+}
+
+// Keyset pagination with (seq, id): orders in the order they last changed
+func (q *Queries) ListOrdersAfterSeq(ctx context.Context, arg ListOrdersAfterSeqParams) ([]Order, error) {
+	rows, err := q.db.Query(ctx, listOrdersAfterSeq,
+		arg.UserID,
+		arg.Status,
+		arg.Side,
+		arg.AfterSeq,
+		arg.AfterID,
+		arg.RowLimit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []Order
+	for rows.Next() {
+		var i Order
+		if err := rows.Scan(
+			&i.ID,
+			&i.UserID,
+			&i.Market,
+			&i.Side,
+			&i.Price,
+			&i.Quantity,
+			&i.Remaining,
+			&i.Status,
+			&i.CreatedAt,
+			&i.TimeInForce,
+			&i.PriorityAt,
+			&i.IsMarket,
+			&i.StopPrice,
+			&i.TriggeredAt,
+			&i.DisplayQuantity,
+			&i.HiddenQuantity,
+			&i.QuoteQuantity,
+			&i.ExpiresAt,
+			&i.Seq,
+			&i.StpMode,
 		); err != nil {
 			return nil, err
 		}
@@ -130,7 +269,7 @@ func (q *Queries) ListOrders(ctx context.Context, arg ListOrdersParams) ([]Order
 const listRestingAsks = `-- name: ListRestingAsks :many
 
 
-SELECT id, user_id, market, side, price, quantity, remaining, status, created_at
+SELECT id, user_id, market, side, price, quantity, remaining, status, created_at, time_in_force, priority_at, is_market, stop_price, triggered_at, display_quantity, hidden_quantity, quote_quantity, expires_at, seq, stp_mode
 FROM orders
 WHERE status IN ('OPEN','PARTIAL')
   AND side = 'SELL'
@@ -139,7 +278,7 @@ WHERE status IN ('OPEN','PARTIAL')
         OR $1 = ''
         OR market = $1
       )
-ORDER BY price ASC, created_at ASC, id ASC
+ORDER BY price ASC, priority_at ASC, id ASC
 `
 
 // Keyset pagination with (created_at, id)
@@ -162,6 +301,17 @@ func (q *Queries) ListRestingAsks(ctx context.Context, dollar_1 string) ([]Order
 			&i.Remaining,
 			&i.Status,
 			&i.CreatedAt,
+			&i.TimeInForce,
+			&i.PriorityAt,
+			&i.IsMarket,
+			&i.StopPrice,
+			&i.TriggeredAt,
+			&i.DisplayQuantity,
+			&i.HiddenQuantity,
+			&i.QuoteQuantity,
+			&i.ExpiresAt,
+			&i.Seq,
+			&i.StpMode,
 		); err != nil {
 			return nil, err
 		}
@@ -174,7 +324,7 @@ func (q *Queries) ListRestingAsks(ctx context.Context, dollar_1 string) ([]Order
 }
 
 const listRestingBids = `-- name: ListRestingBids :many
-SELECT id, user_id, market, side, price, quantity, remaining, status, created_at
+SELECT id, user_id, market, side, price, quantity, remaining, status, created_at, time_in_force, priority_at, is_market, stop_price, triggered_at, display_quantity, hidden_quantity, quote_quantity, expires_at, seq, stp_mode
 FROM orders
 WHERE status IN ('OPEN','PARTIAL')
   AND side = 'BUY'
@@ -183,7 +333,7 @@ WHERE status IN ('OPEN','PARTIAL')
         OR $1 = ''
         OR market = $1
       )
-ORDER BY price DESC, created_at ASC, id ASC
+ORDER BY price DESC, priority_at ASC, id ASC
 `
 
 func (q *Queries) ListRestingBids(ctx context.Context, dollar_1 string) ([]Order, error) {
@@ -205,6 +355,70 @@ func (q *Queries) ListRestingBids(ctx context.Context, dollar_1 string) ([]Order
 			&i.Remaining,
 			&i.Status,
 			&i.CreatedAt,
+			&i.TimeInForce,
+			&i.PriorityAt,
+			&i.IsMarket,
+			&i.StopPrice,
+			&i.TriggeredAt,
+			&i.DisplayQuantity,
+			&i.HiddenQuantity,
+			&i.QuoteQuantity,
+			&i.ExpiresAt,
+			&i.Seq,
+			&i.StpMode,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listUntriggeredOrders = `-- name: ListUntriggeredOrders :many
+SELECT id, user_id, market, side, price, quantity, remaining, status, created_at, time_in_force, priority_at, is_market, stop_price, triggered_at, display_quantity, hidden_quantity, quote_quantity, expires_at, seq, stp_mode
+FROM orders
+WHERE status = 'UNTRIGGERED'
+  AND (
+        $1::text IS NULL
+        OR $1 = ''
+        OR market = $1
+      )
+ORDER BY created_at ASC, id ASC
+`
+
+func (q *Queries) ListUntriggeredOrders(ctx context.Context, dollar_1 string) ([]Order, error) {
+	rows, err := q.db.Query(ctx, listUntriggeredOrders, dollar_1)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []Order
+	for rows.Next() {
+		var i Order
+		if err := rows.Scan(
+			&i.ID,
+			&i.UserID,
+			&i.Market,
+			&i.Side,
+			&i.Price,
+			&i.Quantity,
+			&i.Remaining,
+			&i.Status,
+			&i.CreatedAt,
+			&i.TimeInForce,
+			&i.PriorityAt,
+			&i.IsMarket,
+			&i.StopPrice,
+			&i.TriggeredAt,
+			&i.DisplayQuantity,
+			&i.HiddenQuantity,
+			&i.QuoteQuantity,
+			&i.ExpiresAt,
+			&i.Seq,
+			&i.StpMode,
 		); err != nil {
 			return nil, err
 		}
@@ -218,55 +432,130 @@ func (q *Queries) ListRestingBids(ctx context.Context, dollar_1 string) ([]Order
 
 const markOrderCancelled = `-- name: MarkOrderCancelled :exec
 UPDATE orders
-SET status = 'CANCELLED'
+SET status = 'CANCELLED',
+    seq = $2
+WHERE id = $1
+  AND status IN ('OPEN','PARTIAL','UNTRIGGERED')
+`
+
+type MarkOrderCancelledParams struct {
+	ID  pgtype.UUID
+	Seq int64
+}
+
+func (q *Queries) MarkOrderCancelled(ctx context.Context, arg MarkOrderCancelledParams) error {
+	_, err := q.db.Exec(ctx, markOrderCancelled, arg.ID, arg.Seq)
+	return err
+}
+
+const markOrderExpired = `-- name: MarkOrderExpired :exec
+UPDATE orders
+SET status = 'EXPIRED',
+    seq = $2
 WHERE id = $1
-  AND status IN ('OPEN','PARTIAL')
+  AND status IN ('OPEN','PARTIAL','UNTRIGGERED')
 `
 
-func (q *Queries) MarkOrderCancelled(ctx context.Context, id pgtype.UUID) error {
-	_, err := q.db.Exec(ctx, markOrderCancelled, id)
+type MarkOrderExpiredParams struct {
+	ID  pgtype.UUID
+	Seq int64
+}
+
+func (q *Queries) MarkOrderExpired(ctx context.Context, arg MarkOrderExpiredParams) error {
+	_, err := q.db.Exec(ctx, markOrderExpired, arg.ID, arg.Seq)
+	return err
+}
+
+const markOrdersCancelled = `-- name: MarkOrdersCancelled :exec
+UPDATE orders
+SET status = 'CANCELLED',
+    seq = $1
+WHERE id = ANY($2::uuid[])
+  AND status IN ('OPEN','PARTIAL','UNTRIGGERED')
+`
+
+type MarkOrdersCancelledParams struct {
+	Seq int64
+	Ids []pgtype.UUID
+}
+
+func (q *Queries) MarkOrdersCancelled(ctx context.Context, arg MarkOrdersCancelledParams) error {
+	_, err := q.db.Exec(ctx, markOrdersCancelled, arg.Seq, arg.Ids)
 	return err
 }
 
 const updateOrderAfterMatch = `-- name: UpdateOrderAfterMatch :exec
 UPDATE orders
 SET remaining = $2,
-    status = $3
+    status = $3,
+    hidden_quantity = $4,
+    -- an iceberg order showing its next slice goes to the back of the queue
+    priority_at = CASE WHEN $5::boolean THEN now() ELSE priority_at END,
+    seq = $6
 WHERE id = $1
 `
 
 type UpdateOrderAfterMatchParams struct {
-	ID        pgtype.UUID
-	Remaining pgtype.Numeric
-	Status    string
+	ID             pgtype.UUID
+	Remaining      pgtype.Numeric
+	Status         string
+	HiddenQuantity pgtype.Numeric
+	ResetPriority  bool
+	Seq            int64
 }
 
 func (q *Queries) UpdateOrderAfterMatch(ctx context.Context, arg UpdateOrderAfterMatchParams) error {
-	_, err := q.db.Exec(ctx, updateOrderAfterMatch, arg.ID, arg.Remaining, arg.Status)
+	_, err := q.db.Exec(ctx, updateOrderAfterMatch,
+		arg.ID,
+		arg.Remaining,
+		arg.Status,
+		arg.HiddenQuantity,
+		arg.ResetPriority,
+		arg.Seq,
+	)
 	return err
 }
 
 const upsertOrder = `-- name: UpsertOrder :one
 INSERT INTO orders (
-    id, user_id, market, side, price, quantity, remaining, status
+    id, user_id, market, side, price, quantity, remaining, status, time_in_force,
+    is_market, stop_price, triggered_at, display_quantity, hidden_quantity,
+    quote_quantity, expires_at, seq, stp_mode
 ) VALUES (
-    $1, $2, $3, $4, $5, $6, $7, $8
+    $1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18
 )
 ON CONFLICT (id) DO UPDATE
-SET remaining = EXCLUDED.remaining,
-    status    = EXCLUDED.status
-RETURNING id, user_id, market, side, price, quantity, remaining, status, created_at
+SET quantity        = EXCLUDED.quantity,
+    remaining       = EXCLUDED.remaining,
+    status          = EXCLUDED.status,
+    triggered_at    = EXCLUDED.triggered_at,
+    hidden_quantity = EXCLUDED.hidden_quantity,
+    seq             = EXCLUDED.seq,
+    -- a stop order queues from the moment it triggers
+    priority_at     = CASE WHEN orders.triggered_at IS NULL AND EXCLUDED.triggered_at IS NOT NULL
+                           THEN now() ELSE orders.priority_at END
+RETURNING id, user_id, market, side, price, quantity, remaining, status, created_at, time_in_force, priority_at, is_market, stop_price, triggered_at, display_quantity, hidden_quantity, quote_quantity, expires_at, seq, stp_mode
 `
 
 type UpsertOrderParams struct {
-	ID        pgtype.UUID
-	UserID    pgtype.UUID
-	Market    string
-	Side      string
-	Price     pgtype.Numeric
-	Quantity  pgtype.Numeric
-	Remaining pgtype.Numeric
-	Status    string
+	ID              pgtype.UUID
+	UserID          pgtype.UUID
+	Market          string
+	Side            string
+	Price           pgtype.Numeric
+	Quantity        pgtype.Numeric
+	Remaining       pgtype.Numeric
+	Status          string
+	TimeInForce     string
+	IsMarket        bool
+	StopPrice       pgtype.Numeric
+	TriggeredAt     pgtype.Timestamptz
+	DisplayQuantity pgtype.Numeric
+	HiddenQuantity  pgtype.Numeric
+	QuoteQuantity   pgtype.Numeric
+	ExpiresAt       pgtype.Timestamptz
+	Seq             int64
+	StpMode         pgtype.Text
 }
 
 func (q *Queries) UpsertOrder(ctx context.Context, arg UpsertOrderParams) (Order, error) {
@@ -279,6 +568,16 @@ func (q *Queries) UpsertOrder(ctx context.Context, arg UpsertOrderParams) (Order
 		arg.Quantity,
 		arg.Remaining,
 		arg.Status,
+		arg.TimeInForce,
+		arg.IsMarket,
+		arg.StopPrice,
+		arg.TriggeredAt,
+		arg.DisplayQuantity,
+		arg.HiddenQuantity,
+		arg.QuoteQuantity,
+		arg.ExpiresAt,
+		arg.Seq,
+		arg.StpMode,
 	)
 	var i Order
 	err := row.Scan(
@@ -291,6 +590,17 @@ func (q *Queries) UpsertOrder(ctx context.Context, arg UpsertOrderParams) (Order
 		&i.Remaining,
 		&i.Status,
 		&i.CreatedAt,
+		&i.TimeInForce,
+		&i.PriorityAt,
+		&i.IsMarket,
+		&i.StopPrice,
+		&i.TriggeredAt,
+		&i.DisplayQuantity,
+		&i.HiddenQuantity,
+		&i.QuoteQuantity,
+		&i.ExpiresAt,
+		&i.Seq,
+		&i.StpMode,
 	)
 	return i, err
 }
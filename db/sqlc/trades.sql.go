@@ -11,21 +11,44 @@ import (
 	"github.com/jackc/pgx/v5/pgtype"
 )
 
+const getMaxSeq = `-- name: GetMaxSeq :one
+SELECT GREATEST(
+    (SELECT COALESCE(MAX(seq), 0) FROM orders),
+    (SELECT COALESCE(MAX(seq), 0) FROM trades),
+    (SELECT COALESCE(MAX(last_seq), 0) FROM engine_seq)
+)::bigint AS seq
+`
+
+// the highest engine sequence number handed out or stored on an order or a
+// trade
+func (q *Queries) GetMaxSeq(ctx context.Context) (int64, error) {
+	row := q.db.QueryRow(ctx, getMaxSeq)
+	var seq int64
+	err := row.Scan(&seq)
+	return seq, err
+}
+
 const insertTrade = `-- name: InsertTrade :one
 INSERT INTO trades (
-    id, taker_order_id,maker_order_id, price, quantity
+    id, taker_order_id,maker_order_id, price, quantity,
+    maker_fee, taker_fee, maker_fee_asset, taker_fee_asset, seq
 ) VALUES (
-    $1, $2, $3, $4, $5
+    $1, $2, $3, $4, $5, $6, $7, $8, $9, $10
 )
-RETURNING id, taker_order_id, maker_order_id, price, quantity, traded_at
+RETURNING id, taker_order_id, maker_order_id, price, quantity, traded_at, maker_fee, taker_fee, maker_fee_asset, taker_fee_asset, seq
 `
 
 type InsertTradeParams struct {
-	ID           pgtype.UUID
-	TakerOrderID pgtype.UUID
-	MakerOrderID pgtype.UUID
-	Price        pgtype.Numeric
-	Quantity     pgtype.Numeric
+	ID            pgtype.UUID
+	TakerOrderID  pgtype.UUID
+	MakerOrderID  pgtype.UUID
+	Price         pgtype.Numeric
+	Quantity      pgtype.Numeric
+	MakerFee      pgtype.Numeric
+	TakerFee      pgtype.Numeric
+	MakerFeeAsset string
+	TakerFeeAsset string
+	Seq           int64
 }
 
 func (q *Queries) InsertTrade(ctx context.Context, arg InsertTradeParams) (Trade, error) {
@@ -35,6 +58,11 @@ func (q *Queries) InsertTrade(ctx context.Context, arg InsertTradeParams) (Trade
 		arg.MakerOrderID,
 		arg.Price,
 		arg.Quantity,
+		arg.MakerFee,
+		arg.TakerFee,
+		arg.MakerFeeAsset,
+		arg.TakerFeeAsset,
+		arg.Seq,
 	)
 	var i Trade
 	err := row.Scan(
@@ -44,12 +72,30 @@ func (q *Queries) InsertTrade(ctx context.Context, arg InsertTradeParams) (Trade
 		&i.Price,
 		&i.Quantity,
 		&i.TradedAt,
+		&i.MakerFee,
+		&i.TakerFee,
+		&i.MakerFeeAsset,
+		&i.TakerFeeAsset,
+		&i.Seq,
 	)
 	return i, err
 }
 
+type InsertTradesParams struct {
+	ID            pgtype.UUID
+	TakerOrderID  pgtype.UUID
+	MakerOrderID  pgtype.UUID
+	Price         pgtype.Numeric
+	Quantity      pgtype.Numeric
+	MakerFee      pgtype.Numeric
+	TakerFee      pgtype.Numeric
+	MakerFeeAsset string
+	TakerFeeAsset string
+	Seq           int64
+}
+
 const listTrades = `-- name: ListTrades :many
-SELECT t.id, t.taker_order_id, t.maker_order_id, t.price, t.quantity, t.traded_at
+SELECT t.id, t.taker_order_id, t.maker_order_id, t.price, t.quantity, t.traded_at, t.maker_fee, t.taker_fee, t.maker_fee_asset, t.taker_fee_asset, t.seq
 FROM trades t
 JOIN orders ot ON ot.id = t.taker_order_id
 JOIN orders om ON om.id = t.maker_order_id
@@ -57,7 +103,7 @@ WHERE ($1::uuid IS NULL OR ot.user_id = $1 OR om.user_id = $1)
   AND ($2::uuid IS NULL OR t.taker_order_id = $2 OR t.maker_order_id = $2)
   AND ($3::text = '' OR ot.market = $3 OR om.market = $3)
   AND ($4::timestamptz IS NULL OR t.traded_at >= $4)
-ORDER BY t.traded_at DESC
+ORDER BY t.seq DESC
 LIMIT $5
 `
 
@@ -91,6 +137,70 @@ func (q *Queries) ListTrades(ctx context.Context, arg ListTradesParams) ([]Trade
 			&i.Price,
 			&i.Quantity,
 			&i.TradedAt,
+			&i.MakerFee,
+			&i.TakerFee,
+			&i.MakerFeeAsset,
+			&i.TakerFeeAsset,
+			&i.Seq,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listTradesAfterSeq = `-- name: ListTradesAfterSeq :many
+SELECT t.id, t.taker_order_id, t.maker_order_id, t.price, t.quantity, t.traded_at, t.maker_fee, t.taker_fee, t.maker_fee_asset, t.taker_fee_asset, t.seq
+FROM trades t
+JOIN orders ot ON ot.id = t.taker_order_id
+JOIN orders om ON om.id = t.maker_order_id
+WHERE ($1::uuid IS NULL OR ot.user_id = $1 OR om.user_id = $1)
+  AND ($2::uuid IS NULL OR t.taker_order_id = $2 OR t.maker_order_id = $2)
+  AND ($3::text = '' OR ot.market = $3 OR om.market = $3)
+  AND t.seq > $4::bigint
+ORDER BY t.seq
+LIMIT $5
+`
+
+type ListTradesAfterSeqParams struct {
+	UserID   pgtype.UUID
+	OrderID  pgtype.UUID
+	Market   string
+	AfterSeq int64
+	RowLimit int32
+}
+
+func (q *Queries) ListTradesAfterSeq(ctx context.Context, arg ListTradesAfterSeqParams) ([]Trade, error) {
+	rows, err := q.db.Query(ctx, listTradesAfterSeq,
+		arg.UserID,
+		arg.OrderID,
+		arg.Market,
+		arg.AfterSeq,
+		arg.RowLimit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []Trade
+	for rows.Next() {
+		var i Trade
+		if err := rows.Scan(
+			&i.ID,
+			&i.TakerOrderID,
+			&i.MakerOrderID,
+			&i.Price,
+			&i.Quantity,
+			&i.TradedAt,
+			&i.MakerFee,
+			&i.TakerFee,
+			&i.MakerFeeAsset,
+			&i.TakerFeeAsset,
+			&i.Seq,
 		); err != nil {
 			return nil, err
 		}
@@ -103,9 +213,9 @@ func (q *Queries) ListTrades(ctx context.Context, arg ListTradesParams) ([]Trade
 }
 
 const listTradesByOrder = `-- name: ListTradesByOrder :many
-SELECT id, taker_order_id, maker_order_id, price, quantity, traded_at FROM trades
+SELECT id, taker_order_id, maker_order_id, price, quantity, traded_at, maker_fee, taker_fee, maker_fee_asset, taker_fee_asset, seq FROM trades
 WHERE taker_order_id = $1 OR maker_order_id = $1
-ORDER BY traded_at DESC
+ORDER BY seq DESC
 `
 
 func (q *Queries) ListTradesByOrder(ctx context.Context, takerOrderID pgtype.UUID) ([]Trade, error) {
@@ -124,6 +234,11 @@ func (q *Queries) ListTradesByOrder(ctx context.Context, takerOrderID pgtype.UUI
 			&i.Price,
 			&i.Quantity,
 			&i.TradedAt,
+			&i.MakerFee,
+			&i.TakerFee,
+			&i.MakerFeeAsset,
+			&i.TakerFeeAsset,
+			&i.Seq,
 		); err != nil {
 			return nil, err
 		}
@@ -134,3 +249,13 @@ func (q *Queries) ListTradesByOrder(ctx context.Context, takerOrderID pgtype.UUI
 	}
 	return items, nil
 }
+
+const setLastSeq = `-- name: SetLastSeq :exec
+UPDATE engine_seq SET last_seq = GREATEST(last_seq, $1::bigint)
+`
+
+// records that engine sequence numbers up to seq were handed out
+func (q *Queries) SetLastSeq(ctx context.Context, seq int64) error {
+	_, err := q.db.Exec(ctx, setLastSeq, seq)
+	return err
+}
@@ -17,7 +17,7 @@ INSERT INTO users (
 ) VALUES (
     $1, $2
 )
-RETURNING id, email
+RETURNING id, email, stp_mode, fee_tier
 `
 
 type CreateUserParams struct {
@@ -28,21 +28,63 @@ type CreateUserParams struct {
 func (q *Queries) CreateUser(ctx context.Context, arg CreateUserParams) (User, error) {
 	row := q.db.QueryRow(ctx, createUser, arg.ID, arg.Email)
 	var i User
-	err := row.Scan(&i.ID, &i.Email)
+	err := row.Scan(
+		&i.ID,
+		&i.Email,
+		&i.StpMode,
+		&i.FeeTier,
+	)
 	return i, err
 }
 
 const getUser = `-- name: GetUser :one
-SELECT id, email FROM users WHERE id = $1
+SELECT id, email, stp_mode, fee_tier FROM users WHERE id = $1
 `
 
 func (q *Queries) GetUser(ctx context.Context, id pgtype.UUID) (User, error) {
 	row := q.db.QueryRow(ctx, getUser, id)
 	var i User
-	err := row.Scan(&i.ID, &i.Email)
+	err := row.Scan(
+		&i.ID,
+		&i.Email,
+		&i.StpMode,
+		&i.FeeTier,
+	)
 	return i, err
 }
 
+const setUserFeeTier = `-- name: SetUserFeeTier :exec
+UPDATE users
+SET fee_tier = $2
+WHERE id = $1
+`
+
+type SetUserFeeTierParams struct {
+	ID      pgtype.UUID
+	FeeTier pgtype.Text
+}
+
+func (q *Queries) SetUserFeeTier(ctx context.Context, arg SetUserFeeTierParams) error {
+	_, err := q.db.Exec(ctx, setUserFeeTier, arg.ID, arg.FeeTier)
+	return err
+}
+
+const setUserSTPMode = `-- name: SetUserSTPMode :exec
+UPDATE users
+SET stp_mode = $2
+WHERE id = $1
+`
+
+type SetUserSTPModeParams struct {
+	ID      pgtype.UUID
+	StpMode pgtype.Text
+}
+
+func (q *Queries) SetUserSTPMode(ctx context.Context, arg SetUserSTPModeParams) error {
+	_, err := q.db.Exec(ctx, setUserSTPMode, arg.ID, arg.StpMode)
+	return err
+}
+
 const upsertUser = `-- name: UpsertUser :exec
 INSERT INTO users (id, email)
 VALUES ($1, $2)
@@ -0,0 +1,228 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrOverloaded refuses a command because the engine is too far behind to
+// take it; the OverloadError it comes in says when to try again.
+var ErrOverloaded = errors.New("engine overloaded")
+
+// OverloadError is ErrOverloaded with the wait the admission policy
+// suggests before retrying.
+type OverloadError struct {
+	RetryAfter time.Duration
+}
+
+func (e *OverloadError) Error() string {
+	return fmt.Sprintf("%v: retry after %s", ErrOverloaded, e.RetryAfter)
+}
+
+func (e *OverloadError) Unwrap() error {
+	return ErrOverloaded
+}
+
+// Admission decides what happens to commands sent while the engine is
+// behind. The zero value makes senders wait for room in the queue until
+// their context is done.
+type Admission struct {
+	// RejectAbove refuses commands with ErrOverloaded once this many are
+	// waiting, instead of making them wait. 0 never refuses.
+	RejectAbove int
+	// PerUser refuses a user's commands with ErrOverloaded while this many
+	// of theirs are waiting. 0 sets no limit.
+	PerUser int
+	// RetryAfter is the wait suggested to refused callers.
+	RetryAfter time.Duration
+}
+
+// DefaultRetryAfter is suggested to refused callers unless the admission
+// policy says otherwise.
+const DefaultRetryAfter = time.Second
+
+// UseAdmission sets the admission policy of the command queue. It must be
+// called before Run.
+func (e *Engine) UseAdmission(a Admission) error {
+	if a.RejectAbove < 0 || a.PerUser < 0 || a.RetryAfter < 0 {
+		return errors.New("admission limits must not be negative")
+	}
+	if a.RetryAfter == 0 {
+		a.RetryAfter = DefaultRetryAfter
+	}
+	e.cmds.policy = a
+	return nil
+}
+
+// QueueStats describes the commands waiting for the engine loop.
+type QueueStats struct {
+	Depth    int    `json:"depth"`    // commands waiting
+	Capacity int    `json:"capacity"` // beyond it senders wait
+	Users    int    `json:"users"`    // users with commands waiting
+	Peak     int    `json:"peak"`     // highest depth since the engine started
+	Admitted uint64 `json:"admitted"` // commands queued since the engine started
+	Rejected uint64 `json:"rejected"` // commands refused with ErrOverloaded
+}
+
+// QueueStats returns the current state of the command queue.
+func (e *Engine) QueueStats() QueueStats {
+	return e.cmds.stats()
+}
+
+// cmdQueue holds the commands waiting for the engine loop, in one queue per
+// user, and hands them out taking turns between users: a user sending
+// faster than the engine runs only delays their own commands. Cancels and
+// amends wait in the turn of the order's owner when the caller names them;
+// commands that name no user, such as transfer confirmations, share one
+// turn.
+type cmdQueue struct {
+	mu       sync.Mutex
+	byUser   map[string][]Command
+	turns    []string // users with commands waiting, next turn first
+	depth    int
+	capacity int
+	policy   Admission
+	closed   bool
+
+	ready chan struct{} // holds a token while commands are waiting or the queue is closed
+	room  chan struct{} // closed when a full queue gets room
+
+	peak     int
+	admitted uint64
+	rejected uint64
+}
+
+func newCmdQueue(capacity int) *cmdQueue {
+	return &cmdQueue{
+		byUser:   make(map[string][]Command),
+		capacity: max(capacity, 1),
+		policy:   Admission{RetryAfter: DefaultRetryAfter},
+		ready:    make(chan struct{}, 1),
+		room:     make(chan struct{}),
+	}
+}
+
+// queueUser returns the user whose turn cmd waits for, or "" for commands
+// that name none.
+func (cmd Command) queueUser() string {
+	switch cmd.Type {
+	case CmdPlace:
+		return cmd.Order.UserID
+	case CmdCancel:
+		return cmd.UserID
+	case CmdAmend:
+		return cmd.Amend.UserID
+	case CmdRequestTransfer:
+		return cmd.Transfer.UserID
+	case CmdMassCancel:
+		return cmd.MassCancel.UserID
+	case CmdSetFeeTier, CmdHeartbeat:
+		return cmd.ID
+	}
+	return ""
+}
+
+// push queues cmd, refusing it as the policy says, or waits for room while
+// the queue is full.
+func (q *cmdQueue) push(ctx context.Context, cmd Command) error {
+	user := cmd.queueUser()
+	q.mu.Lock()
+	for {
+		if q.closed {
+			q.mu.Unlock()
+			return ErrStopped
+		}
+		over := q.policy.RejectAbove > 0 && q.depth >= q.policy.RejectAbove
+		if user != "" && q.policy.PerUser > 0 && len(q.byUser[user]) >= q.policy.PerUser {
+			over = true
+		}
+		if over {
+			q.rejected++
+			q.mu.Unlock()
+			return &OverloadError{RetryAfter: q.policy.RetryAfter}
+		}
+		if q.depth < q.capacity {
+			break
+		}
+		room := q.room
+		q.mu.Unlock()
+		select {
+		case <-room:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		q.mu.Lock()
+	}
+
+	if len(q.byUser[user]) == 0 {
+		q.turns = append(q.turns, user)
+	}
+	q.byUser[user] = append(q.byUser[user], cmd)
+	q.depth++
+	q.admitted++
+	q.peak = max(q.peak, q.depth)
+	q.mu.Unlock()
+	q.signal()
+	return nil
+}
+
+// take removes up to n commands, one per user in turn, and reports whether
+// the queue is closed and now empty.
+func (q *cmdQueue) take(n int) (cmds []Command, drained bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	wasFull := q.depth >= q.capacity
+	for len(cmds) < n && len(q.turns) > 0 {
+		user := q.turns[0]
+		q.turns = q.turns[1:]
+		waiting := q.byUser[user]
+		cmds = append(cmds, waiting[0])
+		if len(waiting) == 1 {
+			delete(q.byUser, user)
+		} else {
+			q.byUser[user] = waiting[1:]
+			q.turns = append(q.turns, user)
+		}
+		q.depth--
+	}
+	if wasFull && q.depth < q.capacity {
+		close(q.room)
+		q.room = make(chan struct{})
+	}
+	if q.depth > 0 {
+		q.signal()
+	}
+	return cmds, q.closed && q.depth == 0
+}
+
+// close refuses commands from now on with ErrStopped; the ones waiting are
+// still taken.
+func (q *cmdQueue) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+	q.signal()
+}
+
+func (q *cmdQueue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+func (q *cmdQueue) stats() QueueStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return QueueStats{
+		Depth:    q.depth,
+		Capacity: q.capacity,
+		Users:    len(q.turns),
+		Peak:     q.peak,
+		Admitted: q.admitted,
+		Rejected: q.rejected,
+	}
+}
@@ -0,0 +1,166 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func placeBy(user, id string) Command {
+	return Command{Type: CmdPlace, Order: newSTPOrder(id, user, SideBuy, 100, 1, STPNone)}
+}
+
+func TestQueueTakesTurnsBetweenUsers(t *testing.T) {
+	ctx := context.Background()
+	q := newCmdQueue(16)
+	for _, cmd := range []Command{
+		placeBy("bot", "b1"), placeBy("bot", "b2"), placeBy("bot", "b3"),
+		placeBy("alice", "a1"),
+		{Type: CmdCancel, ID: "c1"},
+		placeBy("alice", "a2"),
+	} {
+		if err := q.push(ctx, cmd); err != nil {
+			t.Fatalf("push: %v", err)
+		}
+	}
+
+	var got []string
+	for {
+		cmds, _ := q.take(4)
+		if len(cmds) == 0 {
+			break
+		}
+		for _, cmd := range cmds {
+			if cmd.Type == CmdCancel {
+				got = append(got, cmd.ID)
+			} else {
+				got = append(got, cmd.Order.ID)
+			}
+		}
+	}
+	want := []string{"b1", "a1", "c1", "b2", "a2", "b3"}
+	if len(got) != len(want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("expected %v, got %v", want, got)
+		}
+	}
+}
+
+func TestCancelFloodWaitsInOwnersTurn(t *testing.T) {
+	ctx := context.Background()
+	q := newCmdQueue(16)
+	for _, id := range []string{"c1", "c2", "c3", "c4", "c5"} {
+		if err := q.push(ctx, Command{Type: CmdCancel, ID: id, UserID: "bot"}); err != nil {
+			t.Fatalf("push: %v", err)
+		}
+	}
+	for _, cmd := range []Command{
+		{Type: CmdAmend, Amend: &Amend{OrderID: "m1", UserID: "bot"}},
+		placeBy("alice", "a1"),
+		{Type: CmdCancel, ID: "x1"},
+	} {
+		if err := q.push(ctx, cmd); err != nil {
+			t.Fatalf("push: %v", err)
+		}
+	}
+	if stats := q.stats(); stats.Users != 3 {
+		t.Fatalf("expected the bot, alice and the shared turn, got %+v", stats)
+	}
+
+	cmds, _ := q.take(3)
+	if len(cmds) != 3 || cmds[0].ID != "c1" || cmds[1].Order == nil || cmds[1].Order.ID != "a1" || cmds[2].ID != "x1" {
+		t.Fatalf("expected alice and the shared turn to go right after the bot's first cancel, got %+v", cmds)
+	}
+}
+
+func TestCancelAndAmendOfOtherUsersOrderNotFound(t *testing.T) {
+	ctx := context.Background()
+	e, _ := startMemEngine(t, NewMemStore())
+	owner, other := uuid.NewString(), uuid.NewString()
+	fund(t, e, owner, "BTC", 10)
+	o := newSTPOrder(uuid.NewString(), owner, SideSell, 100, 4, STPNone)
+	if _, err := e.Place(ctx, o); err != nil {
+		t.Fatalf("place: %v", err)
+	}
+
+	if ok, err := e.CancelFor(ctx, other, o.ID); ok || err != nil {
+		t.Fatalf("expected another user's cancel to find nothing, got %v, %v", ok, err)
+	}
+	if _, _, err := e.Amend(ctx, Amend{OrderID: o.ID, UserID: other, Quantity: 2}); !errors.Is(err, ErrOrderNotFound) {
+		t.Fatalf("expected ErrOrderNotFound, got %v", err)
+	}
+	if _, _, err := e.Amend(ctx, Amend{OrderID: o.ID, UserID: owner, Quantity: 2}); err != nil {
+		t.Fatalf("amend: %v", err)
+	}
+	if ok, err := e.CancelFor(ctx, owner, o.ID); !ok || err != nil {
+		t.Fatalf("expected the owner's cancel to succeed, got %v, %v", ok, err)
+	}
+}
+
+func TestAdmissionRefusesOverLimits(t *testing.T) {
+	ctx := context.Background()
+	e, err := NewEngine(16, NewMemStore())
+	if err != nil {
+		t.Fatalf("new engine: %v", err)
+	}
+	if err := e.UseAdmission(Admission{RejectAbove: 3, PerUser: 2, RetryAfter: 2 * time.Second}); err != nil {
+		t.Fatalf("use admission: %v", err)
+	}
+
+	push := func(cmd Command) error { return e.enqueueCommand(ctx, cmd) }
+	if err := push(placeBy("bot", "b1")); err != nil {
+		t.Fatalf("push: %v", err)
+	}
+	if err := push(placeBy("bot", "b2")); err != nil {
+		t.Fatalf("push: %v", err)
+	}
+	// the bot is at its limit, others are not
+	var overload *OverloadError
+	if err := push(placeBy("bot", "b3")); !errors.As(err, &overload) || overload.RetryAfter != 2*time.Second {
+		t.Fatalf("expected the bot to be refused with a retry hint, got %v", err)
+	}
+	if err := push(placeBy("alice", "a1")); err != nil {
+		t.Fatalf("push: %v", err)
+	}
+	// the queue is at its limit for everyone
+	if err := push(placeBy("carol", "c1")); !errors.Is(err, ErrOverloaded) {
+		t.Fatalf("expected ErrOverloaded above the threshold, got %v", err)
+	}
+
+	stats := e.QueueStats()
+	if stats.Depth != 3 || stats.Users != 2 || stats.Peak != 3 || stats.Admitted != 3 || stats.Rejected != 2 {
+		t.Fatalf("unexpected queue stats %+v", stats)
+	}
+}
+
+func TestFullQueueMakesSendersWait(t *testing.T) {
+	q := newCmdQueue(1)
+	if err := q.push(context.Background(), placeBy("bot", "b1")); err != nil {
+		t.Fatalf("push: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := q.push(ctx, placeBy("alice", "a1")); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the sender to wait until its deadline, got %v", err)
+	}
+
+	pushed := make(chan error, 1)
+	go func() { pushed <- q.push(context.Background(), placeBy("alice", "a2")) }()
+	time.Sleep(5 * time.Millisecond)
+	if cmds, _ := q.take(1); len(cmds) != 1 || cmds[0].Order.ID != "b1" {
+		t.Fatalf("expected b1, got %+v", cmds)
+	}
+	if err := <-pushed; err != nil {
+		t.Fatalf("expected the waiting sender to get in, got %v", err)
+	}
+	if stats := q.stats(); stats.Depth != 1 {
+		t.Fatalf("expected one command waiting, got %+v", stats)
+	}
+}
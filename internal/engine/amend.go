@@ -0,0 +1,179 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	dbsqlc "github.com/hakimelghazi/exchange-core/db/sqlc"
+)
+
+var (
+	ErrOrderNotFound    = errors.New("order not found")
+	ErrAmendNoChange    = &RejectError{Reason: "amend changes neither price nor quantity"}
+	ErrAmendBelowFilled = &RejectError{Reason: "amended quantity must exceed the filled quantity"}
+)
+
+// Amend changes the price and/or total quantity of a resting order.
+type Amend struct {
+	OrderID  string
+	UserID   string // optional owner, whose turn the amend waits in
+	Price    int64  // new limit price, 0 keeps the current one
+	Quantity int64  // new total quantity including fills, 0 keeps the current one
+}
+
+// Amend modifies a resting order in one step and returns it as amended.
+// Reducing the quantity at the same price keeps the order's place in the
+// queue; any price change or size increase re-enters it at the back, and a
+// new price may trade immediately. With a.UserID set, an order of another
+// user is not found.
+func (e *Engine) Amend(ctx context.Context, a Amend) (*Order, *MatchResult, error) {
+	if a.OrderID == "" {
+		return nil, nil, errors.New("empty order id")
+	}
+	resp := make(chan any, 1)
+	cmd := Command{Type: CmdAmend, Amend: &a, Resp: resp}
+
+	if err := e.enqueueCommand(ctx, cmd); err != nil {
+		return nil, nil, err
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil, nil, ctx.Err()
+	case raw := <-resp:
+		out := raw.(amendResult)
+		if out.Err != nil {
+			return nil, nil, out.Err
+		}
+		return &out.Order, out.Result, nil
+	}
+}
+
+// amended returns a copy of o with a applied, and whether the order keeps its
+// queue priority.
+func amended(o *Order, a *Amend) (*Order, bool, error) {
+	next := *o
+	if a.Price != 0 {
+		next.Price = a.Price
+	}
+	if a.Quantity != 0 {
+		next.Quantity = a.Quantity
+	}
+	if next.Price == o.Price && next.Quantity == o.Quantity {
+		return nil, false, ErrAmendNoChange
+	}
+	filled := o.Quantity - o.Remaining
+	next.Remaining = next.Quantity - filled
+	if next.Remaining <= 0 {
+		return nil, false, fmt.Errorf("%w: filled %d, quantity %d", ErrAmendBelowFilled, filled, next.Quantity)
+	}
+	keep := next.Price == o.Price && next.Remaining <= o.Remaining
+	return &next, keep, nil
+}
+
+// checkAmend finds the resting order an amend targets and validates its new
+// terms.
+func (e *Engine) checkAmend(a *Amend) (mb *marketBook, o, next *Order, keepPriority bool, err error) {
+	mb, ok := e.books.findOrder(a.OrderID)
+	if !ok {
+		return nil, nil, nil, false, ErrOrderNotFound
+	}
+	o, _ = mb.book.order(a.OrderID)
+	if a.UserID != "" && o.UserID != a.UserID {
+		return nil, nil, nil, false, ErrOrderNotFound
+	}
+
+	next, keepPriority, err = amended(o, a)
+	if err != nil {
+		return nil, nil, nil, false, err
+	}
+	if err := mb.spec.Validate(next); err != nil {
+		return nil, nil, nil, false, err
+	}
+	if !keepPriority && next.timeInForce() == TIFPostOnly && mb.book.crosses(next) {
+		return nil, nil, nil, false, ErrPostOnlyWouldCross
+	}
+	return mb, o, next, keepPriority, nil
+}
+
+func (e *Engine) handleAmend(cmd Command) {
+	mb, o, next, keepPriority, err := e.checkAmend(cmd.Amend)
+	if err != nil {
+		cmd.Resp <- amendResult{Err: err}
+		return
+	}
+	orderUUID, err := uuidFromString(o.ID)
+	if err != nil {
+		cmd.Resp <- amendResult{Err: err}
+		return
+	}
+
+	res, moves, err := e.execAmend(mb, o, next, keepPriority)
+	if err != nil {
+		cmd.Resp <- amendResult{Err: err}
+		return
+	}
+
+	params := dbsqlc.AmendOrderParams{
+		ID:             orderUUID,
+		Price:          numericFromInt64(o.Price),
+		Quantity:       numericFromInt64(o.Quantity),
+		Remaining:      numericFromInt64(o.Remaining),
+		Status:         orderStatusFromOrder(o, res),
+		ResetPriority:  !keepPriority,
+		HiddenQuantity: numericFromInt64(o.hidden()),
+		Seq:            int64(e.seq),
+	}
+	w := &pendingWrite{}
+	w.add(func(ctx context.Context, b *dbBatch) error {
+		return b.q.AmendOrder(ctx, params)
+	}, e.matchWrite(mb.spec, res), e.movesWrite(moves))
+	e.runTriggers(w, mb, res.Trades)
+
+	out := amendResult{Order: *o, Result: res}
+	w.done = func(err error) {
+		if err != nil {
+			log.Printf("handleAmend: storing amend failed for order %s: %v", cmd.Amend.OrderID, err)
+			out = amendResult{Err: err}
+		}
+		cmd.Resp <- out
+	}
+	e.submit(w)
+}
+
+// execAmend resizes the hold of a resting order and applies the amend in
+// memory. It returns the funds moves to post.
+func (e *Engine) execAmend(mb *marketBook, o, next *Order, keepPriority bool) (*MatchResult, []fundsMove, error) {
+	_, amount := restingHold(mb.spec, next)
+	if err := e.funds.adjust(o.ID, amount); err != nil {
+		return nil, nil, err
+	}
+	res, err := mb.amendOrder(o, next, keepPriority)
+	if err != nil {
+		// prechecked by the caller; Submit only fails on a market mismatch
+		log.Printf("execAmend: matcher failed for order %s: %v", o.ID, err)
+		return nil, nil, err
+	}
+	e.stamp(res)
+	e.fees.charge(mb.spec, o, res, e.funds.owner)
+	e.funds.settle(mb.spec, o, res)
+	return res, e.funds.takeMoves(), nil
+}
+
+// amendOrder applies an amend to a resting order. Keeping priority changes
+// the order in place; otherwise it leaves the book and is submitted again
+// with its new terms, as the taker of any resulting trades.
+func (mb *marketBook) amendOrder(o, next *Order, keepPriority bool) (*MatchResult, error) {
+	if keepPriority {
+		mb.book.touch(o.Side, o.Price)
+		o.Quantity = next.Quantity
+		o.shrink(o.Remaining - next.Remaining)
+		return &MatchResult{Remainder: o}, nil
+	}
+	mb.book.CancelOrder(o.ID)
+	o.Price, o.Quantity, o.Remaining = next.Price, next.Quantity, next.Remaining
+	o.shown = 0 // an iceberg re-enters with a fresh slice
+	return mb.matcher.Submit(o)
+}
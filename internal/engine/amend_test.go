@@ -0,0 +1,107 @@
+package engine
+
+import (
+	"errors"
+	"testing"
+)
+
+// amendResting runs the same in-memory steps as handleAmend.
+func amendResting(t *testing.T, f *funds, mb *marketBook, a Amend) (*MatchResult, error) {
+	t.Helper()
+	o := mb.book.ordersByID[a.OrderID].elem.Value.(*Order)
+	next, keep, err := amended(o, &a)
+	if err != nil {
+		return nil, err
+	}
+	_, amount := restingHold(mb.spec, next)
+	if err := f.adjust(o.ID, amount); err != nil {
+		return nil, err
+	}
+	res, err := mb.amendOrder(o, next, keep)
+	if err != nil {
+		return nil, err
+	}
+	f.settle(mb.spec, o, res)
+	return res, nil
+}
+
+func frontAsk(mb *marketBook) string {
+	return mb.book.bestAsk().orders.Front().Value.(*Order).ID
+}
+
+func TestAmendDecreaseKeepsPriority(t *testing.T) {
+	f := newFunds()
+	mb := newTestRegistry(MarketBTCUSD).byMarket[MarketBTCUSD]
+	f.credit("a", "BTC", 10)
+	f.credit("b", "BTC", 10)
+	placeWithFunds(t, f, mb, newSTPOrder("s1", "a", SideSell, 100, 10, STPNone))
+	placeWithFunds(t, f, mb, newSTPOrder("s2", "b", SideSell, 100, 10, STPNone))
+
+	if _, err := amendResting(t, f, mb, Amend{OrderID: "s1", Quantity: 4}); err != nil {
+		t.Fatalf("amend: %v", err)
+	}
+	if frontAsk(mb) != "s1" {
+		t.Fatalf("expected s1 to keep the front of the queue")
+	}
+	expectBalance(t, f, "a", "BTC", 6, 4)
+}
+
+func TestAmendIncreaseLosesPriority(t *testing.T) {
+	f := newFunds()
+	mb := newTestRegistry(MarketBTCUSD).byMarket[MarketBTCUSD]
+	f.credit("a", "BTC", 20)
+	f.credit("b", "BTC", 10)
+	placeWithFunds(t, f, mb, newSTPOrder("s1", "a", SideSell, 100, 10, STPNone))
+	placeWithFunds(t, f, mb, newSTPOrder("s2", "b", SideSell, 100, 10, STPNone))
+
+	if _, err := amendResting(t, f, mb, Amend{OrderID: "s1", Quantity: 15}); err != nil {
+		t.Fatalf("amend: %v", err)
+	}
+	if frontAsk(mb) != "s2" {
+		t.Fatalf("expected s1 to move behind s2")
+	}
+	expectBalance(t, f, "a", "BTC", 5, 15)
+
+	if _, err := amendResting(t, f, mb, Amend{OrderID: "s1", Quantity: 30}); !errors.Is(err, ErrInsufficientFunds) {
+		t.Fatalf("expected ErrInsufficientFunds, got %v", err)
+	}
+	expectBalance(t, f, "a", "BTC", 5, 15)
+}
+
+func TestAmendPriceCanTrade(t *testing.T) {
+	f := newFunds()
+	mb := newTestRegistry(MarketBTCUSD).byMarket[MarketBTCUSD]
+	f.credit("seller", "BTC", 10)
+	f.credit("buyer", "USD", 1_000)
+	placeWithFunds(t, f, mb, newSTPOrder("s1", "seller", SideSell, 105, 10, STPNone))
+	placeWithFunds(t, f, mb, newSTPOrder("b1", "buyer", SideBuy, 100, 5, STPNone))
+	expectBalance(t, f, "buyer", "USD", 500, 500)
+
+	res, err := amendResting(t, f, mb, Amend{OrderID: "b1", Price: 105})
+	if err != nil {
+		t.Fatalf("amend: %v", err)
+	}
+	if len(res.Trades) != 1 || res.Trades[0].TakerOrderID != "b1" || res.Trades[0].Quantity != 5 {
+		t.Fatalf("expected b1 to take 5, got %+v", res.Trades)
+	}
+	expectBalance(t, f, "buyer", "USD", 475, 0)
+	expectBalance(t, f, "buyer", "BTC", 5, 0)
+	if _, ok := mb.book.ordersByID["b1"]; ok {
+		t.Fatalf("filled order must leave the book")
+	}
+}
+
+func TestAmendedBelowFilledIsRejected(t *testing.T) {
+	o := newTestOrder("o1", SideBuy, 100, 10)
+	o.Remaining = 4
+	if _, _, err := amended(o, &Amend{Quantity: 6}); !errors.Is(err, ErrAmendBelowFilled) {
+		t.Fatalf("expected ErrAmendBelowFilled, got %v", err)
+	}
+	if _, _, err := amended(o, &Amend{Price: 100}); !errors.Is(err, ErrAmendNoChange) {
+		t.Fatalf("expected ErrAmendNoChange, got %v", err)
+	}
+	next, keep, err := amended(o, &Amend{Quantity: 8})
+	if err != nil || !keep || next.Remaining != 2 {
+		t.Fatalf("expected remaining 2 with priority kept, got %+v %v %v", next, keep, err)
+	}
+}
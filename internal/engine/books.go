@@ -0,0 +1,98 @@
+package engine
+
+import "errors"
+
+var ErrMarketMismatch = errors.New("order market does not match book market")
+
+// marketBook pairs the order book and matcher for one market.
+type marketBook struct {
+	market  string
+	spec    Market
+	book    *OrderBook
+	matcher *Matcher
+
+	stops     *stopBook // untriggered stop orders
+	lastPrice int64     // price of the last trade, 0 before the first
+}
+
+// bookRegistry holds one book per market so orders never match across markets.
+type bookRegistry struct {
+	byMarket map[string]*marketBook
+	rec      *recorder // handed to every book
+}
+
+func newBookRegistry() *bookRegistry {
+	return &bookRegistry{byMarket: make(map[string]*marketBook)}
+}
+
+// register adds a market with an empty book, or updates the constraints of
+// an already registered market without touching its resting orders.
+func (r *bookRegistry) register(spec Market) *marketBook {
+	if mb, ok := r.byMarket[spec.Symbol]; ok {
+		mb.spec = spec
+		mb.matcher.spec = spec
+		return mb
+	}
+	book := NewOrderBook()
+	book.market = spec.Symbol
+	book.rec = r.rec
+	mb := &marketBook{
+		market:  spec.Symbol,
+		spec:    spec,
+		book:    book,
+		matcher: &Matcher{book: book, spec: spec},
+		stops:   newStopBook(),
+	}
+	mb.stops.rec = r.rec
+	r.byMarket[spec.Symbol] = mb
+	return mb
+}
+
+func (r *bookRegistry) lookup(market string) (*marketBook, bool) {
+	mb, ok := r.byMarket[market]
+	return mb, ok
+}
+
+// findOrder returns the book currently resting the order with the given id.
+func (r *bookRegistry) findOrder(id string) (*marketBook, bool) {
+	for _, mb := range r.byMarket {
+		if _, ok := mb.book.ordersByID[id]; ok {
+			return mb, true
+		}
+	}
+	return nil, false
+}
+
+// findStop returns the market holding the untriggered stop order with the
+// given id.
+func (r *bookRegistry) findStop(id string) (*marketBook, bool) {
+	for _, mb := range r.byMarket {
+		if _, ok := mb.stops.byID[id]; ok {
+			return mb, true
+		}
+	}
+	return nil, false
+}
+
+// ownedBy reports whether the resting order or untriggered stop with the
+// given id belongs to userID.
+func (r *bookRegistry) ownedBy(id, userID string) bool {
+	if mb, ok := r.findOrder(id); ok {
+		o, _ := mb.book.order(id)
+		return o.UserID == userID
+	}
+	if mb, ok := r.findStop(id); ok {
+		return mb.stops.byID[id].elem.Value.(*Order).UserID == userID
+	}
+	return false
+}
+
+// hasAsset reports whether any registered market trades the asset.
+func (r *bookRegistry) hasAsset(asset string) bool {
+	for _, mb := range r.byMarket {
+		if mb.spec.BaseAsset == asset || mb.spec.QuoteAsset == asset {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,84 @@
+package engine
+
+import "testing"
+
+func testMarket(symbol string) Market {
+	return Market{Symbol: symbol, BaseAsset: "BTC", QuoteAsset: "USD", TickSize: 1, LotSize: 1}
+}
+
+func newTestRegistry(symbols ...string) *bookRegistry {
+	books := newBookRegistry()
+	for _, s := range symbols {
+		books.register(testMarket(s))
+	}
+	return books
+}
+
+func TestMarketsDoNotCross(t *testing.T) {
+	books := newTestRegistry(MarketBTCUSD, "ETH-USD")
+
+	sell := newTestOrder("o1", SideSell, 100, 1)
+	sell.Market = "ETH-USD"
+	if _, err := mustLookup(t, books, sell.Market).matcher.Submit(sell); err != nil {
+		t.Fatalf("submit sell: %v", err)
+	}
+
+	buy := newTestOrder("o2", SideBuy, 100, 1)
+	res, err := mustLookup(t, books, buy.Market).matcher.Submit(buy)
+	if err != nil {
+		t.Fatalf("submit buy: %v", err)
+	}
+	if len(res.Trades) != 0 {
+		t.Fatalf("expected no trades across markets, got %+v", res.Trades)
+	}
+
+	eth, ok := books.lookup("ETH-USD")
+	if !ok || eth.book.bestAsk().price != 100 {
+		t.Fatalf("expected ETH-USD ask to keep resting")
+	}
+	btc, ok := books.lookup(MarketBTCUSD)
+	if !ok || btc.book.bestBid().price != 100 {
+		t.Fatalf("expected BTC-USD bid to rest")
+	}
+}
+
+func TestFindOrderLocatesMarket(t *testing.T) {
+	books := newTestRegistry(MarketBTCUSD, "ETH-USD")
+	o := newTestOrder("o1", SideBuy, 100, 1)
+	o.Market = "ETH-USD"
+	mustLookup(t, books, o.Market).book.AddOrder(o)
+
+	mb, ok := books.findOrder("o1")
+	if !ok || mb.market != "ETH-USD" {
+		t.Fatalf("expected o1 in ETH-USD book")
+	}
+	if _, ok := books.findOrder("missing"); ok {
+		t.Fatalf("expected missing order to be absent")
+	}
+}
+
+func TestSubmitRejectsForeignMarket(t *testing.T) {
+	books := newTestRegistry(MarketBTCUSD, "ETH-USD")
+	o := newTestOrder("o1", SideBuy, 100, 1)
+	o.Market = "ETH-USD"
+
+	if _, err := mustLookup(t, books, MarketBTCUSD).matcher.Submit(o); err != ErrMarketMismatch {
+		t.Fatalf("expected ErrMarketMismatch, got %v", err)
+	}
+}
+
+func TestLookupUnregisteredMarket(t *testing.T) {
+	books := newTestRegistry(MarketBTCUSD)
+	if _, ok := books.lookup("DOGE-USD"); ok {
+		t.Fatalf("expected unregistered market to be absent")
+	}
+}
+
+func mustLookup(t *testing.T, books *bookRegistry, market string) *marketBook {
+	t.Helper()
+	mb, ok := books.lookup(market)
+	if !ok {
+		t.Fatalf("market %s not registered", market)
+	}
+	return mb
+}
@@ -1,26 +1,94 @@
 // internal/engine/command.go
 package engine
 
+import "time"
+
+// CommandType values are written to the journal; add new types at the end.
 type CommandType int
 
 const (
 	CmdPlace CommandType = iota
 	CmdCancel
+	CmdRequestTransfer
+	CmdConfirmTransfer
+	CmdRejectTransfer
+	CmdSetFeeTier
+	CmdAmend
+	CmdMassCancel
+	CmdExpire // internal, issued by the engine loop when a good-till-date order expires
+	CmdHeartbeat
+	CmdDeadManTrip // internal, issued by the engine loop when a dead man's switch trips
+	CmdBookHash    // read-only, not journaled
+	CmdRollback    // journal only: the commands from an earlier entry on were rolled back
+	CmdReconcile   // not journaled; a repair is journaled as CmdRepair
+	CmdRepair      // journal only: the books were brought in line with the database
 )
 
 type Command struct {
-	Type  CommandType
-	Order *Order   // used when Type == CmdPlace
-	ID    string   // used when Type == CmdCancel
-	Resp  chan any // engine sends the result back here
+	Type        CommandType
+	Order       *Order           // used when Type == CmdPlace
+	Idempotency IdempotencyKey   // optional, used when Type == CmdPlace
+	Stored      *storedPlacement // what the store held for a CmdPlace when it was sent
+	Transfer    *Transfer        // used when Type == CmdRequestTransfer
+	Amend       *Amend           // used when Type == CmdAmend
+	MassCancel  *MassCancel      // used when Type == CmdMassCancel
+	ID          string           // order id for CmdCancel/CmdExpire, transfer id for confirm/reject, user id for CmdSetFeeTier/CmdHeartbeat/CmdDeadManTrip, market for CmdReconcile
+	FeeTier     string           // used when Type == CmdSetFeeTier, empty clears the tier
+	FeeRates    *FeeRates        // rates of FeeTier when the CmdSetFeeTier was sent
+	Timeout     time.Duration    // used when Type == CmdHeartbeat, zero disarms the switch
+	ExpiresAt   time.Time        // when a CmdHeartbeat trips the switch, set as the command is applied
+	Repair      bool             // used when Type == CmdReconcile
+	UserID      string           // optional owner of the order for CmdCancel
+	Resp        chan any         // engine sends the result back here
+}
+
+// fail answers cmd with err without running it.
+func (cmd Command) fail(err error) {
+	if cmd.Resp == nil {
+		return
+	}
+	var out any
+	switch cmd.Type {
+	case CmdPlace:
+		out = placeResult{Err: err}
+	case CmdCancel:
+		out = cancelResult{Err: err}
+	case CmdMassCancel:
+		out = massCancelResult{Err: err}
+	case CmdRequestTransfer, CmdConfirmTransfer, CmdRejectTransfer:
+		out = transferResult{Err: err}
+	case CmdSetFeeTier:
+		out = feeTierResult{Err: err}
+	case CmdAmend:
+		out = amendResult{Err: err}
+	case CmdHeartbeat:
+		out = heartbeatResult{Err: err}
+	case CmdReconcile:
+		out = reconcileResult{Err: err}
+	default:
+		return
+	}
+	cmd.Resp <- out
 }
 
 type placeResult struct {
-	Result *MatchResult
-	Err    error
+	Result   *MatchResult
+	Replayed bool // Result is the stored result of an earlier identical request
+	Err      error
 }
 
 type cancelResult struct {
 	OK  bool
 	Err error
 }
+
+type feeTierResult struct {
+	Rates *FeeRates // nil when the user is back on market rates
+	Err   error
+}
+
+type amendResult struct {
+	Order  Order // the order after the amend and any fills
+	Result *MatchResult
+	Err    error
+}
@@ -0,0 +1,255 @@
+package engine
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	dbsqlc "github.com/hakimelghazi/exchange-core/db/sqlc"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// Bounds of a dead man's switch timeout.
+const (
+	MinDeadManTimeout = time.Second
+	MaxDeadManTimeout = time.Hour
+)
+
+var ErrInvalidDeadManTimeout = fmt.Errorf("dead man's switch timeout must be between %s and %s", MinDeadManTimeout, MaxDeadManTimeout)
+
+// DeadManSwitch cancels every open order of a user at ExpiresAt unless a
+// heartbeat pushes it forward first. It trips once and is then disarmed.
+type DeadManSwitch struct {
+	UserID    string    `json:"user_id"`
+	TimeoutMs int64     `json:"timeout_ms"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type heartbeatResult struct {
+	Switch *DeadManSwitch // nil once disarmed
+	Err    error
+}
+
+// deadManSwitches holds the armed switches and the times they trip.
+type deadManSwitches struct {
+	byUser map[string]DeadManSwitch
+	queue  *switchQueue
+	rec    *recorder // undo log of the engine command changing the switches
+}
+
+func newDeadManSwitches() *deadManSwitches {
+	return &deadManSwitches{
+		byUser: make(map[string]DeadManSwitch),
+		queue:  newSwitchQueue(),
+	}
+}
+
+func (d *deadManSwitches) arm(sw DeadManSwitch) {
+	d.touch(sw.UserID)
+	d.byUser[sw.UserID] = sw
+	d.queue.set(sw.ExpiresAt, sw.UserID)
+}
+
+func (d *deadManSwitches) disarm(userID string) {
+	d.touch(userID)
+	delete(d.byUser, userID)
+	d.queue.remove(userID)
+}
+
+// due takes the users whose switch has tripped at now off the queue and
+// returns them; their trip disarms them.
+func (d *deadManSwitches) due(now time.Time) []string {
+	return d.queue.due(now)
+}
+
+// switchQueue is a min-heap of the times the armed switches trip, with one
+// entry per user: a heartbeat moves the user's entry and a disarm removes
+// it, so the queue never grows past the number of switches.
+type switchQueue struct {
+	items []expiry
+	index map[string]int // user id -> position in items
+}
+
+func newSwitchQueue() *switchQueue {
+	return &switchQueue{index: make(map[string]int)}
+}
+
+func (q *switchQueue) Len() int           { return len(q.items) }
+func (q *switchQueue) Less(i, j int) bool { return q.items[i].at.Before(q.items[j].at) }
+func (q *switchQueue) Swap(i, j int) {
+	q.items[i], q.items[j] = q.items[j], q.items[i]
+	q.index[q.items[i].id] = i
+	q.index[q.items[j].id] = j
+}
+func (q *switchQueue) Push(x any) {
+	it := x.(expiry)
+	q.index[it.id] = len(q.items)
+	q.items = append(q.items, it)
+}
+func (q *switchQueue) Pop() any {
+	it := q.items[len(q.items)-1]
+	q.items = q.items[:len(q.items)-1]
+	delete(q.index, it.id)
+	return it
+}
+
+// set queues the user's switch to trip at at, moving the entry it has.
+func (q *switchQueue) set(at time.Time, userID string) {
+	if i, ok := q.index[userID]; ok {
+		q.items[i].at = at
+		heap.Fix(q, i)
+		return
+	}
+	heap.Push(q, expiry{at: at, id: userID})
+}
+
+func (q *switchQueue) remove(userID string) {
+	if i, ok := q.index[userID]; ok {
+		heap.Remove(q, i)
+	}
+}
+
+// next returns the earliest time a switch trips, if any is armed.
+func (q *switchQueue) next() (time.Time, bool) {
+	if len(q.items) == 0 {
+		return time.Time{}, false
+	}
+	return q.items[0].at, true
+}
+
+// due removes and returns the users whose switch trips at or before now,
+// earliest first.
+func (q *switchQueue) due(now time.Time) []string {
+	var users []string
+	for len(q.items) > 0 && !q.items[0].at.After(now) {
+		users = append(users, heap.Pop(q).(expiry).id)
+	}
+	return users
+}
+
+// Heartbeat arms or re-arms the user's dead man's switch: unless another
+// heartbeat arrives within timeout, all of the user's open orders are
+// cancelled. A zero timeout disarms the switch and returns nil.
+func (e *Engine) Heartbeat(ctx context.Context, userID string, timeout time.Duration) (*DeadManSwitch, error) {
+	if timeout != 0 && (timeout < MinDeadManTimeout || timeout > MaxDeadManTimeout) {
+		return nil, ErrInvalidDeadManTimeout
+	}
+	resp := make(chan any, 1)
+	cmd := Command{Type: CmdHeartbeat, ID: userID, Timeout: timeout, Resp: resp}
+
+	if err := e.enqueueCommand(ctx, cmd); err != nil {
+		return nil, err
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case raw := <-resp:
+		out := raw.(heartbeatResult)
+		return out.Switch, out.Err
+	}
+}
+
+func (e *Engine) handleHeartbeat(cmd Command) {
+	userID, timeout := cmd.ID, cmd.Timeout
+	uid, err := uuidFromString(userID)
+	if err != nil {
+		cmd.Resp <- heartbeatResult{Err: fmt.Errorf("invalid user id: %w", err)}
+		return
+	}
+
+	var sw *DeadManSwitch
+	w := &pendingWrite{}
+	if timeout == 0 {
+		e.deadMan.disarm(userID)
+		w.add(func(ctx context.Context, b *dbBatch) error {
+			return b.q.DeleteDeadManSwitch(ctx, uid)
+		})
+	} else {
+		sw = &DeadManSwitch{
+			UserID:    userID,
+			TimeoutMs: timeout.Milliseconds(),
+			ExpiresAt: cmd.ExpiresAt,
+		}
+		e.deadMan.arm(*sw)
+		params := dbsqlc.UpsertDeadManSwitchParams{
+			UserID:    uid,
+			TimeoutMs: sw.TimeoutMs,
+			ExpiresAt: pgtype.Timestamptz{Time: sw.ExpiresAt, Valid: true},
+		}
+		w.add(func(ctx context.Context, b *dbBatch) error {
+			_, err := b.q.UpsertDeadManSwitch(ctx, params)
+			return err
+		})
+	}
+	w.done = func(err error) {
+		if err != nil {
+			log.Printf("handleHeartbeat: storing switch failed for %s: %v", userID, err)
+			sw = nil
+		}
+		cmd.Resp <- heartbeatResult{Switch: sw, Err: err}
+	}
+	e.submit(w)
+}
+
+// tripDeadManSwitches issues a trip command for every switch due at now. It
+// runs on the engine loop, so trips are ordered with every other command.
+func (e *Engine) tripDeadManSwitches(ctx context.Context, now time.Time) {
+	for _, userID := range e.deadMan.due(now) {
+		e.apply(ctx, Command{Type: CmdDeadManTrip, ID: userID})
+	}
+}
+
+// handleDeadManTrip cancels the user's open orders and disarms the switch
+// in one write. If the write fails the trip is rolled back, re-arming the
+// switch, and it trips again right away.
+func (e *Engine) handleDeadManTrip(userID string) {
+	ids, w, err := e.massCancel(&MassCancel{UserID: userID})
+	if err != nil {
+		log.Printf("handleDeadManTrip: cancelling orders of %s failed: %v", userID, err)
+		return
+	}
+	e.deadMan.disarm(userID)
+	if w == nil {
+		w = &pendingWrite{}
+	}
+	if uid, err := uuidFromString(userID); err != nil {
+		log.Printf("handleDeadManTrip: disarming switch of %s failed: %v", userID, err)
+	} else {
+		w.add(func(ctx context.Context, b *dbBatch) error {
+			return b.q.DeleteDeadManSwitch(ctx, uid)
+		})
+	}
+	w.done = func(err error) {
+		if err != nil {
+			log.Printf("handleDeadManTrip: storing trip of %s failed: %v", userID, err)
+			return
+		}
+		log.Printf("dead man's switch of %s tripped, cancelled %d orders", userID, len(ids))
+	}
+	e.submit(w)
+}
+
+// loadDeadManSwitches re-arms persisted switches. Switches that expired
+// while the engine was down trip as soon as Run starts.
+func (e *Engine) loadDeadManSwitches(ctx context.Context) error {
+	rows, err := e.queries.ListDeadManSwitches(ctx)
+	if err != nil {
+		return fmt.Errorf("bootstrap dead man's switches: %w", err)
+	}
+	for _, r := range rows {
+		e.deadMan.arm(deadManSwitchFromRow(r))
+	}
+	return nil
+}
+
+func deadManSwitchFromRow(r dbsqlc.DeadManSwitch) DeadManSwitch {
+	return DeadManSwitch{
+		UserID:    uuid.UUID(r.UserID.Bytes).String(),
+		TimeoutMs: r.TimeoutMs,
+		ExpiresAt: r.ExpiresAt.Time,
+	}
+}
@@ -0,0 +1,67 @@
+package engine
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestDeadManSwitchesDue(t *testing.T) {
+	now := time.Now()
+	d := newDeadManSwitches()
+
+	d.arm(DeadManSwitch{UserID: "tripped", TimeoutMs: 1000, ExpiresAt: now.Add(-time.Second)})
+	d.arm(DeadManSwitch{UserID: "later", TimeoutMs: 1000, ExpiresAt: now.Add(time.Second)})
+
+	// heartbeats move the user's entry instead of queueing another
+	for i := 0; i < 100; i++ {
+		d.arm(DeadManSwitch{UserID: "renewed", TimeoutMs: 1000, ExpiresAt: now.Add(-time.Second)})
+		d.arm(DeadManSwitch{UserID: "renewed", TimeoutMs: 1000, ExpiresAt: now.Add(time.Minute)})
+	}
+
+	d.arm(DeadManSwitch{UserID: "disarmed", TimeoutMs: 1000, ExpiresAt: now.Add(-time.Second)})
+	d.disarm("disarmed")
+
+	d.arm(DeadManSwitch{UserID: "twice", TimeoutMs: 1000, ExpiresAt: now.Add(-time.Minute)})
+	d.arm(DeadManSwitch{UserID: "twice", TimeoutMs: 1000, ExpiresAt: now.Add(-time.Minute)})
+
+	if d.queue.Len() != len(d.byUser) {
+		t.Fatalf("expected one queue entry per armed switch, got %d for %d", d.queue.Len(), len(d.byUser))
+	}
+	got := d.due(now)
+	want := []string{"twice", "tripped"}
+	if len(got) != len(want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("expected %v, got %v", want, got)
+		}
+	}
+	if at, ok := d.queue.next(); !ok || !at.Equal(now.Add(time.Second)) {
+		t.Fatalf("expected the later switch to be next, got %v %v", at, ok)
+	}
+}
+
+func TestReplayArmsSwitchAtJournaledTime(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "journal")
+	e, stop := startJournaledEngine(t, NewMemStore(), path)
+	user := uuid.NewString()
+	sw, err := e.Heartbeat(ctx, user, MinDeadManTimeout)
+	if err != nil {
+		t.Fatalf("heartbeat: %v", err)
+	}
+	stop()
+
+	replayed := newReplayEngine(MarketBTCUSD)
+	if _, err := replayed.replay(ctx, path, 0, 0); err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+	if got := replayed.deadMan.byUser[user]; !got.ExpiresAt.Equal(sw.ExpiresAt) {
+		t.Fatalf("expected the switch to trip at %v, got %v", sw.ExpiresAt, got.ExpiresAt)
+	}
+}
@@ -0,0 +1,116 @@
+package engine
+
+import (
+	"container/heap"
+	"context"
+	"log"
+	"time"
+)
+
+var ErrInvalidExpiry = &RejectError{Reason: "expiry must be in the future and on an order that can rest"}
+
+// expiry is the time a good-till-date order leaves the book, or a dead man's
+// switch trips.
+type expiry struct {
+	at time.Time
+	id string // order id, or user id for a dead man's switch
+}
+
+// expiryQueue is a min-heap of order expiries. Entries are not removed when
+// an order fills or is cancelled; the consumer skips entries that no longer
+// apply.
+type expiryQueue []expiry
+
+func (q expiryQueue) Len() int           { return len(q) }
+func (q expiryQueue) Less(i, j int) bool { return q[i].at.Before(q[j].at) }
+func (q expiryQueue) Swap(i, j int)      { q[i], q[j] = q[j], q[i] }
+func (q *expiryQueue) Push(x any)        { *q = append(*q, x.(expiry)) }
+func (q *expiryQueue) Pop() any {
+	old := *q
+	x := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return x
+}
+
+func newExpiryQueue() *expiryQueue {
+	return &expiryQueue{}
+}
+
+// schedule adds o to the queue if it has an expiry.
+func (q *expiryQueue) schedule(o *Order) {
+	if o.ExpiresAt.IsZero() {
+		return
+	}
+	q.push(o.ExpiresAt, o.ID)
+}
+
+func (q *expiryQueue) push(at time.Time, id string) {
+	heap.Push(q, expiry{at: at, id: id})
+}
+
+// next returns the earliest expiry, if any.
+func (q *expiryQueue) next() (time.Time, bool) {
+	if q.Len() == 0 {
+		return time.Time{}, false
+	}
+	return (*q)[0].at, true
+}
+
+// due removes and returns the ids expiring at or before now, earliest first.
+func (q *expiryQueue) due(now time.Time) []string {
+	var ids []string
+	for q.Len() > 0 && !(*q)[0].at.After(now) {
+		ids = append(ids, heap.Pop(q).(expiry).id)
+	}
+	return ids
+}
+
+// armExpiry sets the timer for the next order expiry or dead man's switch,
+// or stops it if there is none.
+func (e *Engine) armExpiry(t *time.Timer) {
+	at, ok := e.expiries.next()
+	if sw, armed := e.deadMan.queue.next(); armed && (!ok || sw.Before(at)) {
+		at, ok = sw, true
+	}
+	if !ok {
+		t.Stop()
+		return
+	}
+	t.Reset(time.Until(at))
+}
+
+// expireDue issues an expire command for every order due at now that is
+// still resting or waiting for its trigger. It runs on the engine loop, so
+// expirations are ordered with every other command.
+func (e *Engine) expireDue(ctx context.Context, now time.Time) {
+	for _, id := range e.expiries.due(now) {
+		if _, ok := e.books.findOrder(id); !ok {
+			if _, ok := e.books.findStop(id); !ok {
+				continue
+			}
+		}
+		e.apply(ctx, Command{Type: CmdExpire, ID: id})
+	}
+}
+
+// checkExpiry validates the expiry of an order arriving at now.
+func checkExpiry(o *Order, now time.Time) error {
+	if o.ExpiresAt.IsZero() {
+		return nil
+	}
+	tif := o.timeInForce()
+	if o.IsMarket || tif == TIFIOC || tif == TIFFOK || !o.ExpiresAt.After(now) {
+		return ErrInvalidExpiry
+	}
+	return nil
+}
+
+func (e *Engine) handleExpire(id string) {
+	// the expiry was taken off the queue; a rolled back one fires again
+	e.rec.add(func() { e.expiries.push(time.Now(), id) })
+	e.closeOrder(id, "EXPIRED", func(err error) {
+		if err != nil {
+			log.Printf("handleExpire: expiring order %s failed: %v", id, err)
+		}
+	})
+}
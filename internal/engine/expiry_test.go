@@ -0,0 +1,62 @@
+package engine
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExpiryQueueReturnsDueOrdersEarliestFirst(t *testing.T) {
+	now := time.Now()
+	q := newExpiryQueue()
+	for _, e := range []struct {
+		id string
+		in time.Duration
+	}{
+		{"late", time.Hour},
+		{"second", -time.Minute},
+		{"first", -time.Hour},
+		{"now", 0},
+	} {
+		o := newTestOrder(e.id, SideBuy, 100, 1)
+		o.ExpiresAt = now.Add(e.in)
+		q.schedule(o)
+	}
+	q.schedule(newTestOrder("gtc", SideBuy, 100, 1))
+
+	got := q.due(now)
+	want := []string{"first", "second", "now"}
+	if len(got) != len(want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("expected %v, got %v", want, got)
+		}
+	}
+	if at, ok := q.next(); !ok || !at.Equal(now.Add(time.Hour)) {
+		t.Fatalf("expected the late order to be next, got %v %v", at, ok)
+	}
+}
+
+func TestCheckExpiry(t *testing.T) {
+	now := time.Now()
+
+	gtd := newTestOrder("gtd", SideBuy, 100, 1)
+	gtd.ExpiresAt = now.Add(time.Minute)
+	if err := checkExpiry(gtd, now); err != nil {
+		t.Fatalf("expected valid expiry, got %v", err)
+	}
+
+	past := newTestOrder("past", SideBuy, 100, 1)
+	past.ExpiresAt = now.Add(-time.Second)
+	if err := checkExpiry(past, now); err != ErrInvalidExpiry {
+		t.Fatalf("expected past expiry to be rejected, got %v", err)
+	}
+
+	ioc := newTestOrder("ioc", SideBuy, 100, 1)
+	ioc.TimeInForce = TIFIOC
+	ioc.ExpiresAt = now.Add(time.Minute)
+	if err := checkExpiry(ioc, now); err != ErrInvalidExpiry {
+		t.Fatalf("expected IOC expiry to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,176 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+
+	dbsqlc "github.com/hakimelghazi/exchange-core/db/sqlc"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// AccountFees is the exchange's account collecting trading fees in each
+// asset. Maker rebates are paid out of it.
+const AccountFees = "FEES"
+
+const bpsDenominator = 10_000
+
+var (
+	ErrInvalidFeeRates = errors.New("taker fee must be within [0, 10000] bps and maker fee within [-taker, 10000] bps")
+	ErrUnknownFeeTier  = errors.New("unknown fee tier")
+)
+
+// FeeRates are fees in basis points of what each side of a trade receives:
+// buyers pay in base, sellers in quote. A negative maker rate is a rebate.
+type FeeRates struct {
+	MakerBps int64
+	TakerBps int64
+}
+
+func (r FeeRates) validate() error {
+	if r.TakerBps < 0 || r.TakerBps > bpsDenominator || r.MakerBps < -r.TakerBps || r.MakerBps > bpsDenominator {
+		return fmt.Errorf("%w: maker %d, taker %d", ErrInvalidFeeRates, r.MakerBps, r.TakerBps)
+	}
+	return nil
+}
+
+// feeSchedule resolves the rates a user pays on a market: the user's tier if
+// one is assigned, the market's schedule otherwise.
+type feeSchedule struct {
+	byUser map[string]FeeRates // user id -> tier rates
+}
+
+func newFeeSchedule() *feeSchedule {
+	return &feeSchedule{byUser: make(map[string]FeeRates)}
+}
+
+func (s *feeSchedule) rates(mkt Market, userID string) FeeRates {
+	if r, ok := s.byUser[userID]; ok {
+		return r
+	}
+	return FeeRates{MakerBps: mkt.MakerFeeBps, TakerBps: mkt.TakerFeeBps}
+}
+
+// setTier assigns tier rates to a user; nil goes back to market rates.
+func (s *feeSchedule) setTier(userID string, r *FeeRates) {
+	if r == nil {
+		delete(s.byUser, userID)
+		return
+	}
+	s.byUser[userID] = *r
+}
+
+// SetFeeTier assigns a fee tier to a user and returns its rates. An empty
+// tier puts the user back on each market's own schedule and returns nil.
+func (e *Engine) SetFeeTier(ctx context.Context, userID, tier string) (*FeeRates, error) {
+	rates, err := e.lookupFeeTier(ctx, tier)
+	if err != nil {
+		return nil, err
+	}
+	resp := make(chan any, 1)
+	cmd := Command{Type: CmdSetFeeTier, ID: userID, FeeTier: tier, FeeRates: rates, Resp: resp}
+
+	if err := e.enqueueCommand(ctx, cmd); err != nil {
+		return nil, err
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case raw := <-resp:
+		out := raw.(feeTierResult)
+		return out.Rates, out.Err
+	}
+}
+
+// lookupFeeTier returns the rates of tier, nil for no tier. They are
+// resolved before the command is sent and journaled with it, so replay does
+// not depend on what the tier's row says later.
+func (e *Engine) lookupFeeTier(ctx context.Context, tier string) (*FeeRates, error) {
+	if tier == "" {
+		return nil, nil
+	}
+	row, err := e.queries.GetFeeTier(ctx, tier)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, fmt.Errorf("%w %q", ErrUnknownFeeTier, tier)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &FeeRates{MakerBps: row.MakerFeeBps, TakerBps: row.TakerFeeBps}, nil
+}
+
+func (e *Engine) handleSetFeeTier(ctx context.Context, userID, tier string, rates *FeeRates) (*FeeRates, error) {
+	uid, err := uuidFromString(userID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid user id: %w", err)
+	}
+
+	err = e.store.InTx(ctx, func(q Queries) error {
+		return q.SetUserFeeTier(ctx, dbsqlc.SetUserFeeTierParams{
+			ID:      uid,
+			FeeTier: pgtype.Text{String: tier, Valid: tier != ""},
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	e.fees.setTier(userID, rates)
+	return rates, nil
+}
+
+// charge fills in the maker and taker fees of every trade in res. owner maps
+// a maker order id to its user.
+func (s *feeSchedule) charge(mkt Market, taker *Order, res *MatchResult, owner func(orderID string) (string, bool)) {
+	takerRates := s.rates(mkt, taker.UserID)
+	for i := range res.Trades {
+		tr := &res.Trades[i]
+		makerUser, _ := owner(tr.MakerOrderID)
+		makerRates := s.rates(mkt, makerUser)
+
+		notional := tr.Price * tr.Quantity
+		if taker.Side == SideBuy {
+			tr.TakerFee, tr.TakerFeeAsset = feeOn(tr.Quantity, takerRates.TakerBps), mkt.BaseAsset
+			tr.MakerFee, tr.MakerFeeAsset = feeOn(notional, makerRates.MakerBps), mkt.QuoteAsset
+		} else {
+			tr.TakerFee, tr.TakerFeeAsset = feeOn(notional, takerRates.TakerBps), mkt.QuoteAsset
+			tr.MakerFee, tr.MakerFeeAsset = feeOn(tr.Quantity, makerRates.MakerBps), mkt.BaseAsset
+		}
+	}
+}
+
+// feeOn returns bps of amount. Fees round up and rebates round down, so the
+// exchange never pays out more than the schedule says.
+func feeOn(amount, bps int64) int64 {
+	if amount == 0 || bps == 0 {
+		return 0
+	}
+	neg := bps < 0
+	if neg {
+		bps = -bps
+	}
+	q, r := new(big.Int).QuoRem(
+		new(big.Int).Mul(big.NewInt(amount), big.NewInt(bps)),
+		big.NewInt(bpsDenominator),
+		new(big.Int),
+	)
+	fee := q.Int64()
+	if neg {
+		return -fee
+	}
+	if r.Sign() != 0 {
+		fee++
+	}
+	return fee
+}
+
+// sideFees returns the fees paid by the buyer (in base) and the seller (in
+// quote) of a trade.
+func (tr Trade) sideFees(takerSide Side) (buyer, seller int64) {
+	if takerSide == SideBuy {
+		return tr.TakerFee, tr.MakerFee
+	}
+	return tr.MakerFee, tr.TakerFee
+}
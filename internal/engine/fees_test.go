@@ -0,0 +1,93 @@
+package engine
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestFeeOnRounding(t *testing.T) {
+	cases := []struct {
+		amount, bps, want int64
+	}{
+		{10_000, 20, 20},
+		{1, 20, 1}, // fees round up
+		{1, -2, 0}, // rebates round down
+		{15_000, -2, -3},
+		{0, 20, 0},
+		{500, 0, 0},
+	}
+	for _, c := range cases {
+		if got := feeOn(c.amount, c.bps); got != c.want {
+			t.Errorf("feeOn(%d, %d) = %d, want %d", c.amount, c.bps, got, c.want)
+		}
+	}
+}
+
+func TestFeeRatesValidate(t *testing.T) {
+	if err := (FeeRates{MakerBps: -2, TakerBps: 10}).validate(); err != nil {
+		t.Fatalf("expected rebate within taker fee to be valid, got %v", err)
+	}
+	for _, r := range []FeeRates{{MakerBps: -11, TakerBps: 10}, {TakerBps: -1}, {TakerBps: 10_001}} {
+		if err := r.validate(); !errors.Is(err, ErrInvalidFeeRates) {
+			t.Fatalf("%+v: expected ErrInvalidFeeRates, got %v", r, err)
+		}
+	}
+}
+
+func TestSettleChargesFeesInReceivedAsset(t *testing.T) {
+	f := newFunds()
+	fees := newFeeSchedule()
+	mkt := testMarket(MarketBTCUSD)
+	mkt.MakerFeeBps, mkt.TakerFeeBps = 10, 20
+	mb := newBookRegistry().register(mkt)
+
+	f.credit("maker", "USD", 1_000_000)
+	f.credit("taker", "BTC", 1_000)
+	fees.setTier("maker", &FeeRates{MakerBps: -2, TakerBps: 10})
+
+	if _, err := placeWithFees(t, f, fees, mb, newSTPOrder("b1", "maker", SideBuy, 100, 1_000, STPNone)); err != nil {
+		t.Fatalf("place bid: %v", err)
+	}
+
+	res, err := placeWithFees(t, f, fees, mb, newSTPOrder("s1", "taker", SideSell, 100, 1_000, STPNone))
+	if err != nil {
+		t.Fatalf("place ask: %v", err)
+	}
+
+	tr := res.Trades[0]
+	// taker sells and receives 100_000 USD at 20 bps; maker buys 1_000 BTC
+	// with a 2 bps rebate from its tier
+	if tr.TakerFee != 200 || tr.TakerFeeAsset != "USD" {
+		t.Fatalf("unexpected taker fee %d %s", tr.TakerFee, tr.TakerFeeAsset)
+	}
+	if tr.MakerFee != 0 || tr.MakerFeeAsset != "BTC" {
+		t.Fatalf("unexpected maker fee %d %s", tr.MakerFee, tr.MakerFeeAsset)
+	}
+	expectBalance(t, f, "taker", "USD", 99_800, 0)
+	expectBalance(t, f, "maker", "BTC", 1_000, 0)
+	expectBalance(t, f, "maker", "USD", 900_000, 0)
+}
+
+func TestMakerRebateCreditsMaker(t *testing.T) {
+	f := newFunds()
+	fees := newFeeSchedule()
+	mkt := testMarket(MarketBTCUSD)
+	mkt.MakerFeeBps, mkt.TakerFeeBps = -5, 10
+	mb := newBookRegistry().register(mkt)
+
+	f.credit("maker", "BTC", 10)
+	f.credit("taker", "USD", 1_000_000)
+
+	if _, err := placeWithFunds(t, f, mb, newSTPOrder("s1", "maker", SideSell, 10_000, 10, STPNone)); err != nil {
+		t.Fatalf("place ask: %v", err)
+	}
+	if _, err := placeWithFees(t, f, fees, mb, newSTPOrder("b1", "taker", SideBuy, 10_000, 10, STPNone)); err != nil {
+		t.Fatalf("place bid: %v", err)
+	}
+
+	// maker receives 100_000 USD plus a 5 bps rebate; taker pays 10 bps of
+	// 10 BTC, rounded up to 1
+	expectBalance(t, f, "maker", "USD", 100_050, 0)
+	expectBalance(t, f, "taker", "BTC", 9, 0)
+	expectBalance(t, f, "taker", "USD", 900_000, 0)
+}
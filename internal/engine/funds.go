@@ -0,0 +1,274 @@
+package engine
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+)
+
+var ErrInsufficientFunds = &RejectError{Reason: "insufficient funds"}
+
+// Account kinds. Each user has one account per asset and kind; funds move to
+// HELD when an order is accepted and back to AVAILABLE when it no longer
+// needs them.
+const (
+	AccountAvailable = "AVAILABLE"
+	AccountHeld      = "HELD"
+)
+
+// balance is a user's position in one asset.
+type balance struct {
+	available int64
+	held      int64
+}
+
+// orderHold is what is currently reserved for one order.
+type orderHold struct {
+	userID string
+	asset  string
+	amount int64
+}
+
+// fundsMove is a transfer between a user's available and held accounts that
+// still has to be written to the ledger.
+type fundsMove struct {
+	RefType string // "hold" or "release"
+	RefID   string // order or transfer the funds are held for
+	UserID  string
+	Asset   string
+	Amount  int64 // moved available -> held for "hold", held -> available for "release"
+}
+
+// funds tracks balances and per-order holds in memory so admission checks
+// never wait on the database. The ledger stays the source of truth: every
+// change here is mirrored by ledger postings in the same transaction.
+type funds struct {
+	balances map[string]map[string]*balance // user -> asset -> balance
+	holds    map[string]*orderHold          // order or withdrawal id -> hold
+	moves    []fundsMove                    // pending ledger postings
+
+	rec *recorder // undo log of the engine command changing the funds
+}
+
+func newFunds() *funds {
+	return &funds{
+		balances: make(map[string]map[string]*balance),
+		holds:    make(map[string]*orderHold),
+	}
+}
+
+func (f *funds) balance(userID, asset string) *balance {
+	f.touch(userID, asset)
+	byAsset, ok := f.balances[userID]
+	if !ok {
+		byAsset = make(map[string]*balance)
+		f.balances[userID] = byAsset
+	}
+	b, ok := byAsset[asset]
+	if !ok {
+		b = &balance{}
+		byAsset[asset] = b
+	}
+	return b
+}
+
+// reserve moves amount from available to held for the order, or fails with
+// ErrInsufficientFunds without changing anything.
+func (f *funds) reserve(orderID, userID, asset string, amount int64) error {
+	b := f.balance(userID, asset)
+	if b.available < amount {
+		return fmt.Errorf("%w: need %d %s, available %d", ErrInsufficientFunds, amount, asset, b.available)
+	}
+	f.touchHold(orderID)
+	if amount == 0 {
+		f.holds[orderID] = &orderHold{userID: userID, asset: asset}
+		return nil
+	}
+	b.available -= amount
+	b.held += amount
+	f.holds[orderID] = &orderHold{userID: userID, asset: asset, amount: amount}
+	f.moves = append(f.moves, fundsMove{RefType: "hold", RefID: orderID, UserID: userID, Asset: asset, Amount: amount})
+	return nil
+}
+
+// adjust sets the order's hold to amount, reserving or releasing the
+// difference. Growing a hold fails with ErrInsufficientFunds without
+// changing anything.
+func (f *funds) adjust(orderID string, amount int64) error {
+	h, ok := f.holds[orderID]
+	if !ok {
+		return fmt.Errorf("no hold for order %s", orderID)
+	}
+	f.touchHold(orderID)
+	delta := amount - h.amount
+	if delta <= 0 {
+		f.release(orderID, -delta)
+		return nil
+	}
+	b := f.balance(h.userID, h.asset)
+	if b.available < delta {
+		return fmt.Errorf("%w: need %d more %s, available %d", ErrInsufficientFunds, delta, h.asset, b.available)
+	}
+	b.available -= delta
+	b.held += delta
+	h.amount += delta
+	f.moves = append(f.moves, fundsMove{RefType: "hold", RefID: orderID, UserID: h.userID, Asset: h.asset, Amount: delta})
+	return nil
+}
+
+// restore re-creates the hold of an order reloaded at bootstrap; the held
+// balance itself already comes from the ledger.
+func (f *funds) restore(orderID, userID, asset string, amount int64) {
+	f.holds[orderID] = &orderHold{userID: userID, asset: asset, amount: amount}
+}
+
+// drop forgets the order's hold without moving funds, for a hold the ledger
+// does not back.
+func (f *funds) drop(orderID string) {
+	f.touchHold(orderID)
+	delete(f.holds, orderID)
+}
+
+// consume spends amount of the order's hold, e.g. to pay for a trade.
+func (f *funds) consume(orderID string, amount int64) {
+	h, ok := f.holds[orderID]
+	if !ok {
+		return
+	}
+	f.touchHold(orderID)
+	h.amount -= amount
+	f.balance(h.userID, h.asset).held -= amount
+}
+
+// release returns up to amount of the order's hold to available.
+func (f *funds) release(orderID string, amount int64) {
+	h, ok := f.holds[orderID]
+	if !ok {
+		return
+	}
+	amount = min(amount, h.amount)
+	if amount <= 0 {
+		return
+	}
+	f.touchHold(orderID)
+	h.amount -= amount
+	b := f.balance(h.userID, h.asset)
+	b.held -= amount
+	b.available += amount
+	f.moves = append(f.moves, fundsMove{RefType: "release", RefID: orderID, UserID: h.userID, Asset: h.asset, Amount: amount})
+}
+
+// releaseAll returns whatever is left of the order's hold and forgets it.
+func (f *funds) releaseAll(orderID string) {
+	h, ok := f.holds[orderID]
+	if !ok {
+		return
+	}
+	f.touchHold(orderID)
+	f.release(orderID, h.amount)
+	delete(f.holds, orderID)
+}
+
+// credit adds amount to a user's available balance.
+func (f *funds) credit(userID, asset string, amount int64) {
+	f.balance(userID, asset).available += amount
+}
+
+// owner returns the user an order's hold belongs to.
+func (f *funds) owner(orderID string) (string, bool) {
+	h, ok := f.holds[orderID]
+	if !ok {
+		return "", false
+	}
+	return h.userID, true
+}
+
+// takeMoves returns the pending ledger postings and clears them.
+func (f *funds) takeMoves() []fundsMove {
+	moves := f.moves
+	f.moves = nil
+	return moves
+}
+
+// notionalOf returns price * quantity, or false if it does not fit in an
+// int64. Both must be positive.
+func notionalOf(price, quantity int64) (int64, bool) {
+	hi, lo := bits.Mul64(uint64(price), uint64(quantity))
+	if hi != 0 || lo > math.MaxInt64 {
+		return 0, false
+	}
+	return int64(lo), true
+}
+
+// holdFor returns the asset and amount an order must reserve: base quantity
+// for asks, price * quantity in quote for limit bids, the budget of quote
+// market buys and the cost of sweeping the book for other market bids, up
+// to the price band protect has set on them.
+// Market.Validate rejects limit orders whose price * quantity overflows, so
+// neither this nor what their trades settle does.
+func holdFor(mkt Market, book *OrderBook, o *Order) (string, int64) {
+	if o.Side == SideSell {
+		return mkt.BaseAsset, o.Remaining
+	}
+	if o.QuoteQuantity > 0 {
+		return mkt.QuoteAsset, o.QuoteQuantity
+	}
+	if o.IsMarket {
+		return mkt.QuoteAsset, book.cost(o)
+	}
+	return mkt.QuoteAsset, o.Price * o.Remaining
+}
+
+// restingHold is what a resting order keeps reserved for its remainder.
+func restingHold(mkt Market, o *Order) (string, int64) {
+	if o.Side == SideSell {
+		return mkt.BaseAsset, o.Remaining
+	}
+	return mkt.QuoteAsset, o.Price * o.Remaining
+}
+
+// settle moves funds for the trades of one match: buyers pay quote out of
+// their hold and receive base, sellers deliver base out of their hold and
+// receive quote, each net of their fee. Limit bids that trade below their
+// price get the difference released, and every order that is no longer
+// resting gives back what is left of its hold.
+func (f *funds) settle(mkt Market, taker *Order, res *MatchResult) {
+	for _, tr := range res.Trades {
+		buyID, sellID := tr.TakerOrderID, tr.MakerOrderID
+		if taker.Side == SideSell {
+			buyID, sellID = sellID, buyID
+		}
+		buyer, _ := f.owner(buyID)
+		seller, _ := f.owner(sellID)
+		notional := tr.Price * tr.Quantity
+		buyerFee, sellerFee := tr.sideFees(taker.Side)
+
+		f.consume(buyID, notional)
+		f.consume(sellID, tr.Quantity)
+		f.credit(buyer, mkt.BaseAsset, tr.Quantity-buyerFee)
+		f.credit(seller, mkt.QuoteAsset, notional-sellerFee)
+
+		if taker.Side == SideBuy && !taker.IsMarket && taker.Price > tr.Price {
+			f.release(taker.ID, (taker.Price-tr.Price)*tr.Quantity)
+		}
+		if h, ok := f.holds[tr.MakerOrderID]; ok && h.amount == 0 {
+			delete(f.holds, tr.MakerOrderID)
+		}
+	}
+
+	for _, d := range res.Decrements {
+		amount := d.Quantity
+		if taker.Side == SideSell {
+			// the reduced maker is a bid holding price * quantity in quote
+			amount = d.Price * d.Quantity
+		}
+		f.release(d.OrderID, amount)
+	}
+	for _, id := range res.CancelledOrders {
+		f.releaseAll(id)
+	}
+
+	if res.Remainder == nil || taker.IsMarket {
+		f.releaseAll(taker.ID)
+	}
+}
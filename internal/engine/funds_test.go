@@ -0,0 +1,205 @@
+package engine
+
+import (
+	"errors"
+	"math"
+	"testing"
+)
+
+// placeWithFunds runs the same reserve / match / settle sequence as
+// handlePlace, without persistence or fee tiers.
+func placeWithFunds(t *testing.T, f *funds, mb *marketBook, o *Order) (*MatchResult, error) {
+	t.Helper()
+	return placeWithFees(t, f, newFeeSchedule(), mb, o)
+}
+
+func placeWithFees(t *testing.T, f *funds, fees *feeSchedule, mb *marketBook, o *Order) (*MatchResult, error) {
+	t.Helper()
+	if o.IsMarket {
+		if err := mb.matcher.protect(o); err != nil {
+			return nil, err
+		}
+	}
+	asset, amount := holdFor(mb.spec, mb.book, o)
+	if err := f.reserve(o.ID, o.UserID, asset, amount); err != nil {
+		return nil, err
+	}
+	res, err := mb.matcher.Submit(o)
+	if err != nil {
+		f.releaseAll(o.ID)
+		return nil, err
+	}
+	fees.charge(mb.spec, o, res, f.owner)
+	f.settle(mb.spec, o, res)
+	return res, nil
+}
+
+func expectBalance(t *testing.T, f *funds, user, asset string, available, held int64) {
+	t.Helper()
+	b := f.balance(user, asset)
+	if b.available != available || b.held != held {
+		t.Fatalf("%s %s: expected available %d held %d, got %d/%d", user, asset, available, held, b.available, b.held)
+	}
+}
+
+func TestReserveRejectsInsufficientFunds(t *testing.T) {
+	f := newFunds()
+	mb := newTestRegistry(MarketBTCUSD).byMarket[MarketBTCUSD]
+	f.credit("buyer", "USD", 999)
+
+	bid := newSTPOrder("b1", "buyer", SideBuy, 100, 10, STPNone)
+	_, err := placeWithFunds(t, f, mb, bid)
+	if !errors.Is(err, ErrInsufficientFunds) {
+		t.Fatalf("expected ErrInsufficientFunds, got %v", err)
+	}
+	expectBalance(t, f, "buyer", "USD", 999, 0)
+	if _, ok := mb.book.ordersByID["b1"]; ok {
+		t.Fatalf("rejected order must not rest")
+	}
+}
+
+func TestHoldsFollowFillsAndCancels(t *testing.T) {
+	f := newFunds()
+	mb := newTestRegistry(MarketBTCUSD).byMarket[MarketBTCUSD]
+	f.credit("seller", "BTC", 10)
+	f.credit("buyer", "USD", 2_000)
+
+	if _, err := placeWithFunds(t, f, mb, newSTPOrder("s1", "seller", SideSell, 100, 10, STPNone)); err != nil {
+		t.Fatalf("place ask: %v", err)
+	}
+	expectBalance(t, f, "seller", "BTC", 0, 10)
+
+	// bid at 105 fills 10 @ 100; the price improvement goes back to available
+	res, err := placeWithFunds(t, f, mb, newSTPOrder("b1", "buyer", SideBuy, 105, 10, STPNone))
+	if err != nil {
+		t.Fatalf("place bid: %v", err)
+	}
+	if len(res.Trades) != 1 || res.Trades[0].Quantity != 10 {
+		t.Fatalf("expected one fill of 10, got %+v", res.Trades)
+	}
+	expectBalance(t, f, "buyer", "USD", 1_000, 0)
+	expectBalance(t, f, "buyer", "BTC", 10, 0)
+	expectBalance(t, f, "seller", "BTC", 0, 0)
+	expectBalance(t, f, "seller", "USD", 1_000, 0)
+	if len(f.holds) != 0 {
+		t.Fatalf("expected no holds left, got %d", len(f.holds))
+	}
+
+	// resting bid keeps price * remaining held until cancelled
+	if _, err := placeWithFunds(t, f, mb, newSTPOrder("b2", "buyer", SideBuy, 90, 5, STPNone)); err != nil {
+		t.Fatalf("place bid: %v", err)
+	}
+	expectBalance(t, f, "buyer", "USD", 550, 450)
+	mb.book.CancelOrder("b2")
+	f.releaseAll("b2")
+	expectBalance(t, f, "buyer", "USD", 1_000, 0)
+
+	moves := f.takeMoves()
+	if len(moves) == 0 || moves[len(moves)-1].RefType != "release" {
+		t.Fatalf("expected pending ledger moves ending with a release, got %+v", moves)
+	}
+}
+
+func TestMarketBuyHoldsSweepCost(t *testing.T) {
+	f := newFunds()
+	mb := newTestRegistry(MarketBTCUSD).byMarket[MarketBTCUSD]
+	f.credit("seller", "BTC", 3)
+	f.credit("buyer", "USD", 1_000)
+
+	placeWithFunds(t, f, mb, newSTPOrder("s1", "seller", SideSell, 100, 1, STPNone))
+	placeWithFunds(t, f, mb, newSTPOrder("s2", "seller", SideSell, 110, 2, STPNone))
+
+	mkt := newSTPOrder("b1", "buyer", SideBuy, 0, 2, STPNone)
+	mkt.IsMarket = true
+	if _, amount := holdFor(mb.spec, mb.book, mkt); amount != 210 {
+		t.Fatalf("expected sweep cost 210, got %d", amount)
+	}
+	if _, err := placeWithFunds(t, f, mb, mkt); err != nil {
+		t.Fatalf("market buy: %v", err)
+	}
+	expectBalance(t, f, "buyer", "USD", 790, 0)
+	expectBalance(t, f, "buyer", "BTC", 2, 0)
+	expectBalance(t, f, "seller", "BTC", 0, 1)
+}
+
+func TestMarketBuyHoldsOnlyWhatTheBandReaches(t *testing.T) {
+	f := newFunds()
+	mb := newTestRegistry().register(Market{Symbol: MarketBTCUSD, BaseAsset: "BTC", QuoteAsset: "USD", TickSize: 1, LotSize: 1, PriceBandBps: 500})
+	f.credit("seller", "BTC", 3)
+	f.credit("buyer", "USD", 250)
+
+	placeWithFunds(t, f, mb, newSTPOrder("s1", "seller", SideSell, 100, 1, STPNone))
+	placeWithFunds(t, f, mb, newSTPOrder("s2", "seller", SideSell, 105, 1, STPNone))
+	placeWithFunds(t, f, mb, newSTPOrder("s3", "seller", SideSell, 1_000, 1, STPNone))
+
+	// the band of 5% stops at 105, so the ask at 1000 is not paid for
+	mkt := newSTPOrder("b1", "buyer", SideBuy, 0, 3, STPNone)
+	mkt.IsMarket = true
+	res, err := placeWithFunds(t, f, mb, mkt)
+	if err != nil {
+		t.Fatalf("market buy: %v", err)
+	}
+	if len(res.Trades) != 2 || !res.Cancelled {
+		t.Fatalf("expected two fills and the rest cancelled, got %+v", res)
+	}
+	expectBalance(t, f, "buyer", "USD", 45, 0)
+	expectBalance(t, f, "buyer", "BTC", 2, 0)
+}
+
+func TestOverflowingNotionalHoldsNothing(t *testing.T) {
+	f := newFunds()
+	mb := newTestRegistry(MarketBTCUSD).byMarket[MarketBTCUSD]
+	f.credit("seller", "BTC", 2)
+	f.credit("buyer", "USD", math.MaxInt64-1)
+
+	bid := newSTPOrder("b1", "buyer", SideBuy, math.MaxInt64/2+1, 2, STPNone)
+	if err := mb.spec.Validate(bid); !errors.Is(err, ErrNotionalOverflow) {
+		t.Fatalf("expected ErrNotionalOverflow, got %v", err)
+	}
+	huge := newSTPOrder("b2", "buyer", SideBuy, math.MaxInt64-1, math.MaxInt64-1, STPNone)
+	if err := mb.spec.Validate(huge); !errors.Is(err, ErrNotionalOverflow) {
+		t.Fatalf("expected ErrNotionalOverflow, got %v", err)
+	}
+
+	// each ask's notional fits; sweeping both does not
+	for _, id := range []string{"s1", "s2"} {
+		ask := newSTPOrder(id, "seller", SideSell, math.MaxInt64, 1, STPNone)
+		if err := mb.spec.Validate(ask); err != nil {
+			t.Fatalf("expected an ask worth MaxInt64 to be valid, got %v", err)
+		}
+		if _, err := placeWithFunds(t, f, mb, ask); err != nil {
+			t.Fatalf("place %s: %v", id, err)
+		}
+	}
+	mkt := newSTPOrder("b3", "buyer", SideBuy, 0, 2, STPNone)
+	mkt.IsMarket = true
+	if _, amount := holdFor(mb.spec, mb.book, mkt); amount != math.MaxInt64 {
+		t.Fatalf("expected the sweep cost capped at MaxInt64, got %d", amount)
+	}
+	if _, err := placeWithFunds(t, f, mb, mkt); !errors.Is(err, ErrInsufficientFunds) {
+		t.Fatalf("expected ErrInsufficientFunds, got %v", err)
+	}
+	expectBalance(t, f, "buyer", "USD", math.MaxInt64-1, 0)
+	expectBalance(t, f, "seller", "BTC", 0, 2)
+}
+
+func TestQuoteMarketBuyHoldsBudget(t *testing.T) {
+	f := newFunds()
+	mb := newTestRegistry(MarketBTCUSD).byMarket[MarketBTCUSD]
+	f.credit("seller", "BTC", 5)
+	f.credit("buyer", "USD", 1_000)
+
+	placeWithFunds(t, f, mb, newSTPOrder("s1", "seller", SideSell, 100, 5, STPNone))
+
+	mkt := newSTPOrder("b1", "buyer", SideBuy, 0, 0, STPNone)
+	mkt.IsMarket = true
+	mkt.QuoteQuantity = 250
+	if _, amount := holdFor(mb.spec, mb.book, mkt); amount != 250 {
+		t.Fatalf("expected the budget of 250 held, got %d", amount)
+	}
+	if _, err := placeWithFunds(t, f, mb, mkt); err != nil {
+		t.Fatalf("quote market buy: %v", err)
+	}
+	expectBalance(t, f, "buyer", "USD", 800, 0)
+	expectBalance(t, f, "buyer", "BTC", 2, 0)
+}
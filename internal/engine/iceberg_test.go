@@ -0,0 +1,105 @@
+package engine
+
+import "testing"
+
+func newTestIceberg(id string, side Side, price, qty, display int64) *Order {
+	o := newTestOrder(id, side, price, qty)
+	o.DisplayQuantity = display
+	return o
+}
+
+func TestIcebergShowsOnlyDisplayQuantity(t *testing.T) {
+	ob := NewOrderBook()
+	ob.AddOrder(newTestIceberg("ice", SideSell, 100, 10, 3))
+	ob.AddOrder(newTestOrder("plain", SideSell, 100, 2))
+
+	_, asks := ob.Depth(5)
+	if len(asks) != 1 || asks[0].Quantity != 5 {
+		t.Fatalf("expected 5 displayed at 100, got %+v", asks)
+	}
+}
+
+func TestIcebergReplenishesAtBackOfQueue(t *testing.T) {
+	ob := NewOrderBook()
+	m := NewMatcher(ob)
+	ob.AddOrder(newTestIceberg("ice", SideSell, 100, 10, 3))
+	ob.AddOrder(newTestOrder("plain", SideSell, 100, 2))
+
+	res, err := m.Submit(newTestOrder("t1", SideBuy, 100, 4))
+	if err != nil {
+		t.Fatalf("submit: %v", err)
+	}
+	// the visible slice of 3 fills first, then the plain order is ahead of
+	// the new slice
+	if len(res.Trades) != 2 || res.Trades[0].MakerOrderID != "ice" || res.Trades[0].Quantity != 3 ||
+		res.Trades[1].MakerOrderID != "plain" || res.Trades[1].Quantity != 1 {
+		t.Fatalf("unexpected trades %+v", res.Trades)
+	}
+	if len(res.Replenished) != 1 || res.Replenished[0] != "ice" {
+		t.Fatalf("expected ice to be replenished, got %v", res.Replenished)
+	}
+
+	ice, _ := ob.order("ice")
+	if ice.Remaining != 7 || ice.visible() != 3 || ice.hidden() != 4 {
+		t.Fatalf("expected 7 remaining with 3 shown, got remaining %d shown %d", ice.Remaining, ice.visible())
+	}
+	front := ob.bestAsk().orders.Front().Value.(*Order)
+	if front.ID != "plain" {
+		t.Fatalf("expected plain at the front, got %s", front.ID)
+	}
+}
+
+func TestIcebergSweptThroughHiddenQuantity(t *testing.T) {
+	ob := NewOrderBook()
+	m := NewMatcher(ob)
+	ob.AddOrder(newTestIceberg("ice", SideSell, 100, 10, 3))
+
+	res, err := m.Submit(newTestOrder("t1", SideBuy, 100, 10))
+	if err != nil {
+		t.Fatalf("submit: %v", err)
+	}
+	var total int64
+	for _, tr := range res.Trades {
+		if tr.Quantity > 3 {
+			t.Fatalf("trade larger than the display quantity: %+v", tr)
+		}
+		total += tr.Quantity
+	}
+	if total != 10 || !res.OrderFilled {
+		t.Fatalf("expected the iceberg to fill completely, traded %d", total)
+	}
+	if _, ok := ob.order("ice"); ok {
+		t.Fatalf("expected filled iceberg to leave the book")
+	}
+}
+
+func TestIcebergShrinkTakesHiddenFirst(t *testing.T) {
+	o := newTestIceberg("ice", SideBuy, 100, 10, 3)
+	o.show()
+
+	o.shrink(5)
+	if o.visible() != 3 || o.hidden() != 2 {
+		t.Fatalf("expected 3 shown and 2 hidden, got %d and %d", o.visible(), o.hidden())
+	}
+	o.shrink(4)
+	if o.visible() != 1 || o.hidden() != 0 {
+		t.Fatalf("expected 1 shown and nothing hidden, got %d and %d", o.visible(), o.hidden())
+	}
+}
+
+func TestValidateIceberg(t *testing.T) {
+	m := testMarket(MarketBTCUSD)
+	m.LotSize = 2
+
+	if err := m.Validate(newTestIceberg("ok", SideBuy, 100, 10, 4)); err != nil {
+		t.Fatalf("expected valid iceberg, got %v", err)
+	}
+	if err := m.Validate(newTestIceberg("lot", SideBuy, 100, 10, 3)); err == nil {
+		t.Fatalf("expected display quantity off the lot size to be rejected")
+	}
+	ioc := newTestIceberg("ioc", SideBuy, 100, 10, 4)
+	ioc.TimeInForce = TIFIOC
+	if err := m.Validate(ioc); err != ErrIcebergNotResting {
+		t.Fatalf("expected ErrIcebergNotResting, got %v", err)
+	}
+}
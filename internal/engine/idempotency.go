@@ -0,0 +1,217 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	dbsqlc "github.com/hakimelghazi/exchange-core/db/sqlc"
+	"github.com/jackc/pgx/v5"
+)
+
+var (
+	ErrIdempotencyConflict = errors.New("idempotency key was already used for a different request")
+	ErrDuplicateOrderID    = errors.New("order id already exists")
+)
+
+// IdempotencyKey is a client-chosen key for one placement request together
+// with a hash of that request. Keys are scoped to the order's user.
+type IdempotencyKey struct {
+	Key         string
+	RequestHash string
+}
+
+// PlaceIdempotent places o at most once per key. Replaying the same request
+// returns the original result with replayed set; reusing the key for a
+// different request fails with ErrIdempotencyConflict. An empty key behaves
+// like Place.
+func (e *Engine) PlaceIdempotent(ctx context.Context, o *Order, key IdempotencyKey) (*MatchResult, bool, error) {
+	if o == nil {
+		return nil, false, errors.New("nil order")
+	}
+	stored, err := e.lookupPlacement(ctx, o, key)
+	if err != nil {
+		return nil, false, err
+	}
+	resp := make(chan any, 1)
+	cmd := Command{Type: CmdPlace, Order: o, Idempotency: key, Stored: stored, Resp: resp}
+
+	if err := e.enqueueCommand(ctx, cmd); err != nil {
+		return nil, false, err
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil, false, ctx.Err()
+	case raw := <-resp:
+		out := raw.(placeResult)
+		return out.Result, out.Replayed, out.Err
+	}
+}
+
+// placementRetention is how long placements are remembered in memory.
+// Older ones are answered from the store, where they are durable by then.
+const placementRetention = 24 * time.Hour
+
+// storedPlacement is what the store held for a placement when it was
+// requested: whether its order id was taken, and the record of its key. It
+// is looked up before the command is queued, so the loop never waits on the
+// store, and journaled, so replay decides as the live engine did.
+type storedPlacement struct {
+	OrderTaken  bool            `json:"order_taken,omitempty"`
+	RequestHash string          `json:"request_hash,omitempty"` // of the stored key, empty without one
+	Result      json.RawMessage `json:"result,omitempty"`
+}
+
+// lookupPlacement looks up the order id and key of o in the store, one row
+// each. Ids that are not uuids are left for handlePlace to refuse.
+func (e *Engine) lookupPlacement(ctx context.Context, o *Order, key IdempotencyKey) (*storedPlacement, error) {
+	s := &storedPlacement{}
+	if orderID, err := uuidFromString(o.ID); err == nil {
+		_, err := e.queries.GetOrder(ctx, orderID)
+		switch {
+		case err == nil:
+			s.OrderTaken = true
+		case !errors.Is(err, pgx.ErrNoRows):
+			return nil, fmt.Errorf("look up order %s: %w", o.ID, err)
+		}
+	}
+	if userID, err := uuidFromString(o.UserID); err == nil && key.Key != "" {
+		row, err := e.queries.GetIdempotencyKey(ctx, dbsqlc.GetIdempotencyKeyParams{UserID: userID, Key: key.Key})
+		switch {
+		case err == nil:
+			s.RequestHash, s.Result = row.RequestHash, row.Result
+		case !errors.Is(err, pgx.ErrNoRows):
+			return nil, fmt.Errorf("look up idempotency key: %w", err)
+		}
+	}
+	return s, nil
+}
+
+// placement is what a later request needs to know about a placed order
+// to be checked against it.
+type placement struct {
+	requestHash string
+	result      []byte    // the stored result, for keyed placements
+	at          time.Time // when the order was placed
+}
+
+// placements remembers the order ids and idempotency keys taken in the
+// last placementRetention, including placements whose writes are not
+// durable yet, which the store cannot know. An order is added before its
+// writes are durable, and removed if they are rolled back. It is kept in
+// snapshots and rebuilt by replay.
+type placements struct {
+	orders map[string]time.Time // placement time by order id
+	keys   map[string]placement // by historyKey
+	byAge  []placed             // oldest first, some removed since
+}
+
+// placed is one entry of placements, in the order they were added.
+type placed struct {
+	at      time.Time
+	orderID string
+	key     string // historyKey, empty for an unkeyed placement
+}
+
+func newPlacements() *placements {
+	return &placements{orders: make(map[string]time.Time), keys: make(map[string]placement)}
+}
+
+// prior checks, before anything is matched, whether o was already placed,
+// in memory first and then in what the store held: it returns the stored
+// result for a replayed key, and an error for a conflicting key or an order
+// id that is already taken. stored may be nil.
+func (p *placements) prior(o *Order, key IdempotencyKey, stored *storedPlacement) (*MatchResult, error) {
+	if stored == nil {
+		stored = &storedPlacement{}
+	}
+	if k := historyKey(o.UserID, key); k != "" {
+		prev, ok := p.keys[k]
+		if !ok && stored.RequestHash != "" {
+			prev, ok = placement{requestHash: stored.RequestHash, result: stored.Result}, true
+		}
+		if ok {
+			if prev.requestHash != key.RequestHash {
+				return nil, ErrIdempotencyConflict
+			}
+			var res MatchResult
+			if err := json.Unmarshal(prev.result, &res); err != nil {
+				return nil, err
+			}
+			return &res, nil
+		}
+	}
+	if _, ok := p.orders[o.ID]; ok || stored.OrderTaken {
+		return nil, ErrDuplicateOrderID
+	}
+	return nil, nil
+}
+
+// add remembers a placement and forgets those older than the retention at
+// the time it was placed.
+func (p *placements) add(o *Order, key IdempotencyKey, pl placement) {
+	p.prune(pl.at)
+	p.put(o.ID, historyKey(o.UserID, key), pl)
+}
+
+func (p *placements) put(orderID, key string, pl placement) {
+	p.orders[orderID] = pl.at
+	if key != "" {
+		p.keys[key] = pl
+	}
+	p.byAge = append(p.byAge, placed{at: pl.at, orderID: orderID, key: key})
+}
+
+func (p *placements) remove(o *Order, key IdempotencyKey) {
+	delete(p.orders, o.ID)
+	delete(p.keys, historyKey(o.UserID, key))
+}
+
+// current reports whether en is still remembered, rather than removed or
+// replaced by a later placement with the same id.
+func (p *placements) current(en placed) bool {
+	at, ok := p.orders[en.orderID]
+	return ok && at.Equal(en.at)
+}
+
+func (p *placements) prune(now time.Time) {
+	for len(p.byAge) > 0 && now.Sub(p.byAge[0].at) > placementRetention {
+		en := p.byAge[0]
+		p.byAge = p.byAge[1:]
+		if !p.current(en) {
+			continue
+		}
+		delete(p.orders, en.orderID)
+		if pl, ok := p.keys[en.key]; ok && pl.at.Equal(en.at) {
+			delete(p.keys, en.key)
+		}
+	}
+}
+
+// placementWrite returns the step that stores the result of a keyed
+// placement, or nil for an unkeyed one.
+func placementWrite(o *Order, key IdempotencyKey, result []byte) writeStep {
+	if key.Key == "" {
+		return nil
+	}
+	return func(ctx context.Context, b *dbBatch) error {
+		userID, err := uuidFromString(o.UserID)
+		if err != nil {
+			return err
+		}
+		orderID, err := uuidFromString(o.ID)
+		if err != nil {
+			return err
+		}
+		return b.q.InsertIdempotencyKey(ctx, dbsqlc.InsertIdempotencyKeyParams{
+			UserID:      userID,
+			Key:         key.Key,
+			RequestHash: key.RequestHash,
+			OrderID:     orderID,
+			Result:      result,
+		})
+	}
+}
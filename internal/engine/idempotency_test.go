@@ -0,0 +1,208 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	dbsqlc "github.com/hakimelghazi/exchange-core/db/sqlc"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// Replays are served from the JSON stored with the idempotency key, so a
+// stored result must decode back to what the first request returned.
+func TestStoredMatchResultRoundTrip(t *testing.T) {
+	mb := newTestRegistry(MarketBTCUSD).byMarket[MarketBTCUSD]
+	if _, err := mb.matcher.Submit(newTestOrder("s1", SideSell, 100, 4)); err != nil {
+		t.Fatalf("submit ask: %v", err)
+	}
+	res, err := mb.matcher.Submit(newTestOrder("b1", SideBuy, 101, 10))
+	if err != nil {
+		t.Fatalf("submit bid: %v", err)
+	}
+	res.Trades[0].TakerFee, res.Trades[0].TakerFeeAsset = 1, "BTC"
+
+	raw, err := json.Marshal(res)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	var got MatchResult
+	if err := json.Unmarshal(raw, &got); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if !reflect.DeepEqual(got.Trades, res.Trades) {
+		t.Fatalf("trades changed: %+v vs %+v", got.Trades, res.Trades)
+	}
+	if got.Remainder == nil || got.Remainder.ID != "b1" || got.Remainder.Remaining != 6 {
+		t.Fatalf("unexpected remainder %+v", got.Remainder)
+	}
+}
+
+func TestPlacementsRefuseDuplicates(t *testing.T) {
+	p := newPlacements()
+	o := newSTPOrder("o1", "u1", SideBuy, 100, 1, STPNone)
+	key := IdempotencyKey{Key: "k1", RequestHash: "h1"}
+	raw, _ := json.Marshal(&MatchResult{Seq: 7})
+	p.add(o, key, placement{requestHash: key.RequestHash, result: raw, at: time.Now()})
+
+	res, err := p.prior(newSTPOrder("o2", "u1", SideBuy, 100, 1, STPNone), key, nil)
+	if err != nil || res == nil || res.Seq != 7 {
+		t.Fatalf("expected the stored result for a replayed key, got %+v, %v", res, err)
+	}
+	if _, err := p.prior(o, IdempotencyKey{Key: "k1", RequestHash: "h2"}, nil); err != ErrIdempotencyConflict {
+		t.Fatalf("expected a conflict for a reused key, got %v", err)
+	}
+	if _, err := p.prior(o, IdempotencyKey{}, nil); err != ErrDuplicateOrderID {
+		t.Fatalf("expected a duplicate order id, got %v", err)
+	}
+	// keys are scoped to the user
+	if res, err := p.prior(newSTPOrder("o3", "u2", SideBuy, 100, 1, STPNone), key, nil); res != nil || err != nil {
+		t.Fatalf("expected another user's key to be free, got %+v, %v", res, err)
+	}
+
+	// what the store held answers for placements no longer in memory
+	old := IdempotencyKey{Key: "k0", RequestHash: "h0"}
+	stored := &storedPlacement{RequestHash: "h0", Result: raw}
+	if res, err := p.prior(newSTPOrder("o4", "u1", SideBuy, 100, 1, STPNone), old, stored); err != nil || res == nil || res.Seq != 7 {
+		t.Fatalf("expected the stored result of a stored key, got %+v, %v", res, err)
+	}
+	if _, err := p.prior(newSTPOrder("o4", "u1", SideBuy, 100, 1, STPNone), IdempotencyKey{Key: "k0", RequestHash: "h2"}, stored); err != ErrIdempotencyConflict {
+		t.Fatalf("expected a conflict for a reused stored key, got %v", err)
+	}
+	if _, err := p.prior(newSTPOrder("o5", "u1", SideBuy, 100, 1, STPNone), IdempotencyKey{}, &storedPlacement{OrderTaken: true}); err != ErrDuplicateOrderID {
+		t.Fatalf("expected a stored order id to be a duplicate, got %v", err)
+	}
+}
+
+func TestPlacementsForgetAfterRetention(t *testing.T) {
+	p := newPlacements()
+	now := time.Now()
+	key := IdempotencyKey{Key: "k1", RequestHash: "h1"}
+	p.add(newSTPOrder("old", "u1", SideBuy, 100, 1, STPNone), key, placement{requestHash: "h1", at: now.Add(-placementRetention - time.Second)})
+	p.add(newSTPOrder("rolled-back", "u1", SideBuy, 100, 1, STPNone), IdempotencyKey{}, placement{at: now.Add(-placementRetention - time.Second)})
+	p.remove(newSTPOrder("rolled-back", "u1", SideBuy, 100, 1, STPNone), IdempotencyKey{})
+	p.add(newSTPOrder("new", "u1", SideBuy, 100, 1, STPNone), IdempotencyKey{}, placement{at: now})
+
+	if _, ok := p.orders["old"]; ok || len(p.keys) != 0 {
+		t.Fatalf("expected the old placement forgotten, got %v %v", p.orders, p.keys)
+	}
+	if _, ok := p.orders["new"]; !ok || len(p.byAge) != 1 {
+		t.Fatalf("expected only the new placement remembered, got %v %v", p.orders, p.byAge)
+	}
+}
+
+// rowLookups counts the single-row lookups of placements.
+type rowLookups struct {
+	Queries
+	orders, keys *atomic.Int32
+}
+
+func (q rowLookups) GetOrder(ctx context.Context, id pgtype.UUID) (dbsqlc.Order, error) {
+	q.orders.Add(1)
+	return q.Queries.GetOrder(ctx, id)
+}
+
+func (q rowLookups) GetIdempotencyKey(ctx context.Context, arg dbsqlc.GetIdempotencyKeyParams) (dbsqlc.IdempotencyKey, error) {
+	q.keys.Add(1)
+	return q.Queries.GetIdempotencyKey(ctx, arg)
+}
+
+func TestDuplicateChecksAfterRestartLookUpTheStore(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemStore()
+	e, stop := startMemEngine(t, store)
+	user := uuid.NewString()
+	fund(t, e, user, "BTC", 10)
+	o := newSTPOrder(uuid.NewString(), user, SideSell, 100, 2, STPNone)
+	key := IdempotencyKey{Key: "k1", RequestHash: "h1"}
+	first, _, err := e.PlaceIdempotent(ctx, o, key)
+	if err != nil {
+		t.Fatalf("place: %v", err)
+	}
+	stop()
+
+	// nothing is preloaded: each placement looks up its own rows
+	e, err = NewEngine(16, store)
+	if err != nil {
+		t.Fatalf("new engine: %v", err)
+	}
+	var orders, keys atomic.Int32
+	e.queries = rowLookups{Queries: e.queries, orders: &orders, keys: &keys}
+	if err := e.Bootstrap(ctx, nil); err != nil {
+		t.Fatalf("bootstrap: %v", err)
+	}
+	if len(e.placements.orders) != 0 || orders.Load() != 0 || keys.Load() != 0 {
+		t.Fatalf("expected bootstrap to load no placements")
+	}
+	runCtx, cancel := context.WithCancel(ctx)
+	go e.Run(runCtx)
+	t.Cleanup(func() {
+		cancel()
+		<-e.done
+	})
+
+	res, replayed, err := e.PlaceIdempotent(ctx, newSTPOrder(uuid.NewString(), user, SideSell, 100, 2, STPNone), key)
+	if err != nil || !replayed || res.Seq != first.Seq {
+		t.Fatalf("expected the first result replayed, got %+v, %v, %v", res, replayed, err)
+	}
+	if _, err := e.Place(ctx, newSTPOrder(o.ID, user, SideSell, 101, 1, STPNone)); !errors.Is(err, ErrDuplicateOrderID) {
+		t.Fatalf("expected ErrDuplicateOrderID, got %v", err)
+	}
+	if orders.Load() != 2 || keys.Load() != 1 {
+		t.Fatalf("expected one order lookup per placement and one key lookup, got %d and %d", orders.Load(), keys.Load())
+	}
+}
+
+func TestReplayRefusesWhatTheStoreHeld(t *testing.T) {
+	maker := idOf("maker")
+	taken := place(newSTPOrder(idOf("a2"), maker, SideSell, 101, 1, STPNone))
+	taken.Stored = &storedPlacement{OrderTaken: true}
+	cmds := append(deposit("d1", maker, "BTC", 10),
+		place(newSTPOrder(idOf("a1"), maker, SideSell, 100, 1, STPNone)),
+		taken,
+	)
+	path := filepath.Join(t.TempDir(), "journal")
+	writeJournal(t, path, cmds...)
+
+	e := newReplayEngine(MarketBTCUSD)
+	if _, err := e.replay(context.Background(), path, 0, 0); err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+	mb := mustLookup(t, e.books, MarketBTCUSD)
+	if _, ok := mb.book.order(idOf("a2")); ok {
+		t.Fatalf("expected the order the store already held to be refused")
+	}
+	if _, ok := e.placements.orders[idOf("a1")]; !ok {
+		t.Fatalf("expected replay to remember a1")
+	}
+}
+
+// A retry is answered from the key before the order is validated again, so
+// it gets the first outcome even once the order would be rejected.
+func TestRetryOfExpiredOrderReplays(t *testing.T) {
+	ctx := context.Background()
+	e, _ := startMemEngine(t, NewMemStore())
+	user := uuid.NewString()
+	fund(t, e, user, "BTC", 10)
+	o := newSTPOrder(uuid.NewString(), user, SideSell, 100, 2, STPNone)
+	o.ExpiresAt = time.Now().Add(50 * time.Millisecond)
+	key := IdempotencyKey{Key: "k1", RequestHash: "h1"}
+	first, _, err := e.PlaceIdempotent(ctx, o, key)
+	if err != nil {
+		t.Fatalf("place: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	retry := newSTPOrder(o.ID, user, SideSell, 100, 2, STPNone)
+	retry.ExpiresAt = o.ExpiresAt
+	res, replayed, err := e.PlaceIdempotent(ctx, retry, key)
+	if err != nil || !replayed || res.Seq != first.Seq {
+		t.Fatalf("expected the first result replayed, got %+v, %v, %v", res, replayed, err)
+	}
+}
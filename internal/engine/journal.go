@@ -0,0 +1,191 @@
+package engine
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+var ErrJournalCorrupt = errors.New("journal is corrupt")
+
+// journalEntry is one command as the engine accepted it, before it ran.
+type journalEntry struct {
+	Seq         uint64           `json:"seq"`
+	At          time.Time        `json:"at"`
+	Type        CommandType      `json:"type"`
+	Order       *Order           `json:"order,omitempty"`
+	Idempotency *IdempotencyKey  `json:"idempotency,omitempty"`
+	Stored      *storedPlacement `json:"stored,omitempty"`
+	Transfer    *Transfer        `json:"transfer,omitempty"`
+	Amend       *Amend           `json:"amend,omitempty"`
+	MassCancel  *MassCancel      `json:"mass_cancel,omitempty"`
+	ID          string           `json:"id,omitempty"`
+	UserID      string           `json:"user_id,omitempty"`
+	FeeTier     string           `json:"fee_tier,omitempty"`
+	FeeRates    *FeeRates        `json:"fee_rates,omitempty"` // what FeeTier resolved to
+	Timeout     time.Duration    `json:"timeout,omitempty"`
+	ExpiresAt   *time.Time       `json:"expires_at,omitempty"` // when a heartbeat's switch trips
+	From        uint64           `json:"from,omitempty"`       // first entry rolled back, for CmdRollback
+	Repair      *repairPlan      `json:"repair,omitempty"`     // for CmdRepair
+}
+
+// Journal is an append-only file of every command the engine runs, one JSON
+// entry per line with consecutive sequence numbers. Each entry is synced to
+// disk before its command executes, so replaying the journal from the start
+// rebuilds the engine's in-memory state exactly, including time priority.
+type Journal struct {
+	path string
+	f    *os.File
+	w    *bufio.Writer
+	seq  uint64 // of the last entry written
+}
+
+// OpenJournal opens or creates the journal at path and positions it after
+// the last complete entry. A torn entry left at the end by a crash is cut
+// off; damage anywhere else fails with ErrJournalCorrupt.
+func OpenJournal(path string) (*Journal, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	seq, end, err := scanJournal(f, nil)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("open journal %s: %w", path, err)
+	}
+	if err := f.Truncate(end); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(end, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &Journal{path: path, f: f, w: bufio.NewWriter(f), seq: seq}, nil
+}
+
+// Seq returns the sequence number of the last entry written, 0 if none.
+func (j *Journal) Seq() uint64 {
+	return j.seq
+}
+
+func (j *Journal) Close() error {
+	if err := j.w.Flush(); err != nil {
+		j.f.Close()
+		return err
+	}
+	return j.f.Close()
+}
+
+// append writes cmd as the next entry and syncs it.
+func (j *Journal) append(at time.Time, cmd Command) error {
+	en := journalEntry{
+		At:         at,
+		Type:       cmd.Type,
+		Order:      cmd.Order,
+		Stored:     cmd.Stored,
+		Transfer:   cmd.Transfer,
+		Amend:      cmd.Amend,
+		MassCancel: cmd.MassCancel,
+		ID:         cmd.ID,
+		UserID:     cmd.UserID,
+		FeeTier:    cmd.FeeTier,
+		FeeRates:   cmd.FeeRates,
+		Timeout:    cmd.Timeout,
+	}
+	if cmd.Idempotency.Key != "" {
+		en.Idempotency = &cmd.Idempotency
+	}
+	if !cmd.ExpiresAt.IsZero() {
+		en.ExpiresAt = &cmd.ExpiresAt
+	}
+	return j.write(en)
+}
+
+// appendRollback records that the commands of entries from on, up to this
+// entry, were rolled back because their writes failed; replay skips them.
+func (j *Journal) appendRollback(at time.Time, from uint64) error {
+	return j.write(journalEntry{At: at, Type: CmdRollback, From: from})
+}
+
+// appendRepair records the changes a reconcile repair makes to the books.
+func (j *Journal) appendRepair(at time.Time, plan *repairPlan) error {
+	return j.write(journalEntry{At: at, Type: CmdRepair, Repair: plan})
+}
+
+// write numbers en as the next entry, writes it and syncs it.
+func (j *Journal) write(en journalEntry) error {
+	en.Seq = j.seq + 1
+	line, err := json.Marshal(en)
+	if err != nil {
+		return err
+	}
+	if _, err := j.w.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if err := j.w.Flush(); err != nil {
+		return err
+	}
+	if err := j.f.Sync(); err != nil {
+		return err
+	}
+	j.seq = en.Seq
+	return nil
+}
+
+// readJournal calls fn for every complete entry of the journal at path, in
+// order.
+func readJournal(path string, fn func(journalEntry) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, _, err = scanJournal(f, fn)
+	return err
+}
+
+// scanJournal reads entries from the start of f, checking their sequence
+// numbers, and returns the last sequence number and the offset just past the
+// last complete entry.
+func scanJournal(f *os.File, fn func(journalEntry) error) (uint64, int64, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return 0, 0, err
+	}
+	r := bufio.NewReader(f)
+	var seq uint64
+	var end int64
+	for {
+		line, err := r.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			// a line without its newline is a torn write; it never ran
+			return seq, end, nil
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+
+		var en journalEntry
+		if err := json.Unmarshal(bytes.TrimSpace(line), &en); err != nil {
+			if _, peekErr := r.Peek(1); errors.Is(peekErr, io.EOF) {
+				return seq, end, nil
+			}
+			return 0, 0, fmt.Errorf("%w: entry after %d: %v", ErrJournalCorrupt, seq, err)
+		}
+		if en.Seq != seq+1 {
+			return 0, 0, fmt.Errorf("%w: entry %d follows %d", ErrJournalCorrupt, en.Seq, seq)
+		}
+		if fn != nil {
+			if err := fn(en); err != nil {
+				return 0, 0, err
+			}
+		}
+		seq = en.Seq
+		end += int64(len(line))
+	}
+}
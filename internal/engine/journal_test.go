@@ -0,0 +1,232 @@
+package engine
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// newReplayEngine returns an engine with in-memory state only, enough to
+// replay a journal.
+func newReplayEngine(symbols ...string) *Engine {
+	return &Engine{
+		books:      newTestRegistry(symbols...),
+		funds:      newFunds(),
+		fees:       newFeeSchedule(),
+		expiries:   newExpiryQueue(),
+		deadMan:    newDeadManSwitches(),
+		placements: newPlacements(),
+	}
+}
+
+func writeJournal(t *testing.T, path string, cmds ...Command) {
+	t.Helper()
+	j, err := OpenJournal(path)
+	if err != nil {
+		t.Fatalf("open journal: %v", err)
+	}
+	for _, cmd := range cmds {
+		if err := j.append(time.Now(), cmd); err != nil {
+			t.Fatalf("append: %v", err)
+		}
+	}
+	if err := j.Close(); err != nil {
+		t.Fatalf("close journal: %v", err)
+	}
+}
+
+func deposit(id, user, asset string, amount int64) []Command {
+	return []Command{
+		{Type: CmdRequestTransfer, Transfer: &Transfer{ID: id, UserID: user, Kind: TransferDeposit, Asset: asset, Amount: amount, ExternalRef: id}},
+		{Type: CmdConfirmTransfer, ID: id},
+	}
+}
+
+// idOf returns the uuid standing for name in a journal: orders whose ids
+// are not uuids are refused on replay as they are live.
+func idOf(name string) string {
+	return uuid.NewSHA1(uuid.NameSpaceOID, []byte(name)).String()
+}
+
+func place(o *Order) Command {
+	return Command{Type: CmdPlace, Order: o}
+}
+
+func TestJournalDropsTornEntry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal")
+	writeJournal(t, path, deposit("d1", "maker", "BTC", 10)...)
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"seq":3,"type":`)
+	f.Close()
+
+	j, err := OpenJournal(path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	if j.Seq() != 2 {
+		t.Fatalf("expected seq 2 after the torn entry, got %d", j.Seq())
+	}
+	if err := j.append(time.Now(), Command{Type: CmdCancel, ID: "o1"}); err != nil {
+		t.Fatalf("append: %v", err)
+	}
+	j.Close()
+
+	var seqs []uint64
+	if err := readJournal(path, func(en journalEntry) error {
+		seqs = append(seqs, en.Seq)
+		return nil
+	}); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if len(seqs) != 3 || seqs[2] != 3 {
+		t.Fatalf("expected entries 1..3, got %v", seqs)
+	}
+}
+
+func TestReplayRebuildsTimePriority(t *testing.T) {
+	maker, taker := idOf("maker"), idOf("taker")
+	cmds := deposit("d1", maker, "BTC", 10)
+	cmds = append(cmds, deposit("d2", taker, "USD", 1000)...)
+	cmds = append(cmds,
+		place(newSTPOrder(idOf("a1"), maker, SideSell, 100, 2, STPNone)),
+		place(newSTPOrder(idOf("a2"), maker, SideSell, 100, 2, STPNone)),
+		place(newSTPOrder(idOf("a3"), maker, SideSell, 100, 2, STPNone)),
+		Command{Type: CmdCancel, ID: idOf("a2")},
+		place(newSTPOrder(idOf("t1"), taker, SideBuy, 100, 1, STPNone)),
+		// unfunded, refused on replay as it was live
+		place(newSTPOrder(idOf("t2"), taker, SideBuy, 100, 50, STPNone)),
+	)
+	path := filepath.Join(t.TempDir(), "journal")
+	writeJournal(t, path, cmds...)
+
+	ctx := context.Background()
+	first, second := newReplayEngine(MarketBTCUSD), newReplayEngine(MarketBTCUSD)
+	for _, e := range []*Engine{first, second} {
+		if seq, err := e.replay(ctx, path, 0, 0); err != nil || seq != uint64(len(cmds)) {
+			t.Fatalf("replay: seq %d, %v", seq, err)
+		}
+	}
+	if first.books.hash() != second.books.hash() {
+		t.Fatalf("expected replays to build identical books")
+	}
+
+	mb := mustLookup(t, first.books, MarketBTCUSD)
+	if got := frontAsk(mb); got != idOf("a1") {
+		t.Fatalf("expected a1 to keep its place at the front, got %s", got)
+	}
+	a1, _ := mb.book.order(idOf("a1"))
+	if a1.Remaining != 1 {
+		t.Fatalf("expected a1 partly filled, got remaining %d", a1.Remaining)
+	}
+	if _, ok := mb.book.order(idOf("t2")); ok {
+		t.Fatalf("expected unfunded t2 to be refused")
+	}
+	expectBalance(t, first.funds, taker, "BTC", 1, 0)
+
+	// the same orders in another arrival order are a different book
+	swapped := append([]Command(nil), cmds[:4]...)
+	swapped = append(swapped,
+		place(newSTPOrder(idOf("a3"), maker, SideSell, 100, 2, STPNone)),
+		place(newSTPOrder(idOf("a1"), maker, SideSell, 100, 2, STPNone)),
+	)
+	other := filepath.Join(t.TempDir(), "journal")
+	writeJournal(t, other, swapped...)
+	a, b := newReplayEngine(MarketBTCUSD), newReplayEngine(MarketBTCUSD)
+	if seq, err := a.replay(ctx, path, 0, 6); err != nil || seq != 6 {
+		t.Fatalf("partial replay: seq %d, %v", seq, err)
+	}
+	if _, err := b.replay(ctx, other, 0, 6); err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+	if a.books.hash() == b.books.hash() {
+		t.Fatalf("expected different arrival orders to hash differently")
+	}
+}
+
+func TestReplaySkipsRolledBackCommands(t *testing.T) {
+	maker, taker := idOf("maker"), idOf("taker")
+	cmds := deposit("d1", maker, "BTC", 10)
+	cmds = append(cmds, deposit("d2", taker, "USD", 1000)...)
+	cmds = append(cmds, place(newSTPOrder(idOf("a1"), maker, SideSell, 100, 2, STPNone)))
+	rolledBack := []Command{
+		place(newSTPOrder(idOf("t1"), taker, SideBuy, 100, 1, STPNone)),
+		place(newSTPOrder(idOf("a2"), maker, SideSell, 99, 1, STPNone)),
+	}
+	after := place(newSTPOrder(idOf("t2"), taker, SideBuy, 100, 2, STPNone))
+
+	path := filepath.Join(t.TempDir(), "journal")
+	j, err := OpenJournal(path)
+	if err != nil {
+		t.Fatalf("open journal: %v", err)
+	}
+	for _, cmd := range append(cmds[:len(cmds):len(cmds)], rolledBack...) {
+		if err := j.append(time.Now(), cmd); err != nil {
+			t.Fatalf("append: %v", err)
+		}
+	}
+	if err := j.appendRollback(time.Now(), uint64(len(cmds)+1)); err != nil {
+		t.Fatalf("append rollback: %v", err)
+	}
+	if err := j.append(time.Now(), after); err != nil {
+		t.Fatalf("append: %v", err)
+	}
+	if err := j.Close(); err != nil {
+		t.Fatalf("close journal: %v", err)
+	}
+	never := filepath.Join(t.TempDir(), "journal")
+	writeJournal(t, never, append(cmds, after)...)
+
+	ctx := context.Background()
+	replayed, expected := newReplayEngine(MarketBTCUSD), newReplayEngine(MarketBTCUSD)
+	if seq, err := replayed.replay(ctx, path, 0, 0); err != nil || seq != uint64(len(cmds)+len(rolledBack)+2) {
+		t.Fatalf("replay: seq %d, %v", seq, err)
+	}
+	if _, err := expected.replay(ctx, never, 0, 0); err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+	if replayed.books.hash() != expected.books.hash() || replayed.seq != expected.seq {
+		t.Fatalf("expected rolled back commands to leave no trace")
+	}
+	expectBalance(t, replayed.funds, taker, "BTC", 2, 0)
+}
+
+// Replay refuses what the live engine refused and takes fee tiers at the
+// rates journaled with them, without asking the database.
+func TestReplayChecksOrdersAndFeeTiersLikeLive(t *testing.T) {
+	maker := idOf("maker")
+	vip := FeeRates{MakerBps: 5, TakerBps: 15}
+	cmds := append(deposit("d1", maker, "BTC", 10),
+		Command{Type: CmdSetFeeTier, ID: maker, FeeTier: "VIP1", FeeRates: &vip},
+		Command{Type: CmdSetFeeTier, ID: "not-a-uuid", FeeTier: "VIP1", FeeRates: &vip},
+		place(newSTPOrder("not-a-uuid", maker, SideSell, 100, 1, STPNone)),
+		place(newSTPOrder(idOf("a1"), maker, SideSell, 101, 1, STPNone)),
+	)
+	path := filepath.Join(t.TempDir(), "journal")
+	writeJournal(t, path, cmds...)
+
+	e := newReplayEngine(MarketBTCUSD)
+	if _, err := e.replay(context.Background(), path, 0, 0); err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+	mb := mustLookup(t, e.books, MarketBTCUSD)
+	if _, ok := mb.book.order("not-a-uuid"); ok {
+		t.Fatalf("expected the order without a uuid to be refused")
+	}
+	if _, ok := mb.book.order(idOf("a1")); !ok {
+		t.Fatalf("expected a1 to rest")
+	}
+	if got := e.fees.byUser[maker]; got != vip {
+		t.Fatalf("expected the journaled rates %+v, got %+v", vip, got)
+	}
+	if _, ok := e.fees.byUser["not-a-uuid"]; ok {
+		t.Fatalf("expected the tier of an invalid user to be refused")
+	}
+}
@@ -2,59 +2,144 @@ package engine
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
 	"math/big"
 	"strings"
+	"time"
 
 	"github.com/google/uuid"
 	dbsqlc "github.com/hakimelghazi/exchange-core/db/sqlc"
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgtype"
-	"github.com/jackc/pgx/v5/pgxpool"
 )
 
 type Engine struct {
-	book    *OrderBook
-	matcher *Matcher
-	cmds    chan Command
-	done    chan struct{}
+	books *bookRegistry // one order book per market
+	funds *funds        // balances and order holds, mirrored in the ledger
+	fees  *feeSchedule  // per-user fee tier overrides
+	cmds  *cmdQueue     // commands waiting for the loop
+	done  chan struct{}
 
-	pool    *pgxpool.Pool
-	queries *dbsqlc.Queries // sqlc-generated queries
+	expiries *expiryQueue     // good-till-date orders by expiry time
+	deadMan  *deadManSwitches // armed dead man's switches by user
+
+	journal   *Journal     // optional write-ahead command journal
+	history   *history     // what replay needs to know about stored rows, kept with a journal
+	snapshots *snapshotter // optional periodic snapshots of the state replay rebuilds
+
+	seq    uint64 // last engine sequence number assigned
+	cmdSeq uint64 // sequence number of the command being applied, 0 until it takes one
+
+	persist    *persister  // batches the database side of commands
+	placements *placements // order ids and idempotency keys taken
+
+	rec       *recorder       // undo log of the command being applied
+	unsettled []*pendingWrite // submitted writes not known to be durable, oldest first
+	submitted uint64          // number of the last write submitted
+
+	store   Store
+	queries Queries // store.Queries()
 }
 
-func NewEngine(buffer int, pool *pgxpool.Pool, queries *dbsqlc.Queries) (*Engine, error) {
-	if pool == nil || queries == nil {
-		return nil, errors.New("engine requires a persistent database connection")
+// NewEngine returns an engine that persists to store: NewPostgresStore for
+// production, or a MemStore to run without a database.
+func NewEngine(buffer int, store Store) (*Engine, error) {
+	if store == nil {
+		return nil, errors.New("engine requires a store")
 	}
-	book := NewOrderBook()
-	return &Engine{
-		book:    book,
-		matcher: NewMatcher(book),
-		cmds:    make(chan Command, buffer),
-		done:    make(chan struct{}),
-		pool:    pool,
-		queries: queries,
-	}, nil
+	e := &Engine{
+		books:      newBookRegistry(),
+		funds:      newFunds(),
+		fees:       newFeeSchedule(),
+		cmds:       newCmdQueue(buffer),
+		done:       make(chan struct{}),
+		expiries:   newExpiryQueue(),
+		deadMan:    newDeadManSwitches(),
+		persist:    newPersister(store, DefaultBatchSize),
+		placements: newPlacements(),
+		rec:        &recorder{},
+		store:      store,
+		queries:    store.Queries(),
+	}
+	e.books.rec, e.funds.rec, e.deadMan.rec = e.rec, e.rec, e.rec
+	return e, nil
 }
 
+// RegisterMarket makes a market available for trading. It must be called
+// before Run; Bootstrap registers every market in the markets table.
+func (e *Engine) RegisterMarket(m Market) error {
+	if m.Symbol == "" || m.BaseAsset == "" || m.QuoteAsset == "" {
+		return errors.New("market requires symbol, base and quote assets")
+	}
+	if m.TickSize <= 0 || m.LotSize <= 0 {
+		return fmt.Errorf("market %s: tick and lot size must be positive", m.Symbol)
+	}
+	if err := (FeeRates{MakerBps: m.MakerFeeBps, TakerBps: m.TakerFeeBps}).validate(); err != nil {
+		return fmt.Errorf("market %s: %w", m.Symbol, err)
+	}
+	if m.PriceBandBps < 0 || m.PriceBandBps >= bpsDenominator {
+		return fmt.Errorf("market %s: price band must be in [0, %d) bps", m.Symbol, bpsDenominator)
+	}
+	e.books.register(m)
+	return nil
+}
+
+// UseJournal makes the engine write every command to j before running it,
+// and Bootstrap rebuild its state from j instead of the orders table. It must
+// be called before Bootstrap. A journal must be started together with the
+// database it describes: replay begins from an empty engine.
+func (e *Engine) UseJournal(j *Journal) {
+	e.journal = j
+	e.history = newHistory()
+}
+
+// Run executes commands one at a time until Stop is called or ctx is done.
+// Order expiries, dead man's switches and snapshots are driven from the same
+// loop. Commands are taken in batches, users taking turns, up to the
+// persister's batch size, and their writes are committed together off the
+// loop.
+// Cancelling ctx abandons the commands still queued; Stop runs them first.
 func (e *Engine) Run(ctx context.Context) {
 	defer close(e.done)
+	go e.persist.run(context.WithoutCancel(ctx))
+	defer e.persist.stop()
+
+	expiry := time.NewTimer(0)
+	defer expiry.Stop()
+
+	var snapshot <-chan time.Time
+	if e.snapshots != nil {
+		t := time.NewTicker(e.snapshots.every)
+		defer t.Stop()
+		snapshot = t.C
+	}
 
 	for {
+		e.armExpiry(expiry)
 		select {
-		case cmd := <-e.cmds:
-			switch cmd.Type {
+		case <-e.cmds.ready:
+			cmds, drained := e.cmds.take(e.persist.maxBatch)
+			for _, cmd := range cmds {
+				e.rollbackFailed()
+				e.apply(ctx, cmd)
+			}
+			if drained {
+				e.shutdown()
+				return
+			}
 
-			case CmdPlace:
-				e.handlePlace(ctx, cmd)
+		case w := <-e.persist.failed:
+			e.rollback(w)
 
-			case CmdCancel:
-				ok, err := e.handleCancel(ctx, cmd.ID)
-				cmd.Resp <- cancelResult{OK: ok, Err: err}
-			}
+		case now := <-expiry.C:
+			e.expireDue(ctx, now)
+			e.tripDeadManSwitches(ctx, now)
+
+		case <-snapshot:
+			e.takeSnapshot()
 
 		case <-ctx.Done():
 			return
@@ -62,32 +147,135 @@ func (e *Engine) Run(ctx context.Context) {
 	}
 }
 
-func (e *Engine) Place(ctx context.Context, o *Order) (*MatchResult, error) {
-	if o == nil {
-		return nil, errors.New("nil order")
+// Stop shuts the engine down in order: commands sent from now on fail with
+// ErrStopped, the ones already queued run, and their writes are committed
+// before Run returns. It waits for Run to return or ctx to be done.
+func (e *Engine) Stop(ctx context.Context) error {
+	e.cmds.close()
+	select {
+	case <-e.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
-	resp := make(chan any, 1)
-	cmd := Command{Type: CmdPlace, Order: o, Resp: resp}
+}
 
-	if err := e.enqueueCommand(ctx, cmd); err != nil {
-		return nil, err
+// shutdown finishes the work of the commands that ran, once the queue is
+// drained after Stop: their writes are settled, with a failed one rolled
+// back and journaled as such, and a last snapshot is written.
+func (e *Engine) shutdown() {
+	ctx := context.Background()
+	if err := e.settleWrites(ctx); err != nil {
+		log.Printf("shutdown: settling writes failed: %v", err)
+	}
+	if e.snapshots != nil {
+		e.snapshots.wait()
+		e.takeSnapshot()
+		e.snapshots.wait()
 	}
+	log.Printf("shutdown: engine stopped at seq %d", e.seq)
+}
 
-	select {
-	case <-ctx.Done():
-		return nil, ctx.Err()
-	case raw := <-resp:
-		out := raw.(placeResult)
-		return out.Result, out.Err
+// apply executes one command and sends its result to cmd.Resp, once its
+// writes are durable. Internal commands such as CmdExpire have no one
+// waiting for a result.
+func (e *Engine) apply(ctx context.Context, cmd Command) {
+	switch cmd.Type {
+	case CmdRequestTransfer, CmdConfirmTransfer, CmdRejectTransfer, CmdSetFeeTier:
+		// committed on the loop, after the writes of every earlier command
+		// and before it is journaled, so a rollback never spans it
+		if err := e.settleWrites(ctx); err != nil {
+			cmd.fail(err)
+			return
+		}
+	}
+	// neither takes a journal entry or a sequence number; a repair
+	// journals its own changes
+	read := cmd.Type == CmdBookHash || cmd.Type == CmdReconcile
+	now := time.Now()
+	if cmd.Type == CmdHeartbeat && cmd.Timeout != 0 {
+		// journaled, so replay arms the switch for the same time; stored
+		// with microsecond precision
+		cmd.ExpiresAt = now.Add(cmd.Timeout).Truncate(time.Microsecond)
+	}
+	if e.journal != nil && !read {
+		if err := e.journal.append(now, cmd); err != nil {
+			log.Printf("apply: journal append failed for command %d: %v", cmd.Type, err)
+			cmd.fail(err)
+			return
+		}
+	}
+	if !read {
+		e.beginUndo()
+		defer func() { e.rec.log = nil }()
+		e.cmdSeq = 0
+	}
+
+	switch cmd.Type {
+
+	case CmdPlace:
+		e.handlePlace(cmd)
+
+	case CmdCancel:
+		e.handleCancel(cmd)
+
+	case CmdMassCancel:
+		e.handleMassCancel(cmd)
+
+	case CmdExpire:
+		e.handleExpire(cmd.ID)
+
+	case CmdHeartbeat:
+		e.handleHeartbeat(cmd)
+
+	case CmdDeadManTrip:
+		e.handleDeadManTrip(cmd.ID)
+
+	case CmdRequestTransfer:
+		t, created, err := e.handleRequestTransfer(ctx, cmd.Transfer)
+		cmd.Resp <- transferResult{Transfer: t, Created: created, Err: err}
+
+	case CmdConfirmTransfer:
+		t, err := e.handleSettleTransfer(ctx, cmd.ID, TransferConfirmed)
+		cmd.Resp <- transferResult{Transfer: t, Err: err}
+
+	case CmdRejectTransfer:
+		t, err := e.handleSettleTransfer(ctx, cmd.ID, TransferRejected)
+		cmd.Resp <- transferResult{Transfer: t, Err: err}
+
+	case CmdSetFeeTier:
+		rates, err := e.handleSetFeeTier(ctx, cmd.ID, cmd.FeeTier, cmd.FeeRates)
+		cmd.Resp <- feeTierResult{Rates: rates, Err: err}
+
+	case CmdAmend:
+		e.handleAmend(cmd)
+
+	case CmdBookHash:
+		cmd.Resp <- bookHashResult{Hash: e.bookHash()}
+
+	case CmdReconcile:
+		e.handleReconcile(ctx, cmd)
 	}
 }
 
+func (e *Engine) Place(ctx context.Context, o *Order) (*MatchResult, error) {
+	res, _, err := e.PlaceIdempotent(ctx, o, IdempotencyKey{})
+	return res, err
+}
+
 func (e *Engine) Cancel(ctx context.Context, id string) (bool, error) {
+	return e.CancelFor(ctx, "", id)
+}
+
+// CancelFor cancels order id on behalf of userID, the user owning it: the
+// cancel waits in that user's turn, and an order of another user is not
+// found. An empty userID behaves like Cancel.
+func (e *Engine) CancelFor(ctx context.Context, userID, id string) (bool, error) {
 	if id == "" {
 		return false, errors.New("empty order id")
 	}
 	resp := make(chan any, 1)
-	cmd := Command{Type: CmdCancel, ID: id, Resp: resp}
+	cmd := Command{Type: CmdCancel, ID: id, UserID: userID, Resp: resp}
 
 	if err := e.enqueueCommand(ctx, cmd); err != nil {
 		return false, err
@@ -102,21 +290,23 @@ func (e *Engine) Cancel(ctx context.Context, id string) (bool, error) {
 	}
 }
 
+// ErrStopped answers commands sent after Stop.
+var ErrStopped = errors.New("engine is stopped")
+
+// enqueueCommand queues cmd for the loop, waiting for room while the queue
+// is full unless the admission policy refuses it with ErrOverloaded.
 func (e *Engine) enqueueCommand(ctx context.Context, cmd Command) error {
-	select {
-	case e.cmds <- cmd:
-		return nil
-	case <-ctx.Done():
-		return ctx.Err()
-	}
+	return e.cmds.push(ctx, cmd)
 }
 
-// Persist both trades and their ledger postings in a single transaction.
+// Persist both trades and their ledger postings in the batch's transaction.
 func (e *Engine) persistTradesAndLedger(
 	ctx context.Context,
-	q *dbsqlc.Queries,
+	b *dbBatch,
+	mkt Market,
 	trades []Trade,
 ) error {
+	q := b.q
 	for _, tr := range trades {
 		tradeID := mustNewUUID()
 		takerID, err := uuidFromString(tr.TakerOrderID)
@@ -128,24 +318,19 @@ func (e *Engine) persistTradesAndLedger(
 			return err
 		}
 
-		if _, err := q.InsertTrade(ctx, dbsqlc.InsertTradeParams{
-			ID:           tradeID,
-			TakerOrderID: takerID,
-			MakerOrderID: makerID,
-			Price:        numericFromInt64(tr.Price),
-			Quantity:     numericFromInt64(tr.Quantity),
-		}); err != nil {
-			return err
-		}
-
-		ledgerID := mustNewUUID()
-		if _, err := q.CreateLedger(ctx, dbsqlc.CreateLedgerParams{
-			ID:      ledgerID,
-			RefType: "trade",
-			RefID:   tradeID,
-		}); err != nil {
-			return err
-		}
+		b.trade(dbsqlc.InsertTradesParams{
+			ID:            tradeID,
+			TakerOrderID:  takerID,
+			MakerOrderID:  makerID,
+			Price:         numericFromInt64(tr.Price),
+			Quantity:      numericFromInt64(tr.Quantity),
+			MakerFee:      numericFromInt64(tr.MakerFee),
+			TakerFee:      numericFromInt64(tr.TakerFee),
+			MakerFeeAsset: tr.MakerFeeAsset,
+			TakerFeeAsset: tr.TakerFeeAsset,
+			Seq:           int64(tr.Seq),
+		})
+		ledgerID := b.ledger("trade", tradeID)
 
 		takerRow, err := q.GetOrderForUpdate(ctx, takerID)
 		if err != nil {
@@ -157,8 +342,8 @@ func (e *Engine) persistTradesAndLedger(
 		}
 
 		notional := new(big.Int).Mul(big.NewInt(tr.Price), big.NewInt(tr.Quantity))
-		amtUSD := pgtype.Numeric{Int: notional, Valid: true}
-		amtBTC := numericFromInt64(tr.Quantity)
+		amtQuote := pgtype.Numeric{Int: notional, Valid: true}
+		amtBase := numericFromInt64(tr.Quantity)
 
 		var buyerUser, sellerUser uuid.UUID
 		if takerRow.Side == "BUY" {
@@ -168,60 +353,106 @@ func (e *Engine) persistTradesAndLedger(
 			buyerUser = uuid.UUID(makerRow.UserID.Bytes)
 			sellerUser = uuid.UUID(takerRow.UserID.Bytes)
 		}
+		buyerFee, sellerFee := tr.sideFees(Side(takerRow.Side))
+		netQuote := pgtype.Numeric{Int: new(big.Int).Sub(notional, big.NewInt(sellerFee)), Valid: true}
 
-		buyerUSD, err := e.getOrCreateAccountID(ctx, q, buyerUser, "USD")
+		// buyers pay out of held quote, sellers deliver out of held base
+		buyerQuote, err := e.getOrCreateAccountID(ctx, q, buyerUser, mkt.QuoteAsset, AccountHeld)
 		if err != nil {
 			return err
 		}
-		buyerBTC, err := e.getOrCreateAccountID(ctx, q, buyerUser, "BTC")
+		buyerBase, err := e.getOrCreateAccountID(ctx, q, buyerUser, mkt.BaseAsset, AccountAvailable)
 		if err != nil {
 			return err
 		}
-		sellerUSD, err := e.getOrCreateAccountID(ctx, q, sellerUser, "USD")
+		sellerQuote, err := e.getOrCreateAccountID(ctx, q, sellerUser, mkt.QuoteAsset, AccountAvailable)
 		if err != nil {
 			return err
 		}
-		sellerBTC, err := e.getOrCreateAccountID(ctx, q, sellerUser, "BTC")
+		sellerBase, err := e.getOrCreateAccountID(ctx, q, sellerUser, mkt.BaseAsset, AccountHeld)
 		if err != nil {
 			return err
 		}
 
-		if err := q.InsertLedgerEntry(ctx, dbsqlc.InsertLedgerEntryParams{
-			ID:        mustNewUUID(),
-			LedgerID:  ledgerID,
-			AccountID: buyerUSD,
-			Amount:    negate(amtUSD),
-		}); err != nil {
+		b.entry(ledgerID, buyerQuote, negate(amtQuote))
+		b.entry(ledgerID, buyerBase, numericFromInt64(tr.Quantity-buyerFee))
+		b.entry(ledgerID, sellerBase, negate(amtBase))
+		b.entry(ledgerID, sellerQuote, netQuote)
+
+		// fees go to the exchange's fee accounts; rebates come out of them
+		if err := e.postFee(ctx, b, ledgerID, mkt.BaseAsset, buyerFee); err != nil {
 			return err
 		}
-		if err := q.InsertLedgerEntry(ctx, dbsqlc.InsertLedgerEntryParams{
-			ID:        mustNewUUID(),
-			LedgerID:  ledgerID,
-			AccountID: buyerBTC,
-			Amount:    amtBTC,
-		}); err != nil {
+		if err := e.postFee(ctx, b, ledgerID, mkt.QuoteAsset, sellerFee); err != nil {
 			return err
 		}
-		if err := q.InsertLedgerEntry(ctx, dbsqlc.InsertLedgerEntryParams{
-			ID:        mustNewUUID(),
-			LedgerID:  ledgerID,
-			AccountID: sellerBTC,
-			Amount:    negate(amtBTC),
-		}); err != nil {
+	}
+	return nil
+}
+
+// postFee credits amount to the exchange's fee account; a negative amount
+// pays a rebate.
+func (e *Engine) postFee(ctx context.Context, b *dbBatch, ledgerID pgtype.UUID, asset string, amount int64) error {
+	if amount == 0 {
+		return nil
+	}
+	account, err := e.getOrCreateAccountID(ctx, b.q, uuid.MustParse(ExchangeUserID), asset, AccountFees)
+	if err != nil {
+		return err
+	}
+	b.entry(ledgerID, account, numericFromInt64(amount))
+	return nil
+}
+
+// persistFundsMoves writes hold and release postings between a user's
+// available and held accounts, one ledger per move.
+func (e *Engine) persistFundsMoves(
+	ctx context.Context,
+	b *dbBatch,
+	moves []fundsMove,
+) error {
+	for _, mv := range moves {
+		refID, err := uuidFromString(mv.RefID)
+		if err != nil {
 			return err
 		}
-		if err := q.InsertLedgerEntry(ctx, dbsqlc.InsertLedgerEntryParams{
-			ID:        mustNewUUID(),
-			LedgerID:  ledgerID,
-			AccountID: sellerUSD,
-			Amount:    amtUSD,
-		}); err != nil {
+		userID, err := uuid.Parse(mv.UserID)
+		if err != nil {
+			return err
+		}
+
+		ledgerID := b.ledger(mv.RefType, refID)
+		available, err := e.getOrCreateAccountID(ctx, b.q, userID, mv.Asset, AccountAvailable)
+		if err != nil {
 			return err
 		}
+		held, err := e.getOrCreateAccountID(ctx, b.q, userID, mv.Asset, AccountHeld)
+		if err != nil {
+			return err
+		}
+
+		from, to := available, held
+		if mv.RefType == "release" {
+			from, to = held, available
+		}
+		amount := numericFromInt64(mv.Amount)
+		b.entry(ledgerID, from, negate(amount))
+		b.entry(ledgerID, to, amount)
 	}
 	return nil
 }
 
+// movesWrite returns the step that writes funds moves, or nil if there are
+// none.
+func (e *Engine) movesWrite(moves []fundsMove) writeStep {
+	if len(moves) == 0 {
+		return nil
+	}
+	return func(ctx context.Context, b *dbBatch) error {
+		return e.persistFundsMoves(ctx, b, moves)
+	}
+}
+
 func newUUID() (pgtype.UUID, error) {
 	uid, err := uuid.NewRandom()
 	if err != nil {
@@ -277,47 +508,103 @@ func statusFromAmounts(remaining, original int64) string {
 	}
 }
 
-func (e *Engine) updateMatchedOrders(
-	ctx context.Context,
-	q *dbsqlc.Queries,
-	taker *Order,
-	trades []Trade,
-) error {
-	filled := make(map[string]int64)
-	for _, tr := range trades {
-		filled[tr.TakerOrderID] += tr.Quantity
-		filled[tr.MakerOrderID] += tr.Quantity
+// matchWrite returns the step that writes the trades of a match with their
+// ledger postings and brings every resting order the match touched up to
+// date, or nil if the match touched none. The taker's row is written by the
+// caller.
+func (e *Engine) matchWrite(mkt Market, res *MatchResult) writeStep {
+	if len(res.Trades) == 0 && len(res.CancelledOrders) == 0 && len(res.Decrements) == 0 {
+		return nil
+	}
+	trades := res.Trades
+	m := e.matchedOrders(res)
+	return func(ctx context.Context, b *dbBatch) error {
+		if len(trades) > 0 {
+			if err := e.persistTradesAndLedger(ctx, b, mkt, trades); err != nil {
+				return err
+			}
+		}
+		return updateMatchedOrders(ctx, b.q, m)
 	}
+}
+
+// matchedOrders is what a match changed on the resting orders it touched,
+// taken when the match ran.
+type matchedOrders struct {
+	seq         int64
+	cancelled   []string         // cancelled by self-trade prevention
+	filled      map[string]int64 // quantity taken off each order
+	hidden      map[string]int64 // what each order still resting keeps hidden
+	replenished map[string]bool  // iceberg orders that lost queue priority
+}
+
+func (e *Engine) matchedOrders(res *MatchResult) matchedOrders {
+	m := matchedOrders{
+		seq:         int64(e.seq),
+		cancelled:   res.CancelledOrders,
+		filled:      make(map[string]int64),
+		hidden:      make(map[string]int64),
+		replenished: make(map[string]bool),
+	}
+	for _, tr := range res.Trades {
+		m.filled[tr.MakerOrderID] += tr.Quantity
+	}
+	// decrement-and-cancel shrinks makers without a trade
+	for _, d := range res.Decrements {
+		m.filled[d.OrderID] += d.Quantity
+	}
+	for id := range m.filled {
+		// a maker still resting knows what it keeps hidden
+		if mb, ok := e.books.findOrder(id); ok {
+			maker, _ := mb.book.order(id)
+			m.hidden[id] = maker.hidden()
+		}
+	}
+	for _, id := range res.Replenished {
+		m.replenished[id] = true
+	}
+	return m
+}
 
-	for orderID := range filled {
+// updateMatchedOrders brings the resting orders a match filled, reduced or
+// cancelled up to date.
+func updateMatchedOrders(ctx context.Context, q Queries, m matchedOrders) error {
+	for _, orderID := range m.cancelled {
 		orderUUID, err := uuidFromString(orderID)
 		if err != nil {
 			return fmt.Errorf("invalid order id %s: %w", orderID, err)
 		}
+		if err := q.MarkOrderCancelled(ctx, dbsqlc.MarkOrderCancelledParams{ID: orderUUID, Seq: m.seq}); err != nil {
+			return err
+		}
+	}
 
-		var originalQty, newRemaining int64
-		if orderID == taker.ID {
-			originalQty = taker.Quantity
-			newRemaining = taker.Remaining
-		} else {
-			row, err := q.GetOrderForUpdate(ctx, orderUUID)
-			if err != nil {
-				return err
-			}
+	for orderID, filled := range m.filled {
+		orderUUID, err := uuidFromString(orderID)
+		if err != nil {
+			return fmt.Errorf("invalid order id %s: %w", orderID, err)
+		}
 
-			currentRemaining := numericToInt64(row.Remaining)
-			newRemaining = currentRemaining - filled[orderID]
-			if newRemaining < 0 {
-				newRemaining = 0
-			}
-			originalQty = numericToInt64(row.Quantity)
+		row, err := q.GetOrderForUpdate(ctx, orderUUID)
+		if err != nil {
+			return err
 		}
 
+		currentRemaining := numericToInt64(row.Remaining)
+		newRemaining := currentRemaining - filled
+		if newRemaining < 0 {
+			newRemaining = 0
+		}
+		originalQty := numericToInt64(row.Quantity)
+
 		status := statusFromAmounts(newRemaining, originalQty)
 		if err := q.UpdateOrderAfterMatch(ctx, dbsqlc.UpdateOrderAfterMatchParams{
-			ID:        orderUUID,
-			Remaining: numericFromInt64(newRemaining),
-			Status:    status,
+			ID:             orderUUID,
+			Remaining:      numericFromInt64(newRemaining),
+			Status:         status,
+			HiddenQuantity: numericFromInt64(m.hidden[orderID]),
+			ResetPriority:  m.replenished[orderID],
+			Seq:            m.seq,
 		}); err != nil {
 			return err
 		}
@@ -326,7 +613,10 @@ func (e *Engine) updateMatchedOrders(
 	return nil
 }
 
-func orderStatusFromOrder(o *Order) string {
+func orderStatusFromOrder(o *Order, res *MatchResult) string {
+	if res != nil && res.Cancelled {
+		return "CANCELLED"
+	}
 	return statusFromAmounts(o.Remaining, o.Quantity)
 }
 
@@ -344,14 +634,16 @@ func pgUUIDFrom(u uuid.UUID) pgtype.UUID {
 
 func (e *Engine) getOrCreateAccountID(
 	ctx context.Context,
-	q *dbsqlc.Queries,
+	q Queries,
 	user uuid.UUID,
 	asset string,
+	kind string,
 ) (pgtype.UUID, error) {
 	uid := pgUUIDFrom(user)
 	acc, err := q.GetAccountByUserAsset(ctx, dbsqlc.GetAccountByUserAssetParams{
 		UserID: uid,
 		Asset:  asset,
+		Kind:   kind,
 	})
 	if err == nil && acc.ID.Valid {
 		return acc.ID, nil
@@ -364,6 +656,7 @@ func (e *Engine) getOrCreateAccountID(
 		UserID:  uid,
 		Asset:   asset,
 		Balance: zero,
+		Kind:    kind,
 	}); err != nil && !errors.Is(err, pgx.ErrNoRows) {
 		return pgtype.UUID{}, err
 	}
@@ -371,6 +664,7 @@ func (e *Engine) getOrCreateAccountID(
 	acc2, err := q.GetAccountByUserAsset(ctx, dbsqlc.GetAccountByUserAssetParams{
 		UserID: uid,
 		Asset:  asset,
+		Kind:   kind,
 	})
 	if err != nil {
 		return pgtype.UUID{}, err
@@ -387,42 +681,73 @@ func negate(n pgtype.Numeric) pgtype.Numeric {
 	return pgtype.Numeric{Int: cp, Valid: n.Valid, Exp: n.Exp}
 }
 
-func (e *Engine) handleCancel(ctx context.Context, id string) (bool, error) {
-	orderUUID, err := uuidFromString(id)
-	if err != nil {
-		log.Printf("handleCancel: invalid order id %s: %v", id, err)
-		return false, err
+func (e *Engine) handleCancel(cmd Command) {
+	if cmd.UserID != "" && !e.books.ownedBy(cmd.ID, cmd.UserID) {
+		cmd.Resp <- cancelResult{}
+		return
 	}
+	e.closeOrder(cmd.ID, "CANCELLED", func(err error) {
+		if errors.Is(err, ErrOrderNotFound) {
+			// unknown, already filled or already closed
+			cmd.Resp <- cancelResult{}
+			return
+		}
+		cmd.Resp <- cancelResult{OK: err == nil, Err: err}
+	})
+}
 
-	tx, err := e.pool.Begin(ctx)
+// closeOrder takes an order out of its book, or the stop book, releases its
+// hold and stores it as CANCELLED or EXPIRED. done is called once that is
+// durable, or with ErrOrderNotFound right away if the order is in neither.
+func (e *Engine) closeOrder(id, status string, done func(error)) {
+	orderUUID, err := uuidFromString(id)
 	if err != nil {
-		log.Printf("handleCancel: begin tx failed for %s: %v", id, err)
-		return false, err
+		log.Printf("closeOrder: invalid order id %s: %v", id, err)
+		done(err)
+		return
 	}
-	defer func() {
-		if tx != nil {
-			_ = tx.Rollback(ctx)
-		}
-	}()
 
-	qtx := e.queries.WithTx(tx)
-	if err := qtx.MarkOrderCancelled(ctx, orderUUID); err != nil {
-		log.Printf("handleCancel: mark cancelled failed for %s: %v", id, err)
-		return false, err
+	if !e.dropOrder(id) {
+		done(ErrOrderNotFound)
+		return
 	}
+	seq := int64(e.commandSeq())
+	w := &pendingWrite{done: func(err error) {
+		if err != nil {
+			log.Printf("closeOrder: storing %s failed for %s: %v", strings.ToLower(status), id, err)
+		}
+		done(err)
+	}}
+	w.add(func(ctx context.Context, b *dbBatch) error {
+		if status == "EXPIRED" {
+			return b.q.MarkOrderExpired(ctx, dbsqlc.MarkOrderExpiredParams{ID: orderUUID, Seq: seq})
+		}
+		return b.q.MarkOrderCancelled(ctx, dbsqlc.MarkOrderCancelledParams{ID: orderUUID, Seq: seq})
+	}, e.movesWrite(e.funds.takeMoves()))
+	e.submit(w)
+}
 
-	e.book.CancelOrder(id)
-
-	if err := tx.Commit(ctx); err != nil {
-		log.Printf("handleCancel: commit failed for %s: %v", id, err)
-		return false, err
+// dropOrder takes an order out of its book and releases its hold, or takes
+// an untriggered stop out of the stop book, numbering the command. It
+// reports whether it found the order in either.
+func (e *Engine) dropOrder(id string) bool {
+	if mb, ok := e.books.findOrder(id); ok {
+		mb.book.CancelOrder(id)
+		e.funds.releaseAll(id)
+	} else if mb, ok := e.books.findStop(id); ok {
+		// untriggered stops hold no funds
+		mb.stops.remove(id)
+	} else {
+		return false
 	}
-	tx = nil
-
-	return true, nil
+	e.commandSeq()
+	return true
 }
 
-// Bootstrap reloads resting orders from the database into the in-memory book.
+// Bootstrap reloads resting orders from the database into the in-memory book
+// of each order's market. A nil market loads every market. With a non-empty
+// journal it loads the latest snapshot, if snapshots are used, and replays
+// the journal after it instead, always for every market.
 func (e *Engine) Bootstrap(ctx context.Context, market *string) error {
 	if e.queries == nil {
 		return fmt.Errorf("bootstrap: queries is nil")
@@ -433,22 +758,55 @@ func (e *Engine) Bootstrap(ctx context.Context, market *string) error {
 		marketParam = strings.TrimSpace(*market)
 	}
 
+	if err := e.loadMarkets(ctx); err != nil {
+		return err
+	}
+	if e.journal != nil && e.journal.Seq() > 0 {
+		// the journal keeps the exact time priority the orders table loses
+		var from uint64
+		if e.snapshots != nil {
+			var err error
+			if from, err = e.loadLatestSnapshot(); err != nil {
+				return fmt.Errorf("bootstrap: %w", err)
+			}
+			if from > e.journal.Seq() {
+				return fmt.Errorf("bootstrap: snapshot at %d is ahead of the journal at %d", from, e.journal.Seq())
+			}
+		}
+		seq, err := e.replay(ctx, e.journal.path, from, 0)
+		if err != nil {
+			return fmt.Errorf("bootstrap: %w", err)
+		}
+		log.Printf("bootstrap loaded snapshot at %d and replayed %d journal entries into %d market books", from, seq-from, len(e.books.byMarket))
+		return nil
+	}
+	if err := e.loadBalances(ctx); err != nil {
+		return err
+	}
+	if err := e.loadWithdrawalHolds(ctx); err != nil {
+		return err
+	}
+	if err := e.loadFeeTiers(ctx); err != nil {
+		return err
+	}
+	if err := e.loadDeadManSwitches(ctx); err != nil {
+		return err
+	}
+	maxSeq, err := e.queries.GetMaxSeq(ctx)
+	if err != nil {
+		return fmt.Errorf("bootstrap seq: %w", err)
+	}
+	e.seq = uint64(maxSeq)
+
 	asks, err := e.queries.ListRestingAsks(ctx, marketParam)
 	if err != nil {
 		return fmt.Errorf("bootstrap asks: %w", err)
 	}
 	for _, r := range asks {
-		o := &Order{
-			ID:        uuid.UUID(r.ID.Bytes).String(),
-			UserID:    uuid.UUID(r.UserID.Bytes).String(),
-			Market:    r.Market,
-			Side:      SideSell,
-			Price:     numericToInt64(r.Price),
-			Quantity:  numericToInt64(r.Quantity),
-			Remaining: numericToInt64(r.Remaining),
-			IsMarket:  false,
+		o := orderFromRow(r)
+		if err := e.restOrder(o); err != nil {
+			return fmt.Errorf("bootstrap: %w", err)
 		}
-		e.book.AddOrder(o)
 	}
 
 	bids, err := e.queries.ListRestingBids(ctx, marketParam)
@@ -456,93 +814,314 @@ func (e *Engine) Bootstrap(ctx context.Context, market *string) error {
 		return fmt.Errorf("bootstrap bids: %w", err)
 	}
 	for _, r := range bids {
-		o := &Order{
-			ID:        uuid.UUID(r.ID.Bytes).String(),
-			UserID:    uuid.UUID(r.UserID.Bytes).String(),
-			Market:    r.Market,
-			Side:      SideBuy,
-			Price:     numericToInt64(r.Price),
-			Quantity:  numericToInt64(r.Quantity),
-			Remaining: numericToInt64(r.Remaining),
-			IsMarket:  false,
+		o := orderFromRow(r)
+		if err := e.restOrder(o); err != nil {
+			return fmt.Errorf("bootstrap: %w", err)
 		}
-		e.book.AddOrder(o)
 	}
 
-	log.Printf("bootstrap loaded %d asks, %d bids into book", len(asks), len(bids))
+	stops, err := e.queries.ListUntriggeredOrders(ctx, marketParam)
+	if err != nil {
+		return fmt.Errorf("bootstrap stops: %w", err)
+	}
+	for _, r := range stops {
+		o := orderFromRow(r)
+		mb, ok := e.books.lookup(o.Market)
+		if !ok {
+			return fmt.Errorf("bootstrap: order %s: %w %q", o.ID, ErrUnknownMarket, o.Market)
+		}
+		mb.stops.add(o)
+		e.expiries.schedule(o)
+	}
+
+	log.Printf("bootstrap loaded %d asks, %d bids, %d stops into %d market books", len(asks), len(bids), len(stops), len(e.books.byMarket))
 	return nil
 }
 
-func (e *Engine) handlePlace(ctx context.Context, cmd Command) {
-	tx, txErr := e.pool.Begin(ctx)
-	if txErr != nil {
-		log.Printf("handlePlace: begin tx failed for order %s: %v", cmd.Order.ID, txErr)
-		cmd.Resp <- placeResult{Result: nil, Err: txErr}
-		return
+// orderFromRow rebuilds a resting or untriggered engine order from its database row.
+func orderFromRow(r dbsqlc.Order) *Order {
+	side, _ := ParseSide(r.Side)
+	o := &Order{
+		ID:          uuid.UUID(r.ID.Bytes).String(),
+		UserID:      uuid.UUID(r.UserID.Bytes).String(),
+		Market:      r.Market,
+		Side:        side,
+		Price:       numericToInt64(r.Price),
+		Quantity:    numericToInt64(r.Quantity),
+		Remaining:   numericToInt64(r.Remaining),
+		IsMarket:    r.IsMarket,
+		TimeInForce: TimeInForce(r.TimeInForce),
+		STP:         STPMode(r.StpMode.String),
+		StopPrice:   numericToInt64(r.StopPrice),
+		ExpiresAt:   r.ExpiresAt.Time,
+		CreatedAt:   r.CreatedAt.Time,
+
+		DisplayQuantity: numericToInt64(r.DisplayQuantity),
+		QuoteQuantity:   numericToInt64(r.QuoteQuantity),
+	}
+	if o.DisplayQuantity > 0 && r.Status != "UNTRIGGERED" {
+		// keep the slice the iceberg was showing
+		o.shown = o.Remaining - numericToInt64(r.HiddenQuantity)
+	}
+	return o
+}
+
+// loadMarkets registers every market in the markets table.
+func (e *Engine) loadMarkets(ctx context.Context) error {
+	rows, err := e.queries.ListMarkets(ctx)
+	if err != nil {
+		return fmt.Errorf("bootstrap markets: %w", err)
 	}
-	defer func() {
-		if tx != nil {
-			_ = tx.Rollback(ctx)
+	for _, r := range rows {
+		if err := e.RegisterMarket(Market{
+			Symbol:      r.Symbol,
+			BaseAsset:   r.BaseAsset,
+			QuoteAsset:  r.QuoteAsset,
+			TickSize:    r.TickSize,
+			LotSize:     r.LotSize,
+			MinNotional: r.MinNotional,
+			MaxQuantity: r.MaxQuantity,
+			MakerFeeBps: r.MakerFeeBps,
+			TakerFeeBps: r.TakerFeeBps,
+
+			PriceBandBps: r.PriceBandBps,
+		}); err != nil {
+			return fmt.Errorf("bootstrap markets: %w", err)
+		}
+		if r.LastPrice.Valid {
+			mb, _ := e.books.lookup(r.Symbol)
+			mb.lastPrice = r.LastPrice.Int64
 		}
-	}()
+	}
+	return nil
+}
 
-	res, err := e.matcher.Submit(cmd.Order)
+// loadBalances seeds in-memory balances from the ledger. Ledger rows written
+// outside the engine are only picked up on the next bootstrap.
+func (e *Engine) loadBalances(ctx context.Context) error {
+	rows, err := e.queries.ListAccountBalances(ctx)
 	if err != nil {
-		log.Printf("handlePlace: matcher failed for order %s: %v", cmd.Order.ID, err)
-		cmd.Resp <- placeResult{Result: res, Err: err}
-		return
+		return fmt.Errorf("bootstrap balances: %w", err)
+	}
+	for _, r := range rows {
+		b := e.funds.balance(uuid.UUID(r.UserID.Bytes).String(), r.Asset)
+		switch r.Kind {
+		case AccountAvailable:
+			b.available = numericToInt64(r.Balance)
+		case AccountHeld:
+			b.held = numericToInt64(r.Balance)
+		}
+	}
+	return nil
+}
+
+// loadWithdrawalHolds re-creates the holds of withdrawals still waiting for
+// confirmation.
+func (e *Engine) loadWithdrawalHolds(ctx context.Context) error {
+	rows, err := e.queries.ListPendingWithdrawals(ctx)
+	if err != nil {
+		return fmt.Errorf("bootstrap withdrawals: %w", err)
+	}
+	for _, r := range rows {
+		t := transferFromRow(r)
+		e.funds.restore(t.ID, t.UserID, t.Asset, t.Amount)
 	}
+	return nil
+}
+
+// loadFeeTiers loads the fee tier of every user that has one.
+func (e *Engine) loadFeeTiers(ctx context.Context) error {
+	rows, err := e.queries.ListUserFeeTiers(ctx)
+	if err != nil {
+		return fmt.Errorf("bootstrap fee tiers: %w", err)
+	}
+	for _, r := range rows {
+		e.fees.setTier(uuid.UUID(r.UserID.Bytes).String(), &FeeRates{MakerBps: r.MakerFeeBps, TakerBps: r.TakerFeeBps})
+	}
+	return nil
+}
 
-	qtx := e.queries.WithTx(tx)
+// restOrder puts a reloaded order back into its market's book along with
+// the hold backing its remainder.
+func (e *Engine) restOrder(o *Order) error {
+	mb, ok := e.books.lookup(o.Market)
+	if !ok {
+		return fmt.Errorf("order %s: %w %q", o.ID, ErrUnknownMarket, o.Market)
+	}
+	mb.book.AddOrder(o)
+	asset, amount := restingHold(mb.spec, o)
+	e.funds.restore(o.ID, o.UserID, asset, amount)
+	e.expiries.schedule(o)
+	return nil
+}
 
-	orderUUID, err := uuidFromString(cmd.Order.ID)
+// orderWrite returns the step that inserts the order, or updates remaining
+// and status if it is already stored, as the order is now.
+func (e *Engine) orderWrite(o *Order, status string) writeStep {
+	orderUUID, err := uuidFromString(o.ID)
+	if err != nil {
+		return func(context.Context, *dbBatch) error { return fmt.Errorf("invalid order id: %w", err) }
+	}
+	userUUID, err := uuidFromString(o.UserID)
 	if err != nil {
-		log.Printf("handlePlace: invalid order id %s: %v", cmd.Order.ID, err)
-		cmd.Resp <- placeResult{Result: res, Err: fmt.Errorf("invalid order id: %w", err)}
+		return func(context.Context, *dbBatch) error { return fmt.Errorf("invalid user id: %w", err) }
+	}
+
+	var stopPrice, displayQuantity, quoteQuantity pgtype.Numeric
+	var triggeredAt, expiresAt pgtype.Timestamptz
+	if !o.ExpiresAt.IsZero() {
+		expiresAt = pgtype.Timestamptz{Time: o.ExpiresAt, Valid: true}
+	}
+	if o.DisplayQuantity > 0 {
+		displayQuantity = numericFromInt64(o.DisplayQuantity)
+	}
+	if o.QuoteQuantity > 0 {
+		quoteQuantity = numericFromInt64(o.QuoteQuantity)
+	}
+	if o.StopPrice > 0 {
+		stopPrice = numericFromInt64(o.StopPrice)
+		if status != "UNTRIGGERED" {
+			triggeredAt = pgtype.Timestamptz{Time: time.Now(), Valid: true}
+		}
+	}
+
+	params := dbsqlc.UpsertOrderParams{
+		ID:          orderUUID,
+		UserID:      userUUID,
+		Market:      o.Market,
+		Side:        string(o.Side),
+		Price:       numericFromInt64(o.Price),
+		Quantity:    numericFromInt64(o.Quantity),
+		Remaining:   numericFromInt64(o.Remaining),
+		Status:      status,
+		TimeInForce: string(o.timeInForce()),
+		IsMarket:    o.IsMarket,
+		StopPrice:   stopPrice,
+		TriggeredAt: triggeredAt,
+		StpMode:     pgtype.Text{String: string(o.STP), Valid: o.STP != STPNone},
+
+		DisplayQuantity: displayQuantity,
+		HiddenQuantity:  numericFromInt64(o.hidden()),
+		QuoteQuantity:   quoteQuantity,
+		ExpiresAt:       expiresAt,
+		Seq:             int64(e.seq),
+	}
+	return func(ctx context.Context, b *dbBatch) error {
+		_, err := b.q.UpsertOrder(ctx, params)
+		return err
+	}
+}
+
+// checkPlace returns the book of a new order o placed at now, or why it is
+// refused. Replay refuses the same orders.
+func (e *Engine) checkPlace(o *Order, now time.Time) (*marketBook, error) {
+	mb, ok := e.books.lookup(o.Market)
+	if !ok {
+		return nil, ErrUnknownMarket
+	}
+	if err := mb.spec.Validate(o); err != nil {
+		return nil, err
+	}
+	if err := checkExpiry(o, now); err != nil {
+		return nil, err
+	}
+	for _, id := range []string{o.ID, o.UserID} {
+		if _, err := uuidFromString(id); err != nil {
+			return nil, err
+		}
+	}
+	return mb, nil
+}
+
+func (e *Engine) handlePlace(cmd Command) {
+	o := cmd.Order
+	// a retry gets the outcome of the first request even if it would no
+	// longer pass validation, say once a GTD order has expired
+	prev, err := e.placements.prior(o, cmd.Idempotency, cmd.Stored)
+	if err != nil {
+		cmd.Resp <- placeResult{Result: nil, Err: err}
+		return
+	}
+	if prev != nil {
+		// answered after the original placement is durable
+		e.submit(&pendingWrite{done: func(err error) {
+			if err != nil {
+				cmd.Resp <- placeResult{Err: err}
+				return
+			}
+			cmd.Resp <- placeResult{Result: prev, Replayed: true}
+		}})
 		return
 	}
-	userUUID, err := uuidFromString(cmd.Order.UserID)
+
+	mb, err := e.checkPlace(o, time.Now())
 	if err != nil {
-		log.Printf("handlePlace: invalid user id %s: %v", cmd.Order.UserID, err)
-		cmd.Resp <- placeResult{Result: res, Err: fmt.Errorf("invalid user id: %w", err)}
+		cmd.Resp <- placeResult{Result: nil, Err: err}
 		return
 	}
 
-	_, err = qtx.UpsertOrder(ctx, dbsqlc.UpsertOrderParams{
-		ID:        orderUUID,
-		UserID:    userUUID,
-		Market:    cmd.Order.Market,
-		Side:      string(cmd.Order.Side),
-		Price:     numericFromInt64(cmd.Order.Price),
-		Quantity:  numericFromInt64(cmd.Order.Quantity),
-		Remaining: numericFromInt64(cmd.Order.Remaining),
-		Status:    orderStatusFromOrder(cmd.Order),
-	})
+	res, moves, status, err := e.execPlace(mb, o)
 	if err != nil {
-		log.Printf("handlePlace: upsert failed for order %s: %v", cmd.Order.ID, err)
 		cmd.Resp <- placeResult{Result: res, Err: err}
 		return
 	}
 
-	if len(res.Trades) > 0 {
-		if err := e.persistTradesAndLedger(ctx, qtx, res.Trades); err != nil {
-			log.Printf("handlePlace: persistTradesAndLedger failed for order %s: %v", cmd.Order.ID, err)
-			cmd.Resp <- placeResult{Result: res, Err: err}
-			return
-		}
-		if err := e.updateMatchedOrders(ctx, qtx, cmd.Order, res.Trades); err != nil {
-			log.Printf("handlePlace: updateMatchedOrders failed for order %s: %v", cmd.Order.ID, err)
-			cmd.Resp <- placeResult{Result: res, Err: err}
-			return
+	w := &pendingWrite{}
+	w.add(e.orderWrite(o, status), e.matchWrite(mb.spec, res), e.movesWrite(moves))
+	e.runTriggers(w, mb, res.Trades)
+
+	pl := placement{requestHash: cmd.Idempotency.RequestHash, at: time.Now()}
+	if cmd.Idempotency.Key != "" {
+		if pl.result, err = json.Marshal(res); err != nil {
+			log.Printf("handlePlace: marshal result failed for order %s: %v", o.ID, err)
 		}
 	}
+	w.add(placementWrite(o, cmd.Idempotency, pl.result))
+	e.placements.add(o, cmd.Idempotency, pl)
+	e.rec.add(func() { e.placements.remove(o, cmd.Idempotency) })
+	if res.Remainder != nil || res.Untriggered {
+		e.expiries.schedule(o)
+	}
 
-	if err := tx.Commit(ctx); err != nil {
-		log.Printf("handlePlace: commit failed for order %s: %v", cmd.Order.ID, err)
+	w.done = func(err error) {
+		if err != nil {
+			log.Printf("handlePlace: storing order %s failed: %v", o.ID, err)
+		}
 		cmd.Resp <- placeResult{Result: res, Err: err}
-		return
 	}
-	tx = nil
+	e.submit(w)
+}
+
+// execPlace applies a validated order to its market in memory: an
+// untriggered stop joins the stop book, anything else is funded and matched.
+// It returns the funds moves to post and the status to store.
+func (e *Engine) execPlace(mb *marketBook, o *Order) (*MatchResult, []fundsMove, string, error) {
+	if o.StopPrice > 0 && !stopTriggered(o, mb.lastPrice) {
+		// funds are reserved when the stop triggers
+		mb.stops.add(o)
+		return &MatchResult{Trades: make([]Trade, 0), Untriggered: true, Seq: e.commandSeq()}, nil, "UNTRIGGERED", nil
+	}
 
-	cmd.Resp <- placeResult{Result: res, Err: nil}
+	if o.IsMarket {
+		// a market bid holds what it can reach inside the band
+		if err := mb.matcher.protect(o); err != nil {
+			return nil, nil, "", err
+		}
+	}
+	asset, amount := holdFor(mb.spec, mb.book, o)
+	if err := e.funds.reserve(o.ID, o.UserID, asset, amount); err != nil {
+		return nil, nil, "", err
+	}
+	res, err := mb.matcher.Submit(o)
+	if err != nil {
+		log.Printf("execPlace: matcher failed for order %s: %v", o.ID, err)
+		// rejected before touching the book; undo the hold
+		e.funds.releaseAll(o.ID)
+		e.funds.takeMoves()
+		return res, nil, "", err
+	}
+	e.stamp(res)
+	e.fees.charge(mb.spec, o, res, e.funds.owner)
+	e.funds.settle(mb.spec, o, res)
+	return res, e.funds.takeMoves(), orderStatusFromOrder(o, res), nil
 }
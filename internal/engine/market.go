@@ -0,0 +1,93 @@
+package engine
+
+import (
+	"fmt"
+	"math/big"
+)
+
+// Market describes a trading pair and the constraints orders on it must meet.
+// All sizes are in engine units (price ticks, base quantity units).
+type Market struct {
+	Symbol      string
+	BaseAsset   string
+	QuoteAsset  string
+	TickSize    int64 // price must be a multiple of this
+	LotSize     int64 // quantity must be a multiple of this
+	MinNotional int64 // minimum price * quantity for limit orders, 0 = none
+	MaxQuantity int64 // maximum quantity per order, 0 = none
+	MakerFeeBps int64 // default maker fee, negative = rebate
+	TakerFeeBps int64 // default taker fee
+
+	// PriceBandBps stops a market order from trading further than this from
+	// the best opposite price it arrives at; 0 = no band.
+	PriceBandBps int64
+}
+
+// RejectError reports an order refused before it reaches the book.
+type RejectError struct {
+	Reason string
+}
+
+func (e *RejectError) Error() string {
+	return "order rejected: " + e.Reason
+}
+
+var (
+	ErrUnknownMarket     = &RejectError{Reason: "unknown market"}
+	ErrInvalidTickSize   = &RejectError{Reason: "price is not a multiple of the tick size"}
+	ErrInvalidLotSize    = &RejectError{Reason: "quantity is not a multiple of the lot size"}
+	ErrBelowMinNotional  = &RejectError{Reason: "notional is below the market minimum"}
+	ErrAboveMaxQuantity  = &RejectError{Reason: "quantity is above the market maximum"}
+	ErrNotionalOverflow  = &RejectError{Reason: "notional is too large"}
+	ErrNonPositiveAmount = &RejectError{Reason: "price and quantity must be positive"}
+	ErrInvalidDisplay    = &RejectError{Reason: "display quantity must be a positive multiple of the lot size"}
+	ErrIcebergNotResting = &RejectError{Reason: "iceberg orders must be resting limit orders"}
+	ErrInvalidQuoteOrder = &RejectError{Reason: "quote quantity is only for market buys without a base quantity"}
+)
+
+// Validate checks o against the market's tick size, lot size and limits.
+func (m Market) Validate(o *Order) error {
+	if o.Market != m.Symbol {
+		return ErrMarketMismatch
+	}
+	if o.QuoteQuantity != 0 {
+		if o.QuoteQuantity < 0 || !o.IsMarket || o.Side != SideBuy || o.Quantity != 0 {
+			return ErrInvalidQuoteOrder
+		}
+	} else if o.Quantity <= 0 || (!o.IsMarket && o.Price <= 0) {
+		return ErrNonPositiveAmount
+	}
+	if !o.IsMarket && o.Price%m.TickSize != 0 {
+		return fmt.Errorf("%w: price %d, tick size %d", ErrInvalidTickSize, o.Price, m.TickSize)
+	}
+	if o.StopPrice < 0 {
+		return ErrNonPositiveAmount
+	}
+	if o.StopPrice%m.TickSize != 0 {
+		return fmt.Errorf("%w: stop price %d, tick size %d", ErrInvalidTickSize, o.StopPrice, m.TickSize)
+	}
+	if o.Quantity%m.LotSize != 0 {
+		return fmt.Errorf("%w: quantity %d, lot size %d", ErrInvalidLotSize, o.Quantity, m.LotSize)
+	}
+	if o.DisplayQuantity != 0 {
+		if o.DisplayQuantity < 0 || o.DisplayQuantity%m.LotSize != 0 {
+			return fmt.Errorf("%w: display %d, lot size %d", ErrInvalidDisplay, o.DisplayQuantity, m.LotSize)
+		}
+		if o.IsMarket || o.timeInForce() == TIFIOC || o.timeInForce() == TIFFOK {
+			return ErrIcebergNotResting
+		}
+	}
+	if m.MaxQuantity > 0 && o.Quantity > m.MaxQuantity {
+		return fmt.Errorf("%w: quantity %d, max %d", ErrAboveMaxQuantity, o.Quantity, m.MaxQuantity)
+	}
+	if _, ok := notionalOf(o.Price, o.Quantity); !o.IsMarket && !ok {
+		return fmt.Errorf("%w: price %d, quantity %d", ErrNotionalOverflow, o.Price, o.Quantity)
+	}
+	if m.MinNotional > 0 && !o.IsMarket {
+		notional := new(big.Int).Mul(big.NewInt(o.Price), big.NewInt(o.Quantity))
+		if notional.Cmp(big.NewInt(m.MinNotional)) < 0 {
+			return fmt.Errorf("%w: notional %s, min %d", ErrBelowMinNotional, notional, m.MinNotional)
+		}
+	}
+	return nil
+}
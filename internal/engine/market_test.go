@@ -0,0 +1,56 @@
+package engine
+
+import (
+	"errors"
+	"math"
+	"testing"
+)
+
+func TestMarketValidate(t *testing.T) {
+	m := Market{
+		Symbol:      MarketBTCUSD,
+		BaseAsset:   "BTC",
+		QuoteAsset:  "USD",
+		TickSize:    5,
+		LotSize:     10,
+		MinNotional: 10_000,
+		MaxQuantity: 1_000,
+	}
+
+	cases := []struct {
+		name  string
+		price int64
+		qty   int64
+		mkt   bool
+		want  error
+	}{
+		{"valid", 100, 100, false, nil},
+		{"off tick", 101, 100, false, ErrInvalidTickSize},
+		{"off lot", 100, 105, false, ErrInvalidLotSize},
+		{"too large", 100, 1_010, false, ErrAboveMaxQuantity},
+		{"too small notional", 100, 50, false, ErrBelowMinNotional},
+		{"market skips tick and notional", 0, 10, true, nil},
+		{"zero quantity", 100, 0, false, ErrNonPositiveAmount},
+		{"notional overflows", math.MaxInt64 - math.MaxInt64%5, 10, false, ErrNotionalOverflow},
+	}
+
+	for _, tc := range cases {
+		o := newTestOrder("o1", SideBuy, tc.price, tc.qty)
+		o.IsMarket = tc.mkt
+		err := m.Validate(o)
+		if !errors.Is(err, tc.want) {
+			t.Fatalf("%s: expected %v, got %v", tc.name, tc.want, err)
+		}
+		var rej *RejectError
+		if tc.want != nil && !errors.As(err, &rej) {
+			t.Fatalf("%s: expected a RejectError, got %T", tc.name, err)
+		}
+	}
+}
+
+func TestMarketValidateWrongSymbol(t *testing.T) {
+	m := testMarket("ETH-USD")
+	if err := m.Validate(newTestOrder("o1", SideBuy, 100, 1)); err != ErrMarketMismatch {
+		t.Fatalf("expected ErrMarketMismatch, got %v", err)
+	}
+}
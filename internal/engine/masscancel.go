@@ -0,0 +1,136 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+
+	dbsqlc "github.com/hakimelghazi/exchange-core/db/sqlc"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// MassCancel selects the orders of one user to cancel. Empty Market and Side
+// match every market and both sides.
+type MassCancel struct {
+	UserID string
+	Market string
+	Side   Side
+}
+
+type massCancelResult struct {
+	IDs []string
+	Err error
+}
+
+// MassCancel cancels every resting or untriggered order matching the filter
+// in one command and one transaction, and returns the cancelled ids.
+func (e *Engine) MassCancel(ctx context.Context, f MassCancel) ([]string, error) {
+	if f.UserID == "" {
+		return nil, errors.New("empty user id")
+	}
+	resp := make(chan any, 1)
+	cmd := Command{Type: CmdMassCancel, MassCancel: &f, Resp: resp}
+
+	if err := e.enqueueCommand(ctx, cmd); err != nil {
+		return nil, err
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case raw := <-resp:
+		out := raw.(massCancelResult)
+		return out.IDs, out.Err
+	}
+}
+
+// massCancelTargets returns the orders matching f, by market, sorted by id.
+func (r *bookRegistry) massCancelTargets(f *MassCancel) (map[*marketBook][]*Order, []string, error) {
+	books := r.byMarket
+	if f.Market != "" {
+		mb, ok := r.lookup(f.Market)
+		if !ok {
+			return nil, nil, fmt.Errorf("%w %q", ErrUnknownMarket, f.Market)
+		}
+		books = map[string]*marketBook{f.Market: mb}
+	}
+
+	targets := make(map[*marketBook][]*Order)
+	var ids []string
+	for _, mb := range books {
+		orders := append(mb.book.userOrders(f.UserID, f.Side), mb.stops.userOrders(f.UserID, f.Side)...)
+		if len(orders) == 0 {
+			continue
+		}
+		targets[mb] = orders
+		for _, o := range orders {
+			ids = append(ids, o.ID)
+		}
+	}
+	sort.Strings(ids)
+	return targets, ids, nil
+}
+
+func (e *Engine) handleMassCancel(cmd Command) {
+	f := cmd.MassCancel
+	ids, w, err := e.massCancel(f)
+	if err != nil || len(ids) == 0 {
+		cmd.Resp <- massCancelResult{IDs: ids, Err: err}
+		return
+	}
+	w.done = func(err error) {
+		if err != nil {
+			log.Printf("handleMassCancel: storing cancels failed for user %s: %v", f.UserID, err)
+			ids = nil
+		}
+		cmd.Resp <- massCancelResult{IDs: ids, Err: err}
+	}
+	e.submit(w)
+}
+
+// massCancel drops the orders matching f and returns their ids together
+// with the write that stores them cancelled and releases their holds. The
+// caller submits the write; it is nil if nothing matched.
+func (e *Engine) massCancel(f *MassCancel) ([]string, *pendingWrite, error) {
+	targets, ids, err := e.books.massCancelTargets(f)
+	if err != nil || len(ids) == 0 {
+		return ids, nil, err
+	}
+
+	orderUUIDs := make([]pgtype.UUID, 0, len(ids))
+	for _, id := range ids {
+		u, err := uuidFromString(id)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid order id %s: %w", id, err)
+		}
+		orderUUIDs = append(orderUUIDs, u)
+	}
+
+	e.dropTargets(targets)
+	params := dbsqlc.MarkOrdersCancelledParams{Seq: int64(e.seq), Ids: orderUUIDs}
+	w := &pendingWrite{}
+	w.add(func(ctx context.Context, b *dbBatch) error {
+		return b.q.MarkOrdersCancelled(ctx, params)
+	}, e.movesWrite(e.funds.takeMoves()))
+	return ids, w, nil
+}
+
+// dropTargets takes mass cancel targets out of their books and releases the
+// holds of those that were resting, numbering the command if there are any.
+func (e *Engine) dropTargets(targets map[*marketBook][]*Order) {
+	if len(targets) > 0 {
+		e.commandSeq()
+	}
+	for mb, orders := range targets {
+		for _, o := range orders {
+			if mb.book.CancelOrder(o.ID) {
+				e.funds.releaseAll(o.ID)
+			} else {
+				// untriggered stops hold no funds
+				mb.stops.remove(o.ID)
+			}
+		}
+	}
+}
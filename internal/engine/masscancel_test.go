@@ -0,0 +1,74 @@
+package engine
+
+import "testing"
+
+func TestUserIndexFollowsBook(t *testing.T) {
+	ob := NewOrderBook()
+	m := NewMatcher(ob)
+	ob.AddOrder(newSTPOrder("a1", "maker", SideSell, 100, 1, STPNone))
+	ob.AddOrder(newSTPOrder("a2", "maker", SideSell, 101, 1, STPNone))
+	ob.AddOrder(newSTPOrder("b1", "maker", SideBuy, 90, 1, STPNone))
+
+	if got := len(ob.userOrders("maker", "")); got != 3 {
+		t.Fatalf("expected 3 orders for maker, got %d", got)
+	}
+
+	// a fill and a cancel both drop orders from the index
+	if _, err := m.Submit(newSTPOrder("t1", "taker", SideBuy, 100, 1, STPNone)); err != nil {
+		t.Fatalf("submit: %v", err)
+	}
+	ob.CancelOrder("b1")
+
+	left := ob.userOrders("maker", "")
+	if len(left) != 1 || left[0].ID != "a2" {
+		t.Fatalf("expected only a2 left, got %+v", left)
+	}
+	if _, ok := ob.byUser["taker"]; ok {
+		t.Fatalf("expected filled taker not to be indexed")
+	}
+}
+
+func TestMassCancelTargetsFilter(t *testing.T) {
+	books := newTestRegistry(MarketBTCUSD, "ETH-USD")
+	btc := mustLookup(t, books, MarketBTCUSD)
+	eth := mustLookup(t, books, "ETH-USD")
+
+	btc.book.AddOrder(newSTPOrder("btc-bid", "u1", SideBuy, 90, 1, STPNone))
+	btc.book.AddOrder(newSTPOrder("btc-ask", "u1", SideSell, 110, 1, STPNone))
+	btc.book.AddOrder(newSTPOrder("other", "u2", SideBuy, 90, 1, STPNone))
+	stop := newTestStop("btc-stop", SideBuy, 120)
+	stop.UserID = "u1"
+	btc.stops.add(stop)
+	ethBid := newSTPOrder("eth-bid", "u1", SideBuy, 90, 1, STPNone)
+	ethBid.Market = "ETH-USD"
+	eth.book.AddOrder(ethBid)
+
+	cases := []struct {
+		name string
+		f    MassCancel
+		want []string
+	}{
+		{"all", MassCancel{UserID: "u1"}, []string{"btc-ask", "btc-bid", "btc-stop", "eth-bid"}},
+		{"market", MassCancel{UserID: "u1", Market: MarketBTCUSD}, []string{"btc-ask", "btc-bid", "btc-stop"}},
+		{"side", MassCancel{UserID: "u1", Market: MarketBTCUSD, Side: SideBuy}, []string{"btc-bid", "btc-stop"}},
+		{"none", MassCancel{UserID: "u3"}, nil},
+	}
+	for _, c := range cases {
+		_, ids, err := books.massCancelTargets(&c.f)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if len(ids) != len(c.want) {
+			t.Fatalf("%s: expected %v, got %v", c.name, c.want, ids)
+		}
+		for i := range ids {
+			if ids[i] != c.want[i] {
+				t.Fatalf("%s: expected %v, got %v", c.name, c.want, ids)
+			}
+		}
+	}
+
+	if _, _, err := books.massCancelTargets(&MassCancel{UserID: "u1", Market: "DOGE-USD"}); err == nil {
+		t.Fatalf("expected unknown market to fail")
+	}
+}
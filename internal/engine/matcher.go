@@ -1,20 +1,54 @@
 package engine
 
+import (
+	"container/list"
+	"math"
+)
+
 type Trade struct {
+	Seq          uint64 // engine sequence number, assigned by the engine after matching
 	TakerOrderID string
 	MakerOrderID string
 	Price        int64
 	Quantity     int64
+
+	// Fees are charged in the asset each side receives; a negative fee is a
+	// rebate. They are filled in by the engine after matching.
+	MakerFee      int64
+	TakerFee      int64
+	MakerFeeAsset string
+	TakerFeeAsset string
 }
 
 type MatchResult struct {
+	Seq         uint64 // engine sequence number of the command that produced it
 	Trades      []Trade
 	OrderFilled bool   // true if incoming is fully filled
 	Remainder   *Order // if partially filled, the remaining resting order
+	Cancelled   bool   // true if the unfilled part was cancelled (time-in-force or self-trade prevention)
+	Untriggered bool   // stop order accepted and waiting for its trigger price
+
+	CancelledOrders []string    // resting orders cancelled by self-trade prevention
+	Decrements      []Decrement // resting orders reduced by decrement-and-cancel
+	Replenished     []string    // iceberg makers that showed a new slice and lost queue priority
+}
+
+// Decrement records a resting order whose size was reduced without a trade.
+type Decrement struct {
+	OrderID  string
+	Price    int64
+	Quantity int64
 }
 
+var (
+	ErrPostOnlyWouldCross = &RejectError{Reason: "post-only order would take liquidity"}
+	ErrPostOnlyMarket     = &RejectError{Reason: "market orders cannot be post-only"}
+	ErrPriceBandOverflow  = &RejectError{Reason: "price band limit is too large"}
+)
+
 type Matcher struct {
 	book *OrderBook
+	spec Market // trading rules of the book's market, zero for a standalone matcher
 }
 
 func NewMatcher(book *OrderBook) *Matcher {
@@ -22,8 +56,43 @@ func NewMatcher(book *OrderBook) *Matcher {
 }
 
 // Submit takes an incoming order and matches it against the opposite side.
-// Later we can add: order types, time-in-force, self-trade prevention.
+// Post-only orders that would cross are rejected, FOK orders that cannot fill
+// completely are cancelled without touching the book, and IOC remainders are
+// cancelled instead of resting.
+// Self-trade prevention follows the taker's STP mode. Market orders stop at
+// the market's price band and never rest: whatever they cannot fill is
+// cancelled.
 func (m *Matcher) Submit(o *Order) (*MatchResult, error) {
+	if m.book.market != "" && o.Market != m.book.market {
+		return nil, ErrMarketMismatch
+	}
+
+	if o.IsMarket {
+		if err := m.protect(o); err != nil {
+			return nil, err
+		}
+	}
+	if o.QuoteQuantity > 0 {
+		m.sizeQuoteOrder(o)
+		if o.Quantity == 0 {
+			return &MatchResult{Trades: make([]Trade, 0), Cancelled: true}, nil
+		}
+	}
+
+	switch o.timeInForce() {
+	case TIFPostOnly:
+		if o.IsMarket {
+			return nil, ErrPostOnlyMarket
+		}
+		if m.book.crosses(o) {
+			return nil, ErrPostOnlyWouldCross
+		}
+	case TIFFOK:
+		if m.book.fillable(o) < o.Remaining {
+			return &MatchResult{Trades: make([]Trade, 0), Cancelled: true}, nil
+		}
+	}
+
 	if o.Side == SideBuy {
 		return m.matchBuy(o)
 	}
@@ -33,22 +102,32 @@ func (m *Matcher) Submit(o *Order) (*MatchResult, error) {
 func (m *Matcher) matchBuy(o *Order) (*MatchResult, error) {
 	res := &MatchResult{Trades: make([]Trade, 0)}
 	remaining := o.Remaining
+	selfCancelled := false
 
 	for remaining > 0 {
 		bestAsk := m.book.bestAsk()
 		if bestAsk == nil {
 			break
 		}
-		// if limit order and best ask is too expensive, stop
-		if !o.IsMarket && bestAsk.price > o.Price {
+		// if best ask is beyond the limit price or price band, stop
+		if !priceAcceptable(o, bestAsk.price) {
 			break
 		}
+		m.book.touch(SideSell, bestAsk.price)
 		// oldest maker at this price
 		front := bestAsk.orders.Front()
 		maker := front.Value.(*Order)
 
-		// how much can be traded
-		qty := min(remaining, maker.Remaining)
+		if o.STP != STPNone && maker.UserID == o.UserID {
+			if m.preventSelfTrade(o, bestAsk, front, &remaining, res) {
+				selfCancelled = true
+				break
+			}
+			continue
+		}
+
+		// how much can be traded before the maker has to queue again
+		qty := min(remaining, maker.visible())
 
 		// emit trade at maker price
 		res.Trades = append(res.Trades, Trade{
@@ -60,12 +139,15 @@ func (m *Matcher) matchBuy(o *Order) (*MatchResult, error) {
 
 		// decrement
 		remaining -= qty
-		maker.Remaining -= qty
+		replenished := maker.fill(qty)
 
-		// if maker is filled, pop it
+		// if maker is filled, pop it; an iceberg showing its next slice queues again
 		if maker.Remaining == 0 {
 			bestAsk.orders.Remove(front)
 			m.book.removeOrderID(maker.ID)
+		} else if replenished {
+			bestAsk.orders.MoveToBack(front)
+			res.Replenished = append(res.Replenished, maker.ID)
 		}
 		// if price level empty, remove it
 		if bestAsk.orders.Len() == 0 {
@@ -73,6 +155,12 @@ func (m *Matcher) matchBuy(o *Order) (*MatchResult, error) {
 		}
 	}
 
+	if selfCancelled {
+		o.Remaining = remaining
+		res.Cancelled = true
+		return res, nil
+	}
+
 	if remaining == 0 {
 		o.Remaining = 0
 		res.OrderFilled = true
@@ -80,14 +168,7 @@ func (m *Matcher) matchBuy(o *Order) (*MatchResult, error) {
 	}
 
 	o.Remaining = remaining
-	if !o.IsMarket {
-		//rest remainder on bid side
-		m.book.AddOrder(o)
-		res.Remainder = o
-	} else {
-		// market order, return unfilled part
-		res.Remainder = o
-	}
+	m.finish(o, res)
 	return res, nil
 }
 
@@ -95,6 +176,7 @@ func (m *Matcher) matchSell(o *Order) (*MatchResult, error) {
 	// symmetric to matchBuy
 	res := &MatchResult{Trades: make([]Trade, 0)}
 	remaining := o.Remaining
+	selfCancelled := false
 
 	for remaining > 0 {
 		bestBid := m.book.bestBid()
@@ -102,14 +184,23 @@ func (m *Matcher) matchSell(o *Order) (*MatchResult, error) {
 			break
 		}
 
-		if !o.IsMarket && bestBid.price < o.Price {
+		if !priceAcceptable(o, bestBid.price) {
 			break
 		}
+		m.book.touch(SideBuy, bestBid.price)
 
 		front := bestBid.orders.Front()
 		maker := front.Value.(*Order)
 
-		qty := min(remaining, maker.Remaining)
+		if o.STP != STPNone && maker.UserID == o.UserID {
+			if m.preventSelfTrade(o, bestBid, front, &remaining, res) {
+				selfCancelled = true
+				break
+			}
+			continue
+		}
+
+		qty := min(remaining, maker.visible())
 
 		res.Trades = append(res.Trades, Trade{
 			TakerOrderID: o.ID,
@@ -119,11 +210,14 @@ func (m *Matcher) matchSell(o *Order) (*MatchResult, error) {
 		})
 
 		remaining -= qty
-		maker.Remaining -= qty
+		replenished := maker.fill(qty)
 
 		if maker.Remaining == 0 {
 			bestBid.orders.Remove(front)
 			m.book.removeOrderID(maker.ID)
+		} else if replenished {
+			bestBid.orders.MoveToBack(front)
+			res.Replenished = append(res.Replenished, maker.ID)
 		}
 
 		if bestBid.orders.Len() == 0 {
@@ -131,6 +225,12 @@ func (m *Matcher) matchSell(o *Order) (*MatchResult, error) {
 		}
 	}
 
+	if selfCancelled {
+		o.Remaining = remaining
+		res.Cancelled = true
+		return res, nil
+	}
+
 	if remaining == 0 {
 		o.Remaining = 0
 		res.OrderFilled = true
@@ -138,13 +238,117 @@ func (m *Matcher) matchSell(o *Order) (*MatchResult, error) {
 	}
 
 	o.Remaining = remaining
-	if !o.IsMarket {
+	m.finish(o, res)
+	return res, nil
+}
+
+// finish decides what happens to an unfilled remainder once matching stops.
+func (m *Matcher) finish(o *Order, res *MatchResult) {
+	switch {
+	case o.IsMarket, o.timeInForce() == TIFIOC, o.timeInForce() == TIFFOK:
+		res.Cancelled = true
+	default:
+		// rest remainder on its own side
 		m.book.AddOrder(o)
 		res.Remainder = o
-	} else {
-		res.Remainder = o
 	}
-	return res, nil
+}
+
+// protect sets the price band limit of a market order from the best
+// opposite price. A market without a band, or an empty opposite side,
+// leaves the order unbounded; a limit that does not fit in an int64 fails
+// with ErrPriceBandOverflow.
+func (m *Matcher) protect(o *Order) error {
+	o.bound = 0
+	band := m.spec.PriceBandBps
+	if band <= 0 {
+		return nil
+	}
+	best := m.book.bestAsk()
+	if o.Side == SideSell {
+		best = m.book.bestBid()
+	}
+	if best == nil {
+		return nil
+	}
+	width, ok := notionalOf(best.price, band)
+	if !ok {
+		return ErrPriceBandOverflow
+	}
+	width /= bpsDenominator
+	if o.Side == SideSell {
+		o.bound = max(best.price-width, 1)
+		return nil
+	}
+	if best.price > math.MaxInt64-width {
+		return ErrPriceBandOverflow
+	}
+	o.bound = best.price + width
+	return nil
+}
+
+// sizeQuoteOrder sets the quantity of a quote-denominated market buy to what
+// its budget buys from the book right now, in whole lots and within the
+// market's maximum order size. Matching then fills exactly that quantity.
+func (m *Matcher) sizeQuoteOrder(o *Order) {
+	budget := o.QuoteQuantity
+	limit := int64(math.MaxInt64)
+	if m.spec.MaxQuantity > 0 {
+		limit = m.spec.MaxQuantity
+	}
+
+	var qty int64
+	o.Remaining = limit
+	m.book.walk(o, func(price, avail int64, self bool) bool {
+		if self {
+			// decrement-and-cancel takes size without spending
+			qty += avail
+			return true
+		}
+		n := min(avail, budget/price)
+		qty += n
+		budget -= n * price
+		return n == avail
+	})
+	if lot := m.spec.LotSize; lot > 0 {
+		qty -= qty % lot
+	}
+	o.Quantity, o.Remaining = qty, qty
+}
+
+// preventSelfTrade resolves a match between o and a resting order from the
+// same user according to o's STP mode, without emitting a trade. It reports
+// whether the taker must be cancelled.
+func (m *Matcher) preventSelfTrade(o *Order, lvl *priceLevel, elem *list.Element, remaining *int64, res *MatchResult) bool {
+	maker := elem.Value.(*Order)
+
+	switch o.STP {
+	case STPCancelNewest:
+		return true
+
+	case STPCancelOldest:
+		m.book.removeResting(lvl, elem)
+		res.CancelledOrders = append(res.CancelledOrders, maker.ID)
+		return false
+
+	case STPCancelBoth:
+		m.book.removeResting(lvl, elem)
+		res.CancelledOrders = append(res.CancelledOrders, maker.ID)
+		return true
+
+	case STPDecrementAndCancel:
+		qty := min(*remaining, maker.Remaining)
+		*remaining -= qty
+		maker.shrink(qty)
+		if maker.Remaining == 0 {
+			m.book.removeResting(lvl, elem)
+			res.CancelledOrders = append(res.CancelledOrders, maker.ID)
+		} else {
+			res.Decrements = append(res.Decrements, Decrement{OrderID: maker.ID, Price: maker.Price, Quantity: qty})
+		}
+		return *remaining == 0
+	}
+	return false
 }
 
 func min(a, b int64) int64 {
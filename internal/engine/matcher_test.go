@@ -1,6 +1,8 @@
 package engine
 
 import (
+	"errors"
+	"math"
 	"strconv"
 	"testing"
 )
@@ -23,7 +25,7 @@ func TestFullFill(t *testing.T) {
 		t.Fatalf("either order o1 or 2 was found in orderbook")
 	}
 
-	if len(ob.askPrices) != 0 || len(ob.bidPrices) != 0 {
+	if ob.askPrices.Len() != 0 || ob.bidPrices.Len() != 0 {
 		t.Fatalf("expected empty book")
 	}
 
@@ -81,7 +83,7 @@ func TestNoMatch(t *testing.T) {
 		t.Fatalf("order was removed")
 	}
 
-	if len(ob.askPrices) != 1 || len(ob.bidPrices) != 1 {
+	if ob.askPrices.Len() != 1 || ob.bidPrices.Len() != 1 {
 		t.Fatalf("expected 1 ask and 1 bid")
 	}
 
@@ -129,8 +131,279 @@ func TestMarketWalk(t *testing.T) {
 		t.Fatalf("o_test should be fully filled and not resting")
 	}
 
-	if len(ob.askPrices) != 5 {
-		t.Fatalf("expected 5 ask price levels left, got %d", len(ob.askPrices))
+	if ob.askPrices.Len() != 5 {
+		t.Fatalf("expected 5 ask price levels left, got %d", ob.askPrices.Len())
 	}
 
 }
+
+func TestIOCCancelsRemainder(t *testing.T) {
+	ob := NewOrderBook()
+	m := NewMatcher(ob)
+	m.Submit(newTestOrder("o1", SideSell, 100, 1))
+
+	ioc := newTestOrder("o2", SideBuy, 100, 3)
+	ioc.TimeInForce = TIFIOC
+	res, err := m.Submit(ioc)
+	if err != nil {
+		t.Fatalf("submit: %v", err)
+	}
+
+	if len(res.Trades) != 1 || res.Trades[0].Quantity != 1 {
+		t.Fatalf("expected one trade of 1, got %+v", res.Trades)
+	}
+	if !res.Cancelled || res.Remainder != nil {
+		t.Fatalf("expected remainder to be cancelled, got %+v", res)
+	}
+	if _, ok := ob.ordersByID["o2"]; ok {
+		t.Fatalf("IOC order should not rest")
+	}
+}
+
+func TestFOKKillsWithoutTouchingBook(t *testing.T) {
+	ob := NewOrderBook()
+	m := NewMatcher(ob)
+	m.Submit(newTestOrder("o1", SideSell, 100, 1))
+	m.Submit(newTestOrder("o2", SideSell, 101, 1))
+	m.Submit(newTestOrder("o3", SideSell, 105, 5))
+
+	fok := newTestOrder("o4", SideBuy, 101, 3)
+	fok.TimeInForce = TIFFOK
+	res, err := m.Submit(fok)
+	if err != nil {
+		t.Fatalf("submit: %v", err)
+	}
+	if !res.Cancelled || len(res.Trades) != 0 {
+		t.Fatalf("expected FOK to be killed, got %+v", res)
+	}
+	if ob.ordersByID["o1"].elem.Value.(*Order).Remaining != 1 {
+		t.Fatalf("FOK dry run must not modify makers")
+	}
+
+	fok = newTestOrder("o5", SideBuy, 105, 3)
+	fok.TimeInForce = TIFFOK
+	res, err = m.Submit(fok)
+	if err != nil {
+		t.Fatalf("submit: %v", err)
+	}
+	if !res.OrderFilled || len(res.Trades) != 3 {
+		t.Fatalf("expected FOK to fill across levels, got %+v", res)
+	}
+}
+
+func TestPostOnlyRejectsCrossing(t *testing.T) {
+	ob := NewOrderBook()
+	m := NewMatcher(ob)
+	m.Submit(newTestOrder("o1", SideBuy, 100, 1))
+
+	po := newTestOrder("o2", SideSell, 100, 1)
+	po.TimeInForce = TIFPostOnly
+	if _, err := m.Submit(po); err != ErrPostOnlyWouldCross {
+		t.Fatalf("expected ErrPostOnlyWouldCross, got %v", err)
+	}
+
+	po = newTestOrder("o3", SideSell, 101, 1)
+	po.TimeInForce = TIFPostOnly
+	res, err := m.Submit(po)
+	if err != nil {
+		t.Fatalf("submit: %v", err)
+	}
+	if res.Remainder == nil || len(res.Trades) != 0 {
+		t.Fatalf("expected post-only order to rest, got %+v", res)
+	}
+}
+
+func newSTPOrder(id, user string, side Side, price, qty int64, mode STPMode) *Order {
+	o := newTestOrder(id, side, price, qty)
+	o.UserID = user
+	o.STP = mode
+	return o
+}
+
+func TestSTPCancelNewest(t *testing.T) {
+	ob := NewOrderBook()
+	m := NewMatcher(ob)
+	m.Submit(newSTPOrder("o1", "u1", SideSell, 100, 1, STPNone))
+
+	res, _ := m.Submit(newSTPOrder("o2", "u1", SideBuy, 100, 1, STPCancelNewest))
+	if !res.Cancelled || len(res.Trades) != 0 || len(res.CancelledOrders) != 0 {
+		t.Fatalf("expected only the taker to be cancelled, got %+v", res)
+	}
+	if _, ok := ob.ordersByID["o1"]; !ok {
+		t.Fatalf("maker should keep resting")
+	}
+	if _, ok := ob.ordersByID["o2"]; ok {
+		t.Fatalf("taker should not rest")
+	}
+}
+
+func TestSTPCancelOldestKeepsMatching(t *testing.T) {
+	ob := NewOrderBook()
+	m := NewMatcher(ob)
+	m.Submit(newSTPOrder("o1", "u1", SideSell, 100, 1, STPNone))
+	m.Submit(newSTPOrder("o2", "u2", SideSell, 100, 1, STPNone))
+
+	res, _ := m.Submit(newSTPOrder("o3", "u1", SideBuy, 100, 1, STPCancelOldest))
+	if len(res.CancelledOrders) != 1 || res.CancelledOrders[0] != "o1" {
+		t.Fatalf("expected o1 cancelled, got %+v", res.CancelledOrders)
+	}
+	if len(res.Trades) != 1 || res.Trades[0].MakerOrderID != "o2" || !res.OrderFilled {
+		t.Fatalf("expected fill against o2, got %+v", res)
+	}
+	if len(ob.ordersByID) != 0 {
+		t.Fatalf("expected empty book, got %d orders", len(ob.ordersByID))
+	}
+}
+
+func TestSTPCancelBoth(t *testing.T) {
+	ob := NewOrderBook()
+	m := NewMatcher(ob)
+	m.Submit(newSTPOrder("o1", "u1", SideBuy, 100, 2, STPNone))
+
+	res, _ := m.Submit(newSTPOrder("o2", "u1", SideSell, 100, 1, STPCancelBoth))
+	if !res.Cancelled || len(res.CancelledOrders) != 1 || len(res.Trades) != 0 {
+		t.Fatalf("expected taker and maker cancelled, got %+v", res)
+	}
+	if len(ob.ordersByID) != 0 || ob.bidPrices.Len() != 0 {
+		t.Fatalf("expected empty book")
+	}
+}
+
+func TestSTPDecrementAndCancel(t *testing.T) {
+	ob := NewOrderBook()
+	m := NewMatcher(ob)
+	m.Submit(newSTPOrder("o1", "u1", SideSell, 100, 5, STPNone))
+
+	// smaller taker: taker cancelled, maker decremented
+	res, _ := m.Submit(newSTPOrder("o2", "u1", SideBuy, 100, 2, STPDecrementAndCancel))
+	if !res.Cancelled || len(res.Trades) != 0 {
+		t.Fatalf("expected taker cancelled without trades, got %+v", res)
+	}
+	if len(res.Decrements) != 1 || res.Decrements[0] != (Decrement{OrderID: "o1", Price: 100, Quantity: 2}) {
+		t.Fatalf("unexpected decrements %+v", res.Decrements)
+	}
+	if rem := ob.ordersByID["o1"].elem.Value.(*Order).Remaining; rem != 3 {
+		t.Fatalf("expected maker remaining 3, got %d", rem)
+	}
+
+	// larger taker: maker cancelled, taker continues and rests
+	m.Submit(newSTPOrder("o3", "u2", SideSell, 101, 1, STPNone))
+	res, _ = m.Submit(newSTPOrder("o4", "u1", SideBuy, 101, 5, STPDecrementAndCancel))
+	if len(res.CancelledOrders) != 1 || res.CancelledOrders[0] != "o1" {
+		t.Fatalf("expected o1 cancelled, got %+v", res.CancelledOrders)
+	}
+	if len(res.Trades) != 1 || res.Trades[0].MakerOrderID != "o3" {
+		t.Fatalf("expected trade against o3, got %+v", res.Trades)
+	}
+	if res.Remainder == nil || res.Remainder.Remaining != 1 {
+		t.Fatalf("expected 1 left resting, got %+v", res.Remainder)
+	}
+}
+
+func TestFOKIgnoresSelfLiquidity(t *testing.T) {
+	ob := NewOrderBook()
+	m := NewMatcher(ob)
+	m.Submit(newSTPOrder("o1", "u1", SideSell, 100, 1, STPNone))
+	m.Submit(newSTPOrder("o2", "u2", SideSell, 100, 1, STPNone))
+
+	fok := newSTPOrder("o3", "u1", SideBuy, 100, 2, STPCancelOldest)
+	fok.TimeInForce = TIFFOK
+	res, _ := m.Submit(fok)
+	if !res.Cancelled || len(res.Trades) != 0 || len(res.CancelledOrders) != 0 {
+		t.Fatalf("expected FOK killed before touching the book, got %+v", res)
+	}
+}
+
+func TestMarketOrderCancelsUnfilledPart(t *testing.T) {
+	ob := NewOrderBook()
+	m := NewMatcher(ob)
+	m.Submit(newTestOrder("s1", SideSell, 100, 1))
+
+	mkt := newTestOrder("b1", SideBuy, 0, 3)
+	mkt.IsMarket = true
+	res, err := m.Submit(mkt)
+	if err != nil {
+		t.Fatalf("submit: %v", err)
+	}
+	if len(res.Trades) != 1 || !res.Cancelled || res.Remainder != nil {
+		t.Fatalf("expected one trade and the rest cancelled, got %+v", res)
+	}
+}
+
+func TestMarketOrderStopsAtPriceBand(t *testing.T) {
+	mb := newTestRegistry().register(Market{Symbol: MarketBTCUSD, TickSize: 1, LotSize: 1, PriceBandBps: 500})
+	mb.book.AddOrder(newTestOrder("s1", SideSell, 100, 1))
+	mb.book.AddOrder(newTestOrder("s2", SideSell, 105, 1))
+	mb.book.AddOrder(newTestOrder("s3", SideSell, 106, 1))
+
+	mkt := newTestOrder("b1", SideBuy, 0, 3)
+	mkt.IsMarket = true
+	res, err := mb.matcher.Submit(mkt)
+	if err != nil {
+		t.Fatalf("submit: %v", err)
+	}
+	// 5% above the best ask of 100 allows 105 but not 106
+	if len(res.Trades) != 2 || res.Trades[1].Price != 105 {
+		t.Fatalf("expected fills at 100 and 105, got %+v", res.Trades)
+	}
+	if !res.Cancelled || mkt.Remaining != 1 {
+		t.Fatalf("expected 1 cancelled, got remaining %d cancelled %v", mkt.Remaining, res.Cancelled)
+	}
+	if mb.book.bestAsk().price != 106 {
+		t.Fatalf("expected 106 to stay in the book")
+	}
+}
+
+func TestPriceBandOverflowIsRejected(t *testing.T) {
+	mb := newTestRegistry().register(Market{Symbol: MarketBTCUSD, TickSize: 1, LotSize: 1, PriceBandBps: 500})
+	mb.book.AddOrder(newTestOrder("s1", SideSell, math.MaxInt64/2, 1))
+	mb.book.AddOrder(newTestOrder("b1", SideBuy, math.MaxInt64/4, 1))
+
+	for _, side := range []Side{SideBuy, SideSell} {
+		mkt := newTestOrder("m1", side, 0, 1)
+		mkt.IsMarket = true
+		if _, err := mb.matcher.Submit(mkt); !errors.Is(err, ErrPriceBandOverflow) {
+			t.Fatalf("%s: expected ErrPriceBandOverflow, got %v", side, err)
+		}
+	}
+	if mb.book.bestAsk() == nil || mb.book.bestBid() == nil {
+		t.Fatalf("expected the book untouched")
+	}
+}
+
+func TestQuoteMarketBuySpendsBudget(t *testing.T) {
+	mb := newTestRegistry().register(Market{Symbol: MarketBTCUSD, TickSize: 1, LotSize: 2})
+	mb.book.AddOrder(newTestOrder("s1", SideSell, 100, 2))
+	mb.book.AddOrder(newTestOrder("s2", SideSell, 110, 10))
+
+	// 1000 buys 2 at 100 and 7 at 110, rounded down to 8 in lots of 2
+	mkt := newTestOrder("b1", SideBuy, 0, 0)
+	mkt.IsMarket = true
+	mkt.QuoteQuantity = 1_000
+	res, err := mb.matcher.Submit(mkt)
+	if err != nil {
+		t.Fatalf("submit: %v", err)
+	}
+	var bought, spent int64
+	for _, tr := range res.Trades {
+		bought += tr.Quantity
+		spent += tr.Price * tr.Quantity
+	}
+	if bought != 8 || spent != 860 || !res.OrderFilled {
+		t.Fatalf("expected 8 bought for 860, got %d for %d (%+v)", bought, spent, res)
+	}
+}
+
+func TestQuoteMarketBuyWithEmptyBookIsCancelled(t *testing.T) {
+	m := NewMatcher(NewOrderBook())
+	mkt := newTestOrder("b1", SideBuy, 0, 0)
+	mkt.IsMarket = true
+	mkt.QuoteQuantity = 1_000
+	res, err := m.Submit(mkt)
+	if err != nil {
+		t.Fatalf("submit: %v", err)
+	}
+	if !res.Cancelled || len(res.Trades) != 0 {
+		t.Fatalf("expected cancellation without trades, got %+v", res)
+	}
+}
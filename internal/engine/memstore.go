@@ -0,0 +1,646 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	dbsqlc "github.com/hakimelghazi/exchange-core/db/sqlc"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// MemStore is a Store that keeps its rows in memory, for running the engine
+// and its tests without Postgres. Statements behave like their SQL
+// counterparts, including the unique constraints the engine relies on;
+// foreign keys are not checked. A transaction holds the store for its whole
+// duration and undoes its writes if it rolls back.
+type MemStore struct {
+	mu sync.Mutex
+
+	markets   map[string]dbsqlc.Market
+	feeTiers  map[string]dbsqlc.FeeTier
+	users     map[pgtype.UUID]dbsqlc.User
+	accounts  map[accountKey]dbsqlc.Account
+	orders    map[pgtype.UUID]dbsqlc.Order
+	trades    []dbsqlc.Trade
+	ledgers   map[pgtype.UUID]dbsqlc.Ledger
+	entries   []dbsqlc.LedgerEntry
+	transfers map[pgtype.UUID]dbsqlc.Transfer
+	keys      map[idempotencyKey]dbsqlc.IdempotencyKey
+	switches  map[pgtype.UUID]dbsqlc.DeadManSwitch
+	lastSeq   int64
+}
+
+type accountKey struct {
+	user        pgtype.UUID
+	asset, kind string
+}
+
+type idempotencyKey struct {
+	user pgtype.UUID
+	key  string
+}
+
+// NewMemStore returns a store holding the rows the migrations seed: the
+// BTC-USD and ETH-USD markets, the fee tiers and the exchange's user.
+func NewMemStore() *MemStore {
+	s := &MemStore{
+		markets:   make(map[string]dbsqlc.Market),
+		feeTiers:  make(map[string]dbsqlc.FeeTier),
+		users:     make(map[pgtype.UUID]dbsqlc.User),
+		accounts:  make(map[accountKey]dbsqlc.Account),
+		orders:    make(map[pgtype.UUID]dbsqlc.Order),
+		ledgers:   make(map[pgtype.UUID]dbsqlc.Ledger),
+		transfers: make(map[pgtype.UUID]dbsqlc.Transfer),
+		keys:      make(map[idempotencyKey]dbsqlc.IdempotencyKey),
+		switches:  make(map[pgtype.UUID]dbsqlc.DeadManSwitch),
+	}
+	for _, m := range []dbsqlc.Market{
+		{Symbol: "BTC-USD", BaseAsset: "BTC", QuoteAsset: "USD", TickSize: 1, LotSize: 1},
+		{Symbol: "ETH-USD", BaseAsset: "ETH", QuoteAsset: "USD", TickSize: 1, LotSize: 1},
+	} {
+		m.CreatedAt = memNow()
+		s.markets[m.Symbol] = m
+	}
+	s.feeTiers["VIP1"] = dbsqlc.FeeTier{Name: "VIP1", MakerFeeBps: 5, TakerFeeBps: 15}
+	s.feeTiers["MARKET_MAKER"] = dbsqlc.FeeTier{Name: "MARKET_MAKER", MakerFeeBps: -2, TakerFeeBps: 10}
+	exchange := pgUUIDFrom(uuid.MustParse(ExchangeUserID))
+	s.users[exchange] = dbsqlc.User{ID: exchange, Email: pgtype.Text{String: "exchange@example.com", Valid: true}}
+	return s
+}
+
+func (s *MemStore) Queries() Queries {
+	return memQueries{s: s}
+}
+
+func (s *MemStore) InTx(ctx context.Context, fn func(q Queries) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx := &memTx{}
+	if err := fn(memQueries{s: s, tx: tx}); err != nil {
+		for i := len(tx.undo) - 1; i >= 0; i-- {
+			tx.undo[i]()
+		}
+		return err
+	}
+	return nil
+}
+
+// UpsertUser adds a user, as the users table is written outside the engine.
+func (s *MemStore) UpsertUser(ctx context.Context, arg dbsqlc.UpsertUserParams) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[arg.ID]; !ok {
+		s.users[arg.ID] = dbsqlc.User{ID: arg.ID, Email: arg.Email}
+	}
+	return nil
+}
+
+// memTx collects what undoes the writes of a transaction.
+type memTx struct {
+	undo []func()
+}
+
+// memQueries runs statements on a MemStore, inside tx if it is set and
+// each under the store's lock otherwise.
+type memQueries struct {
+	s  *MemStore
+	tx *memTx
+}
+
+func (q memQueries) lock() func() {
+	if q.tx != nil {
+		// the transaction holds the lock
+		return func() {}
+	}
+	q.s.mu.Lock()
+	return q.s.mu.Unlock
+}
+
+func (q memQueries) onRollback(fn func()) {
+	if q.tx != nil {
+		q.tx.undo = append(q.tx.undo, fn)
+	}
+}
+
+// memPut writes a row and remembers how to undo it.
+func memPut[K comparable, V any](q memQueries, rows map[K]V, k K, v V) {
+	prev, existed := rows[k]
+	rows[k] = v
+	q.onRollback(func() {
+		if existed {
+			rows[k] = prev
+		} else {
+			delete(rows, k)
+		}
+	})
+}
+
+func memDelete[K comparable, V any](q memQueries, rows map[K]V, k K) {
+	if prev, ok := rows[k]; ok {
+		delete(rows, k)
+		q.onRollback(func() { rows[k] = prev })
+	}
+}
+
+func memNow() pgtype.Timestamptz {
+	return pgtype.Timestamptz{Time: time.Now(), Valid: true}
+}
+
+func duplicateKey(table string) error {
+	return fmt.Errorf("duplicate key value violates unique constraint on %s", table)
+}
+
+func (q memQueries) UpsertOrder(ctx context.Context, arg dbsqlc.UpsertOrderParams) (dbsqlc.Order, error) {
+	defer q.lock()()
+	o, ok := q.s.orders[arg.ID]
+	if ok {
+		o.Quantity = arg.Quantity
+		o.Remaining = arg.Remaining
+		o.Status = arg.Status
+		// a stop order queues from the moment it triggers
+		if !o.TriggeredAt.Valid && arg.TriggeredAt.Valid {
+			o.PriorityAt = memNow()
+		}
+		o.TriggeredAt = arg.TriggeredAt
+		o.HiddenQuantity = arg.HiddenQuantity
+		o.Seq = arg.Seq
+	} else {
+		o = dbsqlc.Order{
+			ID:              arg.ID,
+			UserID:          arg.UserID,
+			Market:          arg.Market,
+			Side:            arg.Side,
+			Price:           arg.Price,
+			Quantity:        arg.Quantity,
+			Remaining:       arg.Remaining,
+			Status:          arg.Status,
+			CreatedAt:       memNow(),
+			TimeInForce:     arg.TimeInForce,
+			PriorityAt:      memNow(),
+			IsMarket:        arg.IsMarket,
+			StopPrice:       arg.StopPrice,
+			TriggeredAt:     arg.TriggeredAt,
+			DisplayQuantity: arg.DisplayQuantity,
+			HiddenQuantity:  arg.HiddenQuantity,
+			QuoteQuantity:   arg.QuoteQuantity,
+			ExpiresAt:       arg.ExpiresAt,
+			Seq:             arg.Seq,
+			StpMode:         arg.StpMode,
+		}
+	}
+	memPut(q, q.s.orders, arg.ID, o)
+	return o, nil
+}
+
+func (q memQueries) GetOrder(ctx context.Context, id pgtype.UUID) (dbsqlc.Order, error) {
+	return q.GetOrderForUpdate(ctx, id)
+}
+
+func (q memQueries) GetOrderForUpdate(ctx context.Context, id pgtype.UUID) (dbsqlc.Order, error) {
+	defer q.lock()()
+	o, ok := q.s.orders[id]
+	if !ok {
+		return dbsqlc.Order{}, pgx.ErrNoRows
+	}
+	return o, nil
+}
+
+// updateOrder applies fn to a stored order; a missing order is left alone,
+// like an UPDATE that matches no row.
+func (q memQueries) updateOrder(id pgtype.UUID, fn func(o *dbsqlc.Order)) {
+	o, ok := q.s.orders[id]
+	if !ok {
+		return
+	}
+	fn(&o)
+	memPut(q, q.s.orders, id, o)
+}
+
+func (q memQueries) UpdateOrderAfterMatch(ctx context.Context, arg dbsqlc.UpdateOrderAfterMatchParams) error {
+	defer q.lock()()
+	q.updateOrder(arg.ID, func(o *dbsqlc.Order) {
+		o.Remaining = arg.Remaining
+		o.Status = arg.Status
+		o.HiddenQuantity = arg.HiddenQuantity
+		if arg.ResetPriority {
+			o.PriorityAt = memNow()
+		}
+		o.Seq = arg.Seq
+	})
+	return nil
+}
+
+func (q memQueries) AmendOrder(ctx context.Context, arg dbsqlc.AmendOrderParams) error {
+	defer q.lock()()
+	q.updateOrder(arg.ID, func(o *dbsqlc.Order) {
+		o.Price = arg.Price
+		o.Quantity = arg.Quantity
+		o.Remaining = arg.Remaining
+		o.Status = arg.Status
+		if arg.ResetPriority {
+			o.PriorityAt = memNow()
+		}
+		o.HiddenQuantity = arg.HiddenQuantity
+		o.Seq = arg.Seq
+	})
+	return nil
+}
+
+// closeOrder sets the status of an order that is still open.
+func (q memQueries) closeOrder(id pgtype.UUID, status string, seq int64) {
+	q.updateOrder(id, func(o *dbsqlc.Order) {
+		switch o.Status {
+		case "OPEN", "PARTIAL", "UNTRIGGERED":
+			o.Status = status
+			o.Seq = seq
+		}
+	})
+}
+
+func (q memQueries) MarkOrderCancelled(ctx context.Context, arg dbsqlc.MarkOrderCancelledParams) error {
+	defer q.lock()()
+	q.closeOrder(arg.ID, "CANCELLED", arg.Seq)
+	return nil
+}
+
+func (q memQueries) MarkOrderExpired(ctx context.Context, arg dbsqlc.MarkOrderExpiredParams) error {
+	defer q.lock()()
+	q.closeOrder(arg.ID, "EXPIRED", arg.Seq)
+	return nil
+}
+
+func (q memQueries) MarkOrdersCancelled(ctx context.Context, arg dbsqlc.MarkOrdersCancelledParams) error {
+	defer q.lock()()
+	for _, id := range arg.Ids {
+		q.closeOrder(id, "CANCELLED", arg.Seq)
+	}
+	return nil
+}
+
+// listOrders returns the orders of market, or of every market if it is
+// empty, with one of statuses and side if set, in the order of less.
+func (q memQueries) listOrders(market, side string, statuses []string, less func(a, b dbsqlc.Order) int) []dbsqlc.Order {
+	var items []dbsqlc.Order
+	for _, o := range q.s.orders {
+		if market != "" && o.Market != market || side != "" && o.Side != side {
+			continue
+		}
+		for _, st := range statuses {
+			if o.Status == st {
+				items = append(items, o)
+				break
+			}
+		}
+	}
+	sort.Slice(items, func(i, j int) bool {
+		if c := less(items[i], items[j]); c != 0 {
+			return c < 0
+		}
+		return bytes.Compare(items[i].ID.Bytes[:], items[j].ID.Bytes[:]) < 0
+	})
+	return items
+}
+
+func compareTime(a, b pgtype.Timestamptz) int {
+	return a.Time.Compare(b.Time)
+}
+
+func compareInt(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func (q memQueries) ListRestingAsks(ctx context.Context, market string) ([]dbsqlc.Order, error) {
+	defer q.lock()()
+	return q.listOrders(market, "SELL", []string{"OPEN", "PARTIAL"}, func(a, b dbsqlc.Order) int {
+		if c := compareInt(numericToInt64(a.Price), numericToInt64(b.Price)); c != 0 {
+			return c
+		}
+		return compareTime(a.PriorityAt, b.PriorityAt)
+	}), nil
+}
+
+func (q memQueries) ListRestingBids(ctx context.Context, market string) ([]dbsqlc.Order, error) {
+	defer q.lock()()
+	return q.listOrders(market, "BUY", []string{"OPEN", "PARTIAL"}, func(a, b dbsqlc.Order) int {
+		if c := compareInt(numericToInt64(b.Price), numericToInt64(a.Price)); c != 0 {
+			return c
+		}
+		return compareTime(a.PriorityAt, b.PriorityAt)
+	}), nil
+}
+
+func (q memQueries) ListUntriggeredOrders(ctx context.Context, market string) ([]dbsqlc.Order, error) {
+	defer q.lock()()
+	return q.listOrders(market, "", []string{"UNTRIGGERED"}, func(a, b dbsqlc.Order) int {
+		return compareTime(a.CreatedAt, b.CreatedAt)
+	}), nil
+}
+
+func (q memQueries) GetMaxSeq(ctx context.Context) (int64, error) {
+	defer q.lock()()
+	var seq int64
+	for _, o := range q.s.orders {
+		seq = max(seq, o.Seq)
+	}
+	for _, t := range q.s.trades {
+		seq = max(seq, t.Seq)
+	}
+	return max(seq, q.s.lastSeq), nil
+}
+
+func (q memQueries) SetLastSeq(ctx context.Context, seq int64) error {
+	defer q.lock()()
+	if seq > q.s.lastSeq {
+		prev := q.s.lastSeq
+		q.s.lastSeq = seq
+		q.onRollback(func() { q.s.lastSeq = prev })
+	}
+	return nil
+}
+
+func (q memQueries) InsertTrades(ctx context.Context, arg []dbsqlc.InsertTradesParams) (int64, error) {
+	defer q.lock()()
+	n := len(q.s.trades)
+	q.onRollback(func() { q.s.trades = q.s.trades[:n] })
+	for _, t := range arg {
+		q.s.trades = append(q.s.trades, dbsqlc.Trade{
+			ID:            t.ID,
+			TakerOrderID:  t.TakerOrderID,
+			MakerOrderID:  t.MakerOrderID,
+			Price:         t.Price,
+			Quantity:      t.Quantity,
+			TradedAt:      memNow(),
+			MakerFee:      t.MakerFee,
+			TakerFee:      t.TakerFee,
+			MakerFeeAsset: t.MakerFeeAsset,
+			TakerFeeAsset: t.TakerFeeAsset,
+			Seq:           t.Seq,
+		})
+	}
+	return int64(len(arg)), nil
+}
+
+func (q memQueries) CreateLedger(ctx context.Context, arg dbsqlc.CreateLedgerParams) (dbsqlc.Ledger, error) {
+	defer q.lock()()
+	l := dbsqlc.Ledger{ID: arg.ID, RefType: arg.RefType, RefID: arg.RefID, CreatedAt: memNow()}
+	memPut(q, q.s.ledgers, l.ID, l)
+	return l, nil
+}
+
+func (q memQueries) InsertLedgers(ctx context.Context, arg []dbsqlc.InsertLedgersParams) (int64, error) {
+	defer q.lock()()
+	for _, l := range arg {
+		memPut(q, q.s.ledgers, l.ID, dbsqlc.Ledger{ID: l.ID, RefType: l.RefType, RefID: l.RefID, CreatedAt: memNow()})
+	}
+	return int64(len(arg)), nil
+}
+
+func (q memQueries) InsertLedgerEntry(ctx context.Context, arg dbsqlc.InsertLedgerEntryParams) error {
+	_, err := q.InsertLedgerEntries(ctx, []dbsqlc.InsertLedgerEntriesParams{{
+		ID:        arg.ID,
+		LedgerID:  arg.LedgerID,
+		AccountID: arg.AccountID,
+		Amount:    arg.Amount,
+	}})
+	return err
+}
+
+func (q memQueries) InsertLedgerEntries(ctx context.Context, arg []dbsqlc.InsertLedgerEntriesParams) (int64, error) {
+	defer q.lock()()
+	n := len(q.s.entries)
+	q.onRollback(func() { q.s.entries = q.s.entries[:n] })
+	for _, le := range arg {
+		q.s.entries = append(q.s.entries, dbsqlc.LedgerEntry{
+			ID:        le.ID,
+			LedgerID:  le.LedgerID,
+			AccountID: le.AccountID,
+			Amount:    le.Amount,
+			CreatedAt: memNow(),
+		})
+	}
+	return int64(len(arg)), nil
+}
+
+func (q memQueries) GetAccountByUserAsset(ctx context.Context, arg dbsqlc.GetAccountByUserAssetParams) (dbsqlc.Account, error) {
+	defer q.lock()()
+	a, ok := q.s.accounts[accountKey{user: arg.UserID, asset: arg.Asset, kind: arg.Kind}]
+	if !ok {
+		return dbsqlc.Account{}, pgx.ErrNoRows
+	}
+	return a, nil
+}
+
+func (q memQueries) UpsertAccount(ctx context.Context, arg dbsqlc.UpsertAccountParams) (dbsqlc.Account, error) {
+	defer q.lock()()
+	k := accountKey{user: arg.UserID, asset: arg.Asset, kind: arg.Kind}
+	if _, ok := q.s.accounts[k]; ok {
+		// ON CONFLICT DO NOTHING returns no row
+		return dbsqlc.Account{}, pgx.ErrNoRows
+	}
+	a := dbsqlc.Account{ID: arg.ID, UserID: arg.UserID, Asset: arg.Asset, Balance: arg.Balance, Kind: arg.Kind}
+	memPut(q, q.s.accounts, k, a)
+	return a, nil
+}
+
+func (q memQueries) ListAccountBalances(ctx context.Context) ([]dbsqlc.ListAccountBalancesRow, error) {
+	defer q.lock()()
+	sums := make(map[pgtype.UUID]int64)
+	for _, le := range q.s.entries {
+		sums[le.AccountID] += numericToInt64(le.Amount)
+	}
+	items := make([]dbsqlc.ListAccountBalancesRow, 0, len(q.s.accounts))
+	for _, a := range q.s.accounts {
+		items = append(items, dbsqlc.ListAccountBalancesRow{
+			UserID:  a.UserID,
+			Asset:   a.Asset,
+			Kind:    a.Kind,
+			Balance: numericFromInt64(sums[a.ID]),
+		})
+	}
+	sort.Slice(items, func(i, j int) bool {
+		a, b := items[i], items[j]
+		if c := bytes.Compare(a.UserID.Bytes[:], b.UserID.Bytes[:]); c != 0 {
+			return c < 0
+		}
+		if a.Asset != b.Asset {
+			return a.Asset < b.Asset
+		}
+		return a.Kind < b.Kind
+	})
+	return items, nil
+}
+
+func (q memQueries) GetIdempotencyKey(ctx context.Context, arg dbsqlc.GetIdempotencyKeyParams) (dbsqlc.IdempotencyKey, error) {
+	defer q.lock()()
+	k, ok := q.s.keys[idempotencyKey{user: arg.UserID, key: arg.Key}]
+	if !ok {
+		return dbsqlc.IdempotencyKey{}, pgx.ErrNoRows
+	}
+	return k, nil
+}
+
+func (q memQueries) InsertIdempotencyKey(ctx context.Context, arg dbsqlc.InsertIdempotencyKeyParams) error {
+	defer q.lock()()
+	k := idempotencyKey{user: arg.UserID, key: arg.Key}
+	if _, ok := q.s.keys[k]; ok {
+		return duplicateKey("idempotency_keys")
+	}
+	memPut(q, q.s.keys, k, dbsqlc.IdempotencyKey{
+		UserID:      arg.UserID,
+		Key:         arg.Key,
+		RequestHash: arg.RequestHash,
+		OrderID:     arg.OrderID,
+		Result:      arg.Result,
+		CreatedAt:   memNow(),
+	})
+	return nil
+}
+
+func (q memQueries) CreateTransfer(ctx context.Context, arg dbsqlc.CreateTransferParams) (dbsqlc.Transfer, error) {
+	defer q.lock()()
+	for _, t := range q.s.transfers {
+		if t.ID == arg.ID || t.Kind == arg.Kind && t.ExternalRef == arg.ExternalRef {
+			return dbsqlc.Transfer{}, duplicateKey("transfers")
+		}
+	}
+	t := dbsqlc.Transfer{
+		ID:          arg.ID,
+		UserID:      arg.UserID,
+		Kind:        arg.Kind,
+		Asset:       arg.Asset,
+		Amount:      arg.Amount,
+		Status:      arg.Status,
+		ExternalRef: arg.ExternalRef,
+		CreatedAt:   memNow(),
+		UpdatedAt:   memNow(),
+	}
+	memPut(q, q.s.transfers, t.ID, t)
+	return t, nil
+}
+
+func (q memQueries) GetTransferByExternalRef(ctx context.Context, arg dbsqlc.GetTransferByExternalRefParams) (dbsqlc.Transfer, error) {
+	defer q.lock()()
+	for _, t := range q.s.transfers {
+		if t.Kind == arg.Kind && t.ExternalRef == arg.ExternalRef {
+			return t, nil
+		}
+	}
+	return dbsqlc.Transfer{}, pgx.ErrNoRows
+}
+
+func (q memQueries) GetTransferForUpdate(ctx context.Context, id pgtype.UUID) (dbsqlc.Transfer, error) {
+	defer q.lock()()
+	t, ok := q.s.transfers[id]
+	if !ok {
+		return dbsqlc.Transfer{}, pgx.ErrNoRows
+	}
+	return t, nil
+}
+
+func (q memQueries) UpdateTransferStatus(ctx context.Context, arg dbsqlc.UpdateTransferStatusParams) (dbsqlc.Transfer, error) {
+	defer q.lock()()
+	t, ok := q.s.transfers[arg.ID]
+	if !ok {
+		return dbsqlc.Transfer{}, pgx.ErrNoRows
+	}
+	t.Status = arg.Status
+	t.UpdatedAt = memNow()
+	memPut(q, q.s.transfers, t.ID, t)
+	return t, nil
+}
+
+func (q memQueries) ListPendingWithdrawals(ctx context.Context) ([]dbsqlc.Transfer, error) {
+	defer q.lock()()
+	var items []dbsqlc.Transfer
+	for _, t := range q.s.transfers {
+		if t.Kind == string(TransferWithdrawal) && t.Status == string(TransferPending) {
+			items = append(items, t)
+		}
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].CreatedAt.Time.Before(items[j].CreatedAt.Time) })
+	return items, nil
+}
+
+func (q memQueries) ListMarkets(ctx context.Context) ([]dbsqlc.Market, error) {
+	defer q.lock()()
+	items := make([]dbsqlc.Market, 0, len(q.s.markets))
+	for _, m := range q.s.markets {
+		items = append(items, m)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Symbol < items[j].Symbol })
+	return items, nil
+}
+
+func (q memQueries) SetMarketLastPrice(ctx context.Context, arg dbsqlc.SetMarketLastPriceParams) error {
+	defer q.lock()()
+	if m, ok := q.s.markets[arg.Symbol]; ok {
+		m.LastPrice = arg.LastPrice
+		memPut(q, q.s.markets, arg.Symbol, m)
+	}
+	return nil
+}
+
+func (q memQueries) GetFeeTier(ctx context.Context, name string) (dbsqlc.FeeTier, error) {
+	defer q.lock()()
+	t, ok := q.s.feeTiers[name]
+	if !ok {
+		return dbsqlc.FeeTier{}, pgx.ErrNoRows
+	}
+	return t, nil
+}
+
+func (q memQueries) SetUserFeeTier(ctx context.Context, arg dbsqlc.SetUserFeeTierParams) error {
+	defer q.lock()()
+	if u, ok := q.s.users[arg.ID]; ok {
+		u.FeeTier = arg.FeeTier
+		memPut(q, q.s.users, arg.ID, u)
+	}
+	return nil
+}
+
+func (q memQueries) ListUserFeeTiers(ctx context.Context) ([]dbsqlc.ListUserFeeTiersRow, error) {
+	defer q.lock()()
+	var items []dbsqlc.ListUserFeeTiersRow
+	for _, u := range q.s.users {
+		if t, ok := q.s.feeTiers[u.FeeTier.String]; ok && u.FeeTier.Valid {
+			items = append(items, dbsqlc.ListUserFeeTiersRow{UserID: u.ID, MakerFeeBps: t.MakerFeeBps, TakerFeeBps: t.TakerFeeBps})
+		}
+	}
+	return items, nil
+}
+
+func (q memQueries) UpsertDeadManSwitch(ctx context.Context, arg dbsqlc.UpsertDeadManSwitchParams) (dbsqlc.DeadManSwitch, error) {
+	defer q.lock()()
+	sw := dbsqlc.DeadManSwitch{UserID: arg.UserID, TimeoutMs: arg.TimeoutMs, ExpiresAt: arg.ExpiresAt, UpdatedAt: memNow()}
+	memPut(q, q.s.switches, arg.UserID, sw)
+	return sw, nil
+}
+
+func (q memQueries) DeleteDeadManSwitch(ctx context.Context, userID pgtype.UUID) error {
+	defer q.lock()()
+	memDelete(q, q.s.switches, userID)
+	return nil
+}
+
+func (q memQueries) ListDeadManSwitches(ctx context.Context) ([]dbsqlc.DeadManSwitch, error) {
+	defer q.lock()()
+	items := make([]dbsqlc.DeadManSwitch, 0, len(q.s.switches))
+	for _, sw := range q.s.switches {
+		items = append(items, sw)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].ExpiresAt.Time.Before(items[j].ExpiresAt.Time) })
+	return items, nil
+}
@@ -0,0 +1,196 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/google/uuid"
+	dbsqlc "github.com/hakimelghazi/exchange-core/db/sqlc"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// startMemEngine bootstraps an engine from store and runs it until stop is
+// called or the test ends.
+func startMemEngine(t *testing.T, store Store) (e *Engine, stop func()) {
+	t.Helper()
+	e, err := NewEngine(16, store)
+	if err != nil {
+		t.Fatalf("new engine: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := e.Bootstrap(ctx, nil); err != nil {
+		t.Fatalf("bootstrap: %v", err)
+	}
+	go e.Run(ctx)
+	stopped := false
+	stop = func() {
+		if !stopped {
+			stopped = true
+			cancel()
+			<-e.done
+		}
+	}
+	t.Cleanup(stop)
+	return e, stop
+}
+
+// fund deposits amount of asset for user through the engine.
+func fund(t *testing.T, e *Engine, user, asset string, amount int64) {
+	t.Helper()
+	ctx := context.Background()
+	tr, _, err := e.RequestTransfer(ctx, &Transfer{ID: uuid.NewString(), UserID: user, Kind: TransferDeposit, Asset: asset, Amount: amount, ExternalRef: uuid.NewString()})
+	if err != nil {
+		t.Fatalf("request deposit: %v", err)
+	}
+	if _, err := e.ConfirmTransfer(ctx, tr.ID); err != nil {
+		t.Fatalf("confirm deposit: %v", err)
+	}
+}
+
+func storedOrder(t *testing.T, store *MemStore, id string) dbsqlc.Order {
+	t.Helper()
+	row, err := store.Queries().GetOrderForUpdate(context.Background(), pgUUIDFrom(uuid.MustParse(id)))
+	if err != nil {
+		t.Fatalf("order %s: %v", id, err)
+	}
+	return row
+}
+
+func TestEngineRunsOnMemStore(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemStore()
+	e, stop := startMemEngine(t, store)
+
+	maker, taker := uuid.NewString(), uuid.NewString()
+	fund(t, e, maker, "BTC", 10)
+	fund(t, e, taker, "USD", 10_000)
+
+	a1 := newSTPOrder(uuid.NewString(), maker, SideSell, 100, 4, STPNone)
+	a2 := newSTPOrder(uuid.NewString(), maker, SideSell, 101, 4, STPNone)
+	a3 := newSTPOrder(uuid.NewString(), maker, SideSell, 105, 1, STPNone)
+	for _, o := range []*Order{a1, a2, a3} {
+		if _, err := e.Place(ctx, o); err != nil {
+			t.Fatalf("place %s: %v", o.ID, err)
+		}
+	}
+	res, err := e.Place(ctx, newSTPOrder(uuid.NewString(), taker, SideBuy, 101, 6, STPNone))
+	if err != nil || len(res.Trades) != 2 {
+		t.Fatalf("expected two trades, got %+v, %v", res, err)
+	}
+	if ok, err := e.Cancel(ctx, a3.ID); !ok || err != nil {
+		t.Fatalf("cancel: %v", err)
+	}
+
+	for _, id := range []string{a1.ID, a3.ID, uuid.NewString()} {
+		if ok, err := e.Cancel(ctx, id); ok || err != nil {
+			t.Fatalf("cancel %s: expected not found, got %v, %v", id, ok, err)
+		}
+	}
+
+	// answered only once stored
+	if len(store.trades) != 2 {
+		t.Fatalf("expected 2 stored trades, got %d", len(store.trades))
+	}
+	for id, status := range map[string]string{a1.ID: "FILLED", a2.ID: "PARTIAL", a3.ID: "CANCELLED"} {
+		if got := storedOrder(t, store, id).Status; got != status {
+			t.Fatalf("order %s: expected %s, got %s", id, status, got)
+		}
+	}
+
+	// a restart rebuilds the same books and balances from the store
+	stop()
+	restarted, _ := startMemEngine(t, store)
+	h, err := restarted.BookHash(ctx)
+	if err != nil {
+		t.Fatalf("book hash: %v", err)
+	}
+	if h.Hash != e.books.hash() {
+		t.Fatalf("expected the restarted engine to rebuild the books")
+	}
+	expectBalance(t, restarted.funds, maker, "BTC", 2, 2)
+	expectBalance(t, restarted.funds, maker, "USD", 602, 0)
+	expectBalance(t, restarted.funds, taker, "BTC", 6, 0)
+	expectBalance(t, restarted.funds, taker, "USD", 9_398, 0)
+}
+
+// An untriggered stop order is reloaded from its row at bootstrap and must
+// come back with its own self-trade prevention mode.
+func TestRestartKeepsOrderSTP(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemStore()
+	e, stop := startMemEngine(t, store)
+
+	user, seller, buyer := uuid.NewString(), uuid.NewString(), uuid.NewString()
+	fund(t, e, user, "BTC", 1)
+	fund(t, e, user, "USD", 1_000)
+	fund(t, e, seller, "BTC", 1)
+	fund(t, e, buyer, "USD", 1_000)
+
+	ask := newSTPOrder(uuid.NewString(), user, SideSell, 102, 1, STPNone)
+	if _, err := e.Place(ctx, ask); err != nil {
+		t.Fatalf("place ask: %v", err)
+	}
+	stopBid := newSTPOrder(uuid.NewString(), user, SideBuy, 102, 1, STPCancelNewest)
+	stopBid.StopPrice = 101
+	if res, err := e.Place(ctx, stopBid); err != nil || !res.Untriggered {
+		t.Fatalf("expected the stop to wait, got %+v, %v", res, err)
+	}
+	if got := storedOrder(t, store, stopBid.ID).StpMode.String; got != string(STPCancelNewest) {
+		t.Fatalf("expected the stop stored with %s, got %q", STPCancelNewest, got)
+	}
+
+	stop()
+	restarted, _ := startMemEngine(t, store)
+	// a trade at 101 triggers the stop into the user's own ask
+	if _, err := restarted.Place(ctx, newSTPOrder(uuid.NewString(), seller, SideSell, 101, 1, STPNone)); err != nil {
+		t.Fatalf("place trigger ask: %v", err)
+	}
+	if _, err := restarted.Place(ctx, newSTPOrder(uuid.NewString(), buyer, SideBuy, 101, 1, STPNone)); err != nil {
+		t.Fatalf("place trigger bid: %v", err)
+	}
+	if got := storedOrder(t, store, stopBid.ID).Status; got != "CANCELLED" {
+		t.Fatalf("expected the triggered stop cancelled by STP, got %s", got)
+	}
+	if got := storedOrder(t, store, ask.ID).Status; got != "OPEN" {
+		t.Fatalf("expected the user's ask untouched, got %s", got)
+	}
+}
+
+func TestMemStoreRollsBackFailedTransaction(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemStore()
+	orderID := mustNewUUID()
+	boom := errors.New("boom")
+
+	err := store.InTx(ctx, func(q Queries) error {
+		if _, err := q.UpsertOrder(ctx, dbsqlc.UpsertOrderParams{ID: orderID, Market: MarketBTCUSD, Side: "SELL", Status: "OPEN"}); err != nil {
+			return err
+		}
+		if _, err := q.InsertLedgers(ctx, []dbsqlc.InsertLedgersParams{{ID: mustNewUUID(), RefType: "trade", RefID: orderID}}); err != nil {
+			return err
+		}
+		if err := q.SetMarketLastPrice(ctx, dbsqlc.SetMarketLastPriceParams{Symbol: MarketBTCUSD, LastPrice: pgtype.Int8{Int64: 100, Valid: true}}); err != nil {
+			return err
+		}
+		return boom
+	})
+	if !errors.Is(err, boom) {
+		t.Fatalf("expected the transaction's error, got %v", err)
+	}
+
+	q := store.Queries()
+	if _, err := q.GetOrder(ctx, orderID); !errors.Is(err, pgx.ErrNoRows) {
+		t.Fatalf("expected the order to be rolled back")
+	}
+	if len(store.ledgers) != 0 {
+		t.Fatalf("expected the ledger to be rolled back")
+	}
+	markets, _ := q.ListMarkets(ctx)
+	for _, m := range markets {
+		if m.LastPrice.Valid {
+			t.Fatalf("expected the last price of %s to be rolled back", m.Symbol)
+		}
+	}
+}
@@ -15,19 +15,103 @@ const (
 
 const MarketBTCUSD = "BTC-USD"
 
+// TimeInForce controls what happens to the part of an order that does not
+// match immediately.
+type TimeInForce string
+
+const (
+	TIFGTC      TimeInForce = "GTC"       // rest until filled or cancelled
+	TIFIOC      TimeInForce = "IOC"       // fill what is possible, cancel the rest
+	TIFFOK      TimeInForce = "FOK"       // fill completely or not at all
+	TIFPostOnly TimeInForce = "POST_ONLY" // rest only, reject if it would take
+)
+
+// STPMode selects how self-trade prevention resolves a taker that would
+// match a resting order from the same user. The taker's mode applies.
+type STPMode string
+
+const (
+	STPNone               STPMode = ""                     // allow self-trades
+	STPCancelNewest       STPMode = "CANCEL_NEWEST"        // cancel the taker
+	STPCancelOldest       STPMode = "CANCEL_OLDEST"        // cancel the maker, keep matching
+	STPCancelBoth         STPMode = "CANCEL_BOTH"          // cancel taker and maker
+	STPDecrementAndCancel STPMode = "DECREMENT_AND_CANCEL" // reduce both by the smaller size
+)
+
 type Order struct {
-	ID        string
-	UserID    string
-	Market    string
-	Side      Side
-	Price     int64 // integer price (ticks)
-	Quantity  int64 // original quantity
-	Remaining int64 // unfilled
-	IsMarket  bool
-	CreatedAt time.Time
+	ID          string
+	UserID      string
+	Market      string
+	Side        Side
+	Price       int64 // integer price (ticks)
+	Quantity    int64 // original quantity
+	Remaining   int64 // unfilled
+	IsMarket    bool
+	TimeInForce TimeInForce // empty means GTC
+	STP         STPMode     // empty means self-trades are allowed
+	StopPrice   int64       // > 0 for stop and stop-limit orders
+	ExpiresAt   time.Time   // good-till-date expiry, zero = none
+	CreatedAt   time.Time
+
+	// DisplayQuantity > 0 makes a limit order an iceberg: only that much of
+	// the remainder is shown in the book at a time.
+	DisplayQuantity int64
+	shown           int64 // what is left of the current iceberg slice while resting
+
+	// QuoteQuantity > 0 makes a market buy spend up to this much quote
+	// instead of buying a set quantity; the matcher sizes Quantity from it.
+	QuoteQuantity int64
+	bound         int64 // price band limit of a market order, 0 = none
+}
+
+// visible is the part of a resting order that can be seen and matched
+// before it has to queue again.
+func (o *Order) visible() int64 {
+	if o.DisplayQuantity == 0 {
+		return o.Remaining
+	}
+	return o.shown
+}
+
+// hidden is the part of a resting iceberg's remainder not shown in the book.
+func (o *Order) hidden() int64 {
+	if o.shown == 0 {
+		return 0
+	}
+	return o.Remaining - o.shown
+}
+
+// show reveals the next iceberg slice.
+func (o *Order) show() {
+	o.shown = min(o.DisplayQuantity, o.Remaining)
 }
 
-var ErrInvalidSide = errors.New("invalid order side")
+// fill takes a traded quantity out of a resting order and reports whether it
+// used up an iceberg slice and showed the next one.
+func (o *Order) fill(qty int64) bool {
+	o.Remaining -= qty
+	if o.DisplayQuantity == 0 {
+		return false
+	}
+	o.shown -= qty
+	if o.shown > 0 || o.Remaining == 0 {
+		return false
+	}
+	o.show()
+	return true
+}
+
+// shrink reduces a resting order without a trade, hidden quantity first.
+func (o *Order) shrink(qty int64) {
+	o.Remaining -= qty
+	o.shown = min(o.shown, o.Remaining)
+}
+
+var (
+	ErrInvalidSide        = errors.New("invalid order side")
+	ErrInvalidTimeInForce = errors.New("invalid time in force")
+	ErrInvalidSTPMode     = errors.New("invalid self-trade prevention mode")
+)
 
 func ParseSide(s string) (Side, error) {
 	switch strings.ToUpper(strings.TrimSpace(s)) {
@@ -39,3 +123,36 @@ func ParseSide(s string) (Side, error) {
 		return "", ErrInvalidSide
 	}
 }
+
+// ParseTimeInForce parses a time-in-force value; empty input means GTC.
+func ParseTimeInForce(s string) (TimeInForce, error) {
+	switch tif := TimeInForce(strings.ToUpper(strings.TrimSpace(s))); tif {
+	case "":
+		return TIFGTC, nil
+	case TIFGTC, TIFIOC, TIFFOK, TIFPostOnly:
+		return tif, nil
+	default:
+		return "", ErrInvalidTimeInForce
+	}
+}
+
+// timeInForce returns the order's time in force, defaulting to GTC.
+func (o *Order) timeInForce() TimeInForce {
+	if o.TimeInForce == "" {
+		return TIFGTC
+	}
+	return o.TimeInForce
+}
+
+// ParseSTPMode parses a self-trade prevention mode; empty input or "NONE"
+// disables prevention.
+func ParseSTPMode(s string) (STPMode, error) {
+	switch mode := STPMode(strings.ToUpper(strings.TrimSpace(s))); mode {
+	case STPNone, "NONE":
+		return STPNone, nil
+	case STPCancelNewest, STPCancelOldest, STPCancelBoth, STPDecrementAndCancel:
+		return mode, nil
+	default:
+		return "", ErrInvalidSTPMode
+	}
+}
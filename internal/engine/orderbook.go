@@ -2,7 +2,7 @@ package engine
 
 import (
 	"container/list"
-	"sort"
+	"math"
 )
 
 // priceLevel holds FIFO orders for one price.
@@ -12,15 +12,20 @@ type priceLevel struct {
 }
 
 type OrderBook struct {
+	market string // empty for a standalone book that accepts any market
+
 	// key = price, value = *priceLevel
 	bids map[int64]*priceLevel
 	asks map[int64]*priceLevel
 
-	// to keep prices sorted; for a single market and MVP this is fine
-	bidPrices []int64 // sorted desc
-	askPrices []int64 // sorted asc
+	// price levels in priority order, O(log n) insert/remove
+	bidPrices *priceIndex // sorted desc
+	askPrices *priceIndex // sorted asc
 
 	ordersByID map[string]*orderRef
+	byUser     userIndex // resting order ids per user, for mass cancels
+
+	rec *recorder // undo log of the engine command changing the book, nil for a standalone book
 }
 
 type orderRef struct {
@@ -33,13 +38,40 @@ func NewOrderBook() *OrderBook {
 	return &OrderBook{
 		bids:       make(map[int64]*priceLevel),
 		asks:       make(map[int64]*priceLevel),
-		bidPrices:  make([]int64, 0),
-		askPrices:  make([]int64, 0),
+		bidPrices:  newPriceIndex(true),
+		askPrices:  newPriceIndex(false),
 		ordersByID: make(map[string]*orderRef),
+		byUser:     make(userIndex),
 	}
 }
 
+// userIndex maps a user to the ids of their orders in a book.
+type userIndex map[string]map[string]struct{}
+
+func (ix userIndex) add(userID, orderID string) {
+	ids, ok := ix[userID]
+	if !ok {
+		ids = make(map[string]struct{})
+		ix[userID] = ids
+	}
+	ids[orderID] = struct{}{}
+}
+
+func (ix userIndex) remove(userID, orderID string) {
+	ids := ix[userID]
+	delete(ids, orderID)
+	if len(ids) == 0 {
+		delete(ix, userID)
+	}
+}
+
+// AddOrder rests o at the back of its price level. An iceberg order shows
+// its first slice unless it already has one, as when reloaded.
 func (ob *OrderBook) AddOrder(o *Order) {
+	ob.touch(o.Side, o.Price)
+	if o.DisplayQuantity > 0 && o.shown == 0 {
+		o.show()
+	}
 	if o.Side == SideBuy {
 		lvl, ok := ob.bids[o.Price]
 
@@ -55,6 +87,7 @@ func (ob *OrderBook) AddOrder(o *Order) {
 			price: o.Price,
 			elem:  elem,
 		}
+		ob.byUser.add(o.UserID, o.ID)
 		return
 	}
 
@@ -72,6 +105,7 @@ func (ob *OrderBook) AddOrder(o *Order) {
 		price: o.Price,
 		elem:  elem,
 	}
+	ob.byUser.add(o.UserID, o.ID)
 }
 
 // cancel order using OrdersByID
@@ -80,6 +114,7 @@ func (ob *OrderBook) CancelOrder(id string) bool {
 	if !ok {
 		return false
 	}
+	ob.touch(ref.side, ref.price)
 	var lvl *priceLevel
 	if ref.side == SideBuy {
 		lvl = ob.bids[ref.price]
@@ -94,63 +129,209 @@ func (ob *OrderBook) CancelOrder(id string) bool {
 			ob.removeAskLevel(ref.price)
 		}
 	}
-	delete(ob.ordersByID, id)
+	ob.removeOrderID(id)
 	return true
 }
 
+// order returns the resting order with the given id.
+func (ob *OrderBook) order(id string) (*Order, bool) {
+	ref, ok := ob.ordersByID[id]
+	if !ok {
+		return nil, false
+	}
+	return ref.elem.Value.(*Order), true
+}
+
+// DepthLevel is the quantity shown at one price.
+type DepthLevel struct {
+	Price    int64
+	Quantity int64
+}
+
+// Depth returns up to n price levels per side, best first. Only displayed
+// quantity is counted; the hidden part of iceberg orders stays out.
+func (ob *OrderBook) Depth(n int) (bids, asks []DepthLevel) {
+	return depthOf(ob.bidPrices, ob.bids, n), depthOf(ob.askPrices, ob.asks, n)
+}
+
+func depthOf(prices *priceIndex, levels map[int64]*priceLevel, n int) []DepthLevel {
+	out := make([]DepthLevel, 0, n)
+	for p := prices.first(); p != nil && len(out) < n; p = p.next[0] {
+		var qty int64
+		for e := levels[p.price].orders.Front(); e != nil; e = e.Next() {
+			qty += e.Value.(*Order).visible()
+		}
+		out = append(out, DepthLevel{Price: p.price, Quantity: qty})
+	}
+	return out
+}
+
 // bids sorted in descending order
 func (ob *OrderBook) insertBidPrice(price int64) {
-	ob.bidPrices = append(ob.bidPrices, price)
-	sort.Slice(ob.bidPrices, func(i, j int) bool {
-		return ob.bidPrices[i] > ob.bidPrices[j]
-	})
+	ob.bidPrices.insert(price)
 }
 
 // asks sorted in ascending order
 func (ob *OrderBook) insertAskPrice(price int64) {
-	ob.askPrices = append(ob.askPrices, price)
-	sort.Slice(ob.askPrices, func(i, j int) bool {
-		return ob.askPrices[i] < ob.askPrices[j]
-	})
+	ob.askPrices.insert(price)
 }
 
 func (ob *OrderBook) bestBid() *priceLevel {
-	if len(ob.bidPrices) == 0 {
+	n := ob.bidPrices.first()
+	if n == nil {
 		return nil
 	}
-	p := ob.bidPrices[0]
-	return ob.bids[p]
+	return ob.bids[n.price]
 }
 
 func (ob *OrderBook) bestAsk() *priceLevel {
-	if len(ob.askPrices) == 0 {
+	n := ob.askPrices.first()
+	if n == nil {
 		return nil
 	}
+	return ob.asks[n.price]
+}
 
-	p := ob.askPrices[0]
-	return ob.asks[p]
+// crosses reports whether o would match immediately against the opposite side.
+func (ob *OrderBook) crosses(o *Order) bool {
+	if o.Side == SideBuy {
+		best := ob.bestAsk()
+		return best != nil && (o.IsMarket || best.price <= o.Price)
+	}
+	best := ob.bestBid()
+	return best != nil && (o.IsMarket || best.price >= o.Price)
 }
 
-func (ob *OrderBook) removeBidLevel(price int64) {
-	delete(ob.bids, price)
-	for i, p := range ob.bidPrices {
-		if p == price {
-			ob.bidPrices = append(ob.bidPrices[:i], ob.bidPrices[i+1:]...)
-			break
+// fillable returns how much of o could match right now, capped at
+// o.Remaining, without modifying the book. Liquidity behind a self-trade that
+// would stop or shrink o does not count.
+func (ob *OrderBook) fillable(o *Order) int64 {
+	var total int64
+	ob.walk(o, func(price, qty int64, self bool) bool {
+		if self {
+			return false
+		}
+		total += qty
+		return true
+	})
+	return total
+}
+
+// cost returns the quote amount o would pay to take the liquidity it can
+// reach right now, without modifying the book.
+func (ob *OrderBook) cost(o *Order) int64 {
+	var total int64
+	ob.walk(o, func(price, qty int64, self bool) bool {
+		if self {
+			return true
 		}
+		// each maker's notional fits, the sum may not: it is capped at
+		// the largest amount a balance can hold
+		n, _ := notionalOf(price, qty)
+		if total > math.MaxInt64-n {
+			total = math.MaxInt64
+			return false
+		}
+		total += n
+		return true
+	})
+	return total
+}
+
+// walk visits the makers o would reach, best price first, the way the
+// matcher would, passing each maker's price and the quantity o would take
+// from it. Makers skipped or blocked by o's self-trade prevention mode are
+// handled here; decrement-and-cancel makers are passed with self set. The
+// walk ends when o.Remaining is covered or fn returns false.
+func (ob *OrderBook) walk(o *Order, fn func(price, qty int64, self bool) bool) {
+	prices, levels := ob.askPrices, ob.asks
+	if o.Side == SideSell {
+		prices, levels = ob.bidPrices, ob.bids
+	}
+
+	left := o.Remaining
+	for n := prices.first(); n != nil && left > 0; n = n.next[0] {
+		if !priceAcceptable(o, n.price) {
+			return
+		}
+		for e := levels[n.price].orders.Front(); e != nil && left > 0; e = e.Next() {
+			maker := e.Value.(*Order)
+			self := o.STP != STPNone && maker.UserID == o.UserID
+			if self {
+				switch o.STP {
+				case STPCancelOldest:
+					continue
+				case STPCancelNewest, STPCancelBoth:
+					return
+				}
+			}
+			qty := min(left, maker.Remaining)
+			left -= qty
+			if !fn(n.price, qty, self) {
+				return
+			}
+		}
+	}
+}
+
+// priceAcceptable reports whether o may trade at price p: within its limit
+// price, or within the price band of a market order.
+func priceAcceptable(o *Order, p int64) bool {
+	limit := o.Price
+	if o.IsMarket {
+		if o.bound == 0 {
+			return true
+		}
+		limit = o.bound
+	}
+	if o.Side == SideBuy {
+		return p <= limit
 	}
+	return p >= limit
+}
+
+func (ob *OrderBook) removeBidLevel(price int64) {
+	delete(ob.bids, price)
+	ob.bidPrices.remove(price)
 }
 
 func (ob *OrderBook) removeAskLevel(price int64) {
 	delete(ob.asks, price)
-	for i, p := range ob.askPrices {
-		if p == price {
-			ob.askPrices = append(ob.askPrices[:i], ob.askPrices[i+1:]...)
-			break
+	ob.askPrices.remove(price)
+}
+
+// removeResting takes a maker out of its level during matching and drops the
+// level if it is now empty.
+func (ob *OrderBook) removeResting(lvl *priceLevel, elem *list.Element) {
+	o := elem.Value.(*Order)
+	lvl.orders.Remove(elem)
+	ob.removeOrderID(o.ID)
+	if lvl.orders.Len() == 0 {
+		if o.Side == SideBuy {
+			ob.removeBidLevel(lvl.price)
+		} else {
+			ob.removeAskLevel(lvl.price)
 		}
 	}
 }
 
 func (ob *OrderBook) removeOrderID(id string) {
+	ref, ok := ob.ordersByID[id]
+	if !ok {
+		return
+	}
+	ob.byUser.remove(ref.elem.Value.(*Order).UserID, id)
 	delete(ob.ordersByID, id)
 }
+
+// userOrders returns the user's resting orders, optionally only one side.
+func (ob *OrderBook) userOrders(userID string, side Side) []*Order {
+	var out []*Order
+	for id := range ob.byUser[userID] {
+		o, _ := ob.order(id)
+		if side == "" || o.Side == side {
+			out = append(out, o)
+		}
+	}
+	return out
+}
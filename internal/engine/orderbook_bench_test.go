@@ -0,0 +1,148 @@
+package engine
+
+import (
+	"container/list"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"testing"
+)
+
+// sortedPrices is the previous price index: append + sort.Slice on insert,
+// linear scan on remove. Kept here as the benchmark baseline.
+type sortedPrices struct {
+	prices []int64
+}
+
+func (s *sortedPrices) insert(price int64) {
+	s.prices = append(s.prices, price)
+	sort.Slice(s.prices, func(i, j int) bool {
+		return s.prices[i] < s.prices[j]
+	})
+}
+
+func (s *sortedPrices) remove(price int64) {
+	for i, p := range s.prices {
+		if p == price {
+			s.prices = append(s.prices[:i], s.prices[i+1:]...)
+			break
+		}
+	}
+}
+
+// sliceBook is the ask side of the previous order book, levels indexed by a
+// sortedPrices, for comparing whole add and cancel round trips.
+type sliceBook struct {
+	levels map[int64]*priceLevel
+	prices sortedPrices
+	orders map[string]*list.Element
+}
+
+func newSliceBook() *sliceBook {
+	return &sliceBook{levels: make(map[int64]*priceLevel), orders: make(map[string]*list.Element)}
+}
+
+func (sb *sliceBook) add(o *Order) {
+	lvl, ok := sb.levels[o.Price]
+	if !ok {
+		lvl = &priceLevel{price: o.Price, orders: list.New()}
+		sb.levels[o.Price] = lvl
+		sb.prices.insert(o.Price)
+	}
+	sb.orders[o.ID] = lvl.orders.PushBack(o)
+}
+
+func (sb *sliceBook) cancel(id string) {
+	elem, ok := sb.orders[id]
+	if !ok {
+		return
+	}
+	price := elem.Value.(*Order).Price
+	lvl := sb.levels[price]
+	lvl.orders.Remove(elem)
+	if lvl.orders.Len() == 0 {
+		delete(sb.levels, price)
+		sb.prices.remove(price)
+	}
+	delete(sb.orders, id)
+}
+
+var benchLevelCounts = []int{10_000, 50_000}
+
+// shuffledPrices returns n distinct prices in random order, so inserts land
+// throughout the book rather than always at one end.
+func shuffledPrices(n int) []int64 {
+	prices := make([]int64, n)
+	for i := range prices {
+		prices[i] = int64(1_000 + i)
+	}
+	rng := rand.New(rand.NewSource(42))
+	rng.Shuffle(n, func(i, j int) { prices[i], prices[j] = prices[j], prices[i] })
+	return prices
+}
+
+func BenchmarkPriceIndexInsertLevel(b *testing.B) {
+	for _, n := range benchLevelCounts {
+		prices := shuffledPrices(n)
+
+		b.Run(fmt.Sprintf("skiplist/levels=%d", n), func(b *testing.B) {
+			idx := newPriceIndex(false)
+			for _, p := range prices {
+				idx.insert(p)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				p := int64(1_000 + n/2)
+				idx.remove(p)
+				idx.insert(p)
+			}
+		})
+
+		b.Run(fmt.Sprintf("sorted-slice/levels=%d", n), func(b *testing.B) {
+			s := &sortedPrices{}
+			for _, p := range prices {
+				s.prices = append(s.prices, p)
+			}
+			sort.Slice(s.prices, func(i, j int) bool { return s.prices[i] < s.prices[j] })
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				p := int64(1_000 + n/2)
+				s.remove(p)
+				s.insert(p)
+			}
+		})
+	}
+}
+
+func BenchmarkOrderBookAddCancelDeepBook(b *testing.B) {
+	for _, n := range benchLevelCounts {
+		prices := shuffledPrices(n)
+
+		b.Run(fmt.Sprintf("skiplist/levels=%d", n), func(b *testing.B) {
+			ob := NewOrderBook()
+			for i, p := range prices {
+				ob.AddOrder(newTestOrder("seed-"+strconv.Itoa(i), SideSell, p, 1))
+			}
+			o := newTestOrder("probe", SideSell, int64(1_000+n+1), 1)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				ob.AddOrder(o)
+				ob.CancelOrder(o.ID)
+			}
+		})
+
+		b.Run(fmt.Sprintf("sorted-slice/levels=%d", n), func(b *testing.B) {
+			sb := newSliceBook()
+			for i, p := range prices {
+				sb.add(newTestOrder("seed-"+strconv.Itoa(i), SideSell, p, 1))
+			}
+			o := newTestOrder("probe", SideSell, int64(1_000+n+1), 1)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				sb.add(o)
+				sb.cancel(o.ID)
+			}
+		})
+	}
+}
@@ -64,8 +64,8 @@ func TestCancelLastOrderRemovesLevel(t *testing.T) {
 		t.Fatalf("expected cancel to succeed")
 	}
 
-	if len(ob.bidPrices) != 0 {
-		t.Fatalf("expected bidPrices to be empty, got %v", ob.bidPrices)
+	if ob.bidPrices.Len() != 0 {
+		t.Fatalf("expected bidPrices to be empty, got %d levels", ob.bidPrices.Len())
 	}
 	if _, ok := ob.bids[99]; ok {
 		t.Fatalf("expected bids[99] to be removed")
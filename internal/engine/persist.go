@@ -0,0 +1,381 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync/atomic"
+	"time"
+
+	dbsqlc "github.com/hakimelghazi/exchange-core/db/sqlc"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// DefaultBatchSize is how many commands the engine persists per transaction
+// unless UseBatchSize says otherwise.
+const DefaultBatchSize = 256
+
+// writeStep is one part of the database side of a command. Steps capture
+// everything they write when the command runs, so the engine loop can move
+// on while they wait for their batch; they may run more than once if their
+// batch is retried.
+type writeStep func(ctx context.Context, b *dbBatch) error
+
+// ErrRolledBack answers commands taken back because the write of an
+// earlier command failed.
+var ErrRolledBack = errors.New("rolled back: an earlier command could not be stored")
+
+// pendingWrite is the database side of one command and what to tell its
+// caller once it is durable.
+type pendingWrite struct {
+	steps []writeStep
+	done  func(err error)
+
+	n      uint64   // submission number, 0 for writes not submitted by a command
+	seq    uint64   // last sequence number the command took, stored with its write
+	undo   *undoLog // takes the command back if the write fails
+	resume bool     // marks the end of a rollback
+}
+
+// add appends steps, skipping nil ones.
+func (w *pendingWrite) add(steps ...writeStep) {
+	for _, s := range steps {
+		if s != nil {
+			w.steps = append(w.steps, s)
+		}
+	}
+}
+
+func (w *pendingWrite) finish(err error) {
+	if w.done != nil {
+		w.done(err)
+	}
+}
+
+// dbBatch runs queries inside a batch's transaction as they come, and
+// collects the rows of the append-only ledger and trade tables to write them
+// with COPY when the batch is flushed.
+type dbBatch struct {
+	q       Queries
+	ledgers []dbsqlc.InsertLedgersParams
+	entries []dbsqlc.InsertLedgerEntriesParams
+	trades  []dbsqlc.InsertTradesParams
+}
+
+func newDBBatch(q Queries) *dbBatch {
+	return &dbBatch{q: q}
+}
+
+// ledger adds a ledger and returns its id.
+func (b *dbBatch) ledger(refType string, refID pgtype.UUID) pgtype.UUID {
+	id := mustNewUUID()
+	b.ledgers = append(b.ledgers, dbsqlc.InsertLedgersParams{ID: id, RefType: refType, RefID: refID})
+	return id
+}
+
+func (b *dbBatch) entry(ledgerID, accountID pgtype.UUID, amount pgtype.Numeric) {
+	b.entries = append(b.entries, dbsqlc.InsertLedgerEntriesParams{
+		ID:        mustNewUUID(),
+		LedgerID:  ledgerID,
+		AccountID: accountID,
+		Amount:    amount,
+	})
+}
+
+func (b *dbBatch) trade(t dbsqlc.InsertTradesParams) {
+	b.trades = append(b.trades, t)
+}
+
+// flush copies the collected rows, ledgers before the entries that
+// reference them.
+func (b *dbBatch) flush(ctx context.Context) error {
+	if len(b.ledgers) > 0 {
+		if _, err := b.q.InsertLedgers(ctx, b.ledgers); err != nil {
+			return err
+		}
+	}
+	if len(b.entries) > 0 {
+		if _, err := b.q.InsertLedgerEntries(ctx, b.entries); err != nil {
+			return err
+		}
+	}
+	if len(b.trades) > 0 {
+		if _, err := b.q.InsertTrades(ctx, b.trades); err != nil {
+			return err
+		}
+	}
+	b.ledgers, b.entries, b.trades = nil, nil, nil
+	return nil
+}
+
+// persister writes the database side of commands off the engine loop. It
+// takes as many pending writes as are queued, up to its batch size, and
+// commits them in one transaction in the order the commands ran; callers
+// are answered only once their batch is durable.
+//
+// Every command ran on top of the ones before it, so a write that fails
+// takes the writes queued behind it down too: the persister answers the
+// failed write, hands it to the engine loop to roll the commands back, and
+// refuses every later write with ErrRolledBack until the loop's resume
+// marker arrives.
+type persister struct {
+	store    Store
+	writes   chan *pendingWrite
+	maxBatch int
+	stopped  chan struct{}
+
+	failed   chan *pendingWrite // the write a rollback starts at
+	durable  atomic.Uint64      // number of the last write committed
+	refusing bool               // between a failed write and the resume marker
+}
+
+func newPersister(store Store, maxBatch int) *persister {
+	return &persister{
+		store:    store,
+		writes:   make(chan *pendingWrite, 4*maxBatch),
+		maxBatch: maxBatch,
+		stopped:  make(chan struct{}),
+		failed:   make(chan *pendingWrite, 1),
+	}
+}
+
+// UseBatchSize sets how many commands are persisted per transaction; 1
+// commits every command on its own. It must be called before Run.
+func (e *Engine) UseBatchSize(n int) error {
+	if n <= 0 {
+		return errors.New("batch size must be positive")
+	}
+	e.persist = newPersister(e.store, n)
+	return nil
+}
+
+// beginUndo starts the undo log of the command about to be applied.
+func (e *Engine) beginUndo() {
+	u := &undoLog{}
+	if e.journal != nil {
+		u.journalSeq = e.journal.Seq()
+	}
+	seq := e.seq
+	u.steps = append(u.steps, func() { e.seq = seq })
+	e.rec.log = u
+}
+
+// submit hands the write of the command being applied to the persister,
+// together with the command's undo log.
+func (e *Engine) submit(w *pendingWrite) {
+	e.submitted++
+	w.n, w.undo = e.submitted, e.rec.log
+	if e.cmdSeq != 0 {
+		w.seq = e.seq
+	}
+
+	durable := e.persist.durable.Load()
+	i := 0
+	for i < len(e.unsettled) && e.unsettled[i].n <= durable {
+		i++
+	}
+	e.unsettled = append(e.unsettled[i:], w)
+	e.persist.submit(w)
+}
+
+// rollback takes back every command from the one whose write failed on,
+// newest first, leaving the in-memory state exactly as the database has
+// it. The persister refuses the writes of the later commands; a journal
+// records that the commands never happened, and persisting resumes.
+func (e *Engine) rollback(failed *pendingWrite) {
+	rolled := 0
+	for i := len(e.unsettled) - 1; i >= 0 && e.unsettled[i].n >= failed.n; i-- {
+		if u := e.unsettled[i].undo; u != nil {
+			u.rollback()
+		}
+		rolled++
+	}
+	e.unsettled = nil
+	log.Printf("persist: rolled back %d commands after a failed write", rolled)
+
+	if e.journal != nil && failed.undo != nil && failed.undo.journalSeq > 0 {
+		if err := e.journal.appendRollback(time.Now(), failed.undo.journalSeq); err != nil {
+			log.Printf("persist: journaling rollback from %d failed: %v", failed.undo.journalSeq, err)
+		}
+	}
+	e.persist.resume()
+}
+
+// undoCommand takes back the command being applied after a write it made
+// on the loop failed, and journals that it was rolled back.
+func (e *Engine) undoCommand() {
+	u := e.rec.log
+	if u == nil {
+		return
+	}
+	u.rollback()
+	e.funds.takeMoves()
+	if e.journal != nil && u.journalSeq > 0 {
+		if err := e.journal.appendRollback(time.Now(), u.journalSeq); err != nil {
+			log.Printf("persist: journaling rollback of %d failed: %v", u.journalSeq, err)
+		}
+	}
+}
+
+// rollbackFailed rolls back after a write that has failed, if any.
+func (e *Engine) rollbackFailed() {
+	select {
+	case w := <-e.persist.failed:
+		e.rollback(w)
+	default:
+	}
+}
+
+// settleWrites waits until the writes of every command applied so far are
+// done, and rolls back after one that failed.
+func (e *Engine) settleWrites(ctx context.Context) error {
+	if err := e.persist.flush(ctx); err != nil {
+		return err
+	}
+	e.rollbackFailed()
+	return nil
+}
+
+// submit queues a write, blocking while the persister is a full queue
+// behind.
+func (p *persister) submit(w *pendingWrite) {
+	p.writes <- w
+}
+
+// resume ends a rollback: writes submitted after it are committed again.
+func (p *persister) resume() {
+	p.submit(&pendingWrite{resume: true})
+}
+
+// flush waits until every write submitted before it is done.
+func (p *persister) flush(ctx context.Context) error {
+	done := make(chan struct{})
+	p.submit(&pendingWrite{done: func(error) { close(done) }})
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-done:
+		return nil
+	}
+}
+
+// run commits batches until the write queue is closed and drained.
+func (p *persister) run(ctx context.Context) {
+	defer close(p.stopped)
+	batch := make([]*pendingWrite, 0, p.maxBatch)
+	for w := range p.writes {
+		batch = append(batch[:0], w)
+	fill:
+		for len(batch) < p.maxBatch {
+			select {
+			case w, ok := <-p.writes:
+				if !ok {
+					break fill
+				}
+				batch = append(batch, w)
+			default:
+				break fill
+			}
+		}
+		p.commit(ctx, batch)
+	}
+}
+
+// stop closes the write queue and waits for the last batch.
+func (p *persister) stop() {
+	close(p.writes)
+	<-p.stopped
+}
+
+// commit writes a batch and reports the outcome to each command. If the
+// batch fails, its commands are retried one per transaction to find the
+// one that cannot be written; the commands before it are committed.
+func (p *persister) commit(ctx context.Context, batch []*pendingWrite) {
+	batch = p.refuse(batch)
+	if len(batch) == 0 {
+		return
+	}
+	err := p.write(ctx, batch)
+	if err == nil {
+		for _, w := range batch {
+			p.committed(w)
+		}
+		return
+	}
+	if len(batch) > 1 {
+		log.Printf("persist: batch of %d commands failed, retrying one by one: %v", len(batch), err)
+	}
+	for i, w := range batch {
+		if len(batch) > 1 {
+			err = p.write(ctx, batch[i:i+1])
+		}
+		if err != nil {
+			p.fail(w, err)
+			p.commit(ctx, batch[i+1:])
+			return
+		}
+		p.committed(w)
+	}
+}
+
+func (p *persister) committed(w *pendingWrite) {
+	if w.n > 0 {
+		p.durable.Store(w.n)
+	}
+	w.finish(nil)
+}
+
+// fail answers a write that could not be committed and starts refusing the
+// writes behind it.
+func (p *persister) fail(w *pendingWrite, err error) {
+	p.refusing = true
+	// queued for the engine loop before the caller hears of it, so the
+	// caller's next command runs after the rollback; there is room, as
+	// nothing else fails until the loop has resumed
+	p.failed <- w
+	w.finish(err)
+}
+
+// refuse answers the writes of a batch that were queued behind a failed
+// write with ErrRolledBack, up to the resume marker, and returns the rest.
+func (p *persister) refuse(batch []*pendingWrite) []*pendingWrite {
+	for p.refusing && len(batch) > 0 {
+		w := batch[0]
+		batch = batch[1:]
+		if w.resume {
+			p.refusing = false
+			continue
+		}
+		w.finish(ErrRolledBack)
+	}
+	return batch
+}
+
+func (p *persister) write(ctx context.Context, batch []*pendingWrite) error {
+	steps := 0
+	for _, w := range batch {
+		steps += len(w.steps)
+	}
+	if steps == 0 {
+		return nil
+	}
+
+	return p.store.InTx(ctx, func(q Queries) error {
+		b := newDBBatch(q)
+		var seq uint64
+		for _, w := range batch {
+			for _, step := range w.steps {
+				if err := step(ctx, b); err != nil {
+					return err
+				}
+			}
+			seq = max(seq, w.seq)
+		}
+		if seq > 0 {
+			if err := q.SetLastSeq(ctx, int64(seq)); err != nil {
+				return err
+			}
+		}
+		return b.flush(ctx)
+	})
+}
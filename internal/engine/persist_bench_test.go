@@ -0,0 +1,93 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"testing"
+
+	"github.com/google/uuid"
+	dbsqlc "github.com/hakimelghazi/exchange-core/db/sqlc"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// BenchmarkPersistPlace places crossing orders from many goroutines against
+// a migrated database at DATABASE_URL. batch=1 commits every command on its
+// own, as the engine did before persistence was batched.
+func BenchmarkPersistPlace(b *testing.B) {
+	url := os.Getenv("DATABASE_URL")
+	if url == "" {
+		b.Skip("DATABASE_URL not set")
+	}
+	for _, size := range []int{1, DefaultBatchSize} {
+		b.Run(fmt.Sprintf("batch=%d", size), func(b *testing.B) {
+			benchmarkPlace(b, url, size)
+		})
+	}
+}
+
+func benchmarkPlace(b *testing.B, url string, batch int) {
+	ctx, cancel := context.WithCancel(context.Background())
+	pool, err := pgxpool.New(ctx, url)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer pool.Close()
+	q := dbsqlc.New(pool)
+
+	store, err := NewPostgresStore(pool, q)
+	if err != nil {
+		b.Fatal(err)
+	}
+	e, err := NewEngine(1024, store)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err := e.UseBatchSize(batch); err != nil {
+		b.Fatal(err)
+	}
+	if err := e.Bootstrap(ctx, nil); err != nil {
+		b.Fatal(err)
+	}
+	go e.Run(ctx)
+	defer func() {
+		cancel()
+		<-e.done
+	}()
+
+	users := [2]string{uuid.NewString(), uuid.NewString()}
+	for _, u := range users {
+		if err := q.UpsertUser(ctx, dbsqlc.UpsertUserParams{ID: pgUUIDFrom(uuid.MustParse(u))}); err != nil {
+			b.Fatal(err)
+		}
+		for _, asset := range []string{"BTC", "USD"} {
+			t := &Transfer{ID: uuid.NewString(), UserID: u, Kind: TransferDeposit, Asset: asset, Amount: 1 << 40, ExternalRef: uuid.NewString()}
+			if _, _, err := e.RequestTransfer(ctx, t); err != nil {
+				b.Fatal(err)
+			}
+			if _, err := e.ConfirmTransfer(ctx, t.ID); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+
+	var n atomic.Int64
+	b.SetParallelism(16)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			i := n.Add(1)
+			side, user := SideBuy, users[0]
+			if i%2 == 1 {
+				side, user = SideSell, users[1]
+			}
+			o := newSTPOrder(uuid.NewString(), user, side, 100, 1, STPNone)
+			if _, err := e.Place(ctx, o); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "orders/s")
+}
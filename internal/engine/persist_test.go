@@ -0,0 +1,35 @@
+package engine
+
+import (
+	"context"
+	"testing"
+)
+
+func TestPersisterAnswersInSubmitOrder(t *testing.T) {
+	p := newPersister(NewMemStore(), 4)
+	go p.run(context.Background())
+	defer p.stop()
+
+	var got []int
+	for i := 0; i < 10; i++ {
+		w := &pendingWrite{done: func(err error) {
+			if err != nil {
+				t.Errorf("write %d: %v", i, err)
+			}
+			got = append(got, i)
+		}}
+		w.add(nil)
+		p.submit(w)
+	}
+	if err := p.flush(context.Background()); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	if len(got) != 10 {
+		t.Fatalf("expected every write answered before flush returns, got %v", got)
+	}
+	for i, n := range got {
+		if n != i {
+			t.Fatalf("expected answers in submit order, got %v", got)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package engine
+
+const priceIndexMaxLevel = 32
+
+// priceIndex keeps the prices of one book side ordered best-first. It is a
+// skiplist: insert and remove are O(log n) and the best price is the first
+// node. Node heights come from a fixed-seed generator, so the same sequence
+// of operations always builds the same structure.
+type priceIndex struct {
+	desc   bool // true for bids (highest first)
+	head   *priceNode
+	height int
+	length int
+	seed   uint64
+}
+
+type priceNode struct {
+	price int64
+	next  []*priceNode
+}
+
+func newPriceIndex(desc bool) *priceIndex {
+	return &priceIndex{
+		desc:   desc,
+		head:   &priceNode{next: make([]*priceNode, priceIndexMaxLevel)},
+		height: 1,
+		seed:   0x9E3779B97F4A7C15,
+	}
+}
+
+// Len returns the number of price levels in the index.
+func (idx *priceIndex) Len() int {
+	return idx.length
+}
+
+// before reports whether a sorts ahead of b on this side of the book.
+func (idx *priceIndex) before(a, b int64) bool {
+	if idx.desc {
+		return a > b
+	}
+	return a < b
+}
+
+// randomHeight draws a node height with p = 1/4 per extra level (xorshift64).
+func (idx *priceIndex) randomHeight() int {
+	h := 1
+	for h < priceIndexMaxLevel {
+		idx.seed ^= idx.seed << 13
+		idx.seed ^= idx.seed >> 7
+		idx.seed ^= idx.seed << 17
+		if idx.seed&3 != 0 {
+			break
+		}
+		h++
+	}
+	return h
+}
+
+// insert adds price; inserting a price that is already present is a no-op.
+func (idx *priceIndex) insert(price int64) {
+	var update [priceIndexMaxLevel]*priceNode
+	n := idx.head
+	for i := idx.height - 1; i >= 0; i-- {
+		for n.next[i] != nil && idx.before(n.next[i].price, price) {
+			n = n.next[i]
+		}
+		update[i] = n
+	}
+	if next := n.next[0]; next != nil && next.price == price {
+		return
+	}
+
+	h := idx.randomHeight()
+	if h > idx.height {
+		for i := idx.height; i < h; i++ {
+			update[i] = idx.head
+		}
+		idx.height = h
+	}
+	node := &priceNode{price: price, next: make([]*priceNode, h)}
+	for i := 0; i < h; i++ {
+		node.next[i] = update[i].next[i]
+		update[i].next[i] = node
+	}
+	idx.length++
+}
+
+// remove deletes price and reports whether it was present.
+func (idx *priceIndex) remove(price int64) bool {
+	var update [priceIndexMaxLevel]*priceNode
+	n := idx.head
+	for i := idx.height - 1; i >= 0; i-- {
+		for n.next[i] != nil && idx.before(n.next[i].price, price) {
+			n = n.next[i]
+		}
+		update[i] = n
+	}
+	target := n.next[0]
+	if target == nil || target.price != price {
+		return false
+	}
+	for i := 0; i < len(target.next); i++ {
+		update[i].next[i] = target.next[i]
+	}
+	for idx.height > 1 && idx.head.next[idx.height-1] == nil {
+		idx.height--
+	}
+	idx.length--
+	return true
+}
+
+// first returns the best price node, or nil if the index is empty. Walk the
+// rest in priority order with n.next[0].
+func (idx *priceIndex) first() *priceNode {
+	return idx.head.next[0]
+}
@@ -0,0 +1,73 @@
+package engine
+
+import (
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func indexPrices(idx *priceIndex) []int64 {
+	out := make([]int64, 0, idx.Len())
+	for n := idx.first(); n != nil; n = n.next[0] {
+		out = append(out, n.price)
+	}
+	return out
+}
+
+func TestPriceIndexOrdering(t *testing.T) {
+	asks := newPriceIndex(false)
+	bids := newPriceIndex(true)
+	for _, p := range []int64{105, 101, 110, 101, 99} {
+		asks.insert(p)
+		bids.insert(p)
+	}
+
+	if got := indexPrices(asks); len(got) != 4 || got[0] != 99 || got[3] != 110 {
+		t.Fatalf("unexpected ask order %v", got)
+	}
+	if got := indexPrices(bids); len(got) != 4 || got[0] != 110 || got[3] != 99 {
+		t.Fatalf("unexpected bid order %v", got)
+	}
+
+	if !asks.remove(99) || asks.remove(99) {
+		t.Fatalf("expected exactly one successful remove")
+	}
+	if asks.first().price != 101 || asks.Len() != 3 {
+		t.Fatalf("expected best ask 101 after remove")
+	}
+}
+
+func TestPriceIndexMatchesSortedSlice(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	idx := newPriceIndex(true)
+	want := map[int64]bool{}
+
+	for i := 0; i < 5000; i++ {
+		p := rng.Int63n(500)
+		if rng.Intn(3) == 0 {
+			if idx.remove(p) != want[p] {
+				t.Fatalf("remove(%d) disagreed with reference", p)
+			}
+			delete(want, p)
+			continue
+		}
+		idx.insert(p)
+		want[p] = true
+	}
+
+	ref := make([]int64, 0, len(want))
+	for p := range want {
+		ref = append(ref, p)
+	}
+	sort.Slice(ref, func(i, j int) bool { return ref[i] > ref[j] })
+
+	got := indexPrices(idx)
+	if len(got) != len(ref) || idx.Len() != len(ref) {
+		t.Fatalf("expected %d levels, got %d (Len %d)", len(ref), len(got), idx.Len())
+	}
+	for i := range ref {
+		if got[i] != ref[i] {
+			t.Fatalf("level %d: expected %d, got %d", i, ref[i], got[i])
+		}
+	}
+}
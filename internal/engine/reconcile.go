@@ -0,0 +1,273 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+	dbsqlc "github.com/hakimelghazi/exchange-core/db/sqlc"
+)
+
+// Problems Reconcile reports.
+const (
+	ProblemMissingInBook = "missing_in_book" // resting in the database only
+	ProblemMissingInDB   = "missing_in_db"   // resting in the book only
+	ProblemMismatch      = "mismatch"        // side, price or remaining differ
+)
+
+// RestingState is a resting order as the book or the database has it.
+type RestingState struct {
+	Side      Side  `json:"side"`
+	Price     int64 `json:"price"`
+	Remaining int64 `json:"remaining"`
+}
+
+// Discrepancy is a resting order the book and the database disagree on.
+type Discrepancy struct {
+	OrderID string        `json:"order_id"`
+	Market  string        `json:"market"`
+	Problem string        `json:"problem"`
+	Book    *RestingState `json:"book,omitempty"` // nil when missing in the book
+	DB      *RestingState `json:"db,omitempty"`   // nil when missing in the database
+}
+
+// Reconciliation is the outcome of comparing the books with the resting
+// orders stored after the command with engine sequence number Seq.
+type Reconciliation struct {
+	Seq           uint64        `json:"seq"`
+	Checked       int           `json:"checked"` // distinct resting orders compared
+	Discrepancies []Discrepancy `json:"discrepancies"`
+	Repaired      bool          `json:"repaired"`
+}
+
+type reconcileResult struct {
+	Report *Reconciliation
+	Err    error
+}
+
+// Reconcile compares every resting order of market, or of every market if
+// market is empty, with the orders the database lists as resting, and
+// reports where they differ. With repair, the books are brought in line
+// with the database, which is the record: orders it does not list leave the
+// book, the others rest as stored, re-entering at the back of their price
+// level, and the balances of their owners are reloaded from the ledger.
+func (e *Engine) Reconcile(ctx context.Context, market string, repair bool) (*Reconciliation, error) {
+	resp := make(chan any, 1)
+	cmd := Command{Type: CmdReconcile, ID: market, Repair: repair, Resp: resp}
+
+	if err := e.enqueueCommand(ctx, cmd); err != nil {
+		return nil, err
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case raw := <-resp:
+		out := raw.(reconcileResult)
+		return out.Report, out.Err
+	}
+}
+
+func (e *Engine) handleReconcile(ctx context.Context, cmd Command) {
+	rep, err := e.reconcile(ctx, cmd.ID, cmd.Repair)
+	cmd.Resp <- reconcileResult{Report: rep, Err: err}
+}
+
+func (e *Engine) reconcile(ctx context.Context, market string, repair bool) (*Reconciliation, error) {
+	books := e.books.byMarket
+	if market != "" {
+		mb, ok := e.books.lookup(market)
+		if !ok {
+			return nil, fmt.Errorf("%w %q", ErrUnknownMarket, market)
+		}
+		books = map[string]*marketBook{market: mb}
+	}
+	// compare against the writes of every command applied so far
+	if err := e.settleWrites(ctx); err != nil {
+		return nil, err
+	}
+	stored, err := e.restingRows(ctx, market)
+	if err != nil {
+		return nil, err
+	}
+
+	rep := &Reconciliation{Seq: e.seq, Discrepancies: []Discrepancy{}}
+	unmatched := make(map[string]dbsqlc.Order, len(stored))
+	for id, r := range stored {
+		unmatched[id] = r
+	}
+	for symbol, mb := range books {
+		for id, ref := range mb.book.ordersByID {
+			o := ref.elem.Value.(*Order)
+			book := &RestingState{Side: o.Side, Price: o.Price, Remaining: o.Remaining}
+			rep.Checked++
+			r, ok := stored[id]
+			if !ok {
+				rep.Discrepancies = append(rep.Discrepancies, Discrepancy{OrderID: id, Market: symbol, Problem: ProblemMissingInDB, Book: book})
+				continue
+			}
+			delete(unmatched, id)
+			if db := restingStateOf(r); *db != *book {
+				rep.Discrepancies = append(rep.Discrepancies, Discrepancy{OrderID: id, Market: symbol, Problem: ProblemMismatch, Book: book, DB: db})
+			}
+		}
+	}
+	for id, r := range unmatched {
+		rep.Checked++
+		rep.Discrepancies = append(rep.Discrepancies, Discrepancy{OrderID: id, Market: r.Market, Problem: ProblemMissingInBook, DB: restingStateOf(r)})
+	}
+	sort.Slice(rep.Discrepancies, func(i, j int) bool {
+		a, b := rep.Discrepancies[i], rep.Discrepancies[j]
+		if a.Market != b.Market {
+			return a.Market < b.Market
+		}
+		return a.OrderID < b.OrderID
+	})
+	if !repair || len(rep.Discrepancies) == 0 {
+		return rep, nil
+	}
+
+	plan, err := e.planRepair(ctx, rep.Discrepancies, stored)
+	if err != nil {
+		return nil, err
+	}
+	if e.journal != nil {
+		if err := e.journal.appendRepair(time.Now(), plan); err != nil {
+			return nil, err
+		}
+	}
+	if err := e.applyRepair(plan); err != nil {
+		return nil, err
+	}
+	log.Printf("reconcile: repaired %d resting orders", len(rep.Discrepancies))
+	rep.Repaired = true
+	return rep, nil
+}
+
+// restingRows returns the orders the database lists as resting in market,
+// or in every registered market if market is empty, by id.
+func (e *Engine) restingRows(ctx context.Context, market string) (map[string]dbsqlc.Order, error) {
+	asks, err := e.queries.ListRestingAsks(ctx, market)
+	if err != nil {
+		return nil, fmt.Errorf("reconcile asks: %w", err)
+	}
+	bids, err := e.queries.ListRestingBids(ctx, market)
+	if err != nil {
+		return nil, fmt.Errorf("reconcile bids: %w", err)
+	}
+	rows := make(map[string]dbsqlc.Order, len(asks)+len(bids))
+	for _, r := range append(asks, bids...) {
+		if _, ok := e.books.lookup(r.Market); ok {
+			rows[uuid.UUID(r.ID.Bytes).String()] = r
+		}
+	}
+	return rows, nil
+}
+
+func restingStateOf(r dbsqlc.Order) *RestingState {
+	side, _ := ParseSide(r.Side)
+	return &RestingState{Side: side, Price: numericToInt64(r.Price), Remaining: numericToInt64(r.Remaining)}
+}
+
+// repairPlan is what a repair changes. It is journaled before it is
+// applied, so replay repeats it without the database.
+type repairPlan struct {
+	Drop     []string        `json:"drop"`               // orders taken out of the books
+	Rest     []*Order        `json:"rest,omitempty"`     // orders rested again as stored
+	Balances []storedBalance `json:"balances,omitempty"` // every balance of their owners, from the ledger
+}
+
+type storedBalance struct {
+	UserID    string `json:"user_id"`
+	Asset     string `json:"asset"`
+	Available int64  `json:"available"`
+	Held      int64  `json:"held"`
+}
+
+// planRepair takes every order in ds out of the books and rests again those
+// the database has, and reloads the balances of the users owning them.
+func (e *Engine) planRepair(ctx context.Context, ds []Discrepancy, stored map[string]dbsqlc.Order) (*repairPlan, error) {
+	plan := &repairPlan{}
+	users := make(map[string]bool)
+	for _, d := range ds {
+		plan.Drop = append(plan.Drop, d.OrderID)
+		if mb, ok := e.books.findOrder(d.OrderID); ok {
+			o, _ := mb.book.order(d.OrderID)
+			users[o.UserID] = true
+		}
+		if r, ok := stored[d.OrderID]; ok {
+			o := orderFromRow(r)
+			plan.Rest = append(plan.Rest, o)
+			users[o.UserID] = true
+		}
+	}
+
+	// assets the ledger has no account for end up at zero
+	byKey := make(map[balanceKey]*storedBalance)
+	for user := range users {
+		for asset := range e.funds.balances[user] {
+			byKey[balanceKey{user, asset}] = &storedBalance{UserID: user, Asset: asset}
+		}
+	}
+	rows, err := e.queries.ListAccountBalances(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("reconcile balances: %w", err)
+	}
+	for _, r := range rows {
+		user := uuid.UUID(r.UserID.Bytes).String()
+		if !users[user] {
+			continue
+		}
+		key := balanceKey{user, r.Asset}
+		b, ok := byKey[key]
+		if !ok {
+			b = &storedBalance{UserID: user, Asset: r.Asset}
+			byKey[key] = b
+		}
+		switch r.Kind {
+		case AccountAvailable:
+			b.Available = numericToInt64(r.Balance)
+		case AccountHeld:
+			b.Held = numericToInt64(r.Balance)
+		}
+	}
+	for _, b := range byKey {
+		plan.Balances = append(plan.Balances, *b)
+	}
+	sort.Slice(plan.Balances, func(i, j int) bool {
+		a, b := plan.Balances[i], plan.Balances[j]
+		if a.UserID != b.UserID {
+			return a.UserID < b.UserID
+		}
+		return a.Asset < b.Asset
+	})
+	return plan, nil
+}
+
+// applyRepair carries out a repair plan on the books and funds. Holds of
+// dropped orders are forgotten rather than released: the balances that
+// follow already say what is held.
+func (e *Engine) applyRepair(p *repairPlan) error {
+	for _, id := range p.Drop {
+		if mb, ok := e.books.findOrder(id); ok {
+			mb.book.CancelOrder(id)
+			e.funds.drop(id)
+		} else if mb, ok := e.books.findStop(id); ok {
+			mb.stops.remove(id)
+		}
+	}
+	for _, o := range p.Rest {
+		o.shown = 0 // rests with a fresh iceberg slice, as replay does
+		if err := e.restOrder(o); err != nil {
+			return fmt.Errorf("repair: %w", err)
+		}
+	}
+	for _, sb := range p.Balances {
+		b := e.funds.balance(sb.UserID, sb.Asset)
+		b.available, b.held = sb.Available, sb.Held
+	}
+	return nil
+}
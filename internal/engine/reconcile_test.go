@@ -0,0 +1,129 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/uuid"
+	dbsqlc "github.com/hakimelghazi/exchange-core/db/sqlc"
+)
+
+// startJournaledEngine is startMemEngine with a journal at path.
+func startJournaledEngine(t *testing.T, store Store, path string) (e *Engine, stop func()) {
+	t.Helper()
+	e, err := NewEngine(16, store)
+	if err != nil {
+		t.Fatalf("new engine: %v", err)
+	}
+	j, err := OpenJournal(path)
+	if err != nil {
+		t.Fatalf("open journal: %v", err)
+	}
+	e.UseJournal(j)
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := e.Bootstrap(ctx, nil); err != nil {
+		t.Fatalf("bootstrap: %v", err)
+	}
+	go e.Run(ctx)
+	stopped := false
+	stop = func() {
+		if !stopped {
+			stopped = true
+			cancel()
+			<-e.done
+			j.Close()
+		}
+	}
+	t.Cleanup(stop)
+	return e, stop
+}
+
+func TestReconcileReportsAndRepairsDrift(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemStore()
+	path := filepath.Join(t.TempDir(), "journal")
+	e, stop := startJournaledEngine(t, store, path)
+
+	maker := uuid.NewString()
+	fund(t, e, maker, "BTC", 10)
+	a := newSTPOrder(uuid.NewString(), maker, SideSell, 100, 4, STPNone)
+	b := newSTPOrder(uuid.NewString(), maker, SideSell, 101, 2, STPNone)
+	for _, o := range []*Order{a, b} {
+		if _, err := e.Place(ctx, o); err != nil {
+			t.Fatalf("place %s: %v", o.ID, err)
+		}
+	}
+	if rep, err := e.Reconcile(ctx, "", false); err != nil || rep.Checked != 2 || len(rep.Discrepancies) != 0 {
+		t.Fatalf("expected the books to agree with the store, got %+v, %v", rep, err)
+	}
+
+	// the store drifts behind the engine's back
+	q := store.Queries()
+	if err := q.UpdateOrderAfterMatch(ctx, dbsqlc.UpdateOrderAfterMatchParams{ID: pgUUIDFrom(uuid.MustParse(a.ID)), Remaining: numericFromInt64(3), Status: "PARTIAL", HiddenQuantity: numericFromInt64(0)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.MarkOrderCancelled(ctx, dbsqlc.MarkOrderCancelledParams{ID: pgUUIDFrom(uuid.MustParse(b.ID))}); err != nil {
+		t.Fatal(err)
+	}
+	d := uuid.NewString()
+	if _, err := q.UpsertOrder(ctx, dbsqlc.UpsertOrderParams{
+		ID:          pgUUIDFrom(uuid.MustParse(d)),
+		UserID:      pgUUIDFrom(uuid.MustParse(maker)),
+		Market:      MarketBTCUSD,
+		Side:        "SELL",
+		Price:       numericFromInt64(102),
+		Quantity:    numericFromInt64(1),
+		Remaining:   numericFromInt64(1),
+		Status:      "OPEN",
+		TimeInForce: string(TIFGTC),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	before := stateOf(t, e)
+	rep, err := e.Reconcile(ctx, MarketBTCUSD, false)
+	if err != nil {
+		t.Fatalf("reconcile: %v", err)
+	}
+	want := map[string]string{a.ID: ProblemMismatch, b.ID: ProblemMissingInDB, d: ProblemMissingInBook}
+	if rep.Checked != 3 || len(rep.Discrepancies) != len(want) || rep.Repaired {
+		t.Fatalf("expected 3 discrepancies in 3 orders, got %+v", rep)
+	}
+	for _, dis := range rep.Discrepancies {
+		if want[dis.OrderID] != dis.Problem {
+			t.Fatalf("order %s: expected %s, got %s", dis.OrderID, want[dis.OrderID], dis.Problem)
+		}
+		if dis.OrderID == a.ID && (dis.Book.Remaining != 4 || dis.DB.Remaining != 3) {
+			t.Fatalf("expected remaining 4 in the book and 3 stored, got %+v, %+v", dis.Book, dis.DB)
+		}
+	}
+	expectState(t, stateOf(t, e), before)
+
+	if rep, err := e.Reconcile(ctx, "", true); err != nil || !rep.Repaired || len(rep.Discrepancies) != 3 {
+		t.Fatalf("expected a repair, got %+v, %v", rep, err)
+	}
+	if rep, err := e.Reconcile(ctx, "", false); err != nil || rep.Checked != 2 || len(rep.Discrepancies) != 0 {
+		t.Fatalf("expected no discrepancies after the repair, got %+v, %v", rep, err)
+	}
+	live := stateOf(t, e)
+	if live.holds[a.ID].amount != 3 || live.holds[d].amount != 1 {
+		t.Fatalf("expected holds for the stored remainders, got %v", live.holds)
+	}
+
+	// the store and the journal both rebuild the repaired books
+	stop()
+	fromStore, stop := startMemEngine(t, store)
+	expectState(t, stateOf(t, fromStore), live)
+	stop()
+	fromJournal, _ := startJournaledEngine(t, store, path)
+	expectState(t, stateOf(t, fromJournal), live)
+}
+
+func TestReconcileRejectsUnknownMarket(t *testing.T) {
+	e, _ := startMemEngine(t, NewMemStore())
+	if _, err := e.Reconcile(context.Background(), "DOGE-USD", false); !errors.Is(err, ErrUnknownMarket) {
+		t.Fatalf("expected ErrUnknownMarket, got %v", err)
+	}
+}
@@ -0,0 +1,361 @@
+package engine
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+// BookHash is a digest of every order book and stop book after the command
+// with sequence number Seq.
+type BookHash struct {
+	Seq  uint64 `json:"seq"`
+	Hash string `json:"hash"`
+}
+
+type bookHashResult struct {
+	Hash BookHash
+}
+
+// BookHash returns the hash of the live books. Comparing it with the hash
+// ReplayJournal computes up to the same sequence number shows whether
+// replay rebuilds them exactly.
+func (e *Engine) BookHash(ctx context.Context) (*BookHash, error) {
+	resp := make(chan any, 1)
+	cmd := Command{Type: CmdBookHash, Resp: resp}
+
+	if err := e.enqueueCommand(ctx, cmd); err != nil {
+		return nil, err
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case raw := <-resp:
+		out := raw.(bookHashResult)
+		return &out.Hash, nil
+	}
+}
+
+func (e *Engine) bookHash() BookHash {
+	var seq uint64
+	if e.journal != nil {
+		seq = e.journal.Seq()
+	}
+	return BookHash{Seq: seq, Hash: e.books.hash()}
+}
+
+// ReplayJournal rebuilds the books of an engine that has not run yet from
+// the journal at path, up to and including sequence number upTo (0 for the
+// whole journal), and returns their hash. Markets are read from the
+// database and fee tier rates from the journal; nothing is written to it.
+func (e *Engine) ReplayJournal(ctx context.Context, path string, upTo uint64) (*BookHash, error) {
+	if err := e.loadMarkets(ctx); err != nil {
+		return nil, err
+	}
+	seq, err := e.replay(ctx, path, 0, upTo)
+	if err != nil {
+		return nil, err
+	}
+	return &BookHash{Seq: seq, Hash: e.books.hash()}, nil
+}
+
+// replay re-executes the journal entries after sequence number from, up to
+// and including upTo (0 for the rest of the journal), against the in-memory
+// state of a freshly bootstrapped engine whose markets are registered. From
+// 0 it starts the engine's history, so every market starts untraded; from a
+// snapshot it continues where the snapshot left off.
+func (e *Engine) replay(ctx context.Context, path string, from, upTo uint64) (uint64, error) {
+	if from == 0 {
+		for _, mb := range e.books.byMarket {
+			mb.lastPrice = 0
+		}
+	}
+	if e.history == nil {
+		e.history = newHistory()
+	}
+	if e.placements == nil {
+		e.placements = newPlacements()
+	}
+	rolledBack, err := journalRollbacks(path)
+	if err != nil {
+		return 0, err
+	}
+	r := &replayer{e: e, h: e.history}
+	seq := from
+	err = readJournal(path, func(en journalEntry) error {
+		if en.Seq <= from {
+			return nil
+		}
+		if upTo > 0 && en.Seq > upTo {
+			return errStopReplay
+		}
+		switch {
+		case en.Type == CmdRollback:
+		case en.Type == CmdRepair:
+			// a repair takes no sequence number
+			if err := e.applyRepair(en.Repair); err != nil {
+				return fmt.Errorf("replay entry %d: %w", en.Seq, err)
+			}
+		case !rolledBack.has(en.Seq):
+			if err := r.apply(ctx, en); err != nil {
+				return fmt.Errorf("replay entry %d: %w", en.Seq, err)
+			}
+		}
+		seq = en.Seq
+		return nil
+	})
+	if err != nil && !errors.Is(err, errStopReplay) {
+		return 0, err
+	}
+	if upTo > 0 && seq < upTo {
+		return 0, fmt.Errorf("replay: journal ends at %d, before %d", seq, upTo)
+	}
+	return seq, nil
+}
+
+var errStopReplay = errors.New("stop replay")
+
+// seqRanges are ranges of journal entries, first and last included.
+type seqRanges [][2]uint64
+
+func (rs seqRanges) has(seq uint64) bool {
+	for _, r := range rs {
+		if seq >= r[0] && seq <= r[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// journalRollbacks returns the entries of the journal at path that were
+// rolled back after a failed write. They left no trace in the database, so
+// replay skips them.
+func journalRollbacks(path string) (seqRanges, error) {
+	var rs seqRanges
+	err := readJournal(path, func(en journalEntry) error {
+		if en.Type == CmdRollback {
+			rs = append(rs, [2]uint64{en.From, en.Seq})
+		}
+		return nil
+	})
+	return rs, err
+}
+
+// history remembers what the live transfer handlers check against rows
+// already in the database: transfer references and transfers still
+// pending. Replay checks history instead, so it refuses exactly what the
+// live engine refused. It is only kept with a journal; a nil history
+// records nothing. Placements are checked against the engine's placements
+// and the store lookup journaled with them.
+type history struct {
+	refs      map[string]bool      // kind + "/" + external ref
+	transfers map[string]*Transfer // pending transfers by id
+}
+
+func newHistory() *history {
+	return &history{
+		refs:      make(map[string]bool),
+		transfers: make(map[string]*Transfer),
+	}
+}
+
+func historyKey(userID string, key IdempotencyKey) string {
+	if key.Key == "" {
+		return ""
+	}
+	return userID + "/" + key.Key
+}
+
+func transferRef(t *Transfer) string {
+	return string(t.Kind) + "/" + t.ExternalRef
+}
+
+// requested records a transfer that was created pending.
+func (h *history) requested(t *Transfer) {
+	if h == nil {
+		return
+	}
+	h.refs[transferRef(t)] = true
+	h.transfers[t.ID] = t
+}
+
+// settled records that a pending transfer was confirmed or rejected.
+func (h *history) settled(id string) {
+	if h == nil {
+		return
+	}
+	delete(h.transfers, id)
+}
+
+// replayer re-executes journal entries with the same in-memory steps as the
+// live handlers, checking history where they query the database.
+type replayer struct {
+	e *Engine
+	h *history
+}
+
+// apply replays one entry. Commands the live engine refused are refused
+// again and leave no trace; only a failure to replay at all is returned.
+func (r *replayer) apply(ctx context.Context, en journalEntry) error {
+	e := r.e
+	defer e.funds.takeMoves()
+	e.cmdSeq = 0
+
+	switch en.Type {
+	case CmdPlace:
+		r.place(en)
+
+	case CmdCancel:
+		if en.UserID == "" || e.books.ownedBy(en.ID, en.UserID) {
+			e.dropOrder(en.ID)
+		}
+
+	case CmdExpire:
+		e.dropOrder(en.ID)
+
+	case CmdMassCancel:
+		if targets, _, err := e.books.massCancelTargets(en.MassCancel); err == nil {
+			e.dropTargets(targets)
+		}
+
+	case CmdDeadManTrip:
+		targets, _, _ := e.books.massCancelTargets(&MassCancel{UserID: en.ID})
+		e.dropTargets(targets)
+		e.deadMan.disarm(en.ID)
+
+	case CmdAmend:
+		mb, o, next, keepPriority, err := e.checkAmend(en.Amend)
+		if err != nil {
+			return nil
+		}
+		res, _, err := e.execAmend(mb, o, next, keepPriority)
+		if err != nil {
+			return nil
+		}
+		e.fireTriggers(mb, res.Trades, nil)
+
+	case CmdRequestTransfer:
+		r.requestTransfer(en.Transfer)
+
+	case CmdConfirmTransfer:
+		r.settleTransfer(en.ID, TransferConfirmed)
+
+	case CmdRejectTransfer:
+		r.settleTransfer(en.ID, TransferRejected)
+
+	case CmdSetFeeTier:
+		if _, err := uuidFromString(en.ID); err != nil {
+			return nil
+		}
+		// the rates the tier had when the command ran
+		e.fees.setTier(en.ID, en.FeeRates)
+
+	case CmdHeartbeat:
+		if en.Timeout == 0 {
+			e.deadMan.disarm(en.ID)
+		} else if en.Timeout >= MinDeadManTimeout && en.Timeout <= MaxDeadManTimeout {
+			// entries written before the expiry was journaled count from
+			// the time they were applied
+			expiresAt := en.At.Add(en.Timeout)
+			if en.ExpiresAt != nil {
+				expiresAt = *en.ExpiresAt
+			}
+			e.deadMan.arm(DeadManSwitch{UserID: en.ID, TimeoutMs: en.Timeout.Milliseconds(), ExpiresAt: expiresAt})
+		}
+
+	default:
+		return fmt.Errorf("unknown command type %d", en.Type)
+	}
+	return nil
+}
+
+func (r *replayer) place(en journalEntry) {
+	e, o := r.e, en.Order
+	var key IdempotencyKey
+	if en.Idempotency != nil {
+		key = *en.Idempotency
+	}
+	if prev, err := e.placements.prior(o, key, en.Stored); prev != nil || err != nil {
+		return
+	}
+	mb, err := e.checkPlace(o, en.At)
+	if err != nil {
+		return
+	}
+
+	res, _, _, err := e.execPlace(mb, o)
+	if err != nil {
+		return
+	}
+	e.fireTriggers(mb, res.Trades, nil)
+	pl := placement{requestHash: key.RequestHash, at: en.At}
+	if key.Key != "" {
+		pl.result, _ = json.Marshal(res)
+	}
+	e.placements.add(o, key, pl)
+	if res.Remainder != nil || res.Untriggered {
+		e.expiries.schedule(o)
+	}
+}
+
+func (r *replayer) requestTransfer(t *Transfer) {
+	if r.e.checkTransfer(t) != nil || r.h.refs[transferRef(t)] {
+		return
+	}
+	if t.Kind == TransferWithdrawal {
+		if err := r.e.funds.reserve(t.ID, t.UserID, t.Asset, t.Amount); err != nil {
+			return
+		}
+	}
+	t.Status = TransferPending
+	r.h.requested(t)
+}
+
+func (r *replayer) settleTransfer(id string, status TransferStatus) {
+	t, ok := r.h.transfers[id]
+	if !ok {
+		return
+	}
+	r.e.funds.settleTransfer(t, status)
+	r.h.settled(id)
+}
+
+// hash digests every book in market order: resting orders in priority order,
+// then untriggered stops in trigger order, with the fields that decide how
+// each one matches.
+func (r *bookRegistry) hash() string {
+	markets := make([]string, 0, len(r.byMarket))
+	for m := range r.byMarket {
+		markets = append(markets, m)
+	}
+	sort.Strings(markets)
+
+	h := sha256.New()
+	for _, m := range markets {
+		mb := r.byMarket[m]
+		fmt.Fprintf(h, "market %s %d\n", m, mb.lastPrice)
+		hashSide(h, "bid", mb.book.bidPrices, func(p int64) *list.List { return mb.book.bids[p].orders })
+		hashSide(h, "ask", mb.book.askPrices, func(p int64) *list.List { return mb.book.asks[p].orders })
+		hashSide(h, "buy-stop", mb.stops.buyStops, func(p int64) *list.List { return mb.stops.buys[p] })
+		hashSide(h, "sell-stop", mb.stops.sellStops, func(p int64) *list.List { return mb.stops.sells[p] })
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func hashSide(w io.Writer, side string, prices *priceIndex, level func(price int64) *list.List) {
+	for n := prices.first(); n != nil; n = n.next[0] {
+		fmt.Fprintf(w, "%s %d\n", side, n.price)
+		for el := level(n.price).Front(); el != nil; el = el.Next() {
+			o := el.Value.(*Order)
+			fmt.Fprintf(w, "%s %s %d %d %d %d %s\n", o.ID, o.UserID, o.Quantity, o.Remaining, o.visible(), o.StopPrice, o.ExpiresAt.UTC().Format(time.RFC3339Nano))
+		}
+	}
+}
@@ -0,0 +1,680 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	dbsqlc "github.com/hakimelghazi/exchange-core/db/sqlc"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+var errInjected = errors.New("injected failure")
+
+// failingStore is a MemStore whose transactions fail at one step, a query
+// or the commit, while that step is set. A transaction can also be held at
+// its start until released.
+type failingStore struct {
+	*MemStore
+
+	mu      sync.Mutex
+	step    string
+	hold    chan struct{} // closed to let a held transaction go on
+	entered chan struct{} // receives once a transaction is held
+}
+
+func newFailingStore() *failingStore {
+	return &failingStore{MemStore: NewMemStore()}
+}
+
+func (s *failingStore) failAt(step string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.step = step
+}
+
+// holdNext makes the next transaction wait for release.
+func (s *failingStore) holdNext() (entered <-chan struct{}, release func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hold, s.entered = make(chan struct{}), make(chan struct{}, 1)
+	hold := s.hold
+	return s.entered, func() { close(hold) }
+}
+
+func (s *failingStore) InTx(ctx context.Context, fn func(q Queries) error) error {
+	s.mu.Lock()
+	step, hold, entered := s.step, s.hold, s.entered
+	s.hold = nil
+	s.mu.Unlock()
+	if hold != nil {
+		entered <- struct{}{}
+		<-hold
+		s.mu.Lock()
+		step = s.step
+		s.mu.Unlock()
+	}
+
+	return s.MemStore.InTx(ctx, func(q Queries) error {
+		if err := fn(failingQueries{Queries: q, step: step}); err != nil {
+			return err
+		}
+		if step == "commit" {
+			return errInjected
+		}
+		return nil
+	})
+}
+
+type failingQueries struct {
+	Queries
+	step string
+}
+
+func (q failingQueries) fail(step string) error {
+	if q.step == step {
+		return fmt.Errorf("%s: %w", step, errInjected)
+	}
+	return nil
+}
+
+func (q failingQueries) UpsertOrder(ctx context.Context, arg dbsqlc.UpsertOrderParams) (dbsqlc.Order, error) {
+	if err := q.fail("UpsertOrder"); err != nil {
+		return dbsqlc.Order{}, err
+	}
+	return q.Queries.UpsertOrder(ctx, arg)
+}
+
+func (q failingQueries) UpdateOrderAfterMatch(ctx context.Context, arg dbsqlc.UpdateOrderAfterMatchParams) error {
+	if err := q.fail("UpdateOrderAfterMatch"); err != nil {
+		return err
+	}
+	return q.Queries.UpdateOrderAfterMatch(ctx, arg)
+}
+
+func (q failingQueries) InsertTrades(ctx context.Context, arg []dbsqlc.InsertTradesParams) (int64, error) {
+	if err := q.fail("InsertTrades"); err != nil {
+		return 0, err
+	}
+	return q.Queries.InsertTrades(ctx, arg)
+}
+
+func (q failingQueries) InsertLedgerEntries(ctx context.Context, arg []dbsqlc.InsertLedgerEntriesParams) (int64, error) {
+	if err := q.fail("InsertLedgerEntries"); err != nil {
+		return 0, err
+	}
+	return q.Queries.InsertLedgerEntries(ctx, arg)
+}
+
+func (q failingQueries) SetMarketLastPrice(ctx context.Context, arg dbsqlc.SetMarketLastPriceParams) error {
+	if err := q.fail("SetMarketLastPrice"); err != nil {
+		return err
+	}
+	return q.Queries.SetMarketLastPrice(ctx, arg)
+}
+
+func (q failingQueries) MarkOrderCancelled(ctx context.Context, arg dbsqlc.MarkOrderCancelledParams) error {
+	if err := q.fail("MarkOrderCancelled"); err != nil {
+		return err
+	}
+	return q.Queries.MarkOrderCancelled(ctx, arg)
+}
+
+func (q failingQueries) CreateTransfer(ctx context.Context, arg dbsqlc.CreateTransferParams) (dbsqlc.Transfer, error) {
+	if err := q.fail("CreateTransfer"); err != nil {
+		return dbsqlc.Transfer{}, err
+	}
+	return q.Queries.CreateTransfer(ctx, arg)
+}
+
+func (q failingQueries) UpdateTransferStatus(ctx context.Context, arg dbsqlc.UpdateTransferStatusParams) (dbsqlc.Transfer, error) {
+	if err := q.fail("UpdateTransferStatus"); err != nil {
+		return dbsqlc.Transfer{}, err
+	}
+	return q.Queries.UpdateTransferStatus(ctx, arg)
+}
+
+func (q failingQueries) GetOrderForUpdate(ctx context.Context, id pgtype.UUID) (dbsqlc.Order, error) {
+	if err := q.fail("GetOrderForUpdate"); err != nil {
+		return dbsqlc.Order{}, err
+	}
+	return q.Queries.GetOrderForUpdate(ctx, id)
+}
+
+func (q failingQueries) AmendOrder(ctx context.Context, arg dbsqlc.AmendOrderParams) error {
+	if err := q.fail("AmendOrder"); err != nil {
+		return err
+	}
+	return q.Queries.AmendOrder(ctx, arg)
+}
+
+func (q failingQueries) MarkOrderExpired(ctx context.Context, arg dbsqlc.MarkOrderExpiredParams) error {
+	if err := q.fail("MarkOrderExpired"); err != nil {
+		return err
+	}
+	return q.Queries.MarkOrderExpired(ctx, arg)
+}
+
+func (q failingQueries) MarkOrdersCancelled(ctx context.Context, arg dbsqlc.MarkOrdersCancelledParams) error {
+	if err := q.fail("MarkOrdersCancelled"); err != nil {
+		return err
+	}
+	return q.Queries.MarkOrdersCancelled(ctx, arg)
+}
+
+func (q failingQueries) CreateLedger(ctx context.Context, arg dbsqlc.CreateLedgerParams) (dbsqlc.Ledger, error) {
+	if err := q.fail("CreateLedger"); err != nil {
+		return dbsqlc.Ledger{}, err
+	}
+	return q.Queries.CreateLedger(ctx, arg)
+}
+
+func (q failingQueries) InsertLedgers(ctx context.Context, arg []dbsqlc.InsertLedgersParams) (int64, error) {
+	if err := q.fail("InsertLedgers"); err != nil {
+		return 0, err
+	}
+	return q.Queries.InsertLedgers(ctx, arg)
+}
+
+func (q failingQueries) InsertLedgerEntry(ctx context.Context, arg dbsqlc.InsertLedgerEntryParams) error {
+	if err := q.fail("InsertLedgerEntry"); err != nil {
+		return err
+	}
+	return q.Queries.InsertLedgerEntry(ctx, arg)
+}
+
+func (q failingQueries) GetAccountByUserAsset(ctx context.Context, arg dbsqlc.GetAccountByUserAssetParams) (dbsqlc.Account, error) {
+	if err := q.fail("GetAccountByUserAsset"); err != nil {
+		return dbsqlc.Account{}, err
+	}
+	return q.Queries.GetAccountByUserAsset(ctx, arg)
+}
+
+func (q failingQueries) UpsertAccount(ctx context.Context, arg dbsqlc.UpsertAccountParams) (dbsqlc.Account, error) {
+	if err := q.fail("UpsertAccount"); err != nil {
+		return dbsqlc.Account{}, err
+	}
+	return q.Queries.UpsertAccount(ctx, arg)
+}
+
+func (q failingQueries) InsertIdempotencyKey(ctx context.Context, arg dbsqlc.InsertIdempotencyKeyParams) error {
+	if err := q.fail("InsertIdempotencyKey"); err != nil {
+		return err
+	}
+	return q.Queries.InsertIdempotencyKey(ctx, arg)
+}
+
+func (q failingQueries) GetTransferByExternalRef(ctx context.Context, arg dbsqlc.GetTransferByExternalRefParams) (dbsqlc.Transfer, error) {
+	if err := q.fail("GetTransferByExternalRef"); err != nil {
+		return dbsqlc.Transfer{}, err
+	}
+	return q.Queries.GetTransferByExternalRef(ctx, arg)
+}
+
+func (q failingQueries) GetTransferForUpdate(ctx context.Context, id pgtype.UUID) (dbsqlc.Transfer, error) {
+	if err := q.fail("GetTransferForUpdate"); err != nil {
+		return dbsqlc.Transfer{}, err
+	}
+	return q.Queries.GetTransferForUpdate(ctx, id)
+}
+
+func (q failingQueries) GetFeeTier(ctx context.Context, name string) (dbsqlc.FeeTier, error) {
+	if err := q.fail("GetFeeTier"); err != nil {
+		return dbsqlc.FeeTier{}, err
+	}
+	return q.Queries.GetFeeTier(ctx, name)
+}
+
+func (q failingQueries) SetUserFeeTier(ctx context.Context, arg dbsqlc.SetUserFeeTierParams) error {
+	if err := q.fail("SetUserFeeTier"); err != nil {
+		return err
+	}
+	return q.Queries.SetUserFeeTier(ctx, arg)
+}
+
+func (q failingQueries) UpsertDeadManSwitch(ctx context.Context, arg dbsqlc.UpsertDeadManSwitchParams) (dbsqlc.DeadManSwitch, error) {
+	if err := q.fail("UpsertDeadManSwitch"); err != nil {
+		return dbsqlc.DeadManSwitch{}, err
+	}
+	return q.Queries.UpsertDeadManSwitch(ctx, arg)
+}
+
+func (q failingQueries) DeleteDeadManSwitch(ctx context.Context, userID pgtype.UUID) error {
+	if err := q.fail("DeleteDeadManSwitch"); err != nil {
+		return err
+	}
+	return q.Queries.DeleteDeadManSwitch(ctx, userID)
+}
+
+func (q failingQueries) SetLastSeq(ctx context.Context, seq int64) error {
+	if err := q.fail("SetLastSeq"); err != nil {
+		return err
+	}
+	return q.Queries.SetLastSeq(ctx, seq)
+}
+
+// engineState is what a rollback must restore: the books, including stops
+// and last prices, every balance that is not zero, every hold, the armed
+// dead man's switches and the fee tiers.
+type engineState struct {
+	hash     string
+	orders   int
+	balances map[balanceKey]balance
+	holds    map[string]orderHold
+	switches map[string]DeadManSwitch
+	tiers    map[string]FeeRates
+}
+
+// stateOf reads the state of a running engine between commands; the book
+// hash goes through the loop, so any pending rollback is done first.
+func stateOf(t *testing.T, e *Engine) engineState {
+	t.Helper()
+	h, err := e.BookHash(context.Background())
+	if err != nil {
+		t.Fatalf("book hash: %v", err)
+	}
+	return readState(e, h.Hash)
+}
+
+// readState reads the state of an engine whose loop is not running.
+func readState(e *Engine, hash string) engineState {
+	s := engineState{
+		hash:     hash,
+		balances: make(map[balanceKey]balance),
+		holds:    make(map[string]orderHold),
+		switches: make(map[string]DeadManSwitch),
+		tiers:    make(map[string]FeeRates),
+	}
+	for _, mb := range e.books.byMarket {
+		s.orders += len(mb.book.ordersByID) + len(mb.stops.byID)
+	}
+	for user, byAsset := range e.funds.balances {
+		for asset, b := range byAsset {
+			if *b != (balance{}) {
+				s.balances[balanceKey{user, asset}] = *b
+			}
+		}
+	}
+	for id, h := range e.funds.holds {
+		s.holds[id] = *h
+	}
+	for user, sw := range e.deadMan.byUser {
+		s.switches[user] = sw
+	}
+	for user, r := range e.fees.byUser {
+		s.tiers[user] = r
+	}
+	return s
+}
+
+func expectState(t *testing.T, got, want engineState) {
+	t.Helper()
+	if got.hash != want.hash || got.orders != want.orders {
+		t.Fatalf("expected the books to be restored")
+	}
+	if fmt.Sprint(got.balances) != fmt.Sprint(want.balances) {
+		t.Fatalf("expected balances %v, got %v", want.balances, got.balances)
+	}
+	if fmt.Sprint(got.holds) != fmt.Sprint(want.holds) {
+		t.Fatalf("expected holds %v, got %v", want.holds, got.holds)
+	}
+	if len(got.switches) != len(want.switches) {
+		t.Fatalf("expected switches %v, got %v", want.switches, got.switches)
+	}
+	for user, sw := range want.switches {
+		if g, ok := got.switches[user]; !ok || g.TimeoutMs != sw.TimeoutMs || !g.ExpiresAt.Equal(sw.ExpiresAt) {
+			t.Fatalf("expected switches %v, got %v", want.switches, got.switches)
+		}
+	}
+	if fmt.Sprint(got.tiers) != fmt.Sprint(want.tiers) {
+		t.Fatalf("expected fee tiers %v, got %v", want.tiers, got.tiers)
+	}
+}
+
+// sweep is the state sweepSetup leaves behind, and the ids the commands
+// run on top of it use.
+type sweep struct {
+	maker, taker, stopper string
+	ask                   string // the maker's ask at 101
+	withdrawal, deposit   string // pending transfers of the maker and taker
+	id                    string // unused, for whatever the next command creates
+}
+
+// sweepSetup rests a maker's asks at 100, one of them an iceberg, and 101,
+// and a buy stop at 101 that a sweep through 100 triggers. The maker's
+// dead man's switch is armed, and the maker's withdrawal and the taker's
+// deposit are pending.
+func sweepSetup(t *testing.T, e *Engine) *sweep {
+	t.Helper()
+	ctx := context.Background()
+	s := &sweep{maker: uuid.NewString(), taker: uuid.NewString(), stopper: uuid.NewString(), id: uuid.NewString()}
+	fund(t, e, s.maker, "BTC", 100)
+	fund(t, e, s.taker, "USD", 100_000)
+	fund(t, e, s.stopper, "USD", 10_000)
+
+	iceberg := newSTPOrder(uuid.NewString(), s.maker, SideSell, 100, 3, STPNone)
+	iceberg.DisplayQuantity = 1
+	stop := newSTPOrder(uuid.NewString(), s.stopper, SideBuy, 102, 1, STPNone)
+	stop.StopPrice = 101
+	ask := newSTPOrder(uuid.NewString(), s.maker, SideSell, 101, 5, STPNone)
+	s.ask = ask.ID
+	for _, o := range []*Order{
+		newSTPOrder(uuid.NewString(), s.maker, SideSell, 100, 2, STPNone),
+		iceberg,
+		ask,
+		stop,
+	} {
+		if _, err := e.Place(ctx, o); err != nil {
+			t.Fatalf("place %s: %v", o.ID, err)
+		}
+	}
+	if _, err := e.Heartbeat(ctx, s.maker, MaxDeadManTimeout); err != nil {
+		t.Fatalf("heartbeat: %v", err)
+	}
+
+	s.withdrawal, s.deposit = uuid.NewString(), uuid.NewString()
+	for _, tr := range []*Transfer{
+		{ID: s.withdrawal, UserID: s.maker, Kind: TransferWithdrawal, Asset: "BTC", Amount: 10, ExternalRef: uuid.NewString()},
+		{ID: s.deposit, UserID: s.taker, Kind: TransferDeposit, Asset: "BTC", Amount: 3, ExternalRef: uuid.NewString()},
+	} {
+		if _, _, err := e.RequestTransfer(ctx, tr); err != nil {
+			t.Fatalf("request transfer: %v", err)
+		}
+	}
+	return s
+}
+
+// failedWrites lists, for each command, every query its write issues. A
+// case fails if one of its steps is never reached.
+var failedWrites = []struct {
+	name  string
+	steps []string
+	run   func(ctx context.Context, e *Engine, s *sweep) error
+}{
+	{
+		// takes both levels at 100, part of 101, and triggers the stop
+		name: "keyed sweep",
+		steps: []string{"UpsertOrder", "GetOrderForUpdate", "UpdateOrderAfterMatch", "InsertTrades", "InsertLedgers",
+			"InsertLedgerEntries", "GetAccountByUserAsset", "UpsertAccount", "SetMarketLastPrice", "InsertIdempotencyKey", "SetLastSeq", "commit"},
+		run: func(ctx context.Context, e *Engine, s *sweep) error {
+			o := newSTPOrder(s.id, s.taker, SideBuy, 101, 7, STPNone)
+			res, _, err := e.PlaceIdempotent(ctx, o, IdempotencyKey{Key: "sweep", RequestHash: "h"})
+			if err == nil && !res.OrderFilled {
+				return fmt.Errorf("expected the sweep to fill, got %+v", res)
+			}
+			return err
+		},
+	},
+	{
+		name:  "amend price",
+		steps: []string{"AmendOrder", "SetLastSeq", "commit"},
+		run: func(ctx context.Context, e *Engine, s *sweep) error {
+			_, _, err := e.Amend(ctx, Amend{OrderID: s.ask, Price: 102, Quantity: 5})
+			return err
+		},
+	},
+	{
+		name:  "amend quantity",
+		steps: []string{"AmendOrder", "InsertLedgers", "InsertLedgerEntries", "SetLastSeq", "commit"},
+		run: func(ctx context.Context, e *Engine, s *sweep) error {
+			_, _, err := e.Amend(ctx, Amend{OrderID: s.ask, Price: 101, Quantity: 3})
+			return err
+		},
+	},
+	{
+		name:  "cancel",
+		steps: []string{"MarkOrderCancelled", "InsertLedgers", "InsertLedgerEntries", "SetLastSeq", "commit"},
+		run: func(ctx context.Context, e *Engine, s *sweep) error {
+			_, err := e.Cancel(ctx, s.ask)
+			return err
+		},
+	},
+	{
+		name:  "mass cancel",
+		steps: []string{"MarkOrdersCancelled", "InsertLedgers", "InsertLedgerEntries", "SetLastSeq", "commit"},
+		run: func(ctx context.Context, e *Engine, s *sweep) error {
+			_, err := e.MassCancel(ctx, MassCancel{UserID: s.maker})
+			return err
+		},
+	},
+	{
+		name:  "heartbeat",
+		steps: []string{"UpsertDeadManSwitch", "commit"},
+		run: func(ctx context.Context, e *Engine, s *sweep) error {
+			_, err := e.Heartbeat(ctx, s.taker, MaxDeadManTimeout)
+			return err
+		},
+	},
+	{
+		name:  "disarm",
+		steps: []string{"DeleteDeadManSwitch", "commit"},
+		run: func(ctx context.Context, e *Engine, s *sweep) error {
+			_, err := e.Heartbeat(ctx, s.maker, 0)
+			return err
+		},
+	},
+	{
+		name:  "request withdrawal",
+		steps: []string{"GetTransferByExternalRef", "CreateTransfer", "InsertLedgers", "InsertLedgerEntries", "GetAccountByUserAsset", "commit"},
+		run: func(ctx context.Context, e *Engine, s *sweep) error {
+			_, _, err := e.RequestTransfer(ctx, &Transfer{ID: s.id, UserID: s.maker, Kind: TransferWithdrawal, Asset: "BTC", Amount: 5, ExternalRef: s.id})
+			return err
+		},
+	},
+	{
+		name:  "confirm withdrawal",
+		steps: []string{"GetTransferForUpdate", "CreateLedger", "InsertLedgerEntry", "UpdateTransferStatus", "commit"},
+		run: func(ctx context.Context, e *Engine, s *sweep) error {
+			_, err := e.ConfirmTransfer(ctx, s.withdrawal)
+			return err
+		},
+	},
+	{
+		name:  "reject withdrawal",
+		steps: []string{"GetTransferForUpdate", "InsertLedgers", "InsertLedgerEntries", "UpdateTransferStatus", "commit"},
+		run: func(ctx context.Context, e *Engine, s *sweep) error {
+			_, err := e.RejectTransfer(ctx, s.withdrawal)
+			return err
+		},
+	},
+	{
+		name:  "confirm deposit",
+		steps: []string{"GetTransferForUpdate", "CreateLedger", "InsertLedgerEntry", "UpdateTransferStatus", "commit"},
+		run: func(ctx context.Context, e *Engine, s *sweep) error {
+			_, err := e.ConfirmTransfer(ctx, s.deposit)
+			return err
+		},
+	},
+	{
+		name:  "fee tier",
+		steps: []string{"SetUserFeeTier", "commit"},
+		run: func(ctx context.Context, e *Engine, s *sweep) error {
+			_, err := e.SetFeeTier(ctx, s.taker, "VIP1")
+			return err
+		},
+	},
+}
+
+func TestFailedWriteRestoresState(t *testing.T) {
+	for _, c := range failedWrites {
+		for _, step := range c.steps {
+			t.Run(c.name+"/"+step, func(t *testing.T) {
+				ctx := context.Background()
+				store := newFailingStore()
+				e, stop := startMemEngine(t, store)
+				s := sweepSetup(t, e)
+				// fee tiers are kept on the users row
+				if err := store.UpsertUser(ctx, dbsqlc.UpsertUserParams{ID: pgUUIDFrom(uuid.MustParse(s.taker))}); err != nil {
+					t.Fatal(err)
+				}
+				before := stateOf(t, e)
+
+				store.failAt(step)
+				if err := c.run(ctx, e, s); !errors.Is(err, errInjected) {
+					t.Fatalf("expected the injected failure, got %v", err)
+				}
+				expectState(t, stateOf(t, e), before)
+
+				// the command never happened: it can be sent again
+				store.failAt("")
+				if err := c.run(ctx, e, s); err != nil {
+					t.Fatalf("expected the command to succeed, got %v", err)
+				}
+
+				// memory and store agree
+				live := stateOf(t, e)
+				stop()
+				restarted, _ := startMemEngine(t, store)
+				expectState(t, stateOf(t, restarted), live)
+			})
+		}
+	}
+}
+
+// loopless bootstraps an engine from store and runs its persister but not
+// its loop, so a test can apply internal commands itself.
+func loopless(t *testing.T, store Store) *Engine {
+	t.Helper()
+	e, err := NewEngine(16, store)
+	if err != nil {
+		t.Fatalf("new engine: %v", err)
+	}
+	if err := e.Bootstrap(context.Background(), nil); err != nil {
+		t.Fatalf("bootstrap: %v", err)
+	}
+	go e.persist.run(context.Background())
+	t.Cleanup(e.persist.stop)
+	return e
+}
+
+func TestFailedInternalWriteRestoresState(t *testing.T) {
+	cases := []struct {
+		name  string
+		steps []string
+		cmd   func(s *sweep, gtd string) Command
+	}{
+		{
+			name:  "expire",
+			steps: []string{"MarkOrderExpired", "InsertLedgers", "InsertLedgerEntries", "SetLastSeq", "commit"},
+			cmd:   func(s *sweep, gtd string) Command { return Command{Type: CmdExpire, ID: gtd} },
+		},
+		{
+			name:  "dead man trip",
+			steps: []string{"MarkOrdersCancelled", "InsertLedgers", "InsertLedgerEntries", "DeleteDeadManSwitch", "SetLastSeq", "commit"},
+			cmd:   func(s *sweep, gtd string) Command { return Command{Type: CmdDeadManTrip, ID: s.maker} },
+		},
+	}
+	for _, c := range cases {
+		for _, step := range c.steps {
+			t.Run(c.name+"/"+step, func(t *testing.T) {
+				ctx := context.Background()
+				store := newFailingStore()
+				running, stop := startMemEngine(t, store)
+				s := sweepSetup(t, running)
+				gtd := newSTPOrder(uuid.NewString(), s.maker, SideSell, 103, 1, STPNone)
+				gtd.ExpiresAt = time.Now().Add(time.Hour)
+				if _, err := running.Place(ctx, gtd); err != nil {
+					t.Fatalf("place: %v", err)
+				}
+				stop()
+
+				e := loopless(t, store)
+				before := readState(e, e.bookHash().Hash)
+				store.failAt(step)
+				e.apply(ctx, c.cmd(s, gtd.ID))
+				if err := e.settleWrites(ctx); err != nil {
+					t.Fatalf("settle: %v", err)
+				}
+				expectState(t, readState(e, e.bookHash().Hash), before)
+
+				store.failAt("")
+				e.apply(ctx, c.cmd(s, gtd.ID))
+				if err := e.settleWrites(ctx); err != nil {
+					t.Fatalf("settle: %v", err)
+				}
+				live := readState(e, e.bookHash().Hash)
+				if live.hash == before.hash {
+					t.Fatalf("expected the command to change the books")
+				}
+				restarted, _ := startMemEngine(t, store)
+				expectState(t, stateOf(t, restarted), live)
+			})
+		}
+	}
+}
+
+func TestFailedCancelRestoresOrder(t *testing.T) {
+	ctx := context.Background()
+	store := newFailingStore()
+	e, _ := startMemEngine(t, store)
+	user := uuid.NewString()
+	fund(t, e, user, "BTC", 10)
+	o := newSTPOrder(uuid.NewString(), user, SideSell, 100, 4, STPNone)
+	if _, err := e.Place(ctx, o); err != nil {
+		t.Fatalf("place: %v", err)
+	}
+	before := stateOf(t, e)
+
+	store.failAt("MarkOrderCancelled")
+	if ok, err := e.Cancel(ctx, o.ID); ok || !errors.Is(err, errInjected) {
+		t.Fatalf("expected the injected failure, got %v, %v", ok, err)
+	}
+	expectState(t, stateOf(t, e), before)
+
+	store.failAt("")
+	if ok, err := e.Cancel(ctx, o.ID); !ok || err != nil {
+		t.Fatalf("expected the order to be cancelled, got %v", err)
+	}
+}
+
+func TestFailedWriteRollsBackLaterCommands(t *testing.T) {
+	ctx := context.Background()
+	store := newFailingStore()
+	e, _ := startMemEngine(t, store)
+	taker := sweepSetup(t, e).taker
+	before := stateOf(t, e)
+
+	// the sweep's write is held while a second order runs on top of it
+	entered, release := store.holdNext()
+	first := make(chan error, 1)
+	go func() {
+		_, err := e.Place(ctx, newSTPOrder(uuid.NewString(), taker, SideBuy, 100, 4, STPNone))
+		first <- err
+	}()
+	<-entered
+	held := stateOf(t, e)
+	second := make(chan error, 1)
+	go func() {
+		_, err := e.Place(ctx, newSTPOrder(uuid.NewString(), taker, SideBuy, 101, 2, STPNone))
+		second <- err
+	}()
+	for {
+		h, err := e.BookHash(ctx)
+		if err != nil {
+			t.Fatalf("book hash: %v", err)
+		}
+		if h.Hash != held.hash {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	store.failAt("InsertTrades")
+	release()
+	if err := <-first; !errors.Is(err, errInjected) {
+		t.Fatalf("expected the injected failure, got %v", err)
+	}
+	if err := <-second; !errors.Is(err, ErrRolledBack) {
+		t.Fatalf("expected the later order to be rolled back, got %v", err)
+	}
+	expectState(t, stateOf(t, e), before)
+
+	store.failAt("")
+	if _, err := e.Place(ctx, newSTPOrder(uuid.NewString(), taker, SideBuy, 100, 1, STPNone)); err != nil {
+		t.Fatalf("expected orders to be stored again after the rollback, got %v", err)
+	}
+}
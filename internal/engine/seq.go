@@ -0,0 +1,43 @@
+package engine
+
+// Engine sequence numbers order everything the engine does to orders. A
+// command takes the next one the first time it changes an order, and each
+// trade it produces takes the next one after it, so the trades of a command
+// follow its number consecutively: a consumer that knows a command's number
+// and how many trades it produced can tell whether it missed one. Trades
+// store their own number and orders the number of the last event that
+// changed them, which makes both usable as pagination cursors.
+//
+// Not every journaled command is numbered. Commands that are refused or
+// change no order take no number: placements, cancels and amends that
+// fail, transfers, fee tiers and heartbeats. Numbering them would leave
+// gaps in the order and trade stream that no consumer could tell from a
+// missed event. Where every command has to be ordered, the journal numbers
+// each of its entries.
+//
+// Replay hands out the same numbers as the live engine did. Every write of
+// a command that took numbers also stores the last one, and Bootstrap
+// continues after it, so no number is handed out twice.
+
+func (e *Engine) nextSeq() uint64 {
+	e.seq++
+	return e.seq
+}
+
+// commandSeq returns the sequence number of the command being applied,
+// taking the next one if it has none yet.
+func (e *Engine) commandSeq() uint64 {
+	if e.cmdSeq == 0 {
+		e.cmdSeq = e.nextSeq()
+	}
+	return e.cmdSeq
+}
+
+// stamp numbers a result with the command being applied and each of its
+// trades with the next sequence number.
+func (e *Engine) stamp(res *MatchResult) {
+	res.Seq = e.commandSeq()
+	for i := range res.Trades {
+		res.Trades[i].Seq = e.nextSeq()
+	}
+}
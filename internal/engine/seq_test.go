@@ -0,0 +1,93 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestTradesFollowTheirCommandSequenceNumber(t *testing.T) {
+	maker, taker := idOf("maker"), idOf("taker")
+	cmds := deposit("d1", maker, "BTC", 10)
+	cmds = append(cmds, deposit("d2", taker, "USD", 1000)...)
+	cmds = append(cmds,
+		place(newSTPOrder(idOf("a1"), maker, SideSell, 100, 1, STPNone)),
+		place(newSTPOrder(idOf("a2"), maker, SideSell, 101, 1, STPNone)),
+	)
+	path := filepath.Join(t.TempDir(), "journal")
+	writeJournal(t, path, cmds...)
+
+	e := newReplayEngine(MarketBTCUSD)
+	if _, err := e.replay(context.Background(), path, 0, 0); err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+	if e.seq != 2 {
+		t.Fatalf("expected a sequence number per order placed and none per transfer, got %d", e.seq)
+	}
+
+	e.cmdSeq = 0
+	mb := mustLookup(t, e.books, MarketBTCUSD)
+	res, _, _, err := e.execPlace(mb, newSTPOrder(idOf("t1"), taker, SideBuy, 101, 2, STPNone))
+	if err != nil {
+		t.Fatalf("place: %v", err)
+	}
+	if res.Seq != 3 || len(res.Trades) != 2 {
+		t.Fatalf("expected command 3 with two trades, got %d with %d", res.Seq, len(res.Trades))
+	}
+	for i, tr := range res.Trades {
+		if tr.Seq != res.Seq+uint64(i)+1 {
+			t.Fatalf("trade %d: expected seq %d, got %d", i, res.Seq+uint64(i)+1, tr.Seq)
+		}
+	}
+	if e.seq != 5 {
+		t.Fatalf("expected the next command to follow the trades, got last seq %d", e.seq)
+	}
+}
+
+func TestRefusedCommandsTakeNoSequenceNumber(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemStore()
+	e, stop := startMemEngine(t, store)
+	user := uuid.NewString()
+	fund(t, e, user, "BTC", 10)
+
+	first, err := e.Place(ctx, newSTPOrder(uuid.NewString(), user, SideSell, 100, 1, STPNone))
+	if err != nil {
+		t.Fatalf("place: %v", err)
+	}
+	if _, err := e.Place(ctx, newSTPOrder(uuid.NewString(), user, SideSell, 100, 0, STPNone)); !errors.Is(err, ErrNonPositiveAmount) {
+		t.Fatalf("expected ErrNonPositiveAmount, got %v", err)
+	}
+	if ok, err := e.Cancel(ctx, uuid.NewString()); ok || err != nil {
+		t.Fatalf("expected an unknown order not to be cancelled, got %v, %v", ok, err)
+	}
+	if _, err := e.Heartbeat(ctx, user, MaxDeadManTimeout); err != nil {
+		t.Fatalf("heartbeat: %v", err)
+	}
+	second, err := e.Place(ctx, newSTPOrder(uuid.NewString(), user, SideSell, 101, 1, STPNone))
+	if err != nil {
+		t.Fatalf("place: %v", err)
+	}
+	if second.Seq != first.Seq+1 {
+		t.Fatalf("expected %d to follow %d without a gap", second.Seq, first.Seq)
+	}
+
+	// the last number is stored, and a restart without a journal goes on
+	// after it
+	if store.lastSeq != int64(second.Seq) {
+		t.Fatalf("expected last seq %d stored, got %d", second.Seq, store.lastSeq)
+	}
+	stop()
+	store.lastSeq += 5 // as if later writes had stored nothing else
+	e, _ = startMemEngine(t, store)
+	third, err := e.Place(ctx, newSTPOrder(uuid.NewString(), user, SideSell, 102, 1, STPNone))
+	if err != nil {
+		t.Fatalf("place: %v", err)
+	}
+	if third.Seq != second.Seq+6 {
+		t.Fatalf("expected %d after a restart, got %d", second.Seq+6, third.Seq)
+	}
+}
@@ -0,0 +1,548 @@
+package engine
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+var ErrSnapshotCorrupt = errors.New("snapshot is corrupt")
+
+const (
+	snapshotMagic   = "EXSNAP"
+	snapshotVersion = 3
+	snapshotsKept   = 2
+)
+
+// snapshotter writes the engine's state to dir every interval, so Bootstrap
+// only has to replay the journal entries after the latest snapshot.
+type snapshotter struct {
+	dir   string
+	every time.Duration
+	last  uint64        // journal sequence number of the last snapshot taken
+	busy  chan struct{} // holds a token while a snapshot is being written
+}
+
+// UseSnapshots makes the engine snapshot its state into dir every interval
+// and Bootstrap start from the latest snapshot. Snapshots are positions in
+// the journal, so UseJournal must be called first.
+func (e *Engine) UseSnapshots(dir string, every time.Duration) error {
+	if e.journal == nil {
+		return errors.New("snapshots require a journal")
+	}
+	if every <= 0 {
+		return errors.New("snapshot interval must be positive")
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	e.snapshots = &snapshotter{dir: dir, every: every, busy: make(chan struct{}, 1)}
+	return nil
+}
+
+// wait blocks until no snapshot is being written.
+func (s *snapshotter) wait() {
+	s.busy <- struct{}{}
+	<-s.busy
+}
+
+// takeSnapshot encodes the engine's state on the engine loop and writes it
+// in the background. It does nothing if no command ran since the last
+// snapshot or the previous one is still being written.
+func (e *Engine) takeSnapshot() {
+	// only durable commands go into a snapshot
+	if err := e.settleWrites(context.Background()); err != nil {
+		log.Printf("snapshot skipped: %v", err)
+		return
+	}
+	s := e.snapshots
+	seq := e.journal.Seq()
+	if seq == s.last {
+		return
+	}
+	select {
+	case s.busy <- struct{}{}:
+	default:
+		log.Printf("snapshot at %d skipped: previous snapshot still being written", seq)
+		return
+	}
+	data := e.encodeSnapshot(seq)
+	s.last = seq
+	go func() {
+		defer func() { <-s.busy }()
+		if err := writeSnapshot(s.dir, seq, data); err != nil {
+			log.Printf("snapshot at %d failed: %v", seq, err)
+			return
+		}
+		pruneSnapshots(s.dir)
+	}()
+}
+
+// loadLatestSnapshot restores the newest snapshot in the snapshot directory
+// and returns its journal sequence number, or 0 if there is none.
+func (e *Engine) loadLatestSnapshot() (uint64, error) {
+	names, err := snapshotNames(e.snapshots.dir)
+	if err != nil || len(names) == 0 {
+		return 0, err
+	}
+	path := filepath.Join(e.snapshots.dir, names[len(names)-1])
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	seq, err := e.decodeSnapshot(data)
+	if err != nil {
+		return 0, fmt.Errorf("load %s: %w", path, err)
+	}
+	e.snapshots.last = seq
+	return seq, nil
+}
+
+func snapshotName(seq uint64) string {
+	return fmt.Sprintf("snapshot-%020d.bin", seq)
+}
+
+// snapshotNames lists the snapshot files in dir, oldest first.
+func snapshotNames(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, en := range entries {
+		if strings.HasPrefix(en.Name(), "snapshot-") && strings.HasSuffix(en.Name(), ".bin") {
+			names = append(names, en.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// writeSnapshot writes data to a temporary file and renames it into place,
+// so a crash never leaves a partial snapshot under a snapshot name.
+func writeSnapshot(dir string, seq uint64, data []byte) error {
+	tmp, err := os.CreateTemp(dir, "tmp-snapshot-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(dir, snapshotName(seq)))
+}
+
+// pruneSnapshots removes all but the newest snapshots.
+func pruneSnapshots(dir string) {
+	names, err := snapshotNames(dir)
+	if err != nil {
+		log.Printf("prune snapshots: %v", err)
+		return
+	}
+	for len(names) > snapshotsKept {
+		if err := os.Remove(filepath.Join(dir, names[0])); err != nil {
+			log.Printf("prune snapshots: %v", err)
+		}
+		names = names[1:]
+	}
+}
+
+// encodeSnapshot serializes everything replay rebuilds, after the journal
+// entry seq:
+//
+//	magic, version, seq, last engine sequence number
+//	per market: symbol, last price, then bids, asks, buy stops and sell
+//	  stops, each as price levels best first with their orders in FIFO order
+//	balances, holds, fee tiers, dead man's switches
+//	placements oldest first: time, order id, key, and for a key its
+//	  request hash and result
+//	history
+//	CRC-32 of everything before it
+//
+// Integers are varints, strings are length-prefixed and maps are written in
+// key order, so the same state always encodes to the same bytes.
+func (e *Engine) encodeSnapshot(seq uint64) []byte {
+	w := &snapWriter{buf: []byte(snapshotMagic)}
+	w.uint(snapshotVersion)
+	w.uint(seq)
+	w.uint(e.seq)
+
+	markets := sortedKeys(e.books.byMarket)
+	w.uint(uint64(len(markets)))
+	for _, m := range markets {
+		mb := e.books.byMarket[m]
+		w.str(m)
+		w.int(mb.lastPrice)
+		w.side(mb.book.bidPrices, func(p int64) *list.List { return mb.book.bids[p].orders })
+		w.side(mb.book.askPrices, func(p int64) *list.List { return mb.book.asks[p].orders })
+		w.side(mb.stops.buyStops, func(p int64) *list.List { return mb.stops.buys[p] })
+		w.side(mb.stops.sellStops, func(p int64) *list.List { return mb.stops.sells[p] })
+	}
+
+	users := sortedKeys(e.funds.balances)
+	w.uint(uint64(len(users)))
+	for _, u := range users {
+		byAsset := e.funds.balances[u]
+		w.str(u)
+		w.uint(uint64(len(byAsset)))
+		for _, a := range sortedKeys(byAsset) {
+			w.str(a)
+			w.int(byAsset[a].available)
+			w.int(byAsset[a].held)
+		}
+	}
+	holds := sortedKeys(e.funds.holds)
+	w.uint(uint64(len(holds)))
+	for _, id := range holds {
+		h := e.funds.holds[id]
+		w.str(id)
+		w.str(h.userID)
+		w.str(h.asset)
+		w.int(h.amount)
+	}
+
+	tiers := sortedKeys(e.fees.byUser)
+	w.uint(uint64(len(tiers)))
+	for _, u := range tiers {
+		w.str(u)
+		w.int(e.fees.byUser[u].MakerBps)
+		w.int(e.fees.byUser[u].TakerBps)
+	}
+
+	switches := sortedKeys(e.deadMan.byUser)
+	w.uint(uint64(len(switches)))
+	for _, u := range switches {
+		sw := e.deadMan.byUser[u]
+		w.str(u)
+		w.int(sw.TimeoutMs)
+		w.time(sw.ExpiresAt)
+	}
+
+	var placed []placed
+	for _, en := range e.placements.byAge {
+		if e.placements.current(en) {
+			placed = append(placed, en)
+		}
+	}
+	w.uint(uint64(len(placed)))
+	for _, en := range placed {
+		w.time(en.at)
+		w.str(en.orderID)
+		w.str(en.key)
+		if en.key != "" {
+			pl := e.placements.keys[en.key]
+			w.str(pl.requestHash)
+			w.str(string(pl.result))
+		}
+	}
+
+	h := e.history
+	w.strs(sortedKeys(h.refs))
+	pending := sortedKeys(h.transfers)
+	w.uint(uint64(len(pending)))
+	for _, id := range pending {
+		t := h.transfers[id]
+		w.str(t.ID)
+		w.str(t.UserID)
+		w.str(string(t.Kind))
+		w.str(t.Asset)
+		w.int(t.Amount)
+		w.str(t.ExternalRef)
+	}
+
+	return binary.BigEndian.AppendUint32(w.buf, crc32.ChecksumIEEE(w.buf))
+}
+
+// decodeSnapshot restores a snapshot into an engine whose markets are
+// registered and that holds no orders yet, and returns its sequence number.
+func (e *Engine) decodeSnapshot(data []byte) (uint64, error) {
+	if len(data) < len(snapshotMagic)+4 || !bytes.HasPrefix(data, []byte(snapshotMagic)) {
+		return 0, ErrSnapshotCorrupt
+	}
+	body, sum := data[:len(data)-4], binary.BigEndian.Uint32(data[len(data)-4:])
+	if crc32.ChecksumIEEE(body) != sum {
+		return 0, fmt.Errorf("%w: checksum mismatch", ErrSnapshotCorrupt)
+	}
+	r := &snapReader{buf: body[len(snapshotMagic):]}
+	if v := r.uint(); v != snapshotVersion {
+		return 0, fmt.Errorf("unsupported snapshot version %d", v)
+	}
+	seq := r.uint()
+	e.seq = r.uint()
+
+	for n := r.uint(); n > 0 && r.err == nil; n-- {
+		m := r.str()
+		mb, ok := e.books.lookup(m)
+		if !ok {
+			return 0, fmt.Errorf("snapshot: %w %q", ErrUnknownMarket, m)
+		}
+		mb.lastPrice = r.int()
+		for _, side := range []Side{SideBuy, SideSell} {
+			r.side(m, side, false, func(o *Order) { mb.book.AddOrder(o) })
+		}
+		for _, side := range []Side{SideBuy, SideSell} {
+			r.side(m, side, true, mb.stops.add)
+		}
+	}
+
+	for n := r.uint(); n > 0 && r.err == nil; n-- {
+		u := r.str()
+		for m := r.uint(); m > 0 && r.err == nil; m-- {
+			b := e.funds.balance(u, r.str())
+			b.available = r.int()
+			b.held = r.int()
+		}
+	}
+	for n := r.uint(); n > 0 && r.err == nil; n-- {
+		id := r.str()
+		e.funds.holds[id] = &orderHold{userID: r.str(), asset: r.str(), amount: r.int()}
+	}
+
+	for n := r.uint(); n > 0 && r.err == nil; n-- {
+		u := r.str()
+		e.fees.setTier(u, &FeeRates{MakerBps: r.int(), TakerBps: r.int()})
+	}
+
+	for n := r.uint(); n > 0 && r.err == nil; n-- {
+		e.deadMan.arm(DeadManSwitch{UserID: r.str(), TimeoutMs: r.int(), ExpiresAt: r.time()})
+	}
+
+	if e.placements == nil {
+		e.placements = newPlacements()
+	}
+	for n := r.uint(); n > 0 && r.err == nil; n-- {
+		at, orderID, key := r.time(), r.str(), r.str()
+		pl := placement{at: at}
+		if key != "" {
+			pl.requestHash, pl.result = r.str(), []byte(r.str())
+		}
+		e.placements.put(orderID, key, pl)
+	}
+
+	if e.history == nil {
+		e.history = newHistory()
+	}
+	h := e.history
+	for _, ref := range r.strs() {
+		h.refs[ref] = true
+	}
+	for n := r.uint(); n > 0 && r.err == nil; n-- {
+		t := &Transfer{ID: r.str(), UserID: r.str(), Kind: TransferKind(r.str()), Asset: r.str(), Amount: r.int(), ExternalRef: r.str(), Status: TransferPending}
+		h.transfers[t.ID] = t
+	}
+
+	if r.err == nil && len(r.buf) > 0 {
+		r.err = fmt.Errorf("%w: %d trailing bytes", ErrSnapshotCorrupt, len(r.buf))
+	}
+	if r.err != nil {
+		return 0, r.err
+	}
+	for _, mb := range e.books.byMarket {
+		for id := range mb.book.ordersByID {
+			o, _ := mb.book.order(id)
+			e.expiries.schedule(o)
+		}
+		for _, ref := range mb.stops.byID {
+			e.expiries.schedule(ref.elem.Value.(*Order))
+		}
+	}
+	return seq, nil
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+type snapWriter struct {
+	buf []byte
+}
+
+func (w *snapWriter) uint(v uint64) { w.buf = binary.AppendUvarint(w.buf, v) }
+func (w *snapWriter) int(v int64)   { w.buf = binary.AppendVarint(w.buf, v) }
+
+func (w *snapWriter) str(s string) {
+	w.uint(uint64(len(s)))
+	w.buf = append(w.buf, s...)
+}
+
+func (w *snapWriter) strs(ss []string) {
+	w.uint(uint64(len(ss)))
+	for _, s := range ss {
+		w.str(s)
+	}
+}
+
+func (w *snapWriter) bool(b bool) {
+	if b {
+		w.uint(1)
+	} else {
+		w.uint(0)
+	}
+}
+
+// time writes t as Unix nanoseconds, 0 for the zero time.
+func (w *snapWriter) time(t time.Time) {
+	if t.IsZero() {
+		w.int(0)
+		return
+	}
+	w.int(t.UnixNano())
+}
+
+// side writes the price levels of one side of a book, best first.
+func (w *snapWriter) side(prices *priceIndex, level func(price int64) *list.List) {
+	w.uint(uint64(prices.Len()))
+	for n := prices.first(); n != nil; n = n.next[0] {
+		orders := level(n.price)
+		w.int(n.price)
+		w.uint(uint64(orders.Len()))
+		for el := orders.Front(); el != nil; el = el.Next() {
+			w.order(el.Value.(*Order))
+		}
+	}
+}
+
+func (w *snapWriter) order(o *Order) {
+	w.str(o.ID)
+	w.str(o.UserID)
+	w.int(o.Price)
+	w.int(o.Quantity)
+	w.int(o.Remaining)
+	w.bool(o.IsMarket)
+	w.str(string(o.TimeInForce))
+	w.str(string(o.STP))
+	w.int(o.StopPrice)
+	w.time(o.ExpiresAt)
+	w.time(o.CreatedAt)
+	w.int(o.DisplayQuantity)
+	w.int(o.shown)
+	w.int(o.QuoteQuantity)
+}
+
+// snapReader reads what snapWriter wrote. The first error sticks and every
+// later read returns zero values.
+type snapReader struct {
+	buf []byte
+	err error
+}
+
+func (r *snapReader) fail() {
+	if r.err == nil {
+		r.err = fmt.Errorf("%w: truncated", ErrSnapshotCorrupt)
+	}
+	r.buf = nil
+}
+
+func (r *snapReader) uint() uint64 {
+	v, n := binary.Uvarint(r.buf)
+	if n <= 0 {
+		r.fail()
+		return 0
+	}
+	r.buf = r.buf[n:]
+	return v
+}
+
+func (r *snapReader) int() int64 {
+	v, n := binary.Varint(r.buf)
+	if n <= 0 {
+		r.fail()
+		return 0
+	}
+	r.buf = r.buf[n:]
+	return v
+}
+
+func (r *snapReader) str() string {
+	n := r.uint()
+	if n > uint64(len(r.buf)) {
+		r.fail()
+		return ""
+	}
+	s := string(r.buf[:n])
+	r.buf = r.buf[n:]
+	return s
+}
+
+func (r *snapReader) strs() []string {
+	var ss []string
+	for n := r.uint(); n > 0 && r.err == nil; n-- {
+		ss = append(ss, r.str())
+	}
+	return ss
+}
+
+func (r *snapReader) bool() bool {
+	return r.uint() == 1
+}
+
+func (r *snapReader) time() time.Time {
+	v := r.int()
+	if v == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, v).UTC()
+}
+
+// side reads the levels of one side of a book and hands each order to add in
+// FIFO order.
+func (r *snapReader) side(market string, side Side, stop bool, add func(*Order)) {
+	for levels := r.uint(); levels > 0 && r.err == nil; levels-- {
+		price := r.int()
+		for n := r.uint(); n > 0 && r.err == nil; n-- {
+			o := r.order(market, side)
+			if r.err != nil {
+				return
+			}
+			if (stop && o.StopPrice != price) || (!stop && o.Price != price) {
+				r.err = fmt.Errorf("%w: order %s at level %d", ErrSnapshotCorrupt, o.ID, price)
+				return
+			}
+			add(o)
+		}
+	}
+}
+
+func (r *snapReader) order(market string, side Side) *Order {
+	return &Order{
+		ID:              r.str(),
+		UserID:          r.str(),
+		Market:          market,
+		Side:            side,
+		Price:           r.int(),
+		Quantity:        r.int(),
+		Remaining:       r.int(),
+		IsMarket:        r.bool(),
+		TimeInForce:     TimeInForce(r.str()),
+		STP:             STPMode(r.str()),
+		StopPrice:       r.int(),
+		ExpiresAt:       r.time(),
+		CreatedAt:       r.time(),
+		DisplayQuantity: r.int(),
+		shown:           r.int(),
+		QuoteQuantity:   r.int(),
+	}
+}
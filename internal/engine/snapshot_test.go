@@ -0,0 +1,104 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSnapshotThenReplayMatchesFullReplay(t *testing.T) {
+	maker, taker := idOf("maker"), idOf("taker")
+	iceberg := newTestIceberg(idOf("ice"), SideSell, 101, 6, 2)
+	iceberg.UserID = maker
+	gtd := newSTPOrder(idOf("gtd"), maker, SideSell, 102, 1, STPNone)
+	gtd.ExpiresAt = time.Now().Add(time.Hour)
+	stop := newSTPOrder(idOf("stop"), taker, SideBuy, 105, 1, STPNone)
+	stop.StopPrice = 104
+
+	cmds := deposit("d1", maker, "BTC", 20)
+	cmds = append(cmds, deposit("d2", taker, "USD", 10_000)...)
+	cmds = append(cmds,
+		Command{Type: CmdRequestTransfer, Transfer: &Transfer{ID: "w1", UserID: maker, Kind: TransferWithdrawal, Asset: "BTC", Amount: 3, ExternalRef: "w1"}},
+		place(newSTPOrder(idOf("a1"), maker, SideSell, 100, 2, STPNone)),
+		place(iceberg),
+		place(gtd),
+		place(stop),
+		Command{Type: CmdHeartbeat, ID: taker, Timeout: time.Minute},
+		place(newSTPOrder(idOf("t1"), taker, SideBuy, 101, 3, STPNone)),
+		Command{Type: CmdRejectTransfer, ID: "w1"},
+		place(newSTPOrder(idOf("t2"), taker, SideBuy, 101, 1, STPNone)),
+		// a retry of an order placed before the snapshot is still a duplicate
+		place(newSTPOrder(idOf("a1"), maker, SideSell, 100, 2, STPNone)),
+	)
+	path := filepath.Join(t.TempDir(), "journal")
+	writeJournal(t, path, cmds...)
+	ctx := context.Background()
+
+	full := newReplayEngine(MarketBTCUSD)
+	if _, err := full.replay(ctx, path, 0, 0); err != nil {
+		t.Fatalf("full replay: %v", err)
+	}
+
+	// snapshot after the first fill, before the withdrawal is rejected
+	const at = 11
+	before := newReplayEngine(MarketBTCUSD)
+	if _, err := before.replay(ctx, path, 0, at); err != nil {
+		t.Fatalf("replay to %d: %v", at, err)
+	}
+	data := before.encodeSnapshot(at)
+	if !bytes.Equal(data, before.encodeSnapshot(at)) {
+		t.Fatalf("expected the same state to encode to the same bytes")
+	}
+
+	restored := newReplayEngine(MarketBTCUSD)
+	seq, err := restored.decodeSnapshot(data)
+	if err != nil || seq != at {
+		t.Fatalf("decode: seq %d, %v", seq, err)
+	}
+	if restored.books.hash() != before.books.hash() {
+		t.Fatalf("expected the restored books to hash like the snapshotted ones")
+	}
+	if !bytes.Equal(restored.encodeSnapshot(at), data) {
+		t.Fatalf("expected the restored state to encode like the snapshotted one")
+	}
+	if _, ok := restored.deadMan.byUser[taker]; !ok {
+		t.Fatalf("expected the dead man's switch to survive the snapshot")
+	}
+	if due := restored.expiries.due(gtd.ExpiresAt); len(due) != 1 || due[0] != gtd.ID {
+		t.Fatalf("expected gtd to be scheduled to expire, got %v", due)
+	}
+
+	if _, err := restored.replay(ctx, path, at, 0); err != nil {
+		t.Fatalf("replay after snapshot: %v", err)
+	}
+	if restored.books.hash() != full.books.hash() {
+		t.Fatalf("expected snapshot plus replay to rebuild the books of a full replay")
+	}
+	if restored.seq != full.seq {
+		t.Fatalf("expected snapshot plus replay to reach sequence number %d, got %d", full.seq, restored.seq)
+	}
+	for _, u := range []string{maker, taker} {
+		for _, a := range []string{"BTC", "USD"} {
+			b := full.funds.balance(u, a)
+			expectBalance(t, restored.funds, u, a, b.available, b.held)
+		}
+	}
+}
+
+func TestDecodeSnapshotRejectsDamage(t *testing.T) {
+	e := newReplayEngine(MarketBTCUSD)
+	e.history = newHistory()
+	data := e.encodeSnapshot(1)
+
+	damaged := append([]byte(nil), data...)
+	damaged[len(snapshotMagic)+1] ^= 0xff
+	if _, err := newReplayEngine(MarketBTCUSD).decodeSnapshot(damaged); !errors.Is(err, ErrSnapshotCorrupt) {
+		t.Fatalf("expected a checksum failure, got %v", err)
+	}
+	if _, err := newReplayEngine("ETH-USD").decodeSnapshot(data); !errors.Is(err, ErrUnknownMarket) {
+		t.Fatalf("expected an unregistered market to fail, got %v", err)
+	}
+}
@@ -0,0 +1,65 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestStopDrainsQueuedCommands(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemStore()
+	e, _ := startMemEngine(t, store)
+	user := uuid.NewString()
+	fund(t, e, user, "BTC", 100)
+	if err := e.Stop(ctx); err != nil {
+		t.Fatalf("stop: %v", err)
+	}
+	if _, err := e.Place(ctx, newSTPOrder(uuid.NewString(), user, SideSell, 100, 1, STPNone)); !errors.Is(err, ErrStopped) {
+		t.Fatalf("expected ErrStopped after stop, got %v", err)
+	}
+
+	// commands queued before the loop runs are all waiting when Stop is called
+	e, err := NewEngine(16, store)
+	if err != nil {
+		t.Fatalf("new engine: %v", err)
+	}
+	if err := e.Bootstrap(ctx, nil); err != nil {
+		t.Fatalf("bootstrap: %v", err)
+	}
+	orders := make([]*Order, 10)
+	placed := make(chan error, len(orders))
+	for i := range orders {
+		orders[i] = newSTPOrder(uuid.NewString(), user, SideSell, 100+int64(i), 1, STPNone)
+		go func(o *Order) {
+			_, err := e.Place(ctx, o)
+			placed <- err
+		}(orders[i])
+	}
+	for e.QueueStats().Depth < len(orders) {
+		time.Sleep(time.Millisecond)
+	}
+	expired, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := e.Stop(expired); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected stop to give up waiting without a loop, got %v", err)
+	}
+
+	go e.Run(ctx)
+	if err := e.Stop(ctx); err != nil {
+		t.Fatalf("stop: %v", err)
+	}
+	for range orders {
+		if err := <-placed; err != nil {
+			t.Fatalf("expected queued orders to be placed, got %v", err)
+		}
+	}
+	for _, o := range orders {
+		if got := storedOrder(t, store, o.ID).Status; got != "OPEN" {
+			t.Fatalf("order %s: expected OPEN, got %s", o.ID, got)
+		}
+	}
+}
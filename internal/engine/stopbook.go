@@ -0,0 +1,116 @@
+package engine
+
+import "container/list"
+
+// stopBook holds the untriggered stop orders of one market. Buy stops
+// trigger once the last trade price rises to their stop price, sell stops
+// once it falls to it. Stops at the same price trigger in arrival order.
+type stopBook struct {
+	buyStops  *priceIndex // ascending: the lowest buy stop triggers first
+	sellStops *priceIndex // descending: the highest sell stop triggers first
+	buys      map[int64]*list.List
+	sells     map[int64]*list.List
+	byID      map[string]*orderRef
+	byUser    userIndex
+
+	rec *recorder // undo log of the engine command changing the stops
+}
+
+func newStopBook() *stopBook {
+	return &stopBook{
+		buyStops:  newPriceIndex(false),
+		sellStops: newPriceIndex(true),
+		buys:      make(map[int64]*list.List),
+		sells:     make(map[int64]*list.List),
+		byID:      make(map[string]*orderRef),
+		byUser:    make(userIndex),
+	}
+}
+
+func (sb *stopBook) Len() int {
+	return len(sb.byID)
+}
+
+func (sb *stopBook) side(s Side) (*priceIndex, map[int64]*list.List) {
+	if s == SideBuy {
+		return sb.buyStops, sb.buys
+	}
+	return sb.sellStops, sb.sells
+}
+
+func (sb *stopBook) add(o *Order) {
+	sb.touch(o.Side, o.StopPrice)
+	idx, levels := sb.side(o.Side)
+	lvl, ok := levels[o.StopPrice]
+	if !ok {
+		lvl = list.New()
+		levels[o.StopPrice] = lvl
+		idx.insert(o.StopPrice)
+	}
+	sb.byID[o.ID] = &orderRef{side: o.Side, price: o.StopPrice, elem: lvl.PushBack(o)}
+	sb.byUser.add(o.UserID, o.ID)
+}
+
+func (sb *stopBook) remove(id string) bool {
+	ref, ok := sb.byID[id]
+	if !ok {
+		return false
+	}
+	sb.touch(ref.side, ref.price)
+	idx, levels := sb.side(ref.side)
+	lvl := levels[ref.price]
+	lvl.Remove(ref.elem)
+	if lvl.Len() == 0 {
+		delete(levels, ref.price)
+		idx.remove(ref.price)
+	}
+	sb.byUser.remove(ref.elem.Value.(*Order).UserID, id)
+	delete(sb.byID, id)
+	return true
+}
+
+// userOrders returns the user's untriggered stops, optionally only one side.
+func (sb *stopBook) userOrders(userID string, side Side) []*Order {
+	var out []*Order
+	for id := range sb.byUser[userID] {
+		o := sb.byID[id].elem.Value.(*Order)
+		if side == "" || o.Side == side {
+			out = append(out, o)
+		}
+	}
+	return out
+}
+
+// next removes and returns the first stop triggered at the last trade price,
+// buys before sells, or nil if none is. A last price of 0 means the market
+// has not traded yet and triggers nothing.
+func (sb *stopBook) next(last int64) *Order {
+	if last <= 0 {
+		return nil
+	}
+	if n := sb.buyStops.first(); n != nil && n.price <= last {
+		return sb.pop(sb.buys[n.price])
+	}
+	if n := sb.sellStops.first(); n != nil && n.price >= last {
+		return sb.pop(sb.sells[n.price])
+	}
+	return nil
+}
+
+func (sb *stopBook) pop(lvl *list.List) *Order {
+	o := lvl.Front().Value.(*Order)
+	sb.remove(o.ID)
+	return o
+}
+
+// stopTriggered reports whether a stop order is already triggered at the
+// last trade price.
+func stopTriggered(o *Order, last int64) bool {
+	if last <= 0 {
+		return false
+	}
+	if o.Side == SideBuy {
+		return last >= o.StopPrice
+	}
+	return last <= o.StopPrice
+}
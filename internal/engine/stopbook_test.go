@@ -0,0 +1,125 @@
+package engine
+
+import "testing"
+
+func newTestStop(id string, side Side, stop int64) *Order {
+	o := newTestOrder(id, side, 0, 1)
+	o.IsMarket = true
+	o.StopPrice = stop
+	return o
+}
+
+func TestStopBookTriggersInPriceThenArrivalOrder(t *testing.T) {
+	sb := newStopBook()
+	sb.add(newTestStop("b110", SideBuy, 110))
+	sb.add(newTestStop("b105a", SideBuy, 105))
+	sb.add(newTestStop("b105b", SideBuy, 105))
+	sb.add(newTestStop("s90", SideSell, 90))
+
+	if o := sb.next(104); o != nil {
+		t.Fatalf("expected nothing triggered at 104, got %s", o.ID)
+	}
+
+	var got []string
+	for o := sb.next(110); o != nil; o = sb.next(110) {
+		got = append(got, o.ID)
+	}
+	want := []string{"b105a", "b105b", "b110"}
+	if len(got) != len(want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("expected %v, got %v", want, got)
+		}
+	}
+	if sb.Len() != 1 {
+		t.Fatalf("expected the sell stop to remain, have %d stops", sb.Len())
+	}
+}
+
+func TestStopBookSellStopsTriggerHighestFirst(t *testing.T) {
+	sb := newStopBook()
+	sb.add(newTestStop("s80", SideSell, 80))
+	sb.add(newTestStop("s95", SideSell, 95))
+
+	if o := sb.next(90); o == nil || o.ID != "s95" {
+		t.Fatalf("expected s95 to trigger at 90, got %+v", o)
+	}
+	if o := sb.next(90); o != nil {
+		t.Fatalf("expected s80 to wait, got %s", o.ID)
+	}
+	if o := sb.next(80); o == nil || o.ID != "s80" {
+		t.Fatalf("expected s80 to trigger at 80, got %+v", o)
+	}
+}
+
+func TestStopBookRemove(t *testing.T) {
+	sb := newStopBook()
+	sb.add(newTestStop("b1", SideBuy, 105))
+
+	if !sb.remove("b1") {
+		t.Fatalf("expected b1 to be removed")
+	}
+	if sb.remove("b1") {
+		t.Fatalf("expected second remove to report missing")
+	}
+	if o := sb.next(200); o != nil {
+		t.Fatalf("expected removed stop not to trigger, got %s", o.ID)
+	}
+}
+
+func TestStopTriggered(t *testing.T) {
+	buy := newTestStop("b", SideBuy, 100)
+	sell := newTestStop("s", SideSell, 100)
+
+	cases := []struct {
+		o    *Order
+		last int64
+		want bool
+	}{
+		{buy, 0, false},
+		{buy, 99, false},
+		{buy, 100, true},
+		{sell, 101, false},
+		{sell, 100, true},
+		{sell, 0, false},
+	}
+	for _, c := range cases {
+		if got := stopTriggered(c.o, c.last); got != c.want {
+			t.Fatalf("stopTriggered(%s, %d) = %v, want %v", c.o.ID, c.last, got, c.want)
+		}
+	}
+}
+
+func TestTriggeredStopSweepsBookAndCascades(t *testing.T) {
+	books := newTestRegistry(MarketBTCUSD)
+	mb := mustLookup(t, books, MarketBTCUSD)
+	mb.book.AddOrder(newTestOrder("a101", SideSell, 101, 1))
+	mb.book.AddOrder(newTestOrder("a103", SideSell, 103, 1))
+	mb.book.AddOrder(newTestOrder("a105", SideSell, 105, 1))
+	first := newTestStop("b100", SideBuy, 100)
+	first.Quantity, first.Remaining = 2, 2
+	mb.stops.add(first)
+	mb.stops.add(newTestStop("b103", SideBuy, 103))
+
+	// a trade at 100 triggers the first stop, whose fill at 103 triggers the second
+	mb.lastPrice = 100
+	var fills []int64
+	for o := mb.stops.next(mb.lastPrice); o != nil; o = mb.stops.next(mb.lastPrice) {
+		res, err := mb.matcher.Submit(o)
+		if err != nil {
+			t.Fatalf("submit %s: %v", o.ID, err)
+		}
+		for _, tr := range res.Trades {
+			fills = append(fills, tr.Price)
+			mb.lastPrice = tr.Price
+		}
+	}
+	if len(fills) != 3 || fills[0] != 101 || fills[1] != 103 || fills[2] != 105 {
+		t.Fatalf("expected fills at 101, 103 then 105, got %v", fills)
+	}
+	if mb.stops.Len() != 0 {
+		t.Fatalf("expected no stops left, have %d", mb.stops.Len())
+	}
+}
@@ -0,0 +1,112 @@
+package engine
+
+import (
+	"context"
+	"errors"
+
+	dbsqlc "github.com/hakimelghazi/exchange-core/db/sqlc"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Queries are the statements the engine runs against its store. The
+// sqlc-generated *dbsqlc.Queries runs them on Postgres; MemStore answers
+// them from memory. Lookups that find nothing return pgx.ErrNoRows.
+type Queries interface {
+	// orders
+	UpsertOrder(ctx context.Context, arg dbsqlc.UpsertOrderParams) (dbsqlc.Order, error)
+	GetOrder(ctx context.Context, id pgtype.UUID) (dbsqlc.Order, error)
+	GetOrderForUpdate(ctx context.Context, id pgtype.UUID) (dbsqlc.Order, error)
+	UpdateOrderAfterMatch(ctx context.Context, arg dbsqlc.UpdateOrderAfterMatchParams) error
+	AmendOrder(ctx context.Context, arg dbsqlc.AmendOrderParams) error
+	MarkOrderCancelled(ctx context.Context, arg dbsqlc.MarkOrderCancelledParams) error
+	MarkOrderExpired(ctx context.Context, arg dbsqlc.MarkOrderExpiredParams) error
+	MarkOrdersCancelled(ctx context.Context, arg dbsqlc.MarkOrdersCancelledParams) error
+	ListRestingAsks(ctx context.Context, market string) ([]dbsqlc.Order, error)
+	ListRestingBids(ctx context.Context, market string) ([]dbsqlc.Order, error)
+	ListUntriggeredOrders(ctx context.Context, market string) ([]dbsqlc.Order, error)
+	GetMaxSeq(ctx context.Context) (int64, error)
+	SetLastSeq(ctx context.Context, seq int64) error
+
+	// trades and ledger
+	InsertTrades(ctx context.Context, arg []dbsqlc.InsertTradesParams) (int64, error)
+	CreateLedger(ctx context.Context, arg dbsqlc.CreateLedgerParams) (dbsqlc.Ledger, error)
+	InsertLedgers(ctx context.Context, arg []dbsqlc.InsertLedgersParams) (int64, error)
+	InsertLedgerEntry(ctx context.Context, arg dbsqlc.InsertLedgerEntryParams) error
+	InsertLedgerEntries(ctx context.Context, arg []dbsqlc.InsertLedgerEntriesParams) (int64, error)
+	GetAccountByUserAsset(ctx context.Context, arg dbsqlc.GetAccountByUserAssetParams) (dbsqlc.Account, error)
+	UpsertAccount(ctx context.Context, arg dbsqlc.UpsertAccountParams) (dbsqlc.Account, error)
+	ListAccountBalances(ctx context.Context) ([]dbsqlc.ListAccountBalancesRow, error)
+
+	// idempotency keys
+	GetIdempotencyKey(ctx context.Context, arg dbsqlc.GetIdempotencyKeyParams) (dbsqlc.IdempotencyKey, error)
+	InsertIdempotencyKey(ctx context.Context, arg dbsqlc.InsertIdempotencyKeyParams) error
+
+	// transfers
+	CreateTransfer(ctx context.Context, arg dbsqlc.CreateTransferParams) (dbsqlc.Transfer, error)
+	GetTransferByExternalRef(ctx context.Context, arg dbsqlc.GetTransferByExternalRefParams) (dbsqlc.Transfer, error)
+	GetTransferForUpdate(ctx context.Context, id pgtype.UUID) (dbsqlc.Transfer, error)
+	UpdateTransferStatus(ctx context.Context, arg dbsqlc.UpdateTransferStatusParams) (dbsqlc.Transfer, error)
+	ListPendingWithdrawals(ctx context.Context) ([]dbsqlc.Transfer, error)
+
+	// markets, fee tiers and dead man's switches
+	ListMarkets(ctx context.Context) ([]dbsqlc.Market, error)
+	SetMarketLastPrice(ctx context.Context, arg dbsqlc.SetMarketLastPriceParams) error
+	GetFeeTier(ctx context.Context, name string) (dbsqlc.FeeTier, error)
+	SetUserFeeTier(ctx context.Context, arg dbsqlc.SetUserFeeTierParams) error
+	ListUserFeeTiers(ctx context.Context) ([]dbsqlc.ListUserFeeTiersRow, error)
+	UpsertDeadManSwitch(ctx context.Context, arg dbsqlc.UpsertDeadManSwitchParams) (dbsqlc.DeadManSwitch, error)
+	DeleteDeadManSwitch(ctx context.Context, userID pgtype.UUID) error
+	ListDeadManSwitches(ctx context.Context) ([]dbsqlc.DeadManSwitch, error)
+}
+
+var _ Queries = (*dbsqlc.Queries)(nil)
+
+// Store keeps what the engine writes: orders, trades, the ledger,
+// transfers and the settings it bootstraps from.
+type Store interface {
+	// Queries runs each statement on its own.
+	Queries() Queries
+	// InTx runs fn in a transaction, committed if fn returns nil and rolled
+	// back otherwise.
+	InTx(ctx context.Context, fn func(q Queries) error) error
+}
+
+// pgStore is the Postgres store.
+type pgStore struct {
+	pool    *pgxpool.Pool
+	queries *dbsqlc.Queries
+}
+
+// NewPostgresStore returns a store on a migrated Postgres database.
+func NewPostgresStore(pool *pgxpool.Pool, queries *dbsqlc.Queries) (Store, error) {
+	if pool == nil || queries == nil {
+		return nil, errors.New("postgres store requires a database connection")
+	}
+	return &pgStore{pool: pool, queries: queries}, nil
+}
+
+func (s *pgStore) Queries() Queries {
+	return s.queries
+}
+
+func (s *pgStore) InTx(ctx context.Context, fn func(q Queries) error) error {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if tx != nil {
+			_ = tx.Rollback(ctx)
+		}
+	}()
+
+	if err := fn(s.queries.WithTx(tx)); err != nil {
+		return err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+	tx = nil
+	return nil
+}
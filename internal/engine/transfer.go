@@ -0,0 +1,341 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	dbsqlc "github.com/hakimelghazi/exchange-core/db/sqlc"
+	"github.com/jackc/pgx/v5"
+)
+
+// ExchangeUserID owns the omnibus account of each asset. Deposits are
+// funded from it and confirmed withdrawals are paid back into it, so every
+// ledger stays balanced.
+const ExchangeUserID = "00000000-0000-0000-0000-000000000001"
+
+// AccountOmnibus is the exchange's account for funds held off the books.
+const AccountOmnibus = "OMNIBUS"
+
+type TransferKind string
+
+const (
+	TransferDeposit    TransferKind = "DEPOSIT"
+	TransferWithdrawal TransferKind = "WITHDRAWAL"
+)
+
+type TransferStatus string
+
+const (
+	TransferPending   TransferStatus = "PENDING"
+	TransferConfirmed TransferStatus = "CONFIRMED"
+	TransferRejected  TransferStatus = "REJECTED"
+)
+
+// Transfer moves an asset between a user and the outside world. Deposits
+// credit the user only once confirmed; withdrawals hold the amount while
+// pending and pay it out on confirmation.
+type Transfer struct {
+	ID          string         `json:"id"`
+	UserID      string         `json:"user_id"`
+	Kind        TransferKind   `json:"kind"`
+	Asset       string         `json:"asset"`
+	Amount      int64          `json:"amount"`
+	Status      TransferStatus `json:"status"`
+	ExternalRef string         `json:"external_ref"` // idempotency key per kind
+	CreatedAt   time.Time      `json:"created_at"`
+	UpdatedAt   time.Time      `json:"updated_at"`
+}
+
+var (
+	ErrTransferNotFound   = errors.New("transfer not found")
+	ErrTransferConflict   = errors.New("external reference already used by a different transfer")
+	ErrTransferNotPending = errors.New("transfer is no longer pending")
+	ErrUnknownAsset       = &RejectError{Reason: "unknown asset"}
+)
+
+type transferResult struct {
+	Transfer *Transfer
+	Created  bool
+	Err      error
+}
+
+// RequestTransfer records a pending deposit or withdrawal. A repeated
+// request with the same kind and external reference returns the original
+// transfer with created set to false; if its details differ it fails with
+// ErrTransferConflict.
+func (e *Engine) RequestTransfer(ctx context.Context, t *Transfer) (*Transfer, bool, error) {
+	if t == nil {
+		return nil, false, errors.New("nil transfer")
+	}
+	return e.transferCommand(ctx, Command{Type: CmdRequestTransfer, Transfer: t})
+}
+
+// ConfirmTransfer completes a pending transfer.
+func (e *Engine) ConfirmTransfer(ctx context.Context, id string) (*Transfer, error) {
+	t, _, err := e.transferCommand(ctx, Command{Type: CmdConfirmTransfer, ID: id})
+	return t, err
+}
+
+// RejectTransfer cancels a pending transfer, returning held withdrawal funds.
+func (e *Engine) RejectTransfer(ctx context.Context, id string) (*Transfer, error) {
+	t, _, err := e.transferCommand(ctx, Command{Type: CmdRejectTransfer, ID: id})
+	return t, err
+}
+
+func (e *Engine) transferCommand(ctx context.Context, cmd Command) (*Transfer, bool, error) {
+	resp := make(chan any, 1)
+	cmd.Resp = resp
+
+	if err := e.enqueueCommand(ctx, cmd); err != nil {
+		return nil, false, err
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil, false, ctx.Err()
+	case raw := <-resp:
+		out := raw.(transferResult)
+		return out.Transfer, out.Created, out.Err
+	}
+}
+
+// checkTransfer normalizes the asset of a transfer request and validates it.
+func (e *Engine) checkTransfer(t *Transfer) error {
+	t.Asset = strings.ToUpper(strings.TrimSpace(t.Asset))
+	if t.Kind != TransferDeposit && t.Kind != TransferWithdrawal {
+		return fmt.Errorf("invalid transfer kind %q", t.Kind)
+	}
+	if t.Amount <= 0 {
+		return ErrNonPositiveAmount
+	}
+	if !e.books.hasAsset(t.Asset) {
+		return fmt.Errorf("%w %q", ErrUnknownAsset, t.Asset)
+	}
+	return nil
+}
+
+func (e *Engine) handleRequestTransfer(ctx context.Context, t *Transfer) (*Transfer, bool, error) {
+	if err := e.checkTransfer(t); err != nil {
+		return nil, false, err
+	}
+	userID, err := uuidFromString(t.UserID)
+	if err != nil {
+		return nil, false, fmt.Errorf("invalid user id: %w", err)
+	}
+	transferID, err := uuidFromString(t.ID)
+	if err != nil {
+		return nil, false, fmt.Errorf("invalid transfer id: %w", err)
+	}
+
+	var out *Transfer
+	created, reserved := false, false
+	err = e.store.InTx(ctx, func(q Queries) error {
+		existing, err := q.GetTransferByExternalRef(ctx, dbsqlc.GetTransferByExternalRefParams{
+			Kind:        string(t.Kind),
+			ExternalRef: t.ExternalRef,
+		})
+		if err == nil {
+			prev := transferFromRow(existing)
+			if prev.UserID != t.UserID || prev.Asset != t.Asset || prev.Amount != t.Amount {
+				return ErrTransferConflict
+			}
+			out = prev
+			return nil
+		}
+		if !errors.Is(err, pgx.ErrNoRows) {
+			return err
+		}
+
+		if t.Kind == TransferWithdrawal {
+			if err := e.funds.reserve(t.ID, t.UserID, t.Asset, t.Amount); err != nil {
+				return err
+			}
+			reserved = true
+		}
+		moves := e.funds.takeMoves()
+
+		row, err := q.CreateTransfer(ctx, dbsqlc.CreateTransferParams{
+			ID:          transferID,
+			UserID:      userID,
+			Kind:        string(t.Kind),
+			Asset:       t.Asset,
+			Amount:      numericFromInt64(t.Amount),
+			Status:      string(TransferPending),
+			ExternalRef: t.ExternalRef,
+		})
+		if err != nil {
+			return err
+		}
+		b := newDBBatch(q)
+		if err := e.persistFundsMoves(ctx, b, moves); err != nil {
+			return err
+		}
+		if err := b.flush(ctx); err != nil {
+			return err
+		}
+		out, created = transferFromRow(row), true
+		return nil
+	})
+	if err != nil {
+		if reserved {
+			e.undoCommand()
+		}
+		return nil, false, err
+	}
+	if created {
+		e.history.requested(out)
+	}
+	return out, created, nil
+}
+
+func (e *Engine) handleSettleTransfer(ctx context.Context, id string, status TransferStatus) (*Transfer, error) {
+	transferID, err := uuidFromString(id)
+	if err != nil {
+		return nil, fmt.Errorf("invalid transfer id: %w", err)
+	}
+
+	var out *Transfer
+	settled, applied := false, false
+	err = e.store.InTx(ctx, func(q Queries) error {
+		row, err := q.GetTransferForUpdate(ctx, transferID)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ErrTransferNotFound
+		}
+		if err != nil {
+			return err
+		}
+		t := transferFromRow(row)
+		if t.Status == status {
+			// replayed confirm/reject
+			out = t
+			return nil
+		}
+		if t.Status != TransferPending {
+			return ErrTransferNotPending
+		}
+
+		if status == TransferConfirmed {
+			if err := e.postTransfer(ctx, q, t); err != nil {
+				return err
+			}
+		}
+		e.funds.settleTransfer(t, status)
+		applied = true
+		b := newDBBatch(q)
+		if err := e.persistFundsMoves(ctx, b, e.funds.takeMoves()); err != nil {
+			return err
+		}
+		if err := b.flush(ctx); err != nil {
+			return err
+		}
+
+		updated, err := q.UpdateTransferStatus(ctx, dbsqlc.UpdateTransferStatusParams{
+			ID:     transferID,
+			Status: string(status),
+		})
+		if err != nil {
+			return err
+		}
+		out, settled = transferFromRow(updated), true
+		return nil
+	})
+	if err != nil {
+		log.Printf("handleSettleTransfer: settling %s failed: %v", id, err)
+		if applied {
+			e.undoCommand()
+		}
+		return nil, err
+	}
+	if settled {
+		e.history.settled(id)
+	}
+	return out, nil
+}
+
+// settleTransfer applies a confirmed or rejected transfer to the balances:
+// confirmed deposits are credited, confirmed withdrawals spend their hold and
+// rejected withdrawals give it back.
+func (f *funds) settleTransfer(t *Transfer, status TransferStatus) {
+	switch {
+	case t.Kind == TransferDeposit && status == TransferConfirmed:
+		f.credit(t.UserID, t.Asset, t.Amount)
+	case t.Kind == TransferWithdrawal && status == TransferConfirmed:
+		f.consume(t.ID, t.Amount)
+		delete(f.holds, t.ID)
+	case t.Kind == TransferWithdrawal:
+		f.releaseAll(t.ID)
+	}
+}
+
+// postTransfer writes the ledger for a confirmed transfer: deposits move
+// funds from the omnibus account to the user's available account,
+// withdrawals pay the user's held funds back into the omnibus account.
+func (e *Engine) postTransfer(ctx context.Context, q Queries, t *Transfer) error {
+	refID, err := uuidFromString(t.ID)
+	if err != nil {
+		return err
+	}
+	user, err := uuid.Parse(t.UserID)
+	if err != nil {
+		return err
+	}
+
+	omnibus, err := e.getOrCreateAccountID(ctx, q, uuid.MustParse(ExchangeUserID), t.Asset, AccountOmnibus)
+	if err != nil {
+		return err
+	}
+	var from, to = omnibus, omnibus
+	refType := "deposit"
+	if t.Kind == TransferDeposit {
+		to, err = e.getOrCreateAccountID(ctx, q, user, t.Asset, AccountAvailable)
+	} else {
+		refType = "withdrawal"
+		from, err = e.getOrCreateAccountID(ctx, q, user, t.Asset, AccountHeld)
+	}
+	if err != nil {
+		return err
+	}
+
+	ledgerID := mustNewUUID()
+	if _, err := q.CreateLedger(ctx, dbsqlc.CreateLedgerParams{
+		ID:      ledgerID,
+		RefType: refType,
+		RefID:   refID,
+	}); err != nil {
+		return err
+	}
+	amount := numericFromInt64(t.Amount)
+	if err := q.InsertLedgerEntry(ctx, dbsqlc.InsertLedgerEntryParams{
+		ID:        mustNewUUID(),
+		LedgerID:  ledgerID,
+		AccountID: from,
+		Amount:    negate(amount),
+	}); err != nil {
+		return err
+	}
+	return q.InsertLedgerEntry(ctx, dbsqlc.InsertLedgerEntryParams{
+		ID:        mustNewUUID(),
+		LedgerID:  ledgerID,
+		AccountID: to,
+		Amount:    amount,
+	})
+}
+
+func transferFromRow(r dbsqlc.Transfer) *Transfer {
+	return &Transfer{
+		ID:          uuid.UUID(r.ID.Bytes).String(),
+		UserID:      uuid.UUID(r.UserID.Bytes).String(),
+		Kind:        TransferKind(r.Kind),
+		Asset:       r.Asset,
+		Amount:      numericToInt64(r.Amount),
+		Status:      TransferStatus(r.Status),
+		ExternalRef: r.ExternalRef,
+		CreatedAt:   r.CreatedAt.Time,
+		UpdatedAt:   r.UpdatedAt.Time,
+	}
+}
@@ -0,0 +1,120 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestDepositCreditsOnlyOnConfirm(t *testing.T) {
+	f := newFunds()
+	dep := &Transfer{ID: "d1", UserID: "alice", Kind: TransferDeposit, Asset: "USD", Amount: 500}
+
+	f.settleTransfer(dep, TransferRejected)
+	expectBalance(t, f, "alice", "USD", 0, 0)
+
+	f.settleTransfer(dep, TransferConfirmed)
+	expectBalance(t, f, "alice", "USD", 500, 0)
+	if moves := f.takeMoves(); len(moves) != 0 {
+		t.Fatalf("deposits post to the ledger directly, got moves %+v", moves)
+	}
+}
+
+func TestWithdrawalHoldLifecycle(t *testing.T) {
+	f := newFunds()
+	f.credit("alice", "BTC", 10)
+
+	if err := f.reserve("w1", "alice", "BTC", 11); !errors.Is(err, ErrInsufficientFunds) {
+		t.Fatalf("expected ErrInsufficientFunds, got %v", err)
+	}
+	if err := f.reserve("w1", "alice", "BTC", 4); err != nil {
+		t.Fatalf("reserve: %v", err)
+	}
+	if err := f.reserve("w2", "alice", "BTC", 3); err != nil {
+		t.Fatalf("reserve: %v", err)
+	}
+	expectBalance(t, f, "alice", "BTC", 3, 7)
+
+	f.settleTransfer(&Transfer{ID: "w1", UserID: "alice", Kind: TransferWithdrawal, Asset: "BTC", Amount: 4}, TransferConfirmed)
+	expectBalance(t, f, "alice", "BTC", 3, 3)
+
+	f.settleTransfer(&Transfer{ID: "w2", UserID: "alice", Kind: TransferWithdrawal, Asset: "BTC", Amount: 3}, TransferRejected)
+	expectBalance(t, f, "alice", "BTC", 6, 0)
+
+	if len(f.holds) != 0 {
+		t.Fatalf("expected no holds left, got %v", f.holds)
+	}
+	moves := f.takeMoves()
+	if len(moves) != 3 || moves[2].RefType != "release" || moves[2].RefID != "w2" {
+		t.Fatalf("unexpected moves %+v", moves)
+	}
+}
+
+func TestHasAsset(t *testing.T) {
+	books := newTestRegistry(MarketBTCUSD)
+	if !books.hasAsset("BTC") || !books.hasAsset("USD") {
+		t.Fatalf("expected BTC and USD to be known")
+	}
+	if books.hasAsset("DOGE") {
+		t.Fatalf("expected DOGE to be unknown")
+	}
+}
+
+func TestFailedTransferWriteKeepsBalances(t *testing.T) {
+	ctx := context.Background()
+	store := newFailingStore()
+	e, _ := startMemEngine(t, store)
+	user := uuid.NewString()
+	fund(t, e, user, "BTC", 10)
+	withdrawal := func(id string) *Transfer {
+		return &Transfer{ID: id, UserID: user, Kind: TransferWithdrawal, Asset: "BTC", Amount: 4, ExternalRef: uuid.NewString()}
+	}
+
+	before := stateOf(t, e)
+	store.failAt("CreateTransfer")
+	if _, _, err := e.RequestTransfer(ctx, withdrawal(uuid.NewString())); !errors.Is(err, errInjected) {
+		t.Fatalf("expected the injected failure, got %v", err)
+	}
+	expectState(t, stateOf(t, e), before)
+
+	store.failAt("")
+	w, _, err := e.RequestTransfer(ctx, withdrawal(uuid.NewString()))
+	if err != nil {
+		t.Fatalf("request withdrawal: %v", err)
+	}
+	d, _, err := e.RequestTransfer(ctx, &Transfer{ID: uuid.NewString(), UserID: user, Kind: TransferDeposit, Asset: "BTC", Amount: 5, ExternalRef: uuid.NewString()})
+	if err != nil {
+		t.Fatalf("request deposit: %v", err)
+	}
+	before = stateOf(t, e)
+
+	// a reused id fails on insert and leaves the first withdrawal's hold
+	if _, _, err := e.RequestTransfer(ctx, withdrawal(w.ID)); err == nil {
+		t.Fatalf("expected a reused transfer id to fail")
+	}
+	expectState(t, stateOf(t, e), before)
+
+	store.failAt("UpdateTransferStatus")
+	for _, id := range []string{w.ID, d.ID} {
+		if _, err := e.ConfirmTransfer(ctx, id); !errors.Is(err, errInjected) {
+			t.Fatalf("expected the injected failure, got %v", err)
+		}
+		expectState(t, stateOf(t, e), before)
+	}
+	if _, err := e.RejectTransfer(ctx, w.ID); !errors.Is(err, errInjected) {
+		t.Fatalf("expected the injected failure, got %v", err)
+	}
+	expectState(t, stateOf(t, e), before)
+
+	store.failAt("")
+	for _, id := range []string{w.ID, d.ID} {
+		if _, err := e.ConfirmTransfer(ctx, id); err != nil {
+			t.Fatalf("confirm %s: %v", id, err)
+		}
+	}
+	if b := stateOf(t, e).balances[balanceKey{user, "BTC"}]; b != (balance{available: 11}) {
+		t.Fatalf("expected 11 BTC available, got %+v", b)
+	}
+}
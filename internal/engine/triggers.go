@@ -0,0 +1,88 @@
+package engine
+
+import (
+	"context"
+	"log"
+
+	dbsqlc "github.com/hakimelghazi/exchange-core/db/sqlc"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// runTriggers fires the stops a match triggers and adds the writes of each
+// triggered order, its match and its funds moves to w, followed by the
+// market's new last price.
+func (e *Engine) runTriggers(w *pendingWrite, mb *marketBook, trades []Trade) {
+	before := mb.lastPrice
+	e.fireTriggers(mb, trades, func(o *Order, res *MatchResult, status string) {
+		w.add(e.orderWrite(o, status))
+		if res != nil {
+			w.add(e.matchWrite(mb.spec, res))
+		}
+		w.add(e.movesWrite(e.funds.takeMoves()))
+	})
+	if mb.lastPrice == before {
+		return
+	}
+	params := dbsqlc.SetMarketLastPriceParams{
+		Symbol:    mb.market,
+		LastPrice: pgtype.Int8{Int64: mb.lastPrice, Valid: true},
+	}
+	w.add(func(ctx context.Context, b *dbBatch) error {
+		return b.q.SetMarketLastPrice(ctx, params)
+	})
+}
+
+// fireTriggers records the last trade price of a match and submits every
+// stop order it triggers, one at a time in stop book order. Trades of a
+// triggered order move the price again, so the cascade continues until no
+// stop is left to trigger. fn, if set, sees each triggered order before the
+// next one is submitted; a nil result means the stop was cancelled.
+func (e *Engine) fireTriggers(mb *marketBook, trades []Trade, fn func(o *Order, res *MatchResult, status string)) {
+	mb.recordLastPrice(trades)
+	for o := mb.stops.next(mb.lastPrice); o != nil; o = mb.stops.next(mb.lastPrice) {
+		res, status := e.submitTriggered(mb, o)
+		if fn != nil {
+			fn(o, res, status)
+		}
+		if res != nil {
+			mb.recordLastPrice(res.Trades)
+		}
+	}
+}
+
+// submitTriggered reserves funds for a triggered stop and matches it. A stop
+// that cannot be funded or is refused by the matcher is cancelled, and the
+// returned result is nil.
+func (e *Engine) submitTriggered(mb *marketBook, o *Order) (*MatchResult, string) {
+	if o.IsMarket {
+		if err := mb.matcher.protect(o); err != nil {
+			log.Printf("runTriggers: cancelling stop order %s: %v", o.ID, err)
+			return nil, "CANCELLED"
+		}
+	}
+	asset, amount := holdFor(mb.spec, mb.book, o)
+	if err := e.funds.reserve(o.ID, o.UserID, asset, amount); err != nil {
+		log.Printf("runTriggers: cancelling stop order %s: %v", o.ID, err)
+		return nil, "CANCELLED"
+	}
+	res, err := mb.matcher.Submit(o)
+	if err != nil {
+		log.Printf("runTriggers: cancelling stop order %s: %v", o.ID, err)
+		e.funds.releaseAll(o.ID)
+		return nil, "CANCELLED"
+	}
+	e.stamp(res)
+	e.fees.charge(mb.spec, o, res, e.funds.owner)
+	e.funds.settle(mb.spec, o, res)
+	return res, orderStatusFromOrder(o, res)
+}
+
+func (mb *marketBook) recordLastPrice(trades []Trade) {
+	if len(trades) > 0 {
+		mb.book.rec.save(mb, func() func() {
+			prev := mb.lastPrice
+			return func() { mb.lastPrice = prev }
+		})
+		mb.lastPrice = trades[len(trades)-1].Price
+	}
+}
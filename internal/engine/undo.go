@@ -0,0 +1,232 @@
+package engine
+
+import "container/list"
+
+// undoLog takes back what one command changed in memory, for when its write
+// cannot be committed. Before a piece of state changes for the first time
+// in the command, the code changing it records how to put it back; rolling
+// back runs the records newest first.
+type undoLog struct {
+	journalSeq uint64 // journal entry of the command, 0 without a journal
+	seen       map[any]struct{}
+	steps      []func()
+}
+
+func (u *undoLog) rollback() {
+	for i := len(u.steps) - 1; i >= 0; i-- {
+		u.steps[i]()
+	}
+	u.steps = nil
+}
+
+// recorder hands the undo log of the command being applied to the books,
+// funds and switches it changes. Outside a command, as during bootstrap and
+// replay, it has no log and records nothing.
+type recorder struct {
+	log *undoLog
+}
+
+// add records fn to run on rollback.
+func (r *recorder) add(fn func()) {
+	if r == nil || r.log == nil {
+		return
+	}
+	r.log.steps = append(r.log.steps, fn)
+}
+
+// save records how to restore the state under key, the first time it is
+// about to change in the command: keep captures the state as it is and
+// returns the function that puts it back.
+func (r *recorder) save(key any, keep func() func()) {
+	if r == nil || r.log == nil {
+		return
+	}
+	if _, ok := r.log.seen[key]; ok {
+		return
+	}
+	if r.log.seen == nil {
+		r.log.seen = make(map[any]struct{})
+	}
+	r.log.seen[key] = struct{}{}
+	r.log.steps = append(r.log.steps, keep())
+}
+
+// Keys of the state a command saves before changing it.
+type (
+	levelKey struct {
+		book  *OrderBook
+		side  Side
+		price int64
+	}
+	stopLevelKey struct {
+		book  *stopBook
+		side  Side
+		price int64
+	}
+	balanceKey struct{ userID, asset string }
+	holdKey    string
+	switchKey  string
+)
+
+// orderImage is an order as it was when its level was saved.
+type orderImage struct {
+	o *Order
+	v Order
+}
+
+func imageOf(orders *list.List) []orderImage {
+	if orders == nil {
+		return nil
+	}
+	img := make([]orderImage, 0, orders.Len())
+	for e := orders.Front(); e != nil; e = e.Next() {
+		o := e.Value.(*Order)
+		img = append(img, orderImage{o: o, v: *o})
+	}
+	return img
+}
+
+// touch saves the price level at price before it changes: its orders, their
+// queue positions and their sizes.
+func (ob *OrderBook) touch(side Side, price int64) {
+	ob.rec.save(levelKey{ob, side, price}, func() func() {
+		var img []orderImage
+		if lvl, ok := ob.levels(side)[price]; ok {
+			img = imageOf(lvl.orders)
+		}
+		return func() { ob.restoreLevel(side, price, img) }
+	})
+}
+
+func (ob *OrderBook) levels(side Side) map[int64]*priceLevel {
+	if side == SideBuy {
+		return ob.bids
+	}
+	return ob.asks
+}
+
+// restoreLevel puts a saved level back. Orders of the current level are
+// forgotten unless they have moved to another level since, and the saved
+// orders get their sizes back and rest in their saved order.
+func (ob *OrderBook) restoreLevel(side Side, price int64, img []orderImage) {
+	levels, prices := ob.bids, ob.bidPrices
+	if side == SideSell {
+		levels, prices = ob.asks, ob.askPrices
+	}
+	if lvl, ok := levels[price]; ok {
+		for e := lvl.orders.Front(); e != nil; e = e.Next() {
+			id := e.Value.(*Order).ID
+			if ref, ok := ob.ordersByID[id]; ok && ref.elem == e {
+				ob.removeOrderID(id)
+			}
+		}
+		delete(levels, price)
+		prices.remove(price)
+	}
+	if len(img) == 0 {
+		return
+	}
+	lvl := &priceLevel{price: price, orders: list.New()}
+	for _, im := range img {
+		*im.o = im.v
+		ob.ordersByID[im.o.ID] = &orderRef{side: side, price: price, elem: lvl.orders.PushBack(im.o)}
+		ob.byUser.add(im.o.UserID, im.o.ID)
+	}
+	levels[price] = lvl
+	prices.insert(price)
+}
+
+// touch saves the stops at a stop price before they change.
+func (sb *stopBook) touch(side Side, price int64) {
+	sb.rec.save(stopLevelKey{sb, side, price}, func() func() {
+		_, levels := sb.side(side)
+		img := imageOf(levels[price])
+		return func() { sb.restoreLevel(side, price, img) }
+	})
+}
+
+func (sb *stopBook) restoreLevel(side Side, price int64, img []orderImage) {
+	idx, levels := sb.side(side)
+	if lvl, ok := levels[price]; ok {
+		for e := lvl.Front(); e != nil; e = e.Next() {
+			o := e.Value.(*Order)
+			if ref, ok := sb.byID[o.ID]; ok && ref.elem == e {
+				sb.byUser.remove(o.UserID, o.ID)
+				delete(sb.byID, o.ID)
+			}
+		}
+		delete(levels, price)
+		idx.remove(price)
+	}
+	if len(img) == 0 {
+		return
+	}
+	lvl := list.New()
+	for _, im := range img {
+		*im.o = im.v
+		sb.byID[im.o.ID] = &orderRef{side: side, price: price, elem: lvl.PushBack(im.o)}
+		sb.byUser.add(im.o.UserID, im.o.ID)
+	}
+	levels[price] = lvl
+	idx.insert(price)
+}
+
+// touch saves a balance before it changes.
+func (f *funds) touch(userID, asset string) {
+	f.rec.save(balanceKey{userID, asset}, func() func() {
+		prev, ok := f.balances[userID][asset]
+		var v balance
+		if ok {
+			v = *prev
+		}
+		return func() {
+			byAsset := f.balances[userID]
+			if !ok {
+				delete(byAsset, asset)
+				if len(byAsset) == 0 {
+					delete(f.balances, userID)
+				}
+				return
+			}
+			if byAsset == nil {
+				byAsset = make(map[string]*balance)
+				f.balances[userID] = byAsset
+			}
+			byAsset[asset] = &v
+		}
+	})
+}
+
+// touchHold saves the hold of an order or withdrawal before it changes.
+func (f *funds) touchHold(id string) {
+	f.rec.save(holdKey(id), func() func() {
+		prev, ok := f.holds[id]
+		var v orderHold
+		if ok {
+			v = *prev
+		}
+		return func() {
+			if !ok {
+				delete(f.holds, id)
+				return
+			}
+			f.holds[id] = &v
+		}
+	})
+}
+
+// touch saves a user's dead man's switch before it changes.
+func (d *deadManSwitches) touch(userID string) {
+	d.rec.save(switchKey(userID), func() func() {
+		prev, armed := d.byUser[userID]
+		return func() {
+			if !armed {
+				delete(d.byUser, userID)
+				d.queue.remove(userID)
+				return
+			}
+			d.byUser[userID] = prev
+			d.queue.set(prev.ExpiresAt, userID)
+		}
+	})
+}